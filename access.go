@@ -0,0 +1,127 @@
+// Client access rules.
+// ALLOW and DENY in the configuration, and add --allow for a single
+// token, restrict downloads to clients whose address matches a list of
+// networks in CIDR notation (10.0.0.0/8, 2001:db8::/32) or single
+// addresses. Other clients get a 403 page.
+// Behind reverse proxies listed in TRUSTED_PROXIES, the client address
+// is taken from the X-Forwarded-For or Forwarded headers they add.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Parse a list of networks or addresses, single addresses becoming /32
+// or /128 networks
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if len(s) < 1 {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid address: " + s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip,
+				Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.New("invalid network: " + s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Tell whether an address belongs to one of the networks
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the client address recorded by trusted proxies: walking
+// X-Forwarded-For, or the for= values of Forwarded, from the nearest hop
+// back, the first address that is not a trusted proxy. Addresses further
+// left were given by the client itself and cannot be trusted.
+func forwardedFor(h http.Header) string {
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, s := range strings.Split(v, ",") {
+			hops = append(hops, forwardedNode(s))
+		}
+	}
+	if len(hops) < 1 {
+		for _, v := range h.Values("Forwarded") {
+			for _, elem := range strings.Split(v, ",") {
+				for _, pair := range strings.Split(elem, ";") {
+					k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(k, "for") {
+						hops = append(hops, forwardedNode(val))
+					}
+				}
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			return ""
+		}
+		if !inNets(ip, cnf.trustedProxies) {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// Strip the quotes, brackets and port of a forwarded address such as
+// "[2001:db8::1]:4711" or 192.0.2.60
+func forwardedNode(s string) string {
+	s = strings.Trim(strings.TrimSpace(s), "\"")
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return strings.Trim(s, "[]")
+}
+
+// Tell whether the client of req may use a token according to the DENY
+// and ALLOW lists of the configuration and the token allow list
+func allowedClient(tok Token, req *http.Request) bool {
+	if len(cnf.allow) < 1 && len(cnf.deny) < 1 && len(tok.Allow) < 1 {
+		return true
+	}
+	ip := net.ParseIP(clientHost(req))
+	if ip == nil {
+		return false
+	}
+	if inNets(ip, cnf.deny) {
+		return false
+	}
+	if len(cnf.allow) > 0 && !inNets(ip, cnf.allow) {
+		return false
+	}
+	if len(tok.Allow) > 0 {
+		nets, err := parseNets(tok.Allow)
+		if err != nil || !inNets(ip, nets) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseNets(t *testing.T) {
+	tests := []struct {
+		list []string
+		nets []string
+		err  bool
+	}{
+		{nil, nil, false},
+		{[]string{"192.0.2.1"}, []string{"192.0.2.1/32"}, false},
+		{[]string{"2001:db8::1"}, []string{"2001:db8::1/128"}, false},
+		{[]string{"10.0.0.0/8", " 2001:db8::/32 "},
+			[]string{"10.0.0.0/8", "2001:db8::/32"}, false},
+		// Networks are given by their first address
+		{[]string{"192.0.2.77/24"}, []string{"192.0.2.0/24"}, false},
+		{[]string{"", "  ", "192.0.2.1"}, []string{"192.0.2.1/32"}, false},
+		{[]string{"example.com"}, nil, true},
+		{[]string{"192.0.2.1", "192.0.2.300"}, nil, true},
+		{[]string{"10.0.0.0/33"}, nil, true},
+		{[]string{"10.0.0.0/"}, nil, true},
+	}
+	for _, tt := range tests {
+		nets, err := parseNets(tt.list)
+		if (err != nil) != tt.err {
+			t.Errorf("parseNets(%q): err = %v, want error %v", tt.list, err,
+				tt.err)
+			continue
+		}
+		if len(nets) != len(tt.nets) {
+			t.Errorf("parseNets(%q) = %v, want %v", tt.list, nets, tt.nets)
+			continue
+		}
+		for i, n := range nets {
+			if n.String() != tt.nets[i] {
+				t.Errorf("parseNets(%q) = %v, want %v", tt.list, nets,
+					tt.nets)
+				break
+			}
+		}
+	}
+}
+
+func TestAllowedClient(t *testing.T) {
+	savedAllow, savedDeny := cnf.allow, cnf.deny
+	defer func() { cnf.allow, cnf.deny = savedAllow, savedDeny }()
+	nets := func(list ...string) []*net.IPNet {
+		n, err := parseNets(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	tests := []struct {
+		name        string
+		allow, deny []*net.IPNet
+		tokAllow    []string
+		client      string
+		allowed     bool
+	}{
+		{"no rules", nil, nil, nil, "192.0.2.1", true},
+		{"no rules, not an address", nil, nil, nil, "@", true},
+		{"allowed", nets("192.0.2.0/24"), nil, nil, "192.0.2.1", true},
+		{"not allowed", nets("192.0.2.0/24"), nil, nil, "198.51.100.1",
+			false},
+		{"denied", nil, nets("192.0.2.1"), nil, "192.0.2.1", false},
+		{"not denied", nil, nets("192.0.2.1"), nil, "192.0.2.2", true},
+		{"deny wins", nets("192.0.2.0/24"), nets("192.0.2.1"), nil,
+			"192.0.2.1", false},
+		{"IPv6", nets("2001:db8::/32"), nil, nil, "2001:db8::5", true},
+		{"IPv6 not allowed", nets("2001:db8::/32"), nil, nil, "2001:db9::5",
+			false},
+		{"token allowed", nil, nil, []string{"192.0.2.0/28"}, "192.0.2.3",
+			true},
+		{"token not allowed", nil, nil, []string{"192.0.2.0/28"},
+			"192.0.2.17", false},
+		// The token list narrows the configuration, never widens it
+		{"both lists", nets("192.0.2.0/24"), nil, []string{"192.0.2.0/28"},
+			"192.0.2.3", true},
+		{"token outside configuration", nets("192.0.2.0/24"), nil,
+			[]string{"198.51.100.0/24"}, "198.51.100.1", false},
+		{"token list invalid", nil, nil, []string{"nowhere"}, "192.0.2.1",
+			false},
+		{"not an address", nets("192.0.2.0/24"), nil, nil, "@", false},
+	}
+	for _, tt := range tests {
+		cnf.allow, cnf.deny = tt.allow, tt.deny
+		req := httptest.NewRequest("GET", "/d/aaaa1111", nil)
+		req.RemoteAddr = net.JoinHostPort(tt.client, "4321")
+		got := allowedClient(Token{Allow: tt.tokAllow}, req)
+		if got != tt.allowed {
+			t.Errorf("%s: allowedClient = %v, want %v", tt.name, got,
+				tt.allowed)
+		}
+	}
+}
+
+func TestClientHost(t *testing.T) {
+	saved := cnf.trustedProxies
+	defer func() { cnf.trustedProxies = saved }()
+	proxies, err := parseNets([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		trusted bool
+		remote  string
+		header  [2]string
+		client  string
+	}{
+		{"direct", false, "192.0.2.1:4321", [2]string{}, "192.0.2.1"},
+		{"headers ignored", false, "10.0.0.1:4321",
+			[2]string{"X-Forwarded-For", "192.0.2.1"}, "10.0.0.1"},
+		{"untrusted proxy", true, "198.51.100.1:4321",
+			[2]string{"X-Forwarded-For", "192.0.2.1"}, "198.51.100.1"},
+		{"trusted proxy", true, "10.0.0.1:4321",
+			[2]string{"X-Forwarded-For", "192.0.2.1"}, "192.0.2.1"},
+		{"no header", true, "10.0.0.1:4321", [2]string{}, "10.0.0.1"},
+		// Addresses left of the first untrusted hop come from the client
+		{"forged hop", true, "10.0.0.1:4321",
+			[2]string{"X-Forwarded-For", "203.0.113.9, 192.0.2.1, 10.0.0.2"},
+			"192.0.2.1"},
+		{"IPv6 proxy", true, "[2001:db8::1]:4321",
+			[2]string{"X-Forwarded-For", "2001:db8::77"}, "2001:db8::77"},
+		{"garbage hop", true, "10.0.0.1:4321",
+			[2]string{"X-Forwarded-For", "192.0.2.1, unknown"}, "10.0.0.1"},
+		{"forwarded", true, "10.0.0.1:4321",
+			[2]string{"Forwarded", `for="[2001:db8::9]:4711";proto=https`},
+			"2001:db8::9"},
+		{"forwarded chain", true, "10.0.0.1:4321",
+			[2]string{"Forwarded", "for=203.0.113.9, for=192.0.2.60"},
+			"192.0.2.60"},
+	}
+	for _, tt := range tests {
+		cnf.trustedProxies = nil
+		if tt.trusted {
+			cnf.trustedProxies = proxies
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		if len(tt.header[0]) > 0 {
+			req.Header.Set(tt.header[0], tt.header[1])
+		}
+		if got := clientHost(req); got != tt.client {
+			t.Errorf("%s: clientHost = %q, want %q", tt.name, got, tt.client)
+		}
+	}
+}
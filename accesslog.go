@@ -0,0 +1,204 @@
+// HTTP access log.
+// When ACCESS_LOG is set, every request is written to that file as one
+// line in Apache combined format, so that log analyzers such as GoAccess
+// or AWStats can process onetime traffic. ACCESS_LOG_FORMAT selects
+// "combined" (default), "common" or a custom pattern made of Apache
+// LogFormat directives: %h %l %u %t %r %s %>s %b %B %D %T %m %U %q %H %v
+// %{Header}i %{Header}o and %%. The access log is rotated like LOG_FILE.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var accessFormats = map[string]string{
+	"common":   `%h %l %u %t "%r" %>s %b`,
+	"combined": `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"`,
+}
+
+// A request as seen by the access log
+type accessEntry struct {
+	req    *http.Request
+	header http.Header // Response headers
+	start  time.Time
+	took   time.Duration
+	status int
+	bytes  int64
+}
+
+// Return one piece of an access log line
+type accessField func(e *accessEntry) string
+
+// A ResponseWriter remembering the status and size of responses
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (aw *accessWriter) WriteHeader(code int) {
+	if aw.status == 0 {
+		aw.status = code
+	}
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *accessWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(p)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+func (aw *accessWriter) Flush() {
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Escapes client-supplied values so that they cannot forge lines
+var accessEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`,
+	"\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// Return "-" for empty values, as Apache does
+func dash(s string) string {
+	if len(s) < 1 {
+		return "-"
+	}
+	return accessEscaper.Replace(s)
+}
+
+// Compile an access log pattern into fields
+func parseAccessFormat(format string) ([]accessField, error) {
+	if f, ok := accessFormats[format]; ok {
+		format = f
+	}
+	var fields []accessField
+	literal := func(s string) accessField {
+		return func(*accessEntry) string { return s }
+	}
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			j := strings.IndexByte(format[i:], '%')
+			if j < 0 {
+				j = len(format) - i
+			}
+			fields = append(fields, literal(format[i:i+j]))
+			i += j - 1
+			continue
+		}
+		i++
+		if i >= len(format) {
+			return nil, errors.New("invalid ACCESS_LOG_FORMAT in " + cnf.path)
+		}
+		arg := ""
+		if format[i] == '{' {
+			j := strings.IndexByte(format[i:], '}')
+			if j < 0 || i+j+1 >= len(format) {
+				return nil, errors.New("invalid ACCESS_LOG_FORMAT in " +
+					cnf.path)
+			}
+			arg = format[i+1 : i+j]
+			i += j + 1
+		}
+		if format[i] == '>' && i+1 < len(format) {
+			i++
+		}
+		var f accessField
+		switch format[i] {
+		case '%':
+			f = literal("%")
+		case 'h':
+			f = func(e *accessEntry) string { return clientHost(e.req) }
+		case 'l', 'u':
+			f = literal("-")
+		case 't':
+			f = func(e *accessEntry) string {
+				return e.start.Format("[02/Jan/2006:15:04:05 -0700]")
+			}
+		case 'r':
+			f = func(e *accessEntry) string {
+				return accessEscaper.Replace(e.req.Method + " " +
+					e.req.RequestURI + " " + e.req.Proto)
+			}
+		case 's':
+			f = func(e *accessEntry) string { return strconv.Itoa(e.status) }
+		case 'b':
+			f = func(e *accessEntry) string {
+				if e.bytes == 0 {
+					return "-"
+				}
+				return strconv.FormatInt(e.bytes, 10)
+			}
+		case 'B':
+			f = func(e *accessEntry) string {
+				return strconv.FormatInt(e.bytes, 10)
+			}
+		case 'D':
+			f = func(e *accessEntry) string {
+				return strconv.FormatInt(e.took.Microseconds(), 10)
+			}
+		case 'T':
+			f = func(e *accessEntry) string {
+				return strconv.FormatInt(int64(e.took/time.Second), 10)
+			}
+		case 'm':
+			f = func(e *accessEntry) string { return e.req.Method }
+		case 'U':
+			f = func(e *accessEntry) string { return e.req.URL.Path }
+		case 'q':
+			f = func(e *accessEntry) string {
+				if len(e.req.URL.RawQuery) < 1 {
+					return ""
+				}
+				return "?" + e.req.URL.RawQuery
+			}
+		case 'H':
+			f = func(e *accessEntry) string { return e.req.Proto }
+		case 'v':
+			f = func(e *accessEntry) string { return e.req.Host }
+		case 'i':
+			f = func(e *accessEntry) string {
+				return dash(e.req.Header.Get(arg))
+			}
+		case 'o':
+			f = func(e *accessEntry) string {
+				return dash(e.header.Get(arg))
+			}
+		default:
+			return nil, errors.New("invalid ACCESS_LOG_FORMAT in " + cnf.path)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// Write a line to w for every request served by next
+func withAccessLog(next http.Handler, w io.Writer,
+	fields []accessField) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		aw := &accessWriter{ResponseWriter: rw}
+		e := accessEntry{req: req, start: time.Now()}
+		next.ServeHTTP(aw, req)
+		e.took = time.Since(e.start)
+		e.status, e.bytes, e.header = aw.status, aw.bytes, rw.Header()
+		if e.status == 0 {
+			e.status = http.StatusOK
+		}
+		var b strings.Builder
+		for _, f := range fields {
+			b.WriteString(f(&e))
+		}
+		b.WriteByte('\n')
+		io.WriteString(w, b.String())
+	})
+}
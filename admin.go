@@ -0,0 +1,560 @@
+// Administration pages.
+// With ADMIN_PASSWORD set in the configuration, /admin/ lets operators
+// without a shell on the server list, create, renew and delete links,
+// purge expired ones and follow recent activity from a browser. Links to
+// files name a path on the server, as onetime add does, or a file
+// uploaded from the browser to SPOOL_DIR, streamed there without going
+// through memory or temporary files. Activity comes
+// from the audit journal when AUDIT_LOG is set, from download times
+// otherwise. Logging in sets a session cookie signed with the server
+// secret, valid ADMIN_SESSION or until ADMIN_PASSWORD changes. Forms
+// carry a token derived from the session against cross-site requests.
+// Wrong passwords count as misses, see enum.go. With CLIENT_CA, the
+// pages also require a client certificate. Users of USERS log in with
+// their name and API key and only manage their own links, made from
+// uploads: only administrators share paths on the server. See oidc.go
+// for single sign-on, ldap.go for directory accounts.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ADMIN_COOKIE   = "onetime_admin"
+	ADMIN_SESSION  = 12 * time.Hour
+	ADMIN_ACTIVITY = 50 // Events shown
+)
+
+// A link as listed on the administration page
+type AdminRow struct {
+	Token     string
+	URL       string
+	Status    string // Owner status page
+	Name      string
+	Owner     string
+	State     string
+	Created   string
+	Until     string
+	Downloads int
+	created   time.Time
+}
+
+// Return the password of user, ADMIN_PASSWORD for the administrator
+func adminKey(user string) string {
+	if len(user) < 1 {
+		return cnf.ADMIN_PASSWORD
+	}
+	return cnf.USERS[user]
+}
+
+// Return the key sessions of user are signed with, empty if user may not
+// log in
+func sessionKey(user string) string {
+	if key := adminKey(user); len(key) > 0 {
+		return key
+	}
+	if oidcAllowed(user) {
+		return "oidc:" + cnf.OIDC_ISSUER + ":" + cnf.OIDC_CLIENT_ID
+	}
+	if ok, _ := ldapLoggedIn(user); ok {
+		return "ldap:" + cnf.LDAP_URL
+	}
+	return ""
+}
+
+// Return a session cookie value of user valid until t
+func adminSession(user string, t time.Time) string {
+	until := strconv.FormatInt(t.Unix(), 10)
+	return until + "." + user + "." +
+		sign("admin", until+":"+user+":"+sessionKey(user))
+}
+
+// Return the session of a logged in request and its user, "" for the
+// administrator, false if not logged in
+func adminLoggedIn(req *http.Request) (string, string, bool) {
+	c, err := req.Cookie(ADMIN_COOKIE)
+	if err != nil {
+		return "", "", false
+	}
+	// OIDC user names may contain dots
+	i, j := strings.Index(c.Value, "."), strings.LastIndex(c.Value, ".")
+	if i < 0 || j <= i {
+		return "", "", false
+	}
+	user := c.Value[i+1 : j]
+	if len(sessionKey(user)) < 1 {
+		return "", "", false
+	}
+	t, err := strconv.ParseInt(c.Value[:i], 10, 64)
+	if err != nil || time.Now().Unix() > t || !hmac.Equal([]byte(c.Value),
+		[]byte(adminSession(user, time.Unix(t, 0)))) {
+		return "", "", false
+	}
+	return c.Value, user, true
+}
+
+// Set or clear the session cookie
+func setAdminCookie(w http.ResponseWriter, req *http.Request, value string,
+	until time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ADMIN_COOKIE,
+		Value:    value,
+		Path:     "/admin/",
+		Expires:  until,
+		HttpOnly: true,
+		Secure:   req.TLS != nil || strings.HasPrefix(cnf.BASE_ADDR, "https"),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Send the administration page back, once done with a form
+func adminDone(w http.ResponseWriter, req *http.Request, query string) {
+	http.Redirect(w, req, "/admin/?"+query, http.StatusSeeOther)
+}
+
+// Serve the administration pages
+func Admin(w http.ResponseWriter, req *http.Request) {
+	if len(cnf.ADMIN_PASSWORD) < 1 && len(cnf.USERS) < 1 && !oidcEnabled() &&
+		!ldapEnabled() {
+		notFound(w, req)
+		return
+	}
+	noIndex(w)
+	w.Header().Set("Cache-Control", "no-store")
+	action, ott, _ := strings.Cut(req.URL.Path[len("/admin/"):], "/")
+	if action == "oidc" && oidcEnabled() {
+		backoff(req)
+		if ott == "callback" {
+			oidcFinish(w, req)
+		} else {
+			oidcLogin(w, req)
+		}
+		return
+	}
+	if action == "login" && req.Method == "POST" {
+		backoff(req)
+		user := req.PostFormValue("user")
+		given := req.PostFormValue("password")
+		key := adminKey(user)
+		ok := false
+		if len(key) > 0 {
+			ok = subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1
+		} else if len(user) > 0 && ldapEnabled() {
+			ok = ldapAuth(req, user, given)
+		}
+		if !ok {
+			reqLog(req).Warn("DENIED", "admin", true)
+			miss(req, "admin")
+			renderStatus(w, http.StatusUnauthorized, "admin.html", Page{
+				Title:   tr("admin"),
+				Message: tr("admin_denied"),
+				SSO:     oidcEnabled(),
+			})
+			return
+		}
+		until := time.Now().Add(ADMIN_SESSION)
+		setAdminCookie(w, req, adminSession(user, until), until)
+		reqLog(req).Info("ADMIN", "action", "login", "user", user)
+		adminDone(w, req, "")
+		return
+	}
+	session, user, ok := adminLoggedIn(req)
+	if !ok {
+		render(w, "admin.html", Page{Title: tr("admin"), SSO: oidcEnabled()})
+		return
+	}
+	if len(action) < 1 {
+		adminPage(w, req, session, user)
+		return
+	}
+	if action == "upload" && req.Method == "POST" {
+		adminUpload(w, req, session, user)
+		return
+	}
+	if req.Method != "POST" || !hmac.Equal([]byte(req.PostFormValue("csrf")),
+		[]byte(sign("csrf", session))) {
+		renderError(w, http.StatusForbidden, tr("forbidden"),
+			tr("forbidden_message"))
+		return
+	}
+	reqLog(req).Info("ADMIN", "action", action, "token", ott, "user", user)
+	if action == "apikey" && oidcAllowed(user) {
+		// Shown once, never stored
+		p := adminView(req, session, user)
+		p.Key = issuedKey(user, time.Now().AddDate(0, 0, ISSUED_KEY_DAYS))
+		journal("apikey", "", req, user)
+		render(w, "admin.html", p)
+		return
+	}
+	ltok := make(LTokens)
+	ltok.LoadContext(req.Context(), cnf.TOKEN_DB)
+	base := ltok.clone()
+	// Users only act on their own tokens
+	mine := func(ltok LTokens) bool {
+		tok, ok := ltok[ott]
+		return ok && owns(user, tok)
+	}
+	query := ""
+	switch action {
+	case "logout":
+		setAdminCookie(w, req, "", time.Unix(0, 0))
+		adminDone(w, req, "")
+		return
+	case "create":
+		opt := AddOptions{
+			Name:  req.PostFormValue("name"),
+			Note:  req.PostFormValue("note"),
+			Owner: user,
+		}
+		content := strings.TrimSpace(req.PostFormValue("content"))
+		kind := req.PostFormValue("kind")
+		// Any file the server account can read, including the
+		// configuration and the token DB: administrators only, users
+		// upload theirs
+		if kind == "file" && !isAdmin(user) {
+			reqLog(req).Warn("DENIED", "action", action, "user", user)
+			renderError(w, http.StatusForbidden, tr("forbidden"),
+				tr("forbidden_message"))
+			return
+		}
+		size, spooled := int64(len(content)), kind != KIND_REDIRECT
+		if kind == "file" {
+			if sta, err := os.Stat(content); err == nil {
+				size, spooled = sta.Size(), cnf.SPOOL
+			}
+		}
+		if err := ltok.checkQuota(user, size, spooled); err != nil {
+			reqLog(req).Warn("ADMIN", "err", err)
+			adminDone(w, req, "msg=quota")
+			return
+		}
+		created := ""
+		switch kind {
+		case "file":
+			created = ltok.Add(content, opt)
+		case KIND_PASTE:
+			created = ltok.Paste(strings.NewReader(content), opt)
+		case KIND_SECRET:
+			created = ltok.Secret(strings.NewReader(content), opt)
+		case KIND_REDIRECT:
+			created = ltok.Redirect(content, user)
+		}
+		if len(created) < 1 {
+			adminDone(w, req, "msg=create_failed")
+			return
+		}
+		// With tokens evicted to make room, if any
+		ltok.Commit(req.Context(), base)
+		query = "created=" + url.QueryEscape(created)
+	case "renew":
+		found := false
+		updateTokens(req.Context(), func(ltok LTokens) bool {
+			if found = mine(ltok) && ltok.Renew(ott, 0) == nil; found {
+				journal("renew", ott, req, isotime(ltok[ott].ValidUntil()))
+			}
+			return found
+		})
+		if !found {
+			notFound(w, req)
+			return
+		}
+		query = "msg=renewed"
+	case "delete":
+		found := false
+		updateTokens(req.Context(), func(ltok LTokens) bool {
+			if found = mine(ltok); found {
+				ltok.Del(ott)
+			}
+			return found
+		})
+		if !found {
+			notFound(w, req)
+			return
+		}
+		query = "msg=deleted"
+	case "purge":
+		updateTokens(req.Context(), func(ltok LTokens) bool {
+			ltok.Purge(user)
+			return true
+		})
+		query = "msg=purged"
+	default:
+		notFound(w, req)
+		return
+	}
+	adminDone(w, req, query)
+}
+
+// Return the value of a form field read from a multipart request
+func formField(part *multipart.Part) string {
+	b, _ := io.ReadAll(io.LimitReader(part, 4096))
+	return string(b)
+}
+
+// Create a link to a file uploaded from the administration page, written
+// to the spool directory as it arrives
+func adminUpload(w http.ResponseWriter, req *http.Request, session,
+	user string) {
+	if !limitUpload(w, req) {
+		return
+	}
+	mr, err := req.MultipartReader()
+	if err != nil {
+		renderError(w, http.StatusBadRequest, tr("forbidden"),
+			tr("forbidden_message"))
+		return
+	}
+	opt := AddOptions{Owner: user}
+	csrf := false
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			// No file, or the upload was interrupted
+			adminDone(w, req, "msg=upload_failed")
+			return
+		}
+		switch part.FormName() {
+		case "csrf":
+			csrf = hmac.Equal([]byte(formField(part)),
+				[]byte(sign("csrf", session)))
+		case "name":
+			opt.Name = formField(part)
+		case "note":
+			opt.Note = formField(part)
+		case "file":
+			if !csrf {
+				renderError(w, http.StatusForbidden, tr("forbidden"),
+					tr("forbidden_message"))
+				return
+			}
+			if len(part.FileName()) < 1 {
+				adminDone(w, req, "msg=upload_failed")
+				return
+			}
+			name := filepath.Base(part.FileName())
+			if name == "." || name == ".." || name == string(filepath.Separator) {
+				name = "upload"
+			}
+			ltok := make(LTokens)
+			ltok.LoadContext(req.Context(), cnf.TOKEN_DB)
+			if err := ltok.checkQuota(user, 0, true); err != nil {
+				reqLog(req).Warn("UPLOAD", "err", err)
+				adminDone(w, req, "msg=quota")
+				return
+			}
+			ott := GenerateOnetime(ONETIME_SZ)
+			room := ltok.quotaRoom(user)
+			if cnf.maxUpload > 0 && (room < 0 || cnf.maxUpload < room) {
+				room = cnf.maxUpload
+			}
+			path, err := spoolReader(ott, name, quotaReader(part, room))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				uploadTooLarge(w, req)
+				return
+			}
+			if err != nil {
+				reqLog(req).Error("UPLOAD", "err", err)
+				adminDone(w, req, "msg=upload_failed")
+				return
+			}
+			var size int64
+			if sta, err := os.Stat(path); err == nil {
+				size = sta.Size()
+			}
+			if cnf.maxUpload > 0 && size > cnf.maxUpload {
+				os.RemoveAll(filepath.Dir(path))
+				uploadTooLarge(w, req)
+				return
+			}
+			if !adminScan(w, req, ott, path) {
+				return
+			}
+			// Loaded again once the file is in, uploads may take long
+			ltok = make(LTokens)
+			ltok.LoadContext(req.Context(), cnf.TOKEN_DB)
+			base := ltok.clone()
+			if err = ltok.checkQuota(user, size, true); err != nil {
+				reqLog(req).Warn("UPLOAD", "err", err)
+				os.RemoveAll(filepath.Dir(path))
+				adminDone(w, req, "msg=quota")
+				return
+			}
+			if len(ltok.add(ott, path, true, opt)) < 1 {
+				os.RemoveAll(filepath.Dir(path))
+				adminDone(w, req, "msg=upload_failed")
+				return
+			}
+			ltok.Commit(req.Context(), base)
+			reqLog(req).Info("ADMIN", "action", "upload", "token", ott,
+				"bytes", ltok[ott].Size)
+			hook("upload-received", ott, ltok[ott], req)
+			adminDone(w, req, "created="+url.QueryEscape(ott))
+			return
+		}
+	}
+}
+
+// Scan an uploaded file before it gets a link. Return false, having
+// answered, if it is infected or could not be scanned.
+func adminScan(w http.ResponseWriter, req *http.Request, ott,
+	path string) bool {
+	if !scanEnabled() {
+		return true
+	}
+	found, err := scanFile(path)
+	if err != nil {
+		reqLog(req).Error("SCAN", "file", path, "err", err)
+		os.RemoveAll(filepath.Dir(path))
+		renderError(w, http.StatusServiceUnavailable, tr("upload_rejected"),
+			tr("scan_failed_message"))
+		return false
+	}
+	if len(found) > 0 {
+		reqLog(req).Warn("INFECTED", "file", filepath.Base(path),
+			"found", found)
+		if err = quarantine(ott, path); err != nil {
+			reqLog(req).Error("QUARANTINE", "err", err)
+		}
+		renderError(w, http.StatusUnprocessableEntity, tr("upload_rejected"),
+			tr("infected_message"))
+		return false
+	}
+	return true
+}
+
+// Messages shown after a form, by msg parameter
+var adminMessages = map[string]bool{
+	"create_failed": true,
+	"upload_failed": true,
+	"quota":         true,
+	"renewed":       true,
+	"deleted":       true,
+	"purged":        true,
+}
+
+// Send the list of links, the creation form and recent activity
+func adminPage(w http.ResponseWriter, req *http.Request, session,
+	user string) {
+	render(w, "admin.html", adminView(req, session, user))
+}
+
+// Return the administration page of user
+func adminView(req *http.Request, session, user string) Page {
+	ltok := make(LTokens)
+	ltok.LoadContext(req.Context(), cnf.TOKEN_DB)
+	now := time.Now()
+	var rows []AdminRow
+	for ott, tok := range ltok {
+		if tok.Kind == KIND_TRAP || !owns(user, tok) {
+			continue
+		}
+		until := ""
+		if t := tok.ValidUntil(); t.Year() > 1970 {
+			until = isotime(t)
+		}
+		rows = append(rows, AdminRow{
+			Token:     ott,
+			URL:       cnf.BASE_ADDR + "/" + ott,
+			Status:    statusURL(ott),
+			Name:      tok.FileName(),
+			Owner:     tok.Owner,
+			State:     tr("state_" + tok.State(now)),
+			Created:   isotime(tok.Created),
+			Until:     until,
+			Downloads: len(tok.Downloads),
+			created:   tok.Created,
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].created.After(rows[j].created)
+	})
+	p := Page{
+		Title:    tr("admin"),
+		Links:    rows,
+		Activity: adminActivity(ltok, user),
+		User:     user,
+		CSRF:     sign("csrf", session),
+		Issue:    oidcAllowed(user),
+		Admin:    isAdmin(user),
+	}
+	q := req.URL.Query()
+	if ott := q.Get("created"); len(ott) > 0 {
+		if tok, ok := ltok[ott]; ok && owns(user, tok) {
+			p.Token = ott
+			p.Text = cnf.BASE_ADDR + "/" + ott
+		}
+	}
+	if msg := q.Get("msg"); adminMessages[msg] {
+		p.Message = tr("admin_" + msg)
+	}
+	return p
+}
+
+// Return recent events about the tokens of user, newest first
+func adminActivity(ltok LTokens, user string) []StatusRow {
+	var rows []StatusRow
+	if len(cnf.AUDIT_LOG) > 0 {
+		n := ADMIN_ACTIVITY
+		if !isAdmin(user) {
+			// Events of removed tokens cannot be told apart
+			n *= 10
+		}
+		entries, _ := recentJournal(n)
+		for i := len(entries) - 1; i >= 0 && len(rows) < ADMIN_ACTIVITY; i-- {
+			e := entries[i]
+			tok, ok := ltok[e.Token]
+			if !isAdmin(user) && (!ok || !owns(user, tok)) {
+				continue
+			}
+			rows = append(rows, StatusRow{
+				Label: isotime(e.Time.Local()),
+				Value: strings.Join(strings.Fields(e.Event+" "+e.Token+" "+
+					e.Client+" "+e.Detail), " "),
+			})
+		}
+		return rows
+	}
+	type download struct {
+		t        time.Time
+		ott, who string
+	}
+	var all []download
+	for ott, tok := range ltok {
+		if !owns(user, tok) {
+			continue
+		}
+		for i, t := range tok.Downloads {
+			who := ""
+			if len(tok.Clients) == len(tok.Downloads) {
+				who = tok.Clients[i]
+			}
+			all = append(all, download{t, ott, who})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].t.After(all[j].t) })
+	for i, d := range all {
+		if i >= ADMIN_ACTIVITY {
+			break
+		}
+		rows = append(rows, StatusRow{
+			Label: isotime(d.t),
+			Value: strings.TrimSpace("serve " + d.ott + " " + d.who),
+		})
+	}
+	return rows
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminCreateFile(t *testing.T) {
+	savedUsers, savedPassword := cnf.USERS, cnf.ADMIN_PASSWORD
+	defer func() { cnf.USERS, cnf.ADMIN_PASSWORD = savedUsers, savedPassword }()
+	cnf.USERS = map[string]string{"alice": "alice-key-0123456789"}
+	cnf.ADMIN_PASSWORD = "admin-password-0123"
+	db := testTokenDB(t)
+	testSecret(t, "test")
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(filepath.Dir(db), "onetime.json")
+	if err := os.WriteFile(file, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, user string
+		code       int
+		created    int
+	}{
+		{"user", "alice", http.StatusForbidden, 0},
+		{"administrator", "", http.StatusSeeOther, 1},
+	}
+	for _, tt := range tests {
+		session := adminSession(tt.user, time.Now().Add(time.Hour))
+		form := url.Values{
+			"csrf":    {sign("csrf", session)},
+			"kind":    {"file"},
+			"content": {file},
+		}
+		req := httptest.NewRequest("POST", "/admin/create",
+			strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: ADMIN_COOKIE, Value: session})
+		req.RemoteAddr = "192.0.2.1:4321"
+		w := httptest.NewRecorder()
+		Admin(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: %d, want %d", tt.name, w.Code, tt.code)
+		}
+		ltok := make(LTokens)
+		ltok.Load(db)
+		if len(ltok) != tt.created {
+			t.Errorf("%s: %d tokens, want %d", tt.name, len(ltok), tt.created)
+		}
+	}
+}
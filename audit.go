@@ -0,0 +1,223 @@
+// Audit journal.
+// With AUDIT_LOG set in the configuration, every event in the life of a
+// token (create, view, activate, serve, renew, delete, purge) is appended
+// to that file as one JSON document per line. Each entry carries the hash
+// of the previous one and its own hash, so that removing or altering
+// entries breaks the chain. The journal is written by both the server and
+// the command line, under an exclusive lock: a lock file next to it, as
+// Go has no file locking working on all systems. onetime audit lists
+// entries and checks the chain.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// One line of the audit journal
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Token  string    `json:"token"`
+	Client string    `json:"client,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Prev   string    `json:"prev"`
+	Hash   string    `json:"hash,omitempty"`
+}
+
+// Return the hash of an entry, computed over its JSON form without hash
+func (e auditEntry) sum() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// Return the hash of the last entry of the journal, "" if empty
+func lastHash(f *os.File) (string, error) {
+	sta, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	end := sta.Size()
+	if end < 1 {
+		return "", nil
+	}
+	for n := int64(4096); ; n *= 2 {
+		if n > end {
+			n = end
+		}
+		buf := make([]byte, n)
+		if _, err = f.ReadAt(buf, end-n); err != nil {
+			return "", err
+		}
+		// Skip the final newline and look for the one before
+		i := len(buf) - 2
+		for i >= 0 && buf[i] != '\n' {
+			i--
+		}
+		if i >= 0 || n == end {
+			line := buf[i+1:]
+			if len(line) < 1 {
+				return "", nil
+			}
+			var e auditEntry
+			if err = json.Unmarshal(line, &e); err != nil {
+				return "", errors.New("invalid last entry in " + cnf.AUDIT_LOG)
+			}
+			return e.Hash, nil
+		}
+	}
+}
+
+const (
+	AUDIT_LOCK_WAIT  = 5 * time.Second  // Longest wait for the lock
+	AUDIT_LOCK_STALE = 30 * time.Second // Age of locks left by crashes
+)
+
+// Take the lock of the audit journal and return its release function
+func lockJournal() (func(), error) {
+	unlock, err := lockFile(cnf.AUDIT_LOG+".lock", AUDIT_LOCK_WAIT,
+		AUDIT_LOCK_STALE)
+	if err != nil {
+		return nil, errors.New("audit journal " + err.Error())
+	}
+	return unlock, nil
+}
+
+// Append an event about token ott to the audit journal. req is nil for
+// events coming from the command line.
+func journal(event, ott string, req *http.Request, detail string) {
+	if len(cnf.AUDIT_LOG) < 1 {
+		return
+	}
+	f, err := os.OpenFile(cnf.AUDIT_LOG,
+		os.O_RDWR|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		slog.Error("AUDIT", "err", err)
+		return
+	}
+	defer f.Close()
+	unlock, err := lockJournal()
+	if err != nil {
+		slog.Error("AUDIT", "err", err)
+		return
+	}
+	defer unlock()
+	e := auditEntry{
+		Time:   time.Now().UTC(),
+		Event:  event,
+		Token:  ott,
+		Detail: detail,
+	}
+	if req != nil {
+		e.Client = clientHost(req)
+	}
+	if e.Prev, err = lastHash(f); err != nil {
+		slog.Error("AUDIT", "err", err)
+		return
+	}
+	e.Hash = e.sum()
+	b, _ := json.Marshal(e)
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		slog.Error("AUDIT", "err", err)
+	}
+}
+
+// Return the last n entries of the journal
+func recentJournal(n int) ([]auditEntry, error) {
+	f, err := os.Open(cnf.AUDIT_LOG)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []auditEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e auditEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			continue
+		}
+		if entries = append(entries, e); len(entries) > n {
+			entries = entries[1:]
+		}
+	}
+	return entries, sc.Err()
+}
+
+// Filters of onetime audit
+type AuditOptions struct {
+	Token string
+	Event string
+	Since time.Duration
+	JSON  bool
+}
+
+// List journal entries matching opt and check the hash chain
+func Audit(opt AuditOptions) error {
+	if len(cnf.AUDIT_LOG) < 1 {
+		return errors.New("AUDIT_LOG undefined in " + cnf.path)
+	}
+	f, err := os.Open(cnf.AUDIT_LOG)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var since time.Time
+	if opt.Since > 0 {
+		since = time.Now().Add(-opt.Since)
+	}
+	prev := ""
+	n := 0
+	broken := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		n++
+		var e auditEntry
+		if err = json.Unmarshal(sc.Bytes(), &e); err != nil ||
+			e.Prev != prev || e.Hash != e.sum() {
+			if broken == 0 {
+				broken = n
+			}
+		}
+		prev = e.Hash
+		if (len(opt.Token) > 0 && e.Token != opt.Token) ||
+			(len(opt.Event) > 0 && e.Event != opt.Event) ||
+			e.Time.Before(since) {
+			continue
+		}
+		if opt.JSON {
+			fmt.Println(sc.Text())
+			continue
+		}
+		client := e.Client
+		if len(client) < 1 {
+			client = "-"
+		}
+		fmt.Printf("%s  %-8s  %s  %-15s  %s\n", isotime(e.Time.Local()),
+			e.Event, e.Token, client, e.Detail)
+	}
+	if err = sc.Err(); err != nil {
+		return err
+	}
+	if broken > 0 {
+		return errors.New("journal altered at line " + strconv.Itoa(broken) +
+			" of " + cnf.AUDIT_LOG)
+	}
+	if !opt.JSON {
+		fmt.Printf("\n%d entries, chain intact\n", n)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Point the configuration at an audit journal in a test directory, holding
+// a few entries, and return its lines
+func testJournal(t *testing.T) []string {
+	t.Helper()
+	saved := cnf.AUDIT_LOG
+	cnf.AUDIT_LOG = filepath.Join(t.TempDir(), "audit.log")
+	t.Cleanup(func() { cnf.AUDIT_LOG = saved })
+	req := httptest.NewRequest("POST", "/d/aaaa1111", nil)
+	req.RemoteAddr = "192.0.2.1:4321"
+	journal("create", "aaaa1111", nil, "/a.txt")
+	journal("activate", "aaaa1111", req, "")
+	// Longer than the block read back for the hash of the last entry
+	journal("serve", "aaaa1111", req, strings.Repeat("x", 10000))
+	journal("delete", "aaaa1111", nil, "")
+	b, err := os.ReadFile(cnf.AUDIT_LOG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+// Check the journal without listing entries
+func checkJournal() error {
+	return Audit(AuditOptions{Token: "none", JSON: true})
+}
+
+func TestJournalChain(t *testing.T) {
+	lines := testJournal(t)
+	if len(lines) != 4 {
+		t.Fatalf("%d entries, want 4", len(lines))
+	}
+	prev := ""
+	for i, line := range lines {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Prev != prev || e.Hash != e.sum() {
+			t.Errorf("entry %d: prev %q, hash %q, want prev %q", i+1, e.Prev,
+				e.Hash, prev)
+		}
+		prev = e.Hash
+	}
+	if err := checkJournal(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJournalAltered(t *testing.T) {
+	// Change an entry, keeping the hash it had
+	edit := func(line string, change func(*auditEntry)) string {
+		var e auditEntry
+		json.Unmarshal([]byte(line), &e)
+		change(&e)
+		b, _ := json.Marshal(e)
+		return string(b)
+	}
+	tests := []struct {
+		name  string
+		alter func([]string) []string
+		line  string
+	}{
+		{"entry removed", func(l []string) []string {
+			return append(l[:1:1], l[2:]...)
+		}, "line 2 "},
+		{"first entry removed", func(l []string) []string {
+			return l[1:]
+		}, "line 1 "},
+		{"entries swapped", func(l []string) []string {
+			l[1], l[2] = l[2], l[1]
+			return l
+		}, "line 2 "},
+		{"detail changed", func(l []string) []string {
+			l[2] = edit(l[2], func(e *auditEntry) { e.Detail = "y" })
+			return l
+		}, "line 3 "},
+		{"client changed", func(l []string) []string {
+			l[1] = edit(l[1], func(e *auditEntry) { e.Client = "192.0.2.2" })
+			return l
+		}, "line 2 "},
+		// Hashing again does not help without rewriting what follows
+		{"entry rehashed", func(l []string) []string {
+			l[1] = edit(l[1], func(e *auditEntry) {
+				e.Event = "view"
+				e.Hash = e.sum()
+			})
+			return l
+		}, "line 3 "},
+		{"entry inserted", func(l []string) []string {
+			forged := edit(l[3], func(e *auditEntry) { e.Event = "renew" })
+			return append(l[:3:3], forged, l[3])
+		}, "line 4 "},
+		{"garbage", func(l []string) []string {
+			return append(l, "not json")
+		}, "line 5 "},
+	}
+	for _, tt := range tests {
+		lines := tt.alter(testJournal(t))
+		err := os.WriteFile(cnf.AUDIT_LOG,
+			[]byte(strings.Join(lines, "\n")+"\n"), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkJournal()
+		if err == nil || !strings.Contains(err.Error(), tt.line) {
+			t.Errorf("%s: err = %v, want one at %s", tt.name, err, tt.line)
+		}
+	}
+}
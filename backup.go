@@ -0,0 +1,551 @@
+// Backup and restore.
+// onetime backup writes the configuration file, the token DB, the server
+// secret signing status URLs and the spooled files of tokens to a tar
+// archive, compressed with gzip for .tar.gz or .tgz names, or by the
+// zstd command for .tar.zst; onetime restore puts them back, so that an
+// instance moves to a new host with its links working:
+//
+//	onetime backup /tmp/onetime.tar.gz
+//	scp /tmp/onetime.tar.gz newhost:
+//	newhost$ onetime restore onetime.tar.gz
+//
+// backup takes the token DB lock while it reads the token DB and links
+// the spooled files of its tokens aside, then writes the archive from
+// these links without holding the lock: the archive is consistent while
+// the server keeps running. Files shared from outside the spool
+// directory, certificates and logs are not included. restore holds the
+// lock from the time it reads the archived token DB until it is saved.
+// It writes the archived configuration where onetime looks for it when
+// there is none yet, and next to the current one as .restored otherwise;
+// it refuses to replace a token DB holding tokens, or a different server
+// secret, without --force. Tokens kept in PostgreSQL are backed up with
+// the database tools instead.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tokens, as made by GenerateOnetime
+var tokenName = regexp.MustCompile("^[0-9a-z]{" + strconv.Itoa(ONETIME_SZ) +
+	"}$")
+
+// Names of the parts of an archive
+const (
+	BACKUP_CONFIG = "onetime.json"
+	BACKUP_DB     = "token.db"
+	BACKUP_SECRET = "onetime.secret"
+	BACKUP_SPOOL  = "spool/"
+)
+
+// Return a writer compressing to w as the archive name says, and the
+// function finishing the compression
+func compressor(name string, w io.Writer) (io.Writer, func() error, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		gz := gzip.NewWriter(w)
+		return gz, gz.Close, nil
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, nil, errors.New("zstd: " + err.Error() +
+				", use a .tar.gz name instead")
+		}
+		return in, func() error {
+			in.Close()
+			return cmd.Wait()
+		}, nil
+	case strings.HasSuffix(name, ".tar"):
+		return w, func() error { return nil }, nil
+	}
+	return nil, nil, errors.New("archive names end in .tar, .tar.gz, .tgz " +
+		"or .tar.zst")
+}
+
+// Return a reader decompressing r as the archive name says, and the
+// function to call once done
+func decompressor(name string, r io.Reader) (io.Reader, func() error, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, gz.Close, nil
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		cmd := exec.Command("zstd", "-d", "-q", "-c")
+		cmd.Stdin = r
+		cmd.Stderr = os.Stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, nil, errors.New("zstd: " + err.Error())
+		}
+		return out, cmd.Wait, nil
+	case strings.HasSuffix(name, ".tar"):
+		return r, func() error { return nil }, nil
+	}
+	return nil, nil, errors.New("archive names end in .tar, .tar.gz, .tgz " +
+		"or .tar.zst")
+}
+
+// Add the contents of a file to an archive
+func archiveData(tw *tar.Writer, name string, data []byte, mode int64) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    mode,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	return err
+}
+
+// Add a file to an archive
+func archiveFile(tw *tar.Writer, name, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sta, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    sta.Size(),
+		ModTime: sta.ModTime(),
+	})
+	if err == nil {
+		_, err = io.CopyN(tw, f, sta.Size())
+	}
+	return err
+}
+
+// Return the file of the server secret, empty if SECRET is set
+func secretFile() string {
+	if len(cnf.SECRET) > 0 {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(cnf.TOKEN_DB), "onetime.secret")
+}
+
+// Return the archive name of the spooled file of a token, empty if the
+// token has none
+func spoolEntry(ott string, tok Token) string {
+	if !tok.Spooled || len(cnf.SPOOL_DIR) < 1 {
+		return ""
+	}
+	rel, err := filepath.Rel(filepath.Join(cnf.SPOOL_DIR, ott), tok.Path)
+	if err != nil || rel != filepath.Base(tok.Path) {
+		return ""
+	}
+	return BACKUP_SPOOL + ott + "/" + rel
+}
+
+// What a backup archives of the token DB and spool
+type snapshot struct {
+	db      []byte            // Contents of the token DB
+	tokens  int               // Number of tokens
+	files   map[string]string // Spooled files by archive entry name
+	outside int               // Tokens sharing files outside the spool
+	dir     string            // Links to spooled files, removed once done
+}
+
+// Read the token DB and link the spooled files of its tokens aside, under
+// the token DB lock, so that tokens removed while the archive is written
+// keep their files
+func takeSnapshot() (*snapshot, error) {
+	unlock, err := lockTokenDB()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	js, err := os.ReadFile(cnf.TOKEN_DB)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	raw, version, err := parseTokenDB(js)
+	if err != nil {
+		return nil, errors.New("cannot read " + cnf.TOKEN_DB + ": " +
+			err.Error())
+	}
+	ltok, err := tokensOf(raw, version)
+	if err != nil {
+		return nil, errors.New("cannot read " + cnf.TOKEN_DB + ": " +
+			err.Error())
+	}
+	snap := &snapshot{db: js, tokens: len(ltok), files: map[string]string{}}
+	for ott, tok := range ltok {
+		entry := spoolEntry(ott, tok)
+		if len(entry) < 1 {
+			if tok.Kind == KIND_FILE && !isS3(tok.Path) && !isRemote(tok.Path) {
+				snap.outside++
+			}
+			continue
+		}
+		if len(snap.dir) < 1 {
+			if snap.dir, err = os.MkdirTemp(cnf.SPOOL_DIR, ".backup-"); err != nil {
+				return nil, err
+			}
+		}
+		link := filepath.Join(snap.dir, ott)
+		if err = os.Link(tok.Path, link); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			// No hard links here: archived from its place if still there
+			link = tok.Path
+		}
+		snap.files[entry] = link
+	}
+	return snap, nil
+}
+
+// Write the configuration, token DB, secret and spool to an archive
+func Backup(name string) error {
+	if isPostgres(cnf.TOKEN_DB) {
+		return errors.New("tokens are in PostgreSQL: back them up with " +
+			"pg_dump, and the spool directory with them")
+	}
+	if isPluginStore(cnf.TOKEN_DB) {
+		return errors.New("tokens are kept by a plugin: back them up " +
+			"where it keeps them, and the spool directory with them")
+	}
+	snap, err := takeSnapshot()
+	if snap != nil {
+		defer os.RemoveAll(snap.dir)
+	}
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	w, finish, err := compressor(name, tmp)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	if sta, err := os.Stat(cnf.path); err == nil && sta.Mode().IsRegular() {
+		if err = archiveFile(tw, BACKUP_CONFIG, cnf.path); err != nil {
+			return err
+		}
+	}
+	if err = archiveData(tw, BACKUP_DB, snap.db, 0600); err != nil {
+		return err
+	}
+	if f := secretFile(); len(f) > 0 {
+		if key, err := os.ReadFile(f); err == nil {
+			if err = archiveData(tw, BACKUP_SECRET, key, 0600); err != nil {
+				return err
+			}
+		}
+	}
+	spooled := 0
+	for entry, file := range snap.files {
+		err = archiveFile(tw, entry, file)
+		if os.IsNotExist(err) {
+			// Not linked, and deleted since the token DB was read
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		spooled++
+	}
+	err = tw.Close()
+	if ferr := finish(); err == nil {
+		err = ferr
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d tokens, %d spooled files\n", name, snap.tokens,
+		spooled)
+	if snap.outside > 0 {
+		fmt.Printf("%d tokens share files outside the spool directory, "+
+			"not included\n", snap.outside)
+	}
+	return nil
+}
+
+// Tell whether an archive entry name could lead out of the directory it
+// is extracted to
+func unsafeEntry(name string) bool {
+	if path.IsAbs(name) || filepath.IsAbs(name) {
+		return true
+	}
+	for _, elem := range strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || r == filepath.Separator
+	}) {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// Return where to restore the spooled file of token ott, which must be
+// right below its directory in SPOOL_DIR
+func spoolPath(ott, file string) (string, error) {
+	if !tokenName.MatchString(ott) {
+		return "", errors.New("invalid token " + ott)
+	}
+	dir := filepath.Join(filepath.Clean(cnf.SPOOL_DIR), ott)
+	dst := filepath.Join(dir, file)
+	if !strings.HasPrefix(dst, dir+string(filepath.Separator)) ||
+		filepath.Dir(dst) != dir {
+		return "", errors.New(file + " is not below " + dir)
+	}
+	return dst, nil
+}
+
+// Write restored data to a file, creating its directory
+func restoreFile(name string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Restore an archive written by Backup, which puts the configuration and
+// token DB before spooled files. Existing tokens are only replaced with
+// force.
+func Restore(name string, force bool) error {
+	if isPostgres(cnf.TOKEN_DB) {
+		return errors.New("tokens are in PostgreSQL: restore them with " +
+			"pg_restore or psql")
+	}
+	if isPluginStore(cnf.TOKEN_DB) {
+		return errors.New("tokens are kept by a plugin: restore them " +
+			"where it keeps them")
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, finish, err := decompressor(name, f)
+	if err != nil {
+		return err
+	}
+	defer finish()
+	ar := tar.NewReader(r)
+	var ltok LTokens
+	var secret []byte
+	restored := 0
+	for {
+		h, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if unsafeEntry(h.Name) {
+			return errors.New(name + ": unsafe entry " + h.Name)
+		}
+		switch {
+		case h.Name == BACKUP_CONFIG:
+			js, err := io.ReadAll(ar)
+			if err == nil {
+				err = restoreConfig(js)
+			}
+			if err != nil {
+				return err
+			}
+		case h.Name == BACKUP_DB && ltok == nil:
+			if len(cnf.path) < 1 {
+				return errors.New("no configuration, in the archive or here")
+			}
+			err = os.MkdirAll(filepath.Dir(cnf.TOKEN_DB), 0755)
+			if err != nil {
+				return err
+			}
+			// Held until the restored tokens are saved
+			unlock, err := lockTokenDB()
+			if err != nil {
+				return err
+			}
+			defer unlock()
+			if ltok, err = restoreTokens(ar, force); err != nil {
+				return err
+			}
+		case h.Name == BACKUP_SECRET:
+			if secret, err = io.ReadAll(ar); err != nil {
+				return err
+			}
+			if err = checkSecret(secret, force); err != nil {
+				return err
+			}
+		case strings.HasPrefix(h.Name, BACKUP_SPOOL) && ltok != nil:
+			ott, file, _ := strings.Cut(h.Name[len(BACKUP_SPOOL):], "/")
+			if !tokenName.MatchString(ott) {
+				return errors.New(name + ": invalid token in " + h.Name)
+			}
+			dst, err := spoolPath(ott, file)
+			if err != nil {
+				return errors.New(name + ": " + err.Error())
+			}
+			// Paths of spooled tokens were moved to SPOOL_DIR
+			if tok, ok := ltok[ott]; !ok || !tok.Spooled || tok.Path != dst {
+				continue
+			}
+			touchTokenDBLock()
+			if err = restoreFile(dst, ar, 0600); err != nil {
+				return err
+			}
+			restored++
+		}
+	}
+	if ltok == nil {
+		return errors.New(name + " holds no token DB")
+	}
+	if f := secretFile(); len(f) > 0 && secret != nil {
+		if err = restoreFile(f, bytes.NewReader(secret), 0600); err != nil {
+			return err
+		}
+	}
+	dbRefused.Delete(cnf.TOKEN_DB)
+	if err = ltok.Save(cnf.TOKEN_DB); err != nil {
+		return errors.New("spooled files restored, token DB not saved: " +
+			err.Error())
+	}
+	fmt.Printf("%s: %d tokens, %d spooled files restored\n", cnf.TOKEN_DB,
+		len(ltok), restored)
+	return nil
+}
+
+// Read an archived token DB, checking that it may replace the current one
+func restoreTokens(r io.Reader, force bool) (LTokens, error) {
+	js, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	raw, version, err := parseTokenDB(js)
+	if err != nil {
+		return nil, err
+	}
+	ltok, err := tokensOf(raw, version)
+	if err != nil {
+		return nil, err
+	}
+	for ott, tok := range ltok {
+		if !tokenName.MatchString(ott) {
+			return nil, errors.New("invalid token " + ott)
+		}
+		if !tok.Spooled || isS3(tok.Path) || isRemote(tok.Path) {
+			continue
+		}
+		// Spooled files go to SPOOL_DIR on this host, never elsewhere:
+		// their directory is removed with the token
+		if len(cnf.SPOOL_DIR) < 1 {
+			return nil, errors.New("spooled files but no SPOOL_DIR in " +
+				cnf.path)
+		}
+		if tok.Path, err = spoolPath(ott, filepath.Base(tok.Path)); err != nil {
+			return nil, err
+		}
+		ltok[ott] = tok
+	}
+	if force {
+		return ltok, nil
+	}
+	current, _, err := readTokenDB(cnf.TOKEN_DB)
+	if err != nil {
+		return nil, errors.New("cannot read " + cnf.TOKEN_DB + ": " +
+			err.Error() + ", use --force to replace it")
+	}
+	if len(current) > 0 {
+		return nil, fmt.Errorf("%s already holds %d tokens, use --force to "+
+			"replace them", cnf.TOKEN_DB, len(current))
+	}
+	return ltok, nil
+}
+
+// Check that the server secret may be replaced by the archived one:
+// status URLs and receipts signed with the current one would no longer
+// verify
+func checkSecret(secret []byte, force bool) error {
+	f := secretFile()
+	if len(f) < 1 || force {
+		return nil
+	}
+	cur, err := os.ReadFile(f)
+	if os.IsNotExist(err) || (err == nil && bytes.Equal(cur, secret)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return errors.New(f + " differs from the archived one, links and " +
+		"receipts it signed would no longer verify, use --force to " +
+		"replace it")
+}
+
+// Install an archived configuration where onetime looks for one, unless
+// there is one already, then read it
+func restoreConfig(js []byte) error {
+	if len(cnf.path) > 0 {
+		if cur, err := os.ReadFile(cnf.path); err == nil &&
+			!bytes.Equal(cur, js) {
+			fmt.Println("keeping", cnf.path+", archived configuration in",
+				cnf.path+".restored")
+			return os.WriteFile(cnf.path+".restored", js, 0600)
+		}
+		return nil
+	}
+	name := configFiles()[0]
+	if err := restoreFile(name, bytes.NewReader(js), 0600); err != nil {
+		return err
+	}
+	fmt.Println("configuration restored to", name)
+	cnf = Config{}
+	return readConfiguration(&cnf)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnsafeEntry(t *testing.T) {
+	tests := []struct {
+		name   string
+		unsafe bool
+	}{
+		{"onetime.json", false},
+		{"spool/aaaa1111/file.txt", false},
+		{"spool/aaaa1111/..file", false},
+		{"/etc/passwd", true},
+		{"../token.db", true},
+		{"spool/../../etc/cron.d/x", true},
+		{"spool/aaaa1111/..", true},
+		{"spool/aaaa1111/../../x", true},
+	}
+	for _, tt := range tests {
+		if got := unsafeEntry(tt.name); got != tt.unsafe {
+			t.Errorf("unsafeEntry(%q) = %v, want %v", tt.name, got,
+				tt.unsafe)
+		}
+	}
+}
+
+func TestSpoolPath(t *testing.T) {
+	saved := cnf.SPOOL_DIR
+	defer func() { cnf.SPOOL_DIR = saved }()
+	spool := filepath.Join(t.TempDir(), "spool")
+	cnf.SPOOL_DIR = spool + "/"
+	tests := []struct {
+		ott, file string
+		ok        bool
+	}{
+		{"aaaa1111", "file.txt", true},
+		{"aaaa1111", "..file", true},
+		{"aaaa1111", "", false},
+		{"aaaa1111", ".", false},
+		{"aaaa1111", "..", false},
+		{"aaaa1111", "../bbbb2222/file", false},
+		{"aaaa1111", "sub/file", false},
+		{"aaaa1111", "../../../etc/passwd", false},
+		{"..", "file", false},
+	}
+	for _, tt := range tests {
+		dst, err := spoolPath(tt.ott, tt.file)
+		if (err == nil) != tt.ok {
+			t.Errorf("spoolPath(%q, %q) = %q, %v", tt.ott, tt.file, dst, err)
+			continue
+		}
+		if tt.ok && dst != filepath.Join(spool, tt.ott, tt.file) {
+			t.Errorf("spoolPath(%q, %q) = %q", tt.ott, tt.file, dst)
+		}
+	}
+}
+
+func TestRestoreTokens(t *testing.T) {
+	savedSpool, savedPath := cnf.SPOOL_DIR, cnf.path
+	defer func() { cnf.SPOOL_DIR, cnf.path = savedSpool, savedPath }()
+	db := testTokenDB(t)
+	cnf.SPOOL_DIR = filepath.Join(filepath.Dir(db), "spool")
+	tests := []struct {
+		name, js string
+		err      string
+	}{
+		{"valid", `{"aaaa1111": {"Path": "/a"}}`, ""},
+		{"dot dot token", `{"..": {"Path": "/a"}}`, "invalid token"},
+		{"path token", `{"../../x": {}}`, "invalid token"},
+		{"upper case", `{"AAAA1111": {}}`, "invalid token"},
+		{"too long", `{"aaaa11112": {}}`, "invalid token"},
+		{"damaged", `{"aaaa1111": `, "unexpected end"},
+	}
+	for _, tt := range tests {
+		_, err := restoreTokens(strings.NewReader(tt.js), false)
+		if len(tt.err) < 1 && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if len(tt.err) > 0 && (err == nil ||
+			!strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	// Spooled files are moved below SPOOL_DIR, wherever they were
+	ltok, err := restoreTokens(strings.NewReader(
+		`{"aaaa1111": {"Path": "/etc/passwd", "Spooled": true}}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(cnf.SPOOL_DIR, "aaaa1111", "passwd")
+	if ltok["aaaa1111"].Path != want {
+		t.Errorf("spooled path %q, want %q", ltok["aaaa1111"].Path, want)
+	}
+	// Tokens already there are only replaced with force
+	if err = (LTokens{"bbbb2222": {}}).Save(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = restoreTokens(strings.NewReader(`{}`), false); err == nil {
+		t.Error("existing tokens replaced without force")
+	}
+	if _, err = restoreTokens(strings.NewReader(`{}`), true); err != nil {
+		t.Errorf("with force: %v", err)
+	}
+}
+
+// Write a tar archive of entries, in order, and return its name
+func testArchive(t *testing.T, entries [][2]string) string {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, e := range entries {
+		tw.WriteHeader(&tar.Header{Name: e[0], Mode: 0600,
+			Size: int64(len(e[1]))})
+		tw.Write([]byte(e[1]))
+	}
+	tw.Close()
+	name := filepath.Join(t.TempDir(), "backup.tar")
+	if err := os.WriteFile(name, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestRestoreEntries(t *testing.T) {
+	savedSpool, savedPath, savedSecret := cnf.SPOOL_DIR, cnf.path, cnf.SECRET
+	defer func() {
+		cnf.SPOOL_DIR, cnf.path, cnf.SECRET = savedSpool, savedPath,
+			savedSecret
+	}()
+	db := testTokenDB(t)
+	dir := filepath.Dir(db)
+	cnf.SPOOL_DIR = filepath.Join(dir, "spool")
+	cnf.path = filepath.Join(dir, "onetime.json")
+	cnf.SECRET = "test"
+	tokens := `{"tokens": {"aaaa1111": {"Path": "/x/a.txt", "Spooled": true}},
+		"version": 2}`
+	unsafe := []string{
+		"/tmp/evil",
+		"../evil",
+		"spool/../../evil",
+		"spool/aaaa1111/../../../evil",
+	}
+	for _, name := range unsafe {
+		archive := testArchive(t, [][2]string{{BACKUP_DB, tokens},
+			{name, "evil"}})
+		err := Restore(archive, true)
+		if err == nil || !strings.Contains(err.Error(), "unsafe entry") {
+			t.Errorf("entry %q: err = %v", name, err)
+		}
+	}
+	archive := testArchive(t, [][2]string{
+		{BACKUP_DB, tokens},
+		{"spool/aaaa1111/a.txt", "data"},
+		// Not the file of the token, or no such token
+		{"spool/aaaa1111/b.txt", "other"},
+		{"spool/bbbb2222/a.txt", "other"},
+	})
+	if err := Restore(archive, true); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(cnf.SPOOL_DIR, "aaaa1111", "a.txt"))
+	if err != nil || string(b) != "data" {
+		t.Errorf("spooled file %q, %v", b, err)
+	}
+	for _, name := range []string{"aaaa1111/b.txt", "bbbb2222"} {
+		if _, err = os.Stat(filepath.Join(cnf.SPOOL_DIR, name)); err == nil {
+			t.Errorf("%s restored", name)
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), "evil*"))
+	if len(matches) > 0 {
+		t.Errorf("written outside: %v", matches)
+	}
+	archive = testArchive(t, [][2]string{{"spool/AAAA/a.txt", "x"}})
+	if err = Restore(archive, true); err == nil {
+		t.Error("archive without token DB restored")
+	}
+}
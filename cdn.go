@@ -0,0 +1,171 @@
+// CDN offload.
+// With CDN_URL set to the address of a CDN or web server publishing
+// SPOOL_DIR, activated downloads of spooled files are redirected to a
+// signed URL of the file there, valid for CDN_EXPIRY (5 minutes by
+// default), rather than streamed by onetime. As with S3_MODE "redirect"
+// for bucket objects, the token is activated when handing the download
+// over. CDN_SIGN names the scheme the CDN checks:
+//
+//	"nginx"       nginx secure_link, with secure_link_md5
+//	              "$secure_link_expires$uri CDN_KEY"
+//	"bunny"       BunnyCDN token authentication, with CDN_KEY
+//	"cloudfront"  CloudFront canned policy, with the RSA key in CDN_KEY_FILE
+//	              of the key pair CDN_KEY_ID
+//
+// The CDN must refuse unsigned requests and never list directories.
+// Files keep the name they were spooled under; --name is not applied.
+
+package main
+
+import (
+	"crypto"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CDN_EXPIRY = 5 * time.Minute
+
+// Check the CDN settings and load the CloudFront key
+func (c *Config) checkCDN() error {
+	c.cdnExpiry = CDN_EXPIRY
+	c.cdnKey = nil
+	if len(c.CDN_URL) < 1 {
+		return nil
+	}
+	if u, err := url.Parse(c.CDN_URL); err != nil ||
+		(u.Scheme != "https" && u.Scheme != "http") {
+		return errors.New("invalid CDN_URL in " + c.path)
+	}
+	c.CDN_URL = strings.TrimRight(c.CDN_URL, "/")
+	if len(c.SPOOL_DIR) < 1 {
+		return errors.New("CDN_URL needs SPOOL_DIR in " + c.path)
+	}
+	if len(c.CDN_EXPIRY) > 0 {
+		d, err := time.ParseDuration(c.CDN_EXPIRY)
+		if err != nil || d <= 0 {
+			return errors.New("invalid CDN_EXPIRY in " + c.path)
+		}
+		c.cdnExpiry = d
+	}
+	switch c.CDN_SIGN {
+	case "nginx", "bunny":
+		if len(c.CDN_KEY) < 1 {
+			return errors.New("CDN_SIGN " + c.CDN_SIGN + " needs CDN_KEY in " +
+				c.path)
+		}
+	case "cloudfront":
+		if len(c.CDN_KEY_ID) < 1 || len(c.CDN_KEY_FILE) < 1 {
+			return errors.New("CDN_SIGN cloudfront needs CDN_KEY_ID and " +
+				"CDN_KEY_FILE in " + c.path)
+		}
+		key, err := readRSAKey(c.CDN_KEY_FILE)
+		if err != nil {
+			return errors.New("invalid CDN_KEY_FILE in " + c.path + ": " +
+				err.Error())
+		}
+		c.cdnKey = key
+	default:
+		return errors.New("invalid CDN_SIGN in " + c.path)
+	}
+	return nil
+}
+
+// Read an RSA private key, PKCS #1 or PKCS #8, from a PEM file
+func readRSAKey(name string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Tell whether the CDN serves the file of a token
+func cdnServes(tok Token) bool {
+	if len(cnf.CDN_URL) < 1 || !tok.Spooled || isS3(tok.Path) ||
+		isRemote(tok.Path) {
+		return false
+	}
+	rel, err := filepath.Rel(cnf.SPOOL_DIR, tok.Path)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+// Return a signed CDN URL of a spooled file, valid until expires
+func cdnSign(p string, expires time.Time) (string, error) {
+	rel, err := filepath.Rel(cnf.SPOOL_DIR, p)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(cnf.CDN_URL)
+	if err != nil {
+		return "", err
+	}
+	u.Path += "/" + filepath.ToSlash(rel)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{}
+	switch cnf.CDN_SIGN {
+	case "nginx":
+		sum := md5.Sum([]byte(exp + u.Path + " " + cnf.CDN_KEY))
+		q.Set("md5", base64.RawURLEncoding.EncodeToString(sum[:]))
+		q.Set("expires", exp)
+	case "bunny":
+		sum := sha256.Sum256([]byte(cnf.CDN_KEY + u.Path + exp))
+		q.Set("token", base64.RawURLEncoding.EncodeToString(sum[:]))
+		q.Set("expires", exp)
+	case "cloudfront":
+		policy := `{"Statement":[{"Resource":"` + u.String() +
+			`","Condition":{"DateLessThan":{"AWS:EpochTime":` + exp + `}}}]}`
+		sum := sha1.Sum([]byte(policy))
+		sig, err := rsa.SignPKCS1v15(nil, cnf.cdnKey, crypto.SHA1, sum[:])
+		if err != nil {
+			return "", err
+		}
+		// CloudFront's own URL-safe base64 alphabet
+		enc := strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(
+			base64.StdEncoding.EncodeToString(sig))
+		q.Set("Expires", exp)
+		q.Set("Signature", enc)
+		q.Set("Key-Pair-Id", cnf.CDN_KEY_ID)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Redirect the recipient to a signed CDN URL of the token file
+func cdnRedirect(w http.ResponseWriter, req *http.Request, tok Token) bool {
+	target, err := cdnSign(tok.Path, time.Now().Add(cnf.cdnExpiry))
+	if err != nil {
+		reqLog(req).Error("CDN", "file", tok.Path, "err", err)
+		return false
+	}
+	allowFormTarget(w, target)
+	http.Redirect(w, req, target, http.StatusSeeOther)
+	return true
+}
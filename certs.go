@@ -0,0 +1,105 @@
+// Certificate reloading.
+// Certificates are read again when their files change, checked every
+// minute, or when the server receives SIGHUP, so that renewals by certbot
+// and the like are picked up without a restart. Connections already open,
+// downloads in particular, go on undisturbed. When the new files cannot
+// be loaded, e.g. a key not written yet, the current certificates are
+// kept and loading is tried again at the next check.
+
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const CERT_CHECK = time.Minute // Delay between checks of certificate files
+
+// Certificates being served
+var serverCerts struct {
+	sync.RWMutex
+	certs []tls.Certificate
+	stamp string // Modification times of the files they were loaded from
+}
+
+// Return the files of CRT and KEY, then of the pairs of CERTS
+func certificateFiles() []CertPair {
+	return append([]CertPair{{cnf.CRT, cnf.KEY}}, cnf.CERTS...)
+}
+
+// Return a string changing whenever a certificate file changes
+func certificateStamp() string {
+	stamp := ""
+	for _, p := range certificateFiles() {
+		for _, name := range []string{p.CRT, p.KEY} {
+			if sta, err := os.Stat(name); err == nil {
+				stamp += strconv.FormatInt(sta.ModTime().UnixNano(), 10) +
+					"/" + strconv.FormatInt(sta.Size(), 10)
+			}
+			stamp += ","
+		}
+	}
+	return stamp
+}
+
+// Load all certificates, replacing those being served
+func reloadCertificates() error {
+	stamp := certificateStamp()
+	var certs []tls.Certificate
+	for _, p := range certificateFiles() {
+		cert, err := tls.LoadX509KeyPair(p.CRT, p.KEY)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	serverCerts.Lock()
+	serverCerts.certs, serverCerts.stamp = certs, stamp
+	serverCerts.Unlock()
+	return nil
+}
+
+// Return the first certificate matching the name asked for by a client,
+// the first one of all if none matches
+func getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverCerts.RLock()
+	defer serverCerts.RUnlock()
+	for i := range serverCerts.certs {
+		if hello.SupportsCertificate(&serverCerts.certs[i]) == nil {
+			return &serverCerts.certs[i], nil
+		}
+	}
+	return &serverCerts.certs[0], nil
+}
+
+// Reload certificates when their files change or on SIGHUP
+func watchCertificates() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		tick := time.NewTicker(CERT_CHECK)
+		for {
+			select {
+			case <-c:
+			case <-tick.C:
+				serverCerts.RLock()
+				stamp := serverCerts.stamp
+				serverCerts.RUnlock()
+				if stamp == certificateStamp() {
+					continue
+				}
+			}
+			if err := reloadCertificates(); err != nil {
+				slog.Error("CERTS", "err", err)
+				continue
+			}
+			slog.Info("CERTS", "count", len(certificateFiles()))
+		}
+	}()
+}
@@ -0,0 +1,131 @@
+// Configuration from the command line.
+// --base-addr, --token-db and --log-file may be given to any command,
+// before or after its own arguments, e.g.
+//
+//	onetime serve --base-addr http://localhost:2600 --token-db test.db
+//
+// They take precedence over the environment and onetime.json, so that
+// ad-hoc runs and tests need no edit of the configuration file. Relative
+// file names are relative to the working directory.
+// -c or --config names the configuration file to use instead of looking
+// for onetime.json, so that several instances can run from one
+// executable, each with its own file:
+//
+//	onetime -c /etc/onetime/public.json serve
+//	onetime -c /etc/onetime/intranet.json add report.pdf
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Settings that can be given on the command line
+var configFlags = []struct {
+	name  string
+	field string
+	file  bool // Relative to the working directory
+	value string
+	set   bool
+}{
+	{name: "base-addr", field: "BASE_ADDR"},
+	{name: "token-db", field: "TOKEN_DB", file: true},
+	{name: "log-file", field: "LOG_FILE", file: true},
+}
+
+// Configuration file given with -c or --config, searched for if empty
+var configFile string
+
+// Arguments as given, configuration flags included
+var commandLine []string
+
+// Remove configuration flags from args and return the other arguments,
+// leaving command flags to the command
+func parseConfigFlags(args []string) ([]string, error) {
+	commandLine = args
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			return append(rest, args[i:]...), nil
+		}
+		name := strings.TrimLeft(args[i], "-")
+		if len(name) == len(args[i]) {
+			rest = append(rest, args[i])
+			continue
+		}
+		value, hasValue := "", false
+		if k := strings.Index(name, "="); k >= 0 {
+			name, value, hasValue = name[:k], name[k+1:], true
+		}
+		if name == "c" || name == "config" {
+			if !hasValue {
+				if i+1 >= len(args) {
+					return nil, errors.New("flag needs an argument: " +
+						args[i])
+				}
+				i++
+				value = args[i]
+			}
+			abs, err := filepath.Abs(value)
+			if err != nil {
+				return nil, err
+			}
+			configFile = abs
+			continue
+		}
+		found := false
+		for j := range configFlags {
+			if configFlags[j].name != name {
+				continue
+			}
+			if !hasValue {
+				if i+1 >= len(args) {
+					return nil, errors.New("flag needs an argument: " +
+						args[i])
+				}
+				i++
+				value = args[i]
+			}
+			configFlags[j].value, configFlags[j].set = value, true
+			found = true
+		}
+		if !found {
+			rest = append(rest, args[i])
+		}
+	}
+	return rest, nil
+}
+
+// Tell whether any setting is given on the command line
+func cmdlineConfigured() bool {
+	for _, f := range configFlags {
+		if f.set {
+			return true
+		}
+	}
+	return false
+}
+
+// Override settings of c with configuration flags
+func (c *Config) readCommandLine() error {
+	v := reflect.ValueOf(c).Elem()
+	for _, f := range configFlags {
+		if !f.set {
+			continue
+		}
+		value := f.value
+		if f.file && len(value) > 0 && !isSyslog(value) && !isJournal(value) &&
+			isTokenFile(value) {
+			abs, err := filepath.Abs(value)
+			if err != nil {
+				return err
+			}
+			value = abs
+		}
+		v.FieldByName(f.field).SetString(value)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+// Daemon mode.
+// onetime serve --daemon starts the server in the background, detached
+// from the terminal, for hosts without a service manager. With a pid file,
+// given with --pidfile or PID_FILE, the server records its process ID
+// there and removes it when stopped, and onetime stop and onetime status
+// find it there. Go programs cannot fork: the daemon is a new process
+// running the same command, in a new session on systems that have them.
+// Its output is discarded, see LOG_FILE for what happens.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DAEMON_ENV   = "ONETIME_DAEMON_CHILD" // Set in the environment of the daemon
+	DAEMON_START = 2 * time.Second        // Wait for early failures of the daemon
+	STOP_WAIT    = 10 * time.Second       // Wait for the server to stop
+)
+
+// Tell whether this process is the daemon started by serve --daemon
+func isDaemon() bool {
+	return len(os.Getenv(DAEMON_ENV)) > 0
+}
+
+// Return the arguments of this command without --daemon
+func serverArgs() []string {
+	var args []string
+	for _, a := range commandLine[1:] {
+		if strings.TrimLeft(a, "-") != "daemon" {
+			args = append(args, a)
+		}
+	}
+	return args
+}
+
+// Start the same command again in the background, without --daemon
+func daemonize() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, serverArgs()...)
+	cmd.Env = append(os.Environ(), DAEMON_ENV+"=1")
+	// Detach from the terminal where the system knows sessions
+	attr := new(syscall.SysProcAttr)
+	if f := reflect.ValueOf(attr).Elem().FieldByName("Setsid"); f.IsValid() {
+		f.SetBool(true)
+	}
+	cmd.SysProcAttr = attr
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err = <-exited:
+		if err == nil {
+			err = errors.New("exited")
+		}
+		return errors.New("server failed to start (" + err.Error() +
+			"), see " + cnf.LOG_FILE)
+	case <-time.After(DAEMON_START):
+	}
+	fmt.Println("onetime started, pid", cmd.Process.Pid)
+	return nil
+}
+
+// Tell whether a process is running
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// Finding a process there opens it
+		p.Release()
+		return true
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// Return the process ID recorded in a pid file
+func readPidFile(name string) (int, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid < 1 {
+		return 0, errors.New("invalid pid file " + name)
+	}
+	return pid, nil
+}
+
+// Record the process ID in a pid file, replacing a stale one or the one of
+// the server handing over its sockets, and remove it when the server is
+// stopped
+func writePidFile(name string) error {
+	if pid, err := readPidFile(name); err == nil && pid != os.Getpid() &&
+		!(upgrading() && pid == os.Getppid()) && processAlive(pid) {
+		return errors.New("onetime already running with pid " +
+			strconv.Itoa(pid) + ", see " + name)
+	}
+	err := os.WriteFile(name, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		slog.Info("STOP", "signal", sig.String())
+		// Unless taken over by a new server
+		if pid, err := readPidFile(name); err == nil && pid == os.Getpid() {
+			os.Remove(name)
+		}
+		os.Exit(0)
+	}()
+	return nil
+}
+
+// Return the pid file to use, from --pidfile or PID_FILE
+func pidFile(given string) (string, error) {
+	if len(given) > 0 {
+		return filepath.Abs(given)
+	}
+	if len(cnf.PID_FILE) > 0 {
+		return cnf.PID_FILE, nil
+	}
+	return "", errors.New("no pid file: use --pidfile or set PID_FILE in " +
+		cnf.path)
+}
+
+// Stop the server recorded in a pid file
+func StopServer(name string) error {
+	pid, err := readPidFile(name)
+	if err != nil {
+		return err
+	}
+	if !processAlive(pid) {
+		os.Remove(name)
+		return errors.New("onetime not running, removed stale " + name)
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// No signals to ask politely
+		err = p.Kill()
+		os.Remove(name)
+	} else {
+		err = p.Signal(syscall.SIGTERM)
+	}
+	if err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(STOP_WAIT); time.Now().Before(deadline); {
+		if !processAlive(pid) {
+			fmt.Println("onetime stopped, pid", pid)
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New("onetime still running with pid " + strconv.Itoa(pid))
+}
+
+// Print whether the server recorded in a pid file runs, and return an
+// error if not
+func ServerStatus(name string) error {
+	pid, err := readPidFile(name)
+	if err != nil || !processAlive(pid) {
+		return errors.New("onetime not running")
+	}
+	fmt.Println("onetime running, pid", pid)
+	return nil
+}
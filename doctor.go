@@ -0,0 +1,251 @@
+// Configuration and environment check.
+// onetime doctor runs the checks a server start would fail on, and a few
+// it would only fail on later, reporting each with what to fix:
+// configuration validity, token DB and log file writability, certificate
+// and key pairs, listen addresses and resolution of BASE_ADDR. It exits
+// with status 1 if any check fails, so it fits deployment scripts.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Warn about certificates expiring within that long
+const CERT_EXPIRY_WARNING = 30 * 24 * time.Hour
+
+// Results of the checks
+type doctorReport struct {
+	failed int
+}
+
+func (d *doctorReport) ok(what, detail string) {
+	fmt.Printf("ok    %-12s %s\n", what, detail)
+}
+
+func (d *doctorReport) warn(what, detail string) {
+	fmt.Printf("warn  %-12s %s\n", what, detail)
+}
+
+func (d *doctorReport) fail(what string, err error, fix string) {
+	d.failed++
+	fmt.Printf("FAIL  %-12s %s\n", what, err)
+	if len(fix) > 0 {
+		fmt.Printf("      %-12s -> %s\n", "", fix)
+	}
+}
+
+// Check the configuration read with error cerr and the environment,
+// print a report and return an error if anything would prevent serving
+func Doctor(cerr error) error {
+	d := new(doctorReport)
+	if cerr != nil {
+		d.fail("config", cerr, "fix the configuration, or run onetime "+
+			"config to create one")
+		return errors.New("checks failed: 1")
+	}
+	d.ok("config", cnf.path)
+	d.checkTokenDB()
+	d.checkLogFile()
+	d.checkCertificates()
+	d.checkListen()
+	d.checkBaseAddr()
+	if d.failed > 0 {
+		return fmt.Errorf("checks failed: %d", d.failed)
+	}
+	return nil
+}
+
+// Tell whether a file can be written without altering it, creating it
+// and its absence back if needed
+func writable(name string) error {
+	_, serr := os.Stat(name)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if os.IsNotExist(serr) {
+		os.Remove(name)
+	}
+	return nil
+}
+
+func (d *doctorReport) checkTokenDB() {
+	if !isTokenFile(cnf.TOKEN_DB) {
+		st, err := openStore(cnf.TOKEN_DB)
+		var ltok LTokens
+		if err == nil {
+			ltok, err = st.Load(context.Background())
+		}
+		if err != nil && isPluginStore(cnf.TOKEN_DB) {
+			d.fail("token db", err, "check the COMMAND of the store "+
+				"plugin and what it needs to reach its database")
+			return
+		}
+		if err != nil {
+			d.fail("token db", err, "check the server, credentials and "+
+				"sslmode of the TOKEN_DB URL")
+			return
+		}
+		d.ok("token db", fmt.Sprintf("%s (%d tokens)", dbName(cnf.TOKEN_DB),
+			len(ltok)))
+		return
+	}
+	if err := writable(cnf.TOKEN_DB); err != nil {
+		d.fail("token db", err, "make the directory of TOKEN_DB "+
+			"writable by the user running onetime")
+		return
+	}
+	raw, version, err := readTokenDB(cnf.TOKEN_DB)
+	if err == nil {
+		err = migrate(raw, version)
+	}
+	if err != nil {
+		d.fail("token db", err, "restore "+cnf.TOKEN_DB+
+			" from a backup, or upgrade onetime if it is newer")
+		return
+	}
+	if len(raw) == 0 {
+		d.ok("token db", cnf.TOKEN_DB+" (empty)")
+		return
+	}
+	if version < DB_VERSION {
+		d.ok("token db", fmt.Sprintf("%s (%d tokens, version %d, migrated "+
+			"to %d on next save)", cnf.TOKEN_DB, len(raw), version, DB_VERSION))
+		return
+	}
+	d.ok("token db", fmt.Sprintf("%s (%d tokens)", cnf.TOKEN_DB, len(raw)))
+}
+
+func (d *doctorReport) checkLogFile() {
+	if isSyslog(cnf.LOG_FILE) || isJournal(cnf.LOG_FILE) {
+		d.ok("log file", cnf.LOG_FILE)
+		return
+	}
+	for _, name := range []string{cnf.LOG_FILE, cnf.ACCESS_LOG,
+		cnf.FAIL_LOG, cnf.AUDIT_LOG} {
+		if len(name) < 1 {
+			continue
+		}
+		if err := writable(name); err != nil {
+			d.fail("log file", err, "make the directory writable or "+
+				"change the log file name")
+			return
+		}
+	}
+	d.ok("log file", cnf.LOG_FILE)
+}
+
+func (d *doctorReport) checkCertificates() {
+	if !cnf.usesTLS() {
+		d.ok("tls", "not used")
+		return
+	}
+	for _, p := range certificateFiles() {
+		cert, err := tls.LoadX509KeyPair(p.CRT, p.KEY)
+		if err != nil {
+			d.fail("certificate", err, "check that "+p.CRT+" and "+p.KEY+
+				" are PEM files of the same certificate and key")
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			d.fail("certificate", err, "replace "+p.CRT)
+			continue
+		}
+		names := strings.Join(leaf.DNSNames, ", ")
+		if len(names) < 1 {
+			names = leaf.Subject.CommonName
+		}
+		left := time.Until(leaf.NotAfter)
+		switch {
+		case left <= 0:
+			d.fail("certificate", errors.New(p.CRT+" expired on "+
+				isotime(leaf.NotAfter)), "renew it")
+		case left < CERT_EXPIRY_WARNING:
+			d.warn("certificate", p.CRT+" ("+names+") expires on "+
+				isotime(leaf.NotAfter))
+		default:
+			d.ok("certificate", p.CRT+" ("+names+") valid until "+
+				isotime(leaf.NotAfter))
+		}
+	}
+}
+
+// Return the TCP address of a listen address, "" if it is not TCP
+func tcpAddr(addr string) string {
+	if strings.HasPrefix(addr, FCGI_PREFIX) {
+		addr = addr[len(FCGI_PREFIX):]
+		if len(addr) < 1 || strings.HasPrefix(addr, "/") {
+			return ""
+		}
+		return addr
+	}
+	return addr[strings.Index(addr, "://")+3:]
+}
+
+func (d *doctorReport) checkListen() {
+	addrs := cnf.listenAddrs()
+	if len(cnf.HTTP_REDIRECT) > 0 {
+		addrs = append(addrs, "http://"+cnf.HTTP_REDIRECT)
+	}
+	if len(cnf.PPROF) > 0 && cnf.PPROF != PPROF_API {
+		addrs = append(addrs, "http://"+cnf.PPROF)
+	}
+	for _, addr := range addrs {
+		if !strings.HasPrefix(addr, "http://") &&
+			!strings.HasPrefix(addr, "https://") &&
+			!strings.HasPrefix(addr, FCGI_PREFIX) {
+			d.fail("listen", errors.New("unknown protocol in "+addr),
+				"use an http:// or https:// address")
+			continue
+		}
+		hostport := tcpAddr(addr)
+		if len(hostport) < 1 {
+			d.ok("listen", addr)
+			continue
+		}
+		l, err := net.Listen("tcp", hostport)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			d.fail("listen", err, "listen on a local host name or address")
+			continue
+		} else if err != nil {
+			d.fail("listen", err, "stop what uses "+hostport+
+				", or run as a user allowed to bind it")
+			continue
+		}
+		l.Close()
+		d.ok("listen", addr)
+	}
+}
+
+func (d *doctorReport) checkBaseAddr() {
+	u, err := url.Parse(cnf.BASE_ADDR)
+	if err != nil || len(u.Hostname()) < 1 {
+		d.fail("base addr", errors.New("invalid BASE_ADDR "+cnf.BASE_ADDR),
+			"set BASE_ADDR to a URL such as https://host.example.com")
+		return
+	}
+	if net.ParseIP(u.Hostname()) != nil {
+		d.ok("base addr", cnf.BASE_ADDR)
+		return
+	}
+	ips, err := net.LookupHost(u.Hostname())
+	if err != nil {
+		d.fail("base addr", err, "links will not work: add a DNS "+
+			"record for "+u.Hostname())
+		return
+	}
+	d.ok("base addr", cnf.BASE_ADDR+" ("+strings.Join(ips, ", ")+")")
+}
@@ -0,0 +1,92 @@
+// Defense against token enumeration.
+// Requests for unknown or expired tokens all get the same page after a
+// small random delay, so that neither size nor timing tells them apart.
+// Clients collecting misses are slowed down: past ENUM_FREE misses within
+// ENUM_WINDOW, each of their token requests waits twice as long as the
+// previous one, up to ENUM_MAX_DELAY. Reaching ENUM_ALERT misses logs an
+// ENUMERATION line and an "enumeration" failure for fail2ban.
+
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	ENUM_WINDOW        = 10 * time.Minute // Period over which misses are counted
+	ENUM_FREE          = 5                // Misses allowed before slowing down
+	ENUM_MAX_DELAY     = 30 * time.Second // Longest delay imposed on a client
+	ENUM_ALERT_DEFAULT = 20               // Misses triggering an alert by default
+)
+
+// Misses of one client within the current window
+type enumClient struct {
+	first  time.Time
+	misses int
+}
+
+var enumClients = struct {
+	sync.Mutex
+	m      map[string]*enumClient
+	pruned time.Time
+}{m: make(map[string]*enumClient)}
+
+// Record a request for an unknown or expired token, then wait a random
+// while so that all misses take about the same time
+func miss(req *http.Request, reason string) {
+	failure(req, reason)
+	host := clientHost(req)
+	now := time.Now()
+	enumClients.Lock()
+	if now.Sub(enumClients.pruned) > time.Minute {
+		for k, c := range enumClients.m {
+			if now.Sub(c.first) > ENUM_WINDOW {
+				delete(enumClients.m, k)
+			}
+		}
+		enumClients.pruned = now
+	}
+	c, ok := enumClients.m[host]
+	if !ok || now.Sub(c.first) > ENUM_WINDOW {
+		c = &enumClient{first: now}
+		enumClients.m[host] = c
+	}
+	c.misses++
+	misses := c.misses
+	enumClients.Unlock()
+
+	alert := cnf.ENUM_ALERT
+	if alert == 0 {
+		alert = ENUM_ALERT_DEFAULT
+	}
+	if misses == alert {
+		reqLog(req).Warn("ENUMERATION", "misses", misses)
+		failure(req, "enumeration")
+	}
+	time.Sleep(50*time.Millisecond +
+		time.Duration(rand.Int63n(int64(200*time.Millisecond))))
+}
+
+// Slow down token requests from clients collecting misses
+func backoff(req *http.Request) {
+	enumClients.Lock()
+	c, ok := enumClients.m[clientHost(req)]
+	misses := 0
+	if ok && time.Since(c.first) <= ENUM_WINDOW {
+		misses = c.misses
+	}
+	enumClients.Unlock()
+	if misses <= ENUM_FREE {
+		return
+	}
+	d := ENUM_MAX_DELAY
+	if n := misses - ENUM_FREE; n < 16 {
+		if e := time.Duration(1<<uint(n-1)) * 250 * time.Millisecond; e < d {
+			d = e
+		}
+	}
+	time.Sleep(d)
+}
@@ -0,0 +1,96 @@
+// Configuration from the environment.
+// Every setting of onetime.json can be overridden by an environment
+// variable named after it with an ONETIME_ prefix, e.g. ONETIME_BASE_ADDR
+// or ONETIME_TOKEN_DB, which suits containers. Strings are taken as is,
+// booleans and numbers are parsed, lists are comma-separated or JSON
+// arrays, and other values (maps, CERTS) are JSON. Without any
+// onetime.json, the configuration can come from the environment alone:
+// relative file names are then relative to the working directory.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const ENV_PREFIX = "ONETIME_"
+
+// Tell whether any setting is given in the environment
+func envConfigured() bool {
+	t := reflect.TypeOf(cnf)
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).IsExported() {
+			continue
+		}
+		if _, ok := os.LookupEnv(ENV_PREFIX + t.Field(i).Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Override settings of c with ONETIME_* environment variables
+func (c *Config) readEnvironment() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		s, ok := os.LookupEnv(ENV_PREFIX + f.Name)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), s); err != nil {
+			return errors.New("invalid " + ENV_PREFIX + f.Name +
+				" in environment")
+		}
+	}
+	return nil
+}
+
+// Set a configuration field from the text of an environment variable
+func setField(field reflect.Value, s string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String &&
+			!strings.HasPrefix(strings.TrimSpace(s), "[") {
+			var list []string
+			for _, e := range strings.Split(s, ",") {
+				if e = strings.TrimSpace(e); len(e) > 0 {
+					list = append(list, e)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+			return nil
+		}
+		fallthrough
+	default:
+		p := reflect.New(field.Type())
+		if err := json.Unmarshal([]byte(s), p.Interface()); err != nil {
+			return err
+		}
+		field.Set(p.Elem())
+	}
+	return nil
+}
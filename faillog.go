@@ -0,0 +1,60 @@
+// Failure log for fail2ban.
+// When FAIL_LOG is set, every request for an unknown or expired token and
+// every rejected API key is written to that file as one line with a
+// stable format:
+//
+//	2026-01-02T15:04:05Z onetime failure client=203.0.113.7 reason=unknown
+//
+// so that a stock fail2ban filter can ban clients scanning for tokens.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Failure log file opened by Serve
+var failLog = struct {
+	sync.Mutex
+	f *os.File
+}{}
+
+// Open the failure log configured with FAIL_LOG, closing the one
+// previously opened
+func openFailLog() error {
+	if len(cnf.FAIL_LOG) < 1 {
+		return nil
+	}
+	f, err := os.OpenFile(cnf.FAIL_LOG,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	failLog.Lock()
+	defer failLog.Unlock()
+	if failLog.f != nil {
+		failLog.f.Close()
+	}
+	failLog.f = f
+	return nil
+}
+
+// Record a failed request in the failure log. Reasons are single words:
+// unknown, expired, apikey, enumeration, trap.
+func failure(req *http.Request, reason string) {
+	failLog.Lock()
+	defer failLog.Unlock()
+	if failLog.f == nil {
+		return
+	}
+	_, err := fmt.Fprintf(failLog.f, "%s onetime failure client=%s reason=%s\n",
+		time.Now().UTC().Format(time.RFC3339), clientHost(req), reason)
+	if err != nil {
+		slog.Error("FAILLOG", "err", err)
+	}
+}
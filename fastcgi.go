@@ -0,0 +1,37 @@
+// FastCGI serving.
+// A LISTEN address starting with "fcgi://" serves requests over FastCGI
+// instead of HTTP, for web servers that only speak FastCGI:
+//
+//	fcgi://127.0.0.1:9000     TCP address
+//	fcgi:///run/onetime.sock  Unix socket
+//	fcgi://                   socket inherited on stdin from the web server
+//
+// The web server handles TLS and timeouts. Client addresses come from its
+// REMOTE_ADDR parameter.
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const FCGI_PREFIX = "fcgi://"
+
+// Open the socket of a FastCGI address, the part after fcgi://: a TCP
+// address, the path of a Unix socket, or empty for the socket on stdin
+// (nil listener)
+func bindFastCGI(addr string) (net.Listener, error) {
+	if len(addr) < 1 {
+		return nil, nil
+	}
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") || filepath.IsAbs(addr) {
+		network = "unix"
+		// Left behind by a previous run
+		os.Remove(addr)
+	}
+	return net.Listen(network, addr)
+}
@@ -0,0 +1,203 @@
+// Remote resources shared through one-time links.
+// onetime add --fetch http(s)://... creates a token for a URL the server
+// fetches when the recipient downloads it, so that files living on
+// internal systems can be shared without downloading them first. With
+// --spool (or SPOOL in the configuration), the first download stores a
+// copy in the spool directory and later ones are served from it.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Serializes filling the spool with remote resources
+var fetchLock sync.Mutex
+
+// Tell whether a token path refers to a remote URL
+func isRemote(p string) bool {
+	u, err := url.Parse(p)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") &&
+		len(u.Host) > 0
+}
+
+// Send a request for a remote resource, with an optional Range
+func remoteDo(method, p, rng string) (*http.Response, error) {
+	req, err := http.NewRequest(method, p, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(rng) > 0 {
+		req.Header.Set("Range", rng)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// Fetch the size, time and type of the resource at p
+func remoteStat(p string) (objectInfo, error) {
+	resp, err := remoteDo("HEAD", p, "")
+	if err != nil {
+		return objectInfo{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return objectInfo{}, errors.New(p + ": " + resp.Status)
+	}
+	u, _ := url.Parse(p)
+	mod, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return objectInfo{
+		name:     path.Base(u.Path),
+		size:     resp.ContentLength,
+		modTime:  mod,
+		mimeType: resp.Header.Get("Content-Type"),
+	}, nil
+}
+
+// Register a Token for a remote resource and print its URL
+func (ltok LTokens) addRemote(ott, p string, opt AddOptions) string {
+	o, err := remoteStat(p)
+	if err != nil {
+		fmt.Println("cannot fetch:", err)
+		return ""
+	}
+	err = ltok.checkQuota(opt.Owner, o.size, opt.Spool || cnf.SPOOL)
+	if err != nil {
+		fmt.Println(err)
+		return ""
+	}
+	name := opt.Name
+	if len(name) < 1 {
+		name = o.name
+	}
+	if len(name) < 1 || name == "/" || name == "." {
+		name = "download"
+	}
+	mimetype := mime.TypeByExtension(path.Ext(name))
+	if len(mimetype) < 1 {
+		mimetype = o.mimeType
+	}
+	if len(mimetype) < 1 {
+		mimetype = "application/octet-stream"
+	}
+	ltok[ott] = Token{
+		Path:          p,
+		Created:       time.Now(),
+		Activated:     time.Unix(0, 0),
+		Spooled:       opt.Spool || cnf.SPOOL,
+		Name:          name,
+		Note:          opt.Note,
+		Size:          o.size,
+		ModTime:       o.modTime,
+		MimeType:      mimetype,
+		Inline:        opt.Inline,
+		Limit:         opt.Limit,
+		Allow:         opt.Allow,
+		Countries:     opt.Countries,
+		DenyCountries: opt.DenyCountries,
+		Owner:         opt.Owner,
+	}
+	fmt.Printf(`
+
+Name: %s
+Size: %s bytes
+%s/%s
+Status: %s
+
+`, name,
+		prettySize(o.size),
+		cnf.BASE_ADDR, ott, statusURL(ott))
+	journal("create", ott, nil, p)
+	hook("created", ott, ltok[ott], nil)
+	return ott
+}
+
+// Store a copy of the remote resource of token ott in the spool
+// directory, unless already done, and return the updated token
+func fetchRemote(ott string) (Token, os.FileInfo, error) {
+	fetchLock.Lock()
+	defer fetchLock.Unlock()
+	ltok := make(LTokens)
+	ltok.Load(cnf.TOKEN_DB)
+	tok, ok := ltok[ott]
+	if !ok {
+		return tok, nil, errors.New("no such token: " + ott)
+	}
+	if !isRemote(tok.Path) {
+		// Fetched by a concurrent download
+		sta, err := os.Stat(tok.Path)
+		return tok, sta, err
+	}
+	resp, err := remoteDo("GET", tok.Path, "")
+	if err != nil {
+		return tok, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return tok, nil, errors.New(tok.Path + ": " + resp.Status)
+	}
+	dst, err := spoolReader(ott, tok.FileName(), resp.Body)
+	if err != nil {
+		return tok, nil, err
+	}
+	sta, err := os.Stat(dst)
+	if err != nil {
+		return tok, nil, err
+	}
+	slog.Info("FETCH", "token", ott, "url", tok.Path, "file", dst)
+	tok, ok = updateToken(context.Background(), ott, func(tok *Token) bool {
+		tok.Path = dst
+		tok.Size = sta.Size()
+		tok.ModTime = sta.ModTime()
+		return true
+	})
+	if !ok {
+		os.RemoveAll(filepath.Dir(dst))
+		return tok, nil, errors.New("no such token: " + ott)
+	}
+	return tok, sta, nil
+}
+
+// Stream the remote resource of a token to the recipient, passing Range
+// requests on
+func remoteStream(w http.ResponseWriter, req *http.Request, tok Token) {
+	resp, err := remoteDo("GET", tok.Path, req.Header.Get("Range"))
+	if err != nil {
+		reqLog(req).Error("FETCH", "url", tok.Path, "err", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	relay(w, req, resp)
+}
+
+// Pass the response of an upstream server on to the recipient
+func relay(w http.ResponseWriter, req *http.Request, resp *http.Response) {
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent,
+		http.StatusRequestedRangeNotSatisfiable:
+	default:
+		reqLog(req).Error("UPSTREAM", "status", resp.Status)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	for _, k := range []string{"Content-Length", "Content-Range",
+		"Accept-Ranges", "Last-Modified", "ETag"} {
+		if v := resp.Header.Get(k); len(v) > 0 {
+			w.Header().Set(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
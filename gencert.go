@@ -0,0 +1,204 @@
+// Certificate generation.
+// onetime gencert writes a certificate for the host name of BASE_ADDR to
+// CRT and KEY, to get HTTPS working on a LAN in one step. By default the
+// certificate is self-signed. With --ca, a long-lived CA is created next
+// to CRT (ca.crt and ca.key) and signs the certificate: install ca.crt
+// once on client machines and renewed certificates are trusted without
+// further steps. An existing CA is reused. Existing files are never
+// overwritten without --force.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	CERT_DAYS = 825       // Longest validity accepted by Apple systems
+	CA_DAYS   = 10 * 3650 // Internal CA, renewed by hand if ever
+)
+
+// Options of onetime gencert
+type CertOptions struct {
+	CA    bool     // Sign with an internal CA instead of self-signing
+	Force bool     // Overwrite existing files
+	Hosts []string // More names or addresses besides the BASE_ADDR host
+	Days  int      // Validity of the certificate
+}
+
+// Return a new serial number
+func serialNumber() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return n
+}
+
+// Write a certificate or key as PEM, failing if the file exists unless
+// force is set
+func writePEM(name, kind string, der []byte, mode os.FileMode,
+	force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(name, flags, mode)
+	if os.IsExist(err) {
+		return errors.New(name + " exists, use --force to replace it")
+	} else if err != nil {
+		return err
+	}
+	err = pem.Encode(f, &pem.Block{Type: kind, Bytes: der})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Write a new key as PEM
+func writeKey(name string, key *ecdsa.PrivateKey, force bool) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(name, "PRIVATE KEY", der, 0600, force)
+}
+
+// Load the internal CA from dir, creating it if needed
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	crt, key := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	if b, err := os.ReadFile(crt); err == nil {
+		cb, _ := pem.Decode(b)
+		kb, err := os.ReadFile(key)
+		if cb == nil || err != nil {
+			return nil, nil, errors.New("cannot read CA from " + crt +
+				" and " + key)
+		}
+		kp, _ := pem.Decode(kb)
+		if kp == nil {
+			return nil, nil, errors.New("invalid CA key in " + key)
+		}
+		cert, err := x509.ParseCertificate(cb.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		k, err := x509.ParsePKCS8PrivateKey(kp.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		ek, ok := k.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, errors.New("CA key is not ECDSA in " + key)
+		}
+		fmt.Println("Using CA:", crt)
+		return cert, ek, nil
+	}
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "onetime CA " + host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(0, 0, CA_DAYS),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = writeKey(key, k, false); err != nil {
+		return nil, nil, err
+	}
+	if err = writePEM(crt, "CERTIFICATE", der, 0644, false); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Println("CA created:", crt)
+	return cert, k, nil
+}
+
+// Create a certificate for the host of BASE_ADDR in CRT and KEY
+func GenCert(opt CertOptions) error {
+	if len(cnf.CRT) < 1 || len(cnf.KEY) < 1 {
+		return errors.New("CRT and KEY undefined in " + cnf.path)
+	}
+	u, err := url.Parse(cnf.BASE_ADDR)
+	if err != nil || len(u.Hostname()) < 1 {
+		return errors.New("invalid BASE_ADDR in " + cnf.path)
+	}
+	if opt.Days < 1 {
+		opt.Days = CERT_DAYS
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: u.Hostname()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, opt.Days),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range append([]string{u.Hostname()}, opt.Hosts...) {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if len(h) > 0 {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	parent, signer := tmpl, k
+	if opt.CA {
+		if parent, signer, err = loadCA(filepath.Dir(cnf.CRT)); err != nil {
+			return err
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent,
+		&k.PublicKey, signer)
+	if err != nil {
+		return err
+	}
+	if !opt.Force {
+		// Check both before writing either
+		for _, name := range []string{cnf.CRT, cnf.KEY} {
+			if _, err := os.Stat(name); err == nil {
+				return errors.New(name + " exists, use --force to replace it")
+			}
+		}
+	}
+	if err = writeKey(cnf.KEY, k, opt.Force); err != nil {
+		return err
+	}
+	if err = writePEM(cnf.CRT, "CERTIFICATE", der, 0644, opt.Force); err != nil {
+		return err
+	}
+	fmt.Println("Certificate created:", cnf.CRT)
+	fmt.Println("Key created:", cnf.KEY)
+	fmt.Println("Valid until:", isotime(tmpl.NotAfter))
+	if u.Scheme != "https" {
+		fmt.Println("BASE_ADDR is not https: set it to https://" + u.Host +
+			" to use the certificate")
+	}
+	return nil
+}
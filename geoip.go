@@ -0,0 +1,293 @@
+// Country lookup of client addresses.
+// GEOIP_DB in the configuration points to a MaxMind database in MMDB
+// format (GeoLite2-Country, GeoIP2-Country or City). When loaded, log
+// records carry the country code of the client, downloads record
+// it and COUNTRY_ALLOW, COUNTRY_DENY and add --country restrict downloads
+// by country. The reader below only implements what a country lookup
+// needs from the format specification.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Separator between the data section and the metadata of a database
+var mmdbMetaMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// A MaxMind database loaded in memory
+type geoDB struct {
+	buf        []byte
+	data       []byte // Data section
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint // Node for the IPv4 part of IPv6 databases
+}
+
+// Database loaded by Serve when GEOIP_DB is set
+var geoip *geoDB
+
+// Load a MaxMind database
+func openGeoIP(filename string) (*geoDB, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetaMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind database: " + filename)
+	}
+	meta, _, err := mmdbDecode(buf[i+len(mmdbMetaMarker):], 0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid metadata in " + filename)
+	}
+	db := &geoDB{buf: buf}
+	db.nodeCount, _ = mmdbUint(m["node_count"])
+	db.recordSize, _ = mmdbUint(m["record_size"])
+	version, _ := mmdbUint(m["ip_version"])
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, errors.New("unsupported record size in " + filename)
+	}
+	treeSize := db.recordSize * 2 / 8 * db.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("invalid search tree in " + filename)
+	}
+	db.data = buf[treeSize+16 : i]
+	if version == 6 {
+		// IPv4 addresses are stored as ::a.b.c.d
+		node := uint(0)
+		for n := 0; n < 96 && node < db.nodeCount; n++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// Return the left (0) or right (1) record of a node of the search tree
+func (db *geoDB) record(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 |
+				uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 |
+			uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.buf[node*8+bit*4:]))
+	}
+}
+
+// Return the ISO code of the country of an address, "" if unknown
+func (db *geoDB) country(ip net.IP) string {
+	node := uint(0)
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, node, bits = ip4, db.ipv4Start, 32
+	}
+	for i := 0; i < bits && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		return ""
+	}
+	off := node - db.nodeCount - 16
+	if off >= uint(len(db.data)) {
+		return ""
+	}
+	v, _, err := mmdbDecode(db.data, off)
+	if err != nil {
+		return ""
+	}
+	rec, _ := v.(map[string]interface{})
+	c, _ := rec["country"].(map[string]interface{})
+	iso, _ := c["iso_code"].(string)
+	return iso
+}
+
+func mmdbUint(v interface{}) (uint, bool) {
+	switch n := v.(type) {
+	case uint64:
+		return uint(n), true
+	}
+	return 0, false
+}
+
+// Decode the value at offset off of a data section, following pointers,
+// and return it with the offset of the next value
+func mmdbDecode(data []byte, off uint) (interface{}, uint, error) {
+	errBad := errors.New("invalid MaxMind data")
+	if off >= uint(len(data)) {
+		return nil, 0, errBad
+	}
+	ctrl := data[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		// Pointer into the data section
+		ss, vvv := uint(ctrl>>3)&3, uint(ctrl&7)
+		if off+ss+1 > uint(len(data)) {
+			return nil, 0, errBad
+		}
+		b := data[off:]
+		var p uint
+		switch ss {
+		case 0:
+			p = vvv<<8 | uint(b[0])
+		case 1:
+			p = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			p = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) +
+				526336
+		case 3:
+			p = uint(binary.BigEndian.Uint32(b))
+		}
+		v, _, err := mmdbDecode(data, p)
+		return v, off + ss + 1, err
+	}
+	if typ == 0 {
+		if off >= uint(len(data)) {
+			return nil, 0, errBad
+		}
+		typ = 7 + uint(data[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(data)) {
+			return nil, 0, errBad
+		}
+		var ext uint
+		for _, c := range data[off : off+n] {
+			ext = ext<<8 | uint(c)
+		}
+		off += n
+		size = []uint{29, 285, 65821}[n-1] + ext
+	}
+	switch typ {
+	case 7: // Map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := mmdbDecode(data, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next, err := mmdbDecode(data, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, _ := k.(string)
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+	case 11: // Array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := mmdbDecode(data, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case 14: // Boolean, value held by size
+		return size != 0, off, nil
+	}
+	if off+size > uint(len(data)) {
+		return nil, 0, errBad
+	}
+	b := data[off : off+size]
+	off += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), off, nil
+	case 3: // Double
+		if size != 8 {
+			return nil, 0, errBad
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 15: // Float
+		if size != 4 {
+			return nil, 0, errBad
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))),
+			off, nil
+	case 5, 6, 9, 10, 8: // Unsigned and signed integers
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, off, nil
+	default: // Bytes and others
+		return b, off, nil
+	}
+}
+
+// Return the country code of the client of req, "" if unknown or when no
+// database is loaded
+func clientCountry(req *http.Request) string {
+	if geoip == nil {
+		return ""
+	}
+	ip := net.ParseIP(clientHost(req))
+	if ip == nil {
+		return ""
+	}
+	return geoip.country(ip)
+}
+
+// Tell whether a country code belongs to a list, case-insensitively
+func inCountries(c string, list []string) bool {
+	for _, l := range list {
+		if strings.EqualFold(c, strings.TrimSpace(l)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tell whether the client of req may use a token according to the
+// country rules of the configuration and of the token. Clients of unknown
+// countries are refused when a list of allowed countries applies.
+func allowedCountry(tok Token, req *http.Request) bool {
+	if geoip == nil {
+		return true
+	}
+	if len(cnf.COUNTRY_ALLOW) < 1 && len(cnf.COUNTRY_DENY) < 1 &&
+		len(tok.Countries) < 1 && len(tok.DenyCountries) < 1 {
+		return true
+	}
+	c := clientCountry(req)
+	if inCountries(c, cnf.COUNTRY_DENY) || inCountries(c, tok.DenyCountries) {
+		return false
+	}
+	if len(cnf.COUNTRY_ALLOW) > 0 && !inCountries(c, cnf.COUNTRY_ALLOW) {
+		return false
+	}
+	if len(tok.Countries) > 0 && !inCountries(c, tok.Countries) {
+		return false
+	}
+	return true
+}
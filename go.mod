@@ -0,0 +1,3 @@
+module github.com/nicolas314/onetime
+
+go 1.24
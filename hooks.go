@@ -0,0 +1,136 @@
+// Exec hooks.
+// HOOKS maps events in the life of tokens to commands, run with the
+// details of the event in ONETIME_ environment variables, so that
+// operators can script their own reactions:
+//
+//	"HOOKS": {"completed": ["/usr/local/bin/archive-share"],
+//	          "upload-received": ["/usr/local/bin/index", "--new"]}
+//
+// Events: created, activated (first click), completed (a download went
+// through), expired (removed by purge or evicted from the spool),
+// deleted, and upload-received (a file uploaded from the administration
+// pages). Variables: ONETIME_EVENT, ONETIME_TOKEN, ONETIME_URL,
+// ONETIME_STATUS_URL, ONETIME_NAME, ONETIME_PATH, ONETIME_SIZE,
+// ONETIME_OWNER, ONETIME_NOTE, ONETIME_CLIENT and ONETIME_DOWNLOADS.
+// Commands run in the background, without a shell, and are killed after
+// HOOK_TIMEOUT; failures are logged.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const HOOK_TIMEOUT = time.Minute
+
+// Events hooks may be set for
+var hookEvents = map[string]bool{
+	"created":         true,
+	"activated":       true,
+	"completed":       true,
+	"expired":         true,
+	"deleted":         true,
+	"upload-received": true,
+}
+
+// Check HOOKS
+func (c *Config) checkHooks() error {
+	for event, cmd := range c.HOOKS {
+		if !hookEvents[event] {
+			return errors.New("unknown event " + event + " in HOOKS in " +
+				c.path)
+		}
+		if len(cmd) < 1 || len(cmd[0]) < 1 {
+			return errors.New("empty command for " + event + " in HOOKS in " +
+				c.path)
+		}
+	}
+	return nil
+}
+
+// An event in the life of a token, as told to hooks and notifiers
+type Event struct {
+	Event     string `json:"event"`
+	Token     string `json:"token"`
+	URL       string `json:"url"`
+	StatusURL string `json:"status_url"`
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Owner     string `json:"owner,omitempty"`
+	Note      string `json:"note,omitempty"`
+	Client    string `json:"client,omitempty"`
+	Downloads int    `json:"downloads"`
+}
+
+// Run the command hooked to event for token ott, if any, and tell
+// notifiers. req is the request of the client behind the event, nil from
+// the command line.
+func hook(event, ott string, tok Token, req *http.Request) {
+	ev := Event{
+		Event:     event,
+		Token:     ott,
+		URL:       cnf.BASE_ADDR + "/" + ott,
+		StatusURL: statusURL(ott),
+		Name:      tok.FileName(),
+		Path:      tok.Path,
+		Size:      tok.Size,
+		Owner:     tok.Owner,
+		Note:      tok.Note,
+		Client:    tok.Client,
+		Downloads: len(tok.Downloads),
+	}
+	if req != nil {
+		ev.Client = clientHost(req)
+	}
+	notify(ev)
+	argv, ok := cnf.HOOKS[event]
+	if !ok {
+		return
+	}
+	env := map[string]string{
+		"EVENT":      ev.Event,
+		"TOKEN":      ev.Token,
+		"URL":        ev.URL,
+		"STATUS_URL": ev.StatusURL,
+		"NAME":       ev.Name,
+		"PATH":       ev.Path,
+		"SIZE":       strconv.FormatInt(ev.Size, 10),
+		"OWNER":      ev.Owner,
+		"NOTE":       ev.Note,
+		"CLIENT":     ev.Client,
+		"DOWNLOADS":  strconv.Itoa(ev.Downloads),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HOOK_TIMEOUT)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		// No line breaks from notes reaching scripts
+		v = strings.Map(func(r rune) rune {
+			if r == '\n' || r == '\r' {
+				return ' '
+			}
+			return r
+		}, v)
+		cmd.Env = append(cmd.Env, "ONETIME_"+k+"="+v)
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		slog.Error("HOOK", "event", event, "token", ott, "err", err)
+		return
+	}
+	go func() {
+		defer cancel()
+		if err := cmd.Wait(); err != nil {
+			slog.Error("HOOK", "event", event, "token", ott, "err", err)
+		}
+	}()
+}
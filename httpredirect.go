@@ -0,0 +1,56 @@
+// Redirection of plain HTTP to HTTPS.
+// With an https BASE_ADDR, HTTP_REDIRECT names a second address, usually
+// ":80", where every request is redirected to the same path under
+// BASE_ADDR, so that recipients typing a link without its scheme still get
+// through. ACME HTTP-01 challenges are answered from ACME_DIR there, the
+// directory given to certbot --webroot -w, so certificates can be renewed
+// without stopping the server.
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const ACME_PREFIX = "/.well-known/acme-challenge/"
+
+// Valid ACME challenge tokens
+var acmeToken = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Check the redirection settings of the configuration
+func (c *Config) checkHTTPRedirect() error {
+	if len(c.HTTP_REDIRECT) > 0 && !strings.HasPrefix(c.BASE_ADDR, "https") {
+		return errors.New("HTTP_REDIRECT needs an https BASE_ADDR in " + c.path)
+	}
+	return nil
+}
+
+// Answer ACME challenges, redirect anything else to BASE_ADDR
+func toHTTPS(w http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.URL.Path, ACME_PREFIX) && len(cnf.ACME_DIR) > 0 {
+		token := req.URL.Path[len(ACME_PREFIX):]
+		if !acmeToken.MatchString(token) {
+			http.NotFound(w, req)
+			return
+		}
+		reqLog(req).Info("ACME", "challenge", token)
+		http.ServeFile(w, req, filepath.Join(cnf.ACME_DIR, ACME_PREFIX, token))
+		return
+	}
+	reqLog(req).Debug("HTTPS")
+	http.Redirect(w, req, strings.TrimRight(cnf.BASE_ADDR, "/")+
+		req.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// Serve redirections on l, bound to HTTP_REDIRECT
+func redirectToHTTPS(l net.Listener) error {
+	slog.Info("LISTEN", "addr", "http://"+cnf.HTTP_REDIRECT, "redirect", true)
+	return track(newServer(cnf.HTTP_REDIRECT,
+		withRequestID(http.HandlerFunc(toHTTPS)))).Serve(l)
+}
@@ -0,0 +1,55 @@
+// Translation of the strings shown to recipients.
+// Locale bundles are JSON files mapping message keys to translated
+// strings, embedded from the locales directory. The bundle is selected
+// with LOCALE in the configuration, English is used for any missing key.
+
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const DEFAULT_LOCALE = "en"
+
+//go:embed locales/*.json
+var embeddedLocales embed.FS
+
+// Strings of the selected locale, set by loadLocale
+var messages map[string]string
+
+// Load the English bundle, then the named one on top of it
+func loadLocale(name string) error {
+	if len(name) < 1 {
+		name = DEFAULT_LOCALE
+	}
+	msgs := make(map[string]string)
+	for _, l := range []string{DEFAULT_LOCALE, name} {
+		js, err := embeddedLocales.ReadFile("locales/" + l + ".json")
+		if err != nil {
+			return errors.New("unknown LOCALE: " + name)
+		}
+		if err = json.Unmarshal(js, &msgs); err != nil {
+			return err
+		}
+	}
+	messages = msgs
+	return nil
+}
+
+// Translate a message key, return the key itself if unknown
+func tr(key string) string {
+	if msg, ok := messages[key]; ok {
+		return msg
+	}
+	return key
+}
+
+// Pretty-print a duration in the selected locale, e.g. "4 heures"
+func localDuration(d time.Duration) string {
+	parts := strings.SplitN(prettyDuration(d), " ", 2)
+	return parts[0] + " " + tr(parts[1])
+}
@@ -0,0 +1,206 @@
+// Logging to the systemd journal.
+// When the server is started by systemd, log records are also sent to the
+// journal with their level as priority and their attributes as fields
+// (EVENT, IP, TOKEN, BYTES...), so that journalctl -u onetime shows them
+// and can filter on them, e.g. journalctl -u onetime EVENT=DONE.
+// LOG_JOURNAL set to "off" disables this, a LOG_FILE of "journal:" sends
+// records to the journal only. Records are written with the native
+// journal protocol on /run/systemd/journal/socket.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	JOURNAL_PREFIX = "journal:"
+	JOURNAL_SOCKET = "/run/systemd/journal/socket"
+)
+
+// Tell whether LOG_FILE designates the journal
+func isJournal(name string) bool {
+	return strings.HasPrefix(name, JOURNAL_PREFIX)
+}
+
+// Tell whether the process was started by systemd with its output
+// connected to the journal
+func underSystemd() bool {
+	if len(os.Getenv("JOURNAL_STREAM")) < 1 {
+		return false
+	}
+	_, err := os.Stat(JOURNAL_SOCKET)
+	return err == nil
+}
+
+// A slog handler writing records to the journal
+type journalHandler struct {
+	conn   *net.UnixConn
+	level  slog.Leveler
+	attrs  []slog.Attr // Keys already prefixed with their group
+	prefix string      // Current group, e.g. "REQ_"
+}
+
+// Connect to the journal
+func newJournalHandler(opts slog.HandlerOptions) (*journalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: JOURNAL_SOCKET, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	level := opts.Level
+	if level == nil {
+		level = slog.LevelInfo
+	}
+	return &journalHandler{conn: conn, level: level}, nil
+}
+
+func (h *journalHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+// Return a journal field name for an attribute key: uppercase letters,
+// digits and underscores, not starting with an underscore
+func journalField(key string) string {
+	b := []byte(strings.ToUpper(key))
+	for i, c := range b {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			b[i] = '_'
+		}
+	}
+	return strings.TrimLeft(string(b), "_0123456789")
+}
+
+// Append a field to a journal message, in binary form when the value
+// holds newlines
+func appendField(buf *bytes.Buffer, name, value string) {
+	if len(name) < 1 {
+		return
+	}
+	buf.WriteString(name)
+	if strings.Contains(value, "\n") {
+		buf.WriteByte('\n')
+		binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	} else {
+		buf.WriteByte('=')
+	}
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// Return the journal priority of a level
+func journalPriority(l slog.Level) int {
+	switch {
+	case l >= slog.LevelError:
+		return 3
+	case l >= slog.LevelWarn:
+		return 4
+	case l >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := append([]slog.Attr{}, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, h.flatten(h.prefix, a)...)
+		return true
+	})
+	// The message repeats the fields for readers of plain journalctl
+	msg := r.Message
+	var buf bytes.Buffer
+	for _, a := range attrs {
+		v := a.Value.String()
+		msg += " " + a.Key + "=" + v
+		appendField(&buf, journalField(a.Key), v)
+	}
+	appendField(&buf, "MESSAGE", msg)
+	appendField(&buf, "PRIORITY", strconv.Itoa(journalPriority(r.Level)))
+	appendField(&buf, "SYSLOG_IDENTIFIER", "onetime")
+	appendField(&buf, "EVENT", r.Message)
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+// Return an attribute and the members of groups as flat attributes with
+// prefixed keys
+func (h *journalHandler) flatten(prefix string, a slog.Attr) []slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() != slog.KindGroup {
+		if a.Equal(slog.Attr{}) {
+			return nil
+		}
+		return []slog.Attr{{Key: prefix + a.Key, Value: a.Value}}
+	}
+	if len(a.Key) > 0 {
+		prefix += a.Key + "_"
+	}
+	var attrs []slog.Attr
+	for _, g := range a.Value.Group() {
+		attrs = append(attrs, h.flatten(prefix, g)...)
+	}
+	return attrs
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	n.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		n.attrs = append(n.attrs, h.flatten(h.prefix, a)...)
+	}
+	return &n
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	n := *h
+	n.prefix += name + "_"
+	return &n
+}
+
+// A slog handler passing records to several handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			if e := h.Handle(ctx, r.Clone()); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := make(teeHandler, len(t))
+	for i, h := range t {
+		n[i] = h.WithAttrs(attrs)
+	}
+	return n
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	n := make(teeHandler, len(t))
+	for i, h := range t {
+		n[i] = h.WithGroup(name)
+	}
+	return n
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+
+// OS keyrings.
+// On macOS the key of encrypted settings is read from the login keychain
+// with security(1), elsewhere from the Secret Service (GNOME Keyring,
+// KWallet) with secret-tool(1) from libsecret. Store it with:
+//
+//	security add-generic-password -s onetime -a onetime -w "$(onetime genkey)"
+//	onetime genkey | secret-tool store --label onetime service onetime
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Return the secret stored in the keyring under name
+func keyringSecret(name string) (string, error) {
+	cmd := exec.Command("secret-tool", "lookup", "service", name)
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", name,
+			"-w")
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.New("no key " + name + " in the keyring: " +
+			strings.TrimSpace(err.Error()+" "+stderr.String()))
+	}
+	return string(out), nil
+}
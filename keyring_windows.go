@@ -0,0 +1,65 @@
+//go:build windows
+
+// OS keyrings.
+// On Windows the key of encrypted settings is a generic credential of the
+// Credential Manager, read with CredReadW. Store it with:
+//
+//	cmdkey /generic:onetime /user:onetime /pass:KEY
+
+package main
+
+import (
+	"errors"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+const CRED_TYPE_GENERIC = 1
+
+var (
+	procCredReadW = advapi32.NewProc("CredReadW")
+	procCredFree  = advapi32.NewProc("CredFree")
+)
+
+// CREDENTIALW
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// Return the secret stored in the keyring under name
+func keyringSecret(name string) (string, error) {
+	wname, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return "", err
+	}
+	var cred *credential
+	r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(wname)),
+		CRED_TYPE_GENERIC, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		return "", errors.New("no key " + name + " in the keyring: " +
+			err.Error())
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+	// cmdkey stores passwords in UTF-16
+	if len(blob) > 1 && len(blob)%2 == 0 && blob[1] == 0 {
+		u := make([]uint16, len(blob)/2)
+		for i := range u {
+			u[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+		}
+		return string(utf16.Decode(u)), nil
+	}
+	return string(blob), nil
+}
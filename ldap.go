@@ -0,0 +1,415 @@
+// LDAP authentication.
+// With LDAP_URL set, users log in to /admin/ with their directory account
+// (OpenLDAP, FreeIPA, Active Directory...), and may reach the API with
+// HTTP basic authentication instead of a key. onetime binds as the user,
+// LDAP_USER_DN with %s replaced by the user name:
+//
+//	"LDAP_URL": "ldaps://ldap.example.com",
+//	"LDAP_USER_DN": "uid=%s,ou=people,dc=example,dc=com",
+//
+// or "%s@example.com" for Active Directory. With LDAP_GROUP, only the
+// members of that group may log in and create links; members of
+// LDAP_ADMIN_GROUP see all tokens, like the administrator. Membership is
+// read from the memberOf attribute of the user entry, found under
+// LDAP_BASE_DN by LDAP_USER_ATTR ("uid", or "sAMAccountName" for Active
+// Directory). ldap:// connections switch to TLS with StartTLS, except to
+// localhost. A login lasts ADMIN_SESSION and is held in memory: users
+// log in again after the server restarts. Names of USERS take precedence.
+// The client only implements bind and search, the operations needed.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LDAP_TIMEOUT  = 10 * time.Second
+	LDAP_STARTTLS = "1.3.6.1.4.1.1466.20037"
+	// Result codes
+	LDAP_SUCCESS             = 0
+	LDAP_INVALID_CREDENTIALS = 49
+)
+
+// Valid LDAP user names, which need no escaping in DNs
+var ldapName = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+
+// Users logged in by LDAP, and whether they see all tokens
+var ldapUsers = struct {
+	sync.Mutex
+	m map[string]ldapLogin
+}{m: map[string]ldapLogin{}}
+
+type ldapLogin struct {
+	admin bool
+	until time.Time
+}
+
+// Tell whether LDAP authentication is configured
+func ldapEnabled() bool {
+	return len(cnf.LDAP_URL) > 0
+}
+
+// Check the LDAP settings and load LDAP_CA
+func (c *Config) checkLDAP() error {
+	c.ldapCAs = nil
+	if len(c.LDAP_URL) < 1 {
+		return nil
+	}
+	u, err := url.Parse(c.LDAP_URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+		return errors.New("invalid LDAP_URL in " + c.path)
+	}
+	if strings.Count(c.LDAP_USER_DN, "%s") != 1 {
+		return errors.New("invalid LDAP_USER_DN in " + c.path)
+	}
+	if (len(c.LDAP_GROUP) > 0 || len(c.LDAP_ADMIN_GROUP) > 0) &&
+		len(c.LDAP_BASE_DN) < 1 {
+		return errors.New("LDAP groups need LDAP_BASE_DN in " + c.path)
+	}
+	if len(c.LDAP_CA) > 0 {
+		b, err := os.ReadFile(c.LDAP_CA)
+		if err != nil {
+			return err
+		}
+		c.ldapCAs = x509.NewCertPool()
+		if !c.ldapCAs.AppendCertsFromPEM(b) {
+			return errors.New("invalid LDAP_CA in " + c.path)
+		}
+	}
+	return nil
+}
+
+// A connection to the directory
+type ldapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	id   int
+}
+
+// Encode a BER element
+func ber(tag byte, value ...[]byte) []byte {
+	n := 0
+	for _, v := range value {
+		n += len(v)
+	}
+	b := []byte{tag}
+	if n < 128 {
+		b = append(b, byte(n))
+	} else {
+		var l []byte
+		for ; n > 0; n >>= 8 {
+			l = append([]byte{byte(n)}, l...)
+		}
+		b = append(append(b, 0x80|byte(len(l))), l...)
+	}
+	for _, v := range value {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// Encode a BER integer or enumerated value
+func berInt(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return ber(tag, b)
+}
+
+// Encode a BER octet string
+func berString(tag byte, s string) []byte {
+	return ber(tag, []byte(s))
+}
+
+// Read a BER element
+func readBer(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	l, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := int(l)
+	if l&0x80 != 0 {
+		if l&0x7f > 4 {
+			return 0, nil, errors.New("LDAP message too long")
+		}
+		n = 0
+		for i := 0; i < int(l&0x7f); i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("LDAP message too long")
+	}
+	v := make([]byte, n)
+	_, err = io.ReadFull(r, v)
+	return tag, v, err
+}
+
+// Decode a BER integer or enumerated value
+func berValue(v []byte) int {
+	n := 0
+	for _, b := range v {
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+// Split the value of a constructed BER element
+func berItems(v []byte) ([][]byte, []byte, error) {
+	var items [][]byte
+	var tags []byte
+	r := bufio.NewReader(bytes.NewReader(v))
+	for {
+		tag, item, err := readBer(r)
+		if err == io.EOF {
+			return items, tags, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, item)
+		tags = append(tags, tag)
+	}
+}
+
+// Connect to LDAP_URL, over TLS
+func ldapDial() (*ldapConn, error) {
+	u, err := url.Parse(cnf.LDAP_URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if len(u.Port()) < 1 {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	tc := &tls.Config{ServerName: u.Hostname(), RootCAs: cnf.ldapCAs}
+	d := &net.Dialer{Timeout: LDAP_TIMEOUT}
+	var conn net.Conn
+	if u.Scheme == "ldaps" {
+		conn, err = tls.DialWithDialer(d, "tcp", host, tc)
+	} else {
+		conn, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(LDAP_TIMEOUT))
+	lc := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+	if u.Scheme == "ldap" && u.Hostname() != "localhost" {
+		// Extended request, StartTLS
+		code, msg, err := lc.result(lc.send(ber(0x77,
+			berString(0x80, LDAP_STARTTLS))))
+		if err == nil && code != LDAP_SUCCESS {
+			err = errors.New("StartTLS refused: " + msg)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, tc)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		lc.conn, lc.r = tlsConn, bufio.NewReader(tlsConn)
+	}
+	return lc, nil
+}
+
+// Send an operation, returning any write error
+func (lc *ldapConn) send(op []byte) error {
+	lc.id++
+	_, err := lc.conn.Write(ber(0x30, berInt(0x02, lc.id), op))
+	return err
+}
+
+// Read the next operation answering the last one sent
+func (lc *ldapConn) read() (byte, []byte, error) {
+	for {
+		tag, v, err := readBer(lc.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		items, tags, err := berItems(v)
+		if err != nil || tag != 0x30 || len(items) < 2 {
+			return 0, nil, errors.New("invalid LDAP message")
+		}
+		if berValue(items[0]) == lc.id {
+			return tags[1], items[1], nil
+		}
+	}
+}
+
+// Return the result code and diagnostic message of an LDAPResult
+func (lc *ldapConn) result(err error) (int, string, error) {
+	if err != nil {
+		return 0, "", err
+	}
+	_, v, err := lc.read()
+	if err != nil {
+		return 0, "", err
+	}
+	items, _, err := berItems(v)
+	if err != nil || len(items) < 3 {
+		return 0, "", errors.New("invalid LDAP result")
+	}
+	return berValue(items[0]), string(items[2]), nil
+}
+
+// Authenticate as dn
+func (lc *ldapConn) bind(dn, password string) (int, string, error) {
+	return lc.result(lc.send(ber(0x60, berInt(0x02, 3), berString(0x04, dn),
+		berString(0x80, password))))
+}
+
+// Tell whether an entry under base has attr equal to value and memberOf
+// equal to group
+func (lc *ldapConn) member(base, attr, value, group string) (bool, error) {
+	eq := func(a, v string) []byte {
+		return ber(0xa3, berString(0x04, a), berString(0x04, v))
+	}
+	err := lc.send(ber(0x63,
+		berString(0x04, base),
+		berInt(0x0a, 2), // Whole subtree
+		berInt(0x0a, 0), // Never dereference aliases
+		berInt(0x02, 1), // One entry at most
+		berInt(0x02, int(LDAP_TIMEOUT/time.Second)),
+		ber(0x01, []byte{0}),
+		ber(0xa0, eq(attr, value), eq("memberOf", group)),
+		ber(0x30, berString(0x04, "1.1")))) // No attributes
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for {
+		tag, v, err := lc.read()
+		if err != nil {
+			return false, err
+		}
+		switch tag {
+		case 0x64: // Entry
+			found = true
+		case 0x65: // Done
+			items, _, err := berItems(v)
+			if err != nil || len(items) < 3 {
+				return false, errors.New("invalid LDAP result")
+			}
+			code := berValue(items[0])
+			if code != LDAP_SUCCESS && !found {
+				return false, errors.New("LDAP search failed: " +
+					strconv.Itoa(code) + " " + string(items[2]))
+			}
+			return found, nil
+		}
+	}
+}
+
+// Close the connection
+func (lc *ldapConn) close() {
+	lc.send(ber(0x42))
+	lc.conn.Close()
+}
+
+// Check the password of user against the directory, and whether user
+// may log in and sees all tokens
+func ldapCheck(user, password string) (bool, bool, error) {
+	if !ldapName.MatchString(user) || len(password) < 1 {
+		// An empty password would be an anonymous bind, always accepted
+		return false, false, nil
+	}
+	lc, err := ldapDial()
+	if err != nil {
+		return false, false, err
+	}
+	defer lc.close()
+	code, msg, err := lc.bind(strings.Replace(cnf.LDAP_USER_DN, "%s", user,
+		1), password)
+	if err != nil {
+		return false, false, err
+	}
+	if code == LDAP_INVALID_CREDENTIALS {
+		return false, false, nil
+	}
+	if code != LDAP_SUCCESS {
+		return false, false, errors.New("LDAP bind failed: " +
+			strconv.Itoa(code) + " " + msg)
+	}
+	attr := cnf.LDAP_USER_ATTR
+	if len(attr) < 1 {
+		attr = "uid"
+	}
+	admin := false
+	if len(cnf.LDAP_ADMIN_GROUP) > 0 {
+		admin, err = lc.member(cnf.LDAP_BASE_DN, attr, user,
+			cnf.LDAP_ADMIN_GROUP)
+		if err != nil {
+			return false, false, err
+		}
+	}
+	if admin || len(cnf.LDAP_GROUP) < 1 {
+		return true, admin, nil
+	}
+	ok, err := lc.member(cnf.LDAP_BASE_DN, attr, user, cnf.LDAP_GROUP)
+	return ok, false, err
+}
+
+// Log user in with password, false if the directory refuses
+func ldapAuth(req *http.Request, user, password string) bool {
+	ok, admin, err := ldapCheck(user, password)
+	if err != nil {
+		reqLog(req).Error("LDAP", "user", user, "err", err)
+		return false
+	}
+	if ok {
+		ldapUsers.Lock()
+		ldapUsers.m[user] = ldapLogin{admin, time.Now().Add(ADMIN_SESSION)}
+		ldapUsers.Unlock()
+	}
+	return ok
+}
+
+// Tell whether user logged in by LDAP, and sees all tokens
+func ldapLoggedIn(user string) (bool, bool) {
+	if !ldapEnabled() {
+		return false, false
+	}
+	ldapUsers.Lock()
+	defer ldapUsers.Unlock()
+	l, ok := ldapUsers.m[user]
+	if ok && time.Now().After(l.until) {
+		delete(ldapUsers.m, user)
+		return false, false
+	}
+	return ok, l.admin
+}
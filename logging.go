@@ -0,0 +1,96 @@
+// Structured logging.
+// Log records are written with log/slog, as text (default) or JSON lines
+// depending on LOG_FORMAT. The message of a record is the event name
+// (DONE, 404, BUSY...) and attributes describe the request: ip, country,
+// path, token, bytes, duration... LOG_LEVEL selects the records written:
+// debug adds every page displayed and transfer started, info (default)
+// shows downloads and token changes, warn only refused or failed requests
+// and error only server problems.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Level of records written, changed when the configuration is reloaded
+var logLevel slog.LevelVar
+
+// Parse a LOG_LEVEL value, info if empty
+func parseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, errors.New("invalid LOG_LEVEL in " + cnf.path)
+}
+
+// Send log records to LOG_FILE in the configured format and level, and
+// to the journal when started by systemd
+func setupLogging() (io.Closer, error) {
+	logLevel.Set(cnf.logLevel)
+	opts := slog.HandlerOptions{Level: &logLevel}
+	if isJournal(cnf.LOG_FILE) {
+		h, err := newJournalHandler(opts)
+		if err != nil {
+			return nil, err
+		}
+		slog.SetDefault(slog.New(h))
+		return h.conn, nil
+	}
+	var h slog.Handler
+	var c io.Closer
+	if isSyslog(cnf.LOG_FILE) {
+		w, err := openSyslog(cnf.LOG_FILE)
+		if err != nil {
+			return nil, err
+		}
+		h, c = newSyslogHandler(w, opts), w
+	} else {
+		w, err := openLog(cnf.LOG_FILE)
+		if err != nil {
+			return nil, err
+		}
+		if cnf.LOG_FORMAT == "json" {
+			h = slog.NewJSONHandler(w, &opts)
+		} else {
+			h = slog.NewTextHandler(w, &opts)
+		}
+		c = w
+	}
+	if cnf.LOG_JOURNAL != "off" && underSystemd() {
+		if j, err := newJournalHandler(opts); err == nil {
+			h = teeHandler{h, j}
+		}
+	}
+	slog.SetDefault(slog.New(h))
+	return c, nil
+}
+
+// Return a logger describing req: its ID, trace ID when traced, client,
+// client country when known and path
+func reqLog(req *http.Request) *slog.Logger {
+	var args []any
+	if id := requestID(req); len(id) > 0 {
+		args = append(args, "req", id)
+	}
+	if id := traceID(req.Context()); len(id) > 0 {
+		args = append(args, "trace", id)
+	}
+	args = append(args, "ip", clientHost(req))
+	if c := clientCountry(req); len(c) > 0 {
+		args = append(args, "country", c)
+	}
+	args = append(args, "path", req.URL.Path)
+	return slog.With(args...)
+}
@@ -0,0 +1,296 @@
+// Outgoing mail.
+// All mail onetime sends goes through SMTP_SERVER, "localhost:25" by
+// default, and is rendered from templates: NAME.txt, a text/template
+// starting with a Subject: line, and NAME.html, an optional html/template
+// sent along as an alternative. Templates are embedded from the mail
+// directory; files with the same name in the mail subdirectory of
+// TEMPLATE_DIR replace them, an empty NAME.html dropping the HTML part.
+// They are given a Mail.
+//
+//	"SMTP_SERVER": "smtp.example.com:587", "SMTP_TLS": "starttls",
+//	"SMTP_USER": "onetime", "SMTP_PASSWORD": "...",
+//	"MAIL_FROM": "onetime@example.com"
+//
+// SMTP_TLS is "starttls" to require STARTTLS, "tls" for implicit TLS
+// (port 465) or "none"; by default STARTTLS is used when offered. Login
+// with SMTP_USER uses PLAIN authentication, only over TLS or to
+// localhost. onetime testmail sends a test mail to check the setup.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"embed"
+	"encoding/hex"
+	"errors"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const MAIL_TIMEOUT = 30 * time.Second
+
+//go:embed mail/*
+var embeddedMail embed.FS
+
+// What mail templates are given
+type Mail struct {
+	Title    string // BRAND_TITLE, or onetime
+	BaseAddr string
+	Text     string // Message, e.g. the alert
+}
+
+// Check the SMTP settings
+func (c *Config) checkMail() error {
+	switch c.SMTP_TLS {
+	case "", "starttls", "tls", "none":
+	default:
+		return errors.New("invalid SMTP_TLS in " + c.path)
+	}
+	if len(c.SMTP_USER) > 0 && c.SMTP_TLS == "none" {
+		return errors.New("SMTP_USER needs TLS in " + c.path)
+	}
+	return nil
+}
+
+// Return the address of the mail relay, with a port
+func smtpAddr(c *Config) string {
+	addr := c.SMTP_SERVER
+	if len(addr) < 1 {
+		addr = "localhost"
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "25"
+		if c.SMTP_TLS == "tls" {
+			port = "465"
+		}
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	return addr
+}
+
+// Return the sender address
+func mailFrom() string {
+	if len(cnf.MAIL_FROM) > 0 {
+		return cnf.MAIL_FROM
+	}
+	return "onetime@localhost"
+}
+
+// Return the contents of a mail template, from TEMPLATE_DIR if there
+func mailTemplate(name string) ([]byte, error) {
+	if len(cnf.TEMPLATE_DIR) > 0 {
+		b, err := os.ReadFile(filepath.Join(cnf.TEMPLATE_DIR, "mail", name))
+		if err == nil || !os.IsNotExist(err) {
+			return b, err
+		}
+	}
+	return embeddedMail.ReadFile("mail/" + name)
+}
+
+// Render the named mail templates, return the subject and the text and
+// HTML bodies, the latter empty without an HTML template
+func renderMail(name string, m Mail) (string, string, string, error) {
+	src, err := mailTemplate(name + ".txt")
+	if err != nil {
+		return "", "", "", err
+	}
+	t, err := template.New(name).Parse(string(src))
+	if err != nil {
+		return "", "", "", err
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, m); err != nil {
+		return "", "", "", err
+	}
+	first, text, _ := strings.Cut(buf.String(), "\n")
+	subject, ok := strings.CutPrefix(strings.TrimSpace(first), "Subject:")
+	if !ok {
+		return "", "", "", errors.New("mail template " + name +
+			".txt does not start with Subject:")
+	}
+	text = strings.TrimLeft(text, "\r\n")
+	src, err = mailTemplate(name + ".html")
+	if os.IsNotExist(err) {
+		return strings.TrimSpace(subject), text, "", nil
+	}
+	if err != nil {
+		return "", "", "", err
+	}
+	h, err := htmltemplate.New(name).Parse(string(src))
+	if err != nil {
+		return "", "", "", err
+	}
+	buf.Reset()
+	if err = h.Execute(&buf, m); err != nil {
+		return "", "", "", err
+	}
+	// An empty HTML template sends plain text only
+	html := strings.TrimSpace(buf.String())
+	return strings.TrimSpace(subject), text, html, nil
+}
+
+// Return a text part with CRLF line endings, as SMTP wants
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n",
+		"\r\n")
+}
+
+// Build a message from the named templates
+func buildMail(to []string, name string, m Mail) ([]byte, error) {
+	subject, text, html, err := renderMail(name, m)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 12)
+	rand.Read(id)
+	domain := "localhost"
+	if at := strings.LastIndex(mailFrom(), "@"); at >= 0 {
+		domain = strings.Trim(mailFrom()[at+1:], "<> ")
+	}
+	var buf bytes.Buffer
+	buf.WriteString("From: " + mailFrom() + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <" + hex.EncodeToString(id) + "@" + domain + ">\r\n" +
+		"MIME-Version: 1.0\r\n")
+	if len(html) < 1 {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		buf.WriteString(crlf(text))
+		return buf.Bytes(), nil
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ kind, s string }{
+		{"text/plain", text}, {"text/html", html}} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {part.kind + "; charset=utf-8"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.Write([]byte(crlf(part.s)))
+	}
+	mw.Close()
+	buf.WriteString("Content-Type: multipart/alternative; boundary=" +
+		mw.Boundary() + "\r\n\r\n")
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// Connect to SMTP_SERVER and log in, as SMTP_TLS and SMTP_USER say
+func smtpConnect() (*smtp.Client, error) {
+	addr := smtpAddr(&cnf)
+	host, _, _ := net.SplitHostPort(addr)
+	tc := &tls.Config{ServerName: host}
+	dialer := &net.Dialer{Timeout: MAIL_TIMEOUT}
+	var conn net.Conn
+	var err error
+	if cnf.SMTP_TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tc)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(MAIL_TIMEOUT))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = c.Hello("localhost"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if cnf.SMTP_TLS != "tls" && cnf.SMTP_TLS != "none" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(tc); err != nil {
+				c.Close()
+				return nil, err
+			}
+		} else if cnf.SMTP_TLS == "starttls" {
+			c.Close()
+			return nil, errors.New(addr + " does not offer STARTTLS")
+		}
+	}
+	if len(cnf.SMTP_USER) > 0 {
+		// PlainAuth refuses to send passwords in the clear, but to localhost
+		auth := smtp.PlainAuth("", cnf.SMTP_USER, cnf.SMTP_PASSWORD, host)
+		if err = c.Auth(auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Send a mail rendered from the named templates
+func sendMail(to []string, name string, m Mail) error {
+	if len(m.Title) < 1 {
+		m.Title = cnf.BRAND_TITLE
+	}
+	if len(m.Title) < 1 {
+		m.Title = "onetime"
+	}
+	if len(m.BaseAddr) < 1 {
+		m.BaseAddr = cnf.BASE_ADDR
+	}
+	msg, err := buildMail(to, name, m)
+	if err != nil {
+		return err
+	}
+	c, err := smtpConnect()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	from := mailFrom()
+	if a, err := mailAddress(from); err == nil {
+		from = a
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if a, err := mailAddress(rcpt); err == nil {
+			rcpt = a
+		}
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Return the bare address of "Name <address>"
+func mailAddress(s string) (string, error) {
+	a, err := mail.ParseAddress(s)
+	if err != nil {
+		return "", err
+	}
+	return a.Address, nil
+}
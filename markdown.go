@@ -0,0 +1,178 @@
+// Minimal Markdown renderer for the download page.
+// Supports the common subset found in one-off documents: headings,
+// paragraphs, emphasis, inline and fenced code, lists, block quotes,
+// horizontal rules and links. All text is HTML-escaped before any markup
+// is produced, so the output is safe to embed in a page.
+
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	mdHeading = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	mdRule    = regexp.MustCompile(`^(\*\s*){3,}$|^(-\s*){3,}$|^(_\s*){3,}$`)
+	mdUlist   = regexp.MustCompile(`^\s{0,3}[-*+]\s+(.*)$`)
+	mdOlist   = regexp.MustCompile(`^\s{0,3}\d+[.)]\s+(.*)$`)
+	mdLink    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdBold    = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdItalic  = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+)
+
+// Render inline markup in a line of text
+func mdInline(text string) string {
+	// Code spans are copied verbatim, markup applies to the rest
+	parts := strings.Split(text, "`")
+	if len(parts)%2 == 0 {
+		// Unbalanced backtick: treat the last one as text
+		parts[len(parts)-2] += "`" + parts[len(parts)-1]
+		parts = parts[:len(parts)-1]
+	}
+	var out strings.Builder
+	for i, p := range parts {
+		p = html.EscapeString(p)
+		if i%2 == 1 {
+			out.WriteString("<code>" + p + "</code>")
+			continue
+		}
+		p = mdLink.ReplaceAllStringFunc(p, func(m string) string {
+			sub := mdLink.FindStringSubmatch(m)
+			if !mdSafeURL(html.UnescapeString(sub[2])) {
+				return sub[1]
+			}
+			return `<a href="` + sub[2] + `">` + sub[1] + `</a>`
+		})
+		p = mdBold.ReplaceAllString(p, "<strong>$1$2</strong>")
+		p = mdItalic.ReplaceAllString(p, "<em>$1$2</em>")
+		out.WriteString(p)
+	}
+	return out.String()
+}
+
+// Tell whether a link target may be used in the page: no javascript: or
+// data: URLs
+func mdSafeURL(u string) bool {
+	l := strings.ToLower(u)
+	i := strings.Index(l, ":")
+	if i >= 0 && !strings.ContainsAny(l[:i], "/?#") {
+		return strings.HasPrefix(l, "http:") ||
+			strings.HasPrefix(l, "https:") ||
+			strings.HasPrefix(l, "mailto:")
+	}
+	return true
+}
+
+// Render a Markdown document to HTML
+func Markdown(src string) string {
+	var out strings.Builder
+	var para []string
+	list := "" // Currently open list tag, if any
+	quote := false
+
+	flushPara := func() {
+		if len(para) > 0 {
+			out.WriteString("<p>" + mdInline(strings.Join(para, " ")) +
+				"</p>\n")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if len(list) > 0 {
+			out.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	closeQuote := func() {
+		if quote {
+			flushPara()
+			out.WriteString("</blockquote>\n")
+			quote = false
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeList()
+			out.WriteString("<" + tag + ">\n")
+			list = tag
+		}
+	}
+
+	lines := strings.Split(strings.Replace(src, "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t")
+		trimmed := strings.TrimSpace(line)
+
+		// Fenced code block: copy verbatim up to the closing fence
+		if strings.HasPrefix(trimmed, "```") ||
+			strings.HasPrefix(trimmed, "~~~") {
+			fence := trimmed[:3]
+			flushPara()
+			closeList()
+			closeQuote()
+			out.WriteString("<pre><code>")
+			for i++; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), fence) {
+					break
+				}
+				out.WriteString(html.EscapeString(lines[i]) + "\n")
+			}
+			out.WriteString("</code></pre>\n")
+			continue
+		}
+
+		if len(trimmed) == 0 {
+			flushPara()
+			closeList()
+			closeQuote()
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, ">") {
+			closeList()
+			if !quote {
+				flushPara()
+				out.WriteString("<blockquote>\n")
+				quote = true
+			}
+			para = append(para, strings.TrimSpace(trimmed[1:]))
+			continue
+		}
+		closeQuote()
+
+		if m := mdHeading.FindStringSubmatch(trimmed); m != nil {
+			flushPara()
+			closeList()
+			tag := "h" + string(rune('0'+len(m[1])))
+			out.WriteString("<" + tag + ">" + mdInline(m[2]) +
+				"</" + tag + ">\n")
+			continue
+		}
+		if mdRule.MatchString(trimmed) {
+			flushPara()
+			closeList()
+			out.WriteString("<hr>\n")
+			continue
+		}
+		if m := mdUlist.FindStringSubmatch(line); m != nil {
+			flushPara()
+			openList("ul")
+			out.WriteString("<li>" + mdInline(m[1]) + "</li>\n")
+			continue
+		}
+		if m := mdOlist.FindStringSubmatch(line); m != nil {
+			flushPara()
+			openList("ol")
+			out.WriteString("<li>" + mdInline(m[1]) + "</li>\n")
+			continue
+		}
+		closeList()
+		para = append(para, trimmed)
+	}
+	flushPara()
+	closeList()
+	closeQuote()
+	return out.String()
+}
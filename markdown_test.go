@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMdSafeURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		safe bool
+	}{
+		{"https://example.com/a?b=c", true},
+		{"http://example.com", true},
+		{"HTTPS://EXAMPLE.COM", true},
+		{"mailto:someone@example.com", true},
+		{"/relative/path", true},
+		{"page.html#part", true},
+		{"?q=a:b", true},
+		{"dir/file:1", true},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{" javascript:alert(1)", false},
+		{"java\tscript:alert(1)", false},
+		{"data:text/html;base64,PHNjcmlwdD4=", false},
+		{"vbscript:msgbox(1)", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, tt := range tests {
+		if got := mdSafeURL(tt.url); got != tt.safe {
+			t.Errorf("mdSafeURL(%q) = %v, want %v", tt.url, got, tt.safe)
+		}
+	}
+}
+
+func TestMdInline(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"<b>&", "&lt;b&gt;&amp;"},
+		{"**bold** and *it*", "<strong>bold</strong> and <em>it</em>"},
+		{"`<code>` *x*", "<code>&lt;code&gt;</code> <em>x</em>"},
+		{"`**not bold**`", "<code>**not bold**</code>"},
+		{"a ` b", "a ` b"},
+		{"[site](https://example.com)",
+			`<a href="https://example.com">site</a>`},
+		{"[x](javascript:void0)", "x"},
+		{"[x](JAVASCRIPT:void0)", "x"},
+		// Entities are text, never decoded into a scheme
+		{"[x](&#106;avascript:void0)",
+			`<a href="&amp;#106;avascript:void0">x</a>`},
+		{`[x](https://e.com/"onmouseover=)`,
+			`<a href="https://e.com/&#34;onmouseover=">x</a>`},
+		{"[<img src=x>](https://e.com)",
+			`<a href="https://e.com">&lt;img src=x&gt;</a>`},
+	}
+	for _, tt := range tests {
+		if got := mdInline(tt.in); got != tt.want {
+			t.Errorf("mdInline(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"heading", "# Title #", "<h1>Title</h1>\n"},
+		{"paragraph", "one\ntwo\n\nthree",
+			"<p>one two</p>\n<p>three</p>\n"},
+		{"list", "- a\n- b\n1. c",
+			"<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n<ol>\n<li>c</li>\n</ol>\n"},
+		{"quote", "> said\n> more",
+			"<blockquote>\n<p>said more</p>\n</blockquote>\n"},
+		{"rule", "***", "<hr>\n"},
+		{"fence", "```\n<script>\n# no\n```",
+			"<pre><code>&lt;script&gt;\n# no\n</code></pre>\n"},
+		{"unclosed fence", "~~~\nx",
+			"<pre><code>x\n</code></pre>\n"},
+		{"html", "<script>alert(1)</script>",
+			"<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"crlf", "a\r\nb", "<p>a b</p>\n"},
+	}
+	for _, tt := range tests {
+		if got := Markdown(tt.in); got != tt.want {
+			t.Errorf("%s: Markdown(%q) = %q, want %q", tt.name, tt.in,
+				got, tt.want)
+		}
+	}
+	if out := Markdown("[x](data:text/html,<script>)"); strings.Contains(out,
+		"href") {
+		t.Errorf("data: link kept: %q", out)
+	}
+}
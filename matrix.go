@@ -0,0 +1,87 @@
+// Matrix notifications.
+// With MATRIX_HOMESERVER, MATRIX_TOKEN and MATRIX_ROOM set, token events
+// are posted to a Matrix room as notices, as with SLACK_WEBHOOK:
+//
+//	"MATRIX_HOMESERVER": "https://matrix.example.com",
+//	"MATRIX_TOKEN": "syt_...", "MATRIX_ROOM": "!abcdef:example.com"
+//
+// The access token is that of an account which joined the room; the room
+// is named by its ID, not an alias. MATRIX_EVENTS and MATRIX_MASK_IP work
+// as SLACK_EVENTS and SLACK_MASK_IP.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MATRIX_TIMEOUT = 10 * time.Second
+
+var matrixClient = &http.Client{Timeout: MATRIX_TIMEOUT}
+
+// Posts token events to MATRIX_ROOM
+type matrix struct{}
+
+// Check the Matrix settings
+func (c *Config) checkMatrix() error {
+	set := 0
+	for _, s := range []string{c.MATRIX_HOMESERVER, c.MATRIX_TOKEN,
+		c.MATRIX_ROOM} {
+		if len(s) > 0 {
+			set++
+		}
+	}
+	if set != 0 && set != 3 {
+		return errors.New("MATRIX_HOMESERVER, MATRIX_TOKEN and MATRIX_ROOM " +
+			"go together in " + c.path)
+	}
+	if set > 0 && !strings.HasPrefix(c.MATRIX_ROOM, "!") {
+		return errors.New("MATRIX_ROOM is not a room ID in " + c.path)
+	}
+	for _, e := range c.MATRIX_EVENTS {
+		if !hookEvents[e] {
+			return errors.New("unknown event " + e + " in MATRIX_EVENTS in " +
+				c.path)
+		}
+	}
+	return nil
+}
+
+// Post an event to MATRIX_ROOM
+func (matrix) Notify(ev Event) error {
+	if !eventWanted(ev.Event, cnf.MATRIX_EVENTS, slackEvents) {
+		return nil
+	}
+	body, _ := json.Marshal(map[string]string{
+		"msgtype": "m.notice",
+		"body":    ev.summary(cnf.MATRIX_MASK_IP),
+	})
+	// Transaction IDs only need to be unique for the access token
+	txn := strconv.FormatInt(time.Now().UnixNano(), 36) + "." +
+		GenerateOnetime(ONETIME_SZ)
+	req, err := http.NewRequest(http.MethodPut,
+		strings.TrimSuffix(cnf.MATRIX_HOMESERVER, "/")+
+			"/_matrix/client/v3/rooms/"+url.PathEscape(cnf.MATRIX_ROOM)+
+			"/send/m.room.message/"+txn, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cnf.MATRIX_TOKEN)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := matrixClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("matrix: " + resp.Status)
+	}
+	return nil
+}
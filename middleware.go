@@ -0,0 +1,128 @@
+// HTTP middleware wrapped around all request handlers.
+// Requests go through this chain, outermost first:
+//
+//	withRequestID        X-Request-Id and log attribute
+//	withTracing          with OTLP_ENDPOINT
+//	withAccessLog        with ACCESS_LOG
+//	middleware from Use  in registration order
+//	withSecurityHeaders  then the routes of Serve
+//
+// Deployments needing more, e.g. authentication in front of everything,
+// custom logging or headers, can drop a Go file next to the others that
+// registers middleware with Use from an init function and rebuild.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Security headers sent with every response. HSTS is only sent over TLS.
+// Entries of SECURITY_HEADERS in the configuration replace these values,
+// an empty value removes the header.
+var defaultSecurityHeaders = map[string]string{
+	"Content-Security-Policy": "default-src 'none'; " +
+		"style-src 'self' 'unsafe-inline'; img-src 'self'; " +
+		"media-src 'self'; base-uri 'none'; form-action 'self'; " +
+		"frame-ancestors 'none'",
+	"X-Content-Type-Options":    "nosniff",
+	"Referrer-Policy":           "no-referrer",
+	"X-Frame-Options":           "DENY",
+	"Strict-Transport-Security": "max-age=31536000",
+}
+
+// Return the security headers for this deployment
+func securityHeaders() map[string]string {
+	h := make(map[string]string)
+	for k, v := range defaultSecurityHeaders {
+		h[k] = v
+	}
+	for k, v := range cnf.SECURITY_HEADERS {
+		k = http.CanonicalHeaderKey(k)
+		if len(v) > 0 {
+			h[k] = v
+		} else {
+			delete(h, k)
+		}
+	}
+	return h
+}
+
+// Wrap a handler in another one
+type Middleware func(http.Handler) http.Handler
+
+// Custom middleware registered with Use
+var middlewares []Middleware
+
+// Insert middleware in the chain, before the security headers and the
+// routes. Must be called before the server starts, e.g. from init.
+func Use(m ...Middleware) {
+	middlewares = append(middlewares, m...)
+}
+
+// Wrap a handler in a chain of middleware, the first one outermost
+func chain(h http.Handler, mws []Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Add security headers to all responses of a handler
+func withSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Built for every request, SECURITY_HEADERS may be reloaded
+		for k, v := range securityHeaders() {
+			if k == "Strict-Transport-Security" && req.TLS == nil {
+				continue
+			}
+			w.Header().Set(k, v)
+		}
+		if cnf.SERVER_HEADER {
+			w.Header().Set("Server", "onetime/"+version)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Key of the request ID in request contexts
+type requestIDKey struct{}
+
+// Return the ID of a request, "" outside of withRequestID
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// Tell whether a request ID set by a front proxy can be kept
+func validRequestID(id string) bool {
+	if len(id) < 1 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+			'0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Give every request an ID, returned in X-Request-Id and attached to its
+// log records. An ID set by a front proxy is kept.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-Id", id)
+		ctx := context.WithValue(req.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
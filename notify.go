@@ -0,0 +1,75 @@
+// systemd readiness and watchdog.
+// Under a unit of Type=notify, the server tells systemd it is ready once
+// all its addresses are bound, so that units ordered after onetime only
+// start when it answers. With WatchdogSec= set in the unit, it then pings
+// the watchdog at half that interval, and systemd restarts it if the
+// pings stop. Both go through the datagram socket systemd names in
+// NOTIFY_SOCKET; nothing is sent when it is not set.
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Send a state line such as "READY=1" to systemd
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if len(name) < 1 {
+		return nil
+	}
+	if name[0] == '@' {
+		// Abstract socket
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Return the watchdog interval asked for by systemd, 0 if none
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 &&
+		pid != strconv.Itoa(os.Getpid()) {
+		// Meant for another process
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Tell systemd the server is ready and start pinging its watchdog
+func notifyReady() {
+	status := "STATUS=serving on " + strings.Join(cnf.listenAddrs(), " ")
+	// After an upgrade, the new server becomes the main process
+	mainpid := "MAINPID=" + strconv.Itoa(os.Getpid())
+	if err := sdNotify("READY=1\n" + mainpid + "\n" + status); err != nil {
+		slog.Warn("NOTIFY", "err", err)
+		return
+	}
+	d := watchdogInterval()
+	if d <= 0 {
+		return
+	}
+	go func() {
+		tick := time.NewTicker(d / 2)
+		for range tick.C {
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("WATCHDOG", "err", err)
+			}
+		}
+	}()
+}
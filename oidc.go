@@ -0,0 +1,326 @@
+// OpenID Connect login.
+// With OIDC_ISSUER, OIDC_CLIENT_ID and OIDC_CLIENT_SECRET set, the
+// administration pages offer to log in through the identity provider of
+// the organization, so that access follows single sign-on rather than
+// one more password. Register BASE_ADDR/admin/oidc/callback as redirect
+// URI with the provider. The user name is the OIDC_CLAIM claim of the ID
+// token, "preferred_username" by default, then "email". OIDC_ALLOW lists
+// the users allowed in, or "@domain" for all addresses of a domain,
+// anyone the provider knows if empty; OIDC_ADMINS lists those who see
+// all tokens, like the administrator. Others see their own tokens, as
+// with USERS.
+// The ID token comes straight from the token endpoint of the provider,
+// over TLS with the client secret, so the TLS connection vouches for it
+// rather than its signature (OpenID Connect Core 3.1.3.7); issuer,
+// audience, expiry and nonce are checked. Logged in users can issue
+// themselves personal API keys from the administration pages, valid
+// ISSUED_KEY_DAYS, and lose them when removed from OIDC_ALLOW.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OIDC_COOKIE     = "onetime_oidc"
+	OIDC_TIMEOUT    = 10 * time.Second
+	OIDC_LOGIN      = 10 * time.Minute // Longest stay at the provider
+	ISSUED_KEY_DAYS = 90
+	ISSUED_PREFIX   = "ot."
+)
+
+// Valid user names coming from the provider, safe in cookies
+var oidcName = regexp.MustCompile(`^[A-Za-z0-9._@+-]+$`)
+
+var oidcClient = &http.Client{Timeout: OIDC_TIMEOUT}
+
+// Endpoints of the provider, from its discovery document
+type oidcProvider struct {
+	Issuer        string `json:"issuer"`
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+}
+
+// Tell whether OpenID Connect login is configured
+func oidcEnabled() bool {
+	return len(cnf.OIDC_ISSUER) > 0
+}
+
+// Check the OpenID Connect settings
+func (c *Config) checkOIDC() error {
+	if len(c.OIDC_ISSUER) < 1 {
+		return nil
+	}
+	u, err := url.Parse(c.OIDC_ISSUER)
+	if err != nil || (u.Scheme != "https" && u.Hostname() != "localhost") {
+		return errors.New("invalid OIDC_ISSUER in " + c.path)
+	}
+	if len(c.OIDC_CLIENT_ID) < 1 {
+		return errors.New("OIDC_ISSUER needs OIDC_CLIENT_ID in " + c.path)
+	}
+	return nil
+}
+
+// Fetch the discovery document of the provider
+func discoverOIDC() (*oidcProvider, error) {
+	issuer := strings.TrimSuffix(cnf.OIDC_ISSUER, "/")
+	resp, err := oidcClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("OIDC discovery: " + resp.Status)
+	}
+	p := new(oidcProvider)
+	if err = json.NewDecoder(resp.Body).Decode(p); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != issuer || len(p.Authorization) < 1 ||
+		len(p.Token) < 1 {
+		return nil, errors.New("OIDC discovery: unexpected document from " +
+			issuer)
+	}
+	return p, nil
+}
+
+// Return a random string for state, nonce and PKCE
+func oidcRandom() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Return the redirect URI registered with the provider
+func oidcCallback() string {
+	return strings.TrimSuffix(cnf.BASE_ADDR, "/") + "/admin/oidc/callback"
+}
+
+// Tell whether a user authenticated by the provider may log in
+func oidcAllowed(user string) bool {
+	if !oidcEnabled() || !oidcName.MatchString(user) {
+		return false
+	}
+	if len(cnf.OIDC_ALLOW) < 1 {
+		return true
+	}
+	for _, a := range append(cnf.OIDC_ALLOW, cnf.OIDC_ADMINS...) {
+		if strings.EqualFold(a, user) || (strings.HasPrefix(a, "@") &&
+			strings.HasSuffix(strings.ToLower(user), strings.ToLower(a))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tell whether user is one of OIDC_ADMINS
+func oidcAdmin(user string) bool {
+	for _, a := range cnf.OIDC_ADMINS {
+		if strings.EqualFold(a, user) && oidcAllowed(user) {
+			return true
+		}
+	}
+	return false
+}
+
+// Send the browser to the provider
+func oidcLogin(w http.ResponseWriter, req *http.Request) {
+	p, err := discoverOIDC()
+	if err != nil {
+		reqLog(req).Error("OIDC", "err", err)
+		renderError(w, http.StatusBadGateway, tr("admin"), tr("sso_failed"))
+		return
+	}
+	state, nonce, verifier := oidcRandom(), oidcRandom(), oidcRandom()
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDC_COOKIE,
+		Value:    state + "." + nonce + "." + verifier,
+		Path:     "/admin/oidc/",
+		MaxAge:   int(OIDC_LOGIN / time.Second),
+		HttpOnly: true,
+		Secure:   req.TLS != nil || strings.HasPrefix(cnf.BASE_ADDR, "https"),
+		// Sent back when the provider redirects to the callback
+		SameSite: http.SameSiteLaxMode,
+	})
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cnf.OIDC_CLIENT_ID},
+		"redirect_uri":          {oidcCallback()},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	target := p.Authorization
+	if strings.Contains(target, "?") {
+		target += "&" + q.Encode()
+	} else {
+		target += "?" + q.Encode()
+	}
+	http.Redirect(w, req, target, http.StatusFound)
+}
+
+// Return the user name from the ID token obtained for code
+func oidcExchange(code, verifier, nonce string) (string, error) {
+	p, err := discoverOIDC()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcCallback()},
+		"code_verifier": {verifier},
+		"client_id":     {cnf.OIDC_CLIENT_ID},
+	}
+	r, err := http.NewRequest("POST", p.Token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(cnf.OIDC_CLIENT_SECRET) > 0 {
+		r.SetBasicAuth(url.QueryEscape(cnf.OIDC_CLIENT_ID),
+			url.QueryEscape(cnf.OIDC_CLIENT_SECRET))
+	}
+	resp, err := oidcClient.Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&answer)
+	if resp.StatusCode != http.StatusOK || len(answer.IDToken) < 1 {
+		return "", errors.New("token endpoint: " + resp.Status + " " +
+			answer.Error)
+	}
+	parts := strings.Split(answer.IDToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("invalid ID token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("invalid ID token")
+	}
+	var claims map[string]interface{}
+	if err = json.Unmarshal(b, &claims); err != nil {
+		return "", errors.New("invalid ID token")
+	}
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return "", errors.New("ID token from another issuer: " + iss)
+	}
+	audOK := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audOK = aud == cnf.OIDC_CLIENT_ID
+	case []interface{}:
+		for _, a := range aud {
+			audOK = audOK || a == cnf.OIDC_CLIENT_ID
+		}
+	}
+	if !audOK {
+		return "", errors.New("ID token for another client")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().Unix() > int64(exp) {
+		return "", errors.New("ID token expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return "", errors.New("ID token with another nonce")
+	}
+	claim := cnf.OIDC_CLAIM
+	if len(claim) < 1 {
+		claim = "preferred_username"
+	}
+	for _, c := range []string{claim, "email", "sub"} {
+		if name, _ := claims[c].(string); len(name) > 0 {
+			return name, nil
+		}
+	}
+	return "", errors.New("ID token without " + claim)
+}
+
+// Log in the user coming back from the provider
+func oidcFinish(w http.ResponseWriter, req *http.Request) {
+	c, err := req.Cookie(OIDC_COOKIE)
+	http.SetCookie(w, &http.Cookie{Name: OIDC_COOKIE, Path: "/admin/oidc/",
+		MaxAge: -1})
+	var parts []string
+	if err == nil {
+		parts = strings.Split(c.Value, ".")
+	}
+	q := req.URL.Query()
+	if len(parts) != 3 || q.Get("state") != parts[0] {
+		reqLog(req).Warn("OIDC", "err", "state mismatch")
+		miss(req, "oidc")
+		renderError(w, http.StatusBadRequest, tr("admin"), tr("sso_failed"))
+		return
+	}
+	if e := q.Get("error"); len(e) > 0 {
+		reqLog(req).Warn("OIDC", "err", e)
+		renderError(w, http.StatusForbidden, tr("admin"), tr("sso_failed"))
+		return
+	}
+	user, err := oidcExchange(q.Get("code"), parts[2], parts[1])
+	if err == nil && !oidcAllowed(user) {
+		err = errors.New("user not allowed: " + user)
+	}
+	if err != nil {
+		reqLog(req).Warn("OIDC", "err", err)
+		failure(req, "oidc")
+		renderError(w, http.StatusForbidden, tr("admin"), tr("sso_failed"))
+		return
+	}
+	until := time.Now().Add(ADMIN_SESSION)
+	setAdminCookie(w, req, adminSession(user, until), until)
+	reqLog(req).Info("ADMIN", "action", "login", "user", user, "oidc", true)
+	// The session cookie is only sent on same-site navigation, which a
+	// redirection following the provider is not
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(`<!DOCTYPE html><meta http-equiv="refresh" ` +
+		`content="0; url=/admin/"><a href="/admin/">/admin/</a>`))
+}
+
+// Return a personal API key of user valid until t
+func issuedKey(user string, t time.Time) string {
+	until := strconv.FormatInt(t.Unix(), 10)
+	return ISSUED_PREFIX + user + "." + until + "." +
+		sign("apikey", user+":"+until)
+}
+
+// Return the user of a key issued on the administration pages, false if
+// invalid, expired or of a user no longer allowed
+func issuedKeyUser(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, ISSUED_PREFIX)
+	i := strings.LastIndex(rest, ".")
+	if !ok || i < 0 {
+		return "", false
+	}
+	j := strings.LastIndex(rest[:i], ".")
+	if j < 0 {
+		return "", false
+	}
+	user := rest[:j]
+	t, err := strconv.ParseInt(rest[j+1:i], 10, 64)
+	if err != nil || time.Now().Unix() > t || len(sessionKey(user)) < 1 ||
+		!hmac.Equal([]byte(key), []byte(issuedKey(user, time.Unix(t, 0)))) {
+		return "", false
+	}
+	return user, true
+}
@@ -7,37 +7,250 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"html/template"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	ONETIME_SZ = 8 // Length of a one-time token
+	ONETIME_SZ = 8   // Length of a one-time token
+	THUMB_SZ   = 320 // Largest side of image previews, in pixels
+	// Largest image accepted for previews, in pixels
+	THUMB_MAX_PIXELS = 50 * 1000 * 1000
 	// Token validity once clicked, in seconds
 	TOKEN_VAL = time.Duration(4*60*60) * time.Second
-	CNF_NAME  = "/onetime.json"
+	CNF_NAME  = "onetime.json"
+	// Token kinds
+	KIND_FILE     = ""         // Regular file download
+	KIND_PASTE    = "paste"    // Text shown in the page, with raw download
+	KIND_SECRET   = "secret"   // Text shown exactly once, then destroyed
+	KIND_REDIRECT = "redirect" // Redirection to URL, burnt once followed
+	KIND_TRAP     = "trap"     // Honeypot, never given to anyone
 )
 
 type Config struct {
-	TOKEN_DB  string
-	BASE_ADDR string
-	LOG_FILE  string
-	CRT       string
-	KEY       string
-	path      string
+	TOKEN_DB   string
+	BASE_ADDR  string
+	LISTEN     []string // e.g. "https://:443", BASE_ADDR if empty
+	LOG_FILE   string
+	LOG_LEVEL  string // "debug", "info" (default), "warn" or "error"
+	LOG_FORMAT string // "text" (default) or "json"
+	PID_FILE   string // Process ID of the server, for stop and status
+	// "auto" (default) also logs to the journal under systemd, or "off"
+	LOG_JOURNAL string
+	// Rotation of LOG_FILE, disabled if both limits are empty
+	LOG_MAX_SIZE string // e.g. "10MB"
+	LOG_MAX_AGE  string // e.g. "24h"
+	LOG_KEEP     int    // Rotated files kept, all if 0
+	LOG_COMPRESS bool   // Gzip rotated files
+	FAIL_LOG     string // Failed requests in a fail2ban friendly format
+	ACCESS_LOG   string // Every request, in Apache combined format
+	// "combined" (default), "common" or an Apache LogFormat pattern
+	ACCESS_LOG_FORMAT string
+	ENUM_ALERT        int // Misses from one client triggering an alert
+	// Alerts for honeypot hits
+	ALERT_WEBHOOK string // URL receiving a JSON message
+	ALERT_MAIL    string // Address receiving a mail
+	SMTP_SERVER   string // Mail relay, default "localhost:25", see mail.go
+	SMTP_TLS      string // "starttls", "tls" (implicit) or "none", STARTTLS if offered by default
+	SMTP_USER     string // Login to SMTP_SERVER, none if empty
+	SMTP_PASSWORD string
+	MAIL_FROM     string // Sender of mail, default "onetime@localhost"
+	TRAP_BAN      string // Ban duration of clients hitting a honeypot
+	CRT           string
+	KEY           string
+	UNCLAIMED     string // Lifetime of never-clicked tokens, e.g. "168h"
+	API_KEY       string // Bearer key for /api/, API disabled if empty
+	SECRET        string // Key signing owner URLs, onetime.secret if empty
+	ON_CHANGE     string // "refuse" (default) or "warn" on files changed since add
+	UNLINK        bool   // Remove shared files when their token expires
+	SPOOL_DIR     string // Directory holding copies of spooled files
+	SPOOL         bool   // Spool all files at add time
+	SPOOL_QUOTA   string // Total size of spooled files, e.g. "50GB", unlimited if empty
+	SPOOL_FULL    string // "refuse" (default) or "evict" expired files when full
+	CACHE_DIR     string // Directory for image previews, disabled if empty
+	RECEIPT_DIR   string // Directory for download receipts, disabled if empty
+	AUDIT_LOG     string // Hash-chained journal of token events, disabled if empty
+	// OpenTelemetry collector receiving traces, disabled if empty
+	OTLP_ENDPOINT string            // e.g. "http://localhost:4318"
+	OTLP_HEADERS  map[string]string // Sent with every export
+	SERVICE_NAME  string            // Service name in traces, default "onetime"
+	// Address redirecting plain HTTP to BASE_ADDR, e.g. ":80", and
+	// webroot of ACME challenges answered there
+	HTTP_REDIRECT string
+	ACME_DIR      string
+	// TLS policy, Go defaults if empty, see tls.go
+	TLS_MIN_VERSION string     // "1.0", "1.1", "1.2" (default) or "1.3"
+	TLS_CIPHERS     []string   // e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+	TLS_CURVES      []string   // e.g. "X25519", "P256"
+	CLIENT_CA       string     // CA of client certificates for admin endpoints
+	CERTS           []CertPair // More certificates, selected by SNI
+	// Limits on clients, see server.go
+	READ_HEADER_TIMEOUT string // Default "10s"
+	READ_TIMEOUT        string // Unlimited if empty
+	WRITE_TIMEOUT       string // Longest stall of a response, unlimited if empty
+	IDLE_TIMEOUT        string // Default "2m"
+	MAX_HEADER_SIZE     string // e.g. "16KB", default 1MB
+	MAX_UPLOAD          string // Largest upload, e.g. "2GB", unlimited if empty
+	// "on" (default) over TLS, "off", or "h2c" also over plain HTTP
+	HTTP2 string
+	// Profiler: "api" behind API_KEY, or a private listen address
+	PPROF        string
+	TEMPLATE_DIR string // Directory holding page template overrides
+	// Releases API for onetime update, and Ed25519 key signing them
+	UPDATE_URL string // Default the GitHub releases of the project
+	UPDATE_KEY string // Base64 public key, checksums only if empty
+	// Password of the administration pages, disabled if empty
+	ADMIN_PASSWORD string
+	// Personal API keys by user name, see users.go
+	USERS map[string]string
+	// Single sign-on to the administration pages, see oidc.go
+	OIDC_ISSUER        string   // Provider URL, disabled if empty
+	OIDC_CLIENT_ID     string   // Client registered with the provider
+	OIDC_CLIENT_SECRET string   // Its secret
+	OIDC_CLAIM         string   // User name claim, default preferred_username
+	OIDC_ALLOW         []string // Users or "@domain" let in, all if empty
+	OIDC_ADMINS        []string // Users seeing all tokens
+	// Directory accounts, see ldap.go
+	LDAP_URL         string // ldaps://host or ldap://host, disabled if empty
+	LDAP_CA          string // PEM file of its CAs, system CAs if empty
+	LDAP_USER_DN     string // DN to bind as, %s the user name
+	LDAP_BASE_DN     string // Where users are found for group checks
+	LDAP_USER_ATTR   string // Attribute holding user names, default uid
+	LDAP_GROUP       string // DN of the group allowed in, all if empty
+	LDAP_ADMIN_GROUP string // DN of the group seeing all tokens
+	// Limits of each user, "*" for all, see quota.go
+	QUOTAS map[string]Quota
+	// Virus scanning of uploads, see scan.go
+	SCAN_CLAMD     string   // clamd socket, path or host:port
+	SCAN_COMMAND   []string // Scanner run with the file path appended
+	QUARANTINE_DIR string   // Where infected files go, removed if empty
+	// Commands run on token events, see hooks.go
+	HOOKS map[string][]string
+	// Notifier, scanner and store programs, see plugin.go
+	PLUGINS []Plugin
+	// Chat notifications, see slack.go
+	SLACK_WEBHOOK string   // Incoming webhook URL, disabled if empty
+	SLACK_EVENTS  []string // Events posted, default created, activated, completed
+	SLACK_MASK_IP bool     // Hide the host part of client addresses
+	// Bot sharing files sent to it, see telegram.go
+	TELEGRAM_TOKEN string            // Bot token, bot disabled if empty
+	TELEGRAM_USERS map[string]string // Telegram user ID to owner name
+	TELEGRAM_API   string            // Bot API server, default api.telegram.org
+	// Matrix room notified of token events, see matrix.go
+	MATRIX_HOMESERVER string   // e.g. "https://matrix.example.com"
+	MATRIX_TOKEN      string   // Access token of an account in the room
+	MATRIX_ROOM       string   // Room ID, e.g. "!abcdef:example.com"
+	MATRIX_EVENTS     []string // Events posted, default created, activated, completed
+	MATRIX_MASK_IP    bool     // Hide the host part of client addresses
+	// Links texted by onetime send-sms, see sms.go
+	SMS_TWILIO_SID      string            // Twilio account SID
+	SMS_TWILIO_TOKEN    string            // Twilio auth token
+	SMS_GATEWAY         string            // Other gateway receiving JSON posts
+	SMS_GATEWAY_HEADERS map[string]string // Sent to SMS_GATEWAY
+	SMS_FROM            string            // Sender number or name
+	// Branding of the pages
+	BRAND_TITLE      string // Organization name
+	BRAND_LOGO       string // Logo image file
+	BRAND_BACKGROUND string // Page background color
+	BRAND_ACCENT     string // Main box and link color
+	BRAND_FOOTER     string // Text at the bottom of all pages
+	LOCALE           string // Language of the pages: en, fr, de, es
+	THEME            string // "auto" (default), "light" or "dark"
+	// Security headers overriding the defaults, "" removes a header
+	SECURITY_HEADERS    map[string]string
+	SERVER_HEADER       bool   // Send the version in a Server header
+	RATE_LIMIT          string // Total download rate, e.g. "10MB/s", unlimited if empty
+	MAX_DOWNLOADS       int    // Simultaneous downloads, unlimited if 0
+	MAX_TOKEN_DOWNLOADS int    // Simultaneous downloads of one token
+	OFFLOAD             string // Hand files to the front proxy: "nginx" or "apache"
+	OFFLOAD_PREFIX      string // Internal nginx location mapped to /
+	// Bucket holding s3://bucket/key files
+	S3_ENDPOINT   string // e.g. "https://s3.eu-west-1.amazonaws.com"
+	S3_REGION     string // Region used for signing, default "us-east-1"
+	S3_ACCESS_KEY string
+	S3_SECRET_KEY string
+	S3_MODE       string // "redirect" (default) or "stream"
+	// CDN publishing SPOOL_DIR, see cdn.go
+	CDN_URL      string // e.g. "https://cdn.example.com/spool", disabled if empty
+	CDN_SIGN     string // "nginx", "bunny" or "cloudfront"
+	CDN_KEY      string // Secret of nginx and bunny signatures
+	CDN_KEY_ID   string // CloudFront key pair ID
+	CDN_KEY_FILE string // CloudFront RSA private key
+	CDN_EXPIRY   string // Validity of signed URLs, default "5m"
+	// Once activated, only serve tokens to the same client address
+	// ("ip") or network ("subnet", /24 or /64)
+	BIND_CLIENT string
+	// Networks allowed to download, all if empty, and networks refused
+	ALLOW []string
+	DENY  []string
+	// Reverse proxies whose X-Forwarded-For or Forwarded headers give
+	// the client address, none if empty
+	TRUSTED_PROXIES []string
+	// MaxMind country database, countries allowed (all if empty) and
+	// countries refused
+	GEOIP_DB      string
+	COUNTRY_ALLOW []string
+	COUNTRY_DENY  []string
+	// Interrupted downloads allowed before a token is activated anyway
+	RETRIES int
+	// User agent substrings of link preview bots, replaces the defaults
+	BOT_AGENTS []string
+	path       string
+	unclaimed  time.Duration
+	rateLimit  int64
+	spoolQuota int64
+	logLevel   slog.Level
+	logMaxSize int64
+	logMaxAge  time.Duration
+	access     []accessField
+	trapBan    time.Duration
+	// TLS policy
+	tlsMin     uint16
+	tlsCiphers []uint16
+	tlsCurves  []tls.CurveID
+	clientCAs  *x509.CertPool
+	ldapCAs    *x509.CertPool
+	// Server limits
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderSize     int64
+	maxUpload         int64
+	allow             []*net.IPNet
+	deny              []*net.IPNet
+	trustedProxies    []*net.IPNet
+	cdnExpiry         time.Duration
+	cdnKey            *rsa.PrivateKey
 }
 
 // Yeah, global. So what?
@@ -79,6 +292,78 @@ func prettySize(sz int64) string {
 	return strings.Join(pr, ",")
 }
 
+// Pretty-print a duration in the largest unit that fits: "4 hours",
+// "2 days", "90 minutes"
+func prettyDuration(d time.Duration) string {
+	n, unit := int64(d/time.Second), "second"
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		n, unit = int64(d/(24*time.Hour)), "day"
+	case d >= time.Hour && d%time.Hour == 0:
+		n, unit = int64(d/time.Hour), "hour"
+	case d >= time.Minute && d%time.Minute == 0:
+		n, unit = int64(d/time.Minute), "minute"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", n, unit)
+}
+
+// Compute the hex-encoded SHA-256 sum of a file
+func fileSha256(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Detect the content type of a file, from the extension of its download
+// name or path first, then by sniffing its first bytes
+func detectMimeType(filename, name string) string {
+	if len(name) < 1 {
+		name = filename
+	}
+	t := mime.TypeByExtension(filepath.Ext(name))
+	if len(t) > 0 && t != "application/octet-stream" {
+		return t
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	return http.DetectContentType(buf[:n])
+}
+
+// Tell whether a content type is safe to display inline. Types able to
+// run scripts in the page (HTML, SVG, XML) are always downloaded.
+func inlineSafe(mimetype string) bool {
+	t, _, err := mime.ParseMediaType(mimetype)
+	if err != nil {
+		return false
+	}
+	switch {
+	case t == "text/plain", t == "application/pdf":
+		return true
+	case t == "image/svg+xml":
+		return false
+	case strings.HasPrefix(t, "image/"),
+		strings.HasPrefix(t, "audio/"),
+		strings.HasPrefix(t, "video/"):
+		return true
+	}
+	return false
+}
+
 // Generate a one-time token of length sz
 func GenerateOnetime(sz int) string {
 	// Character set used to create one-time tokens
@@ -106,60 +391,497 @@ type Token struct {
 	Path      string
 	Created   time.Time
 	Activated time.Time
+	Validity  time.Duration // Validity once clicked, TOKEN_VAL if zero
+	Downloads []time.Time   // Time of every completed download
+	Partial   int           // Downloads interrupted before the end
+	Resume    string        // Client allowed to resume an interrupted download
+	Client    string        // Address of the client that activated the token
+	Allow     []string      // Networks allowed to download, all if empty
+	Origins   []string      // Country of every completed download, if known
+	Clients   []string      // Address of the client of every download
+	Agents    []string      // User agent of the client of every download
+	Opened    time.Time     // First display of the download page
+	Sent      int64         // Bytes delivered, including interrupted downloads
+	// Countries allowed to download, all if empty, and countries refused
+	Countries     []string
+	DenyCountries []string
+	Unlink        bool      // Remove the file when the token expires
+	Spooled       bool      // Path is a copy owned by the spool directory
+	Name          string    // Download file name, base of Path if empty
+	Note          string    // Message shown to the recipient
+	Kind          string    // One of the KIND_ constants
+	URL           string    // Target of KIND_REDIRECT tokens
+	Sha256        string    // Hex-encoded checksum of the file at add time
+	Size          int64     // File size at add time
+	ModTime       time.Time // File modification time at add time
+	MimeType      string    // Content type detected at add time
+	Inline        bool      // Let the browser display the file
+	Limit         int64     // Download rate limit in bytes per second
+	Owner         string    // User who created the token, see users.go
 }
 
-// List of Tokens as an object
-type LTokens map[string]Token
+// Return the file name presented to the recipient, or the target URL
+// for redirections
+func (tok Token) FileName() string {
+	if tok.Kind == KIND_REDIRECT {
+		return tok.URL
+	}
+	if len(tok.Name) > 0 {
+		return tok.Name
+	}
+	return filepath.Base(tok.Path)
+}
+
+// Activate token ott for the client of req, remembering the first client
+// so that BIND_CLIENT can refuse other ones
+func (tok *Token) activate(req *http.Request, ott string, now time.Time) {
+	first := !tok.IsActivated()
+	if first {
+		journal("activate", ott, req, "")
+	}
+	tok.Activated = now
+	if len(tok.Client) < 1 {
+		tok.Client = clientHost(req)
+	}
+	if first {
+		hook("activated", ott, *tok, req)
+	}
+}
+
+// Record a completed download of token ott by the client of req,
+// activating the token
+func (tok *Token) download(req *http.Request, ott string, now time.Time) {
+	tok.activate(req, ott, now)
+	journal("serve", ott, req, req.UserAgent())
+	tok.Downloads = append(tok.Downloads, now)
+	tok.Origins = append(tok.Origins, clientCountry(req))
+	tok.Clients = append(tok.Clients, clientHost(req))
+	tok.Agents = append(tok.Agents, req.UserAgent())
+	hook("completed", ott, *tok, req)
+}
+
+// Tell whether a token has been clicked at least once
+func (tok Token) IsActivated() bool {
+	return tok.Activated.Year() > 1970
+}
+
+// Return how long a token remains valid once clicked
+func (tok Token) ValidFor() time.Duration {
+	if tok.Validity > 0 {
+		return tok.Validity
+	}
+	return TOKEN_VAL
+}
+
+// Return the time at which a token stops being valid.
+// Activated tokens expire ValidFor() after the first click, tokens never
+// clicked expire after the configured UNCLAIMED lifetime, if any.
+// Tokens without an end of validity return the zero Unix time.
+func (tok Token) ValidUntil() time.Time {
+	if tok.IsActivated() {
+		return tok.Activated.Add(tok.ValidFor())
+	}
+	if cnf.unclaimed > 0 {
+		return tok.Created.Add(cnf.unclaimed)
+	}
+	return time.Unix(0, 0)
+}
+
+// Tell whether a token is past its validity at time now
+func (tok Token) Expired(now time.Time) bool {
+	if tok.Kind == KIND_TRAP {
+		return false
+	}
+	until := tok.ValidUntil()
+	return until.Year() > 1970 && now.After(until)
+}
+
+// Return a one-word description of the token state at time now
+func (tok Token) State(now time.Time) string {
+	if tok.Expired(now) {
+		return "expired"
+	}
+	if tok.Kind == KIND_REDIRECT {
+		return "pending"
+	}
+	if tok.Kind == KIND_TRAP {
+		return "trap"
+	}
+	if sta, err := tok.CheckFile(); sta == nil {
+		return "missing"
+	} else if err != nil {
+		return "changed"
+	}
+	if tok.IsActivated() {
+		return "active"
+	}
+	return "pending"
+}
+
+// Check that the file behind a token is still the one registered at add
+// time. Return the file information, or an error if the file is missing
+// or was modified.
+func (tok Token) CheckFile() (os.FileInfo, error) {
+	sta, err := statFile(tok.Path)
+	if err != nil {
+		return nil, err
+	}
+	if tok.ModTime.IsZero() {
+		// Token created before sizes and times were recorded
+		return sta, nil
+	}
+	if sta.Size() != tok.Size || !sta.ModTime().Equal(tok.ModTime) {
+		return sta, errors.New("file changed since add: " + tok.Path)
+	}
+	return sta, nil
+}
+
+// Remove the file behind an expired token if it was requested, either
+// for this token or config-wide. Spooled copies are always removed.
+func (tok Token) RemoveFile() {
+	if isS3(tok.Path) || isRemote(tok.Path) {
+		return
+	}
+	if tok.Spooled {
+		if err := os.RemoveAll(filepath.Dir(tok.Path)); err != nil {
+			slog.Error("UNLINK", "file", tok.Path, "err", err)
+		}
+		return
+	}
+	if len(tok.Path) < 1 || (!tok.Unlink && !cnf.UNLINK) {
+		return
+	}
+	if err := os.Remove(tok.Path); err != nil && !os.IsNotExist(err) {
+		slog.Error("UNLINK", "file", tok.Path, "err", err)
+	}
+}
+
+// Options given when adding a Token
+type AddOptions struct {
+	Unlink bool     // Remove the file when the token expires
+	Spool  bool     // Copy the file to the spool directory
+	Name   string   // Download file name, also used for data read from stdin
+	Note   string   // Message shown to the recipient
+	Inline bool     // Let the browser display the file
+	Limit  int64    // Download rate limit in bytes per second, 0 for none
+	Fetch  bool     // Share a remote URL fetched by the server
+	Owner  string   // User creating the token
+	Allow  []string // Networks allowed to download, all if empty
+	// Countries allowed to download, all if empty, and countries refused
+	Countries     []string
+	DenyCountries []string
+}
+
+// Copy a file, preserving its modification time
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if sta, err := in.Stat(); err == nil {
+		os.Chtimes(dst, sta.ModTime(), sta.ModTime())
+	}
+	return nil
+}
+
+// Create the spool directory for a token
+func spoolDir(ott string) (string, error) {
+	if len(cnf.SPOOL_DIR) < 1 {
+		return "", errors.New("SPOOL_DIR undefined in " + cnf.path)
+	}
+	dir := filepath.Join(cnf.SPOOL_DIR, ott)
+	return dir, os.MkdirAll(dir, 0755)
+}
 
-// Save a list of Tokens
-func (ltok LTokens) Save(filename string) {
-	js, _ := json.Marshal(ltok)
-	ioutil.WriteFile(filename, js, 0644)
+// Write the contents of a reader to the spool directory of a token under
+// the given file name. Return the new path.
+func spoolReader(ott, name string, r io.Reader) (string, error) {
+	dir, err := spoolDir(ott)
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(dir, filepath.Base(name))
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dst, nil
 }
 
-// Load a list of Tokens
-func (ltok LTokens) Load(filename string) {
-	js, _ := ioutil.ReadFile(filename)
-	json.Unmarshal(js, &ltok)
+// Place a file into the spool directory under a per-token directory,
+// hardlinking when possible and copying otherwise. Return the new path.
+func spoolFile(ott, filename string) (string, error) {
+	dir, err := spoolDir(ott)
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(dir, filepath.Base(filename))
+	if os.Link(filename, dst) == nil {
+		return dst, nil
+	}
+	if err := copyFile(filename, dst); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dst, nil
 }
 
+// List of Tokens as an object
+type LTokens map[string]Token
+
 // Add a Token to a list
-func (ltok LTokens) Add(filename string) {
+// A file name of "-" reads the data from stdin into the spool directory.
+// Return the new token, or an empty string if the file cannot be shared.
+func (ltok LTokens) Add(filename string, opt AddOptions) string {
+	ott := GenerateOnetime(ONETIME_SZ)
+	if filename == "-" {
+		name := opt.Name
+		if len(name) < 1 {
+			name = "stdin"
+		}
+		ffilename, err := spoolReader(ott, name,
+			quotaReader(os.Stdin, ltok.quotaRoom(opt.Owner)))
+		if err != nil {
+			fmt.Println("cannot spool stdin:", err)
+			return ""
+		}
+		return ltok.add(ott, ffilename, true, opt)
+	}
+	if isS3(filename) {
+		return ltok.addS3(ott, filename, opt)
+	}
+	if isRemote(filename) {
+		if !opt.Fetch {
+			fmt.Println("use --fetch to share a remote URL:", filename)
+			return ""
+		}
+		return ltok.addRemote(ott, filename, opt)
+	}
 	// Add leading path if it was not provided
 	ffilename, _ := filepath.Abs(filename)
 	// Check file exists and is readable
 	sta, err := os.Stat(ffilename)
 	if err != nil {
-		fmt.Println("cannot find file: %s", ffilename)
-		return
+		fmt.Println("cannot find file:", ffilename)
+		return ""
 	}
 	if sta.IsDir() {
 		fmt.Println("cannot send directories")
-		return
+		return ""
+	}
+	spooled := opt.Spool || cnf.SPOOL
+	if spooled {
+		ffilename, err = spoolFile(ott, ffilename)
+		if err != nil {
+			fmt.Println("cannot spool file:", err)
+			return ""
+		}
+	}
+	return ltok.add(ott, ffilename, spooled, opt)
+}
+
+// Register a Token for a file known to exist and print its URL
+func (ltok LTokens) add(ott, ffilename string, spooled bool, opt AddOptions) string {
+	sta, err := os.Stat(ffilename)
+	if err != nil {
+		fmt.Println("cannot find file:", ffilename)
+		if spooled {
+			os.RemoveAll(filepath.Dir(ffilename))
+		}
+		return ""
+	}
+	if err = ltok.checkQuota(opt.Owner, sta.Size(), spooled); err != nil {
+		fmt.Println(err)
+		if spooled {
+			os.RemoveAll(filepath.Dir(ffilename))
+		}
+		return ""
+	}
+	sum, err := fileSha256(ffilename)
+	if err != nil {
+		fmt.Println("cannot read file:", ffilename)
+		if spooled {
+			os.RemoveAll(filepath.Dir(ffilename))
+		}
+		return ""
 	}
-	ott := GenerateOnetime(ONETIME_SZ)
 	now := time.Now()
-	ltok[ott] = Token{ffilename, now, time.Unix(0, 0)}
+	ltok[ott] = Token{
+		Path:          ffilename,
+		Created:       now,
+		Activated:     time.Unix(0, 0),
+		Unlink:        opt.Unlink,
+		Spooled:       spooled,
+		Name:          opt.Name,
+		Note:          opt.Note,
+		Sha256:        sum,
+		Size:          sta.Size(),
+		ModTime:       sta.ModTime(),
+		MimeType:      detectMimeType(ffilename, opt.Name),
+		Inline:        opt.Inline,
+		Limit:         opt.Limit,
+		Allow:         opt.Allow,
+		Countries:     opt.Countries,
+		DenyCountries: opt.DenyCountries,
+		Owner:         opt.Owner,
+	}
 	fmt.Printf(`
 
 Name: %s
 Size: %s bytes
 %s/%s
+Status: %s
 
-`, sta.Name(),
+`, ltok[ott].FileName(),
 		prettySize(sta.Size()),
-		cnf.BASE_ADDR, ott)
+		cnf.BASE_ADDR, ott, statusURL(ott))
+	journal("create", ott, nil, ffilename)
+	hook("created", ott, ltok[ott], nil)
+	return ott
+}
+
+// Print a summary table of URLs for a set of Tokens
+func (ltok LTokens) Summary(otts []string) {
+	for _, ott := range otts {
+		fmt.Printf("%s/%s  %s\n", cnf.BASE_ADDR, ott,
+			ltok[ott].FileName())
+	}
+	fmt.Println()
+}
+
+// Create a Token serving a text paste read from r
+func (ltok LTokens) Paste(r io.Reader, opt AddOptions) string {
+	return ltok.addText(r, KIND_PASTE, "paste.txt", opt)
+}
+
+// Create a Token serving a secret read from r, shown only once
+func (ltok LTokens) Secret(r io.Reader, opt AddOptions) string {
+	return ltok.addText(r, KIND_SECRET, "secret.txt", opt)
+}
+
+// Spool text read from r and register a Token of the given kind for it
+func (ltok LTokens) addText(r io.Reader, kind, name string,
+	opt AddOptions) string {
+	ott := GenerateOnetime(ONETIME_SZ)
+	if len(opt.Name) < 1 {
+		opt.Name = name
+	}
+	ffilename, err := spoolReader(ott, opt.Name, r)
+	if err != nil {
+		fmt.Println("cannot spool text:", err)
+		return ""
+	}
+	if len(ltok.add(ott, ffilename, true, opt)) < 1 {
+		return ""
+	}
+	tok := ltok[ott]
+	tok.Kind = kind
+	ltok[ott] = tok
+	return ott
+}
+
+// Create a Token of owner redirecting to target once, then burnt
+func (ltok LTokens) Redirect(target, owner string) string {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		fmt.Println("invalid URL:", target)
+		return ""
+	}
+	if err = ltok.checkQuota(owner, 0, false); err != nil {
+		fmt.Println(err)
+		return ""
+	}
+	ott := GenerateOnetime(ONETIME_SZ)
+	ltok[ott] = Token{
+		Created:   time.Now(),
+		Activated: time.Unix(0, 0),
+		Kind:      KIND_REDIRECT,
+		URL:       u.String(),
+		Owner:     owner,
+	}
+	fmt.Printf(`
+
+ URL: %s
+%s/%s
+Status: %s
+
+`, u.String(), cnf.BASE_ADDR, ott, statusURL(ott))
+	journal("create", ott, nil, u.String())
+	hook("created", ott, ltok[ott], nil)
+	return ott
 }
 
 // Delete a Token from a list
 func (ltok LTokens) Del(ott string) {
+	ltok.remove(ott, "delete")
+}
+
+// Remove a Token from a list, recording why in the audit journal
+func (ltok LTokens) remove(ott, event string) {
 	fmt.Printf("removing token: %s\n", ott)
+	tok, ok := ltok[ott]
+	if ok && tok.Spooled {
+		tok.RemoveFile()
+	}
+	removeThumbnail(ott)
 	delete(ltok, ott)
+	if ok {
+		journal(event, ott, nil, "")
+		if event == "delete" {
+			hook("deleted", ott, tok, nil)
+		} else {
+			hook("expired", ott, tok, nil)
+		}
+	}
+}
+
+// Renew a Token for duration d (TOKEN_VAL if zero).
+// An activated token gets a fresh validity window starting now, a token
+// that was never clicked restarts its unclaimed lifetime and will remain
+// valid for d once clicked.
+func (ltok LTokens) Renew(ott string, d time.Duration) error {
+	tok, ok := ltok[ott]
+	if !ok {
+		return errors.New("no such token: " + ott)
+	}
+	now := time.Now()
+	if tok.IsActivated() {
+		tok.Activated = now
+	} else {
+		tok.Created = now
+	}
+	tok.Validity = d
+	ltok[ott] = tok
+	return nil
 }
 
-// Show all Tokens in the list
-func (ltok LTokens) List() {
+// Show the Tokens of user in the list, all of them if empty
+func (ltok LTokens) List(user string) {
 	for k, v := range ltok {
+		if !owns(user, v) {
+			continue
+		}
 		fmt.Printf(`
 
     token: %s
@@ -168,18 +890,85 @@ func (ltok LTokens) List() {
   created: %s
 activated: %s
  validity: %s
+    owner: %s
 
 `, k, cnf.BASE_ADDR, k, v.Path, isotime(v.Created), isotime(v.Activated),
-			isotime(v.Activated.Add(TOKEN_VAL)))
+			isotime(v.ValidUntil()), v.Owner)
+	}
+}
+
+// Show everything known about a single Token
+func (ltok LTokens) Info(ott string) error {
+	tok, ok := ltok[ott]
+	if !ok {
+		return errors.New("no such token: " + ott)
+	}
+	now := time.Now()
+	size, sum := "unknown", "unknown"
+	if sta, err := statFile(tok.Path); err == nil {
+		size = prettySize(sta.Size()) + " bytes"
+	}
+	if len(tok.Sha256) > 0 {
+		sum = tok.Sha256
+	} else if h, err := fileSha256(tok.Path); err == nil {
+		sum = h
+	}
+	countries := strings.Join(tok.Countries, ", ")
+	if len(tok.DenyCountries) > 0 {
+		countries += " (not " + strings.Join(tok.DenyCountries, ", ") + ")"
+	}
+	remaining := "forever"
+	if until := tok.ValidUntil(); until.Year() > 1970 {
+		remaining = "none"
+		if now.Before(until) {
+			remaining = until.Sub(now).Round(time.Second).String()
+		}
+	}
+	fmt.Printf(`
+    token: %s
+      url: %s/%s
+   status: %s
+     file: %s
+     name: %s
+     note: %s
+     type: %s
+     size: %s
+   sha256: %s
+    state: %s
+  created: %s
+activated: %s
+ validity: %s
+remaining: %s
+    limit: %s
+downloads: %d
+  partial: %d
+   client: %s
+    allow: %s
+countries: %s
+    owner: %s
+`, ott, cnf.BASE_ADDR, ott, statusURL(ott), tok.Path, tok.FileName(), tok.Note, tok.MimeType, size, sum, tok.State(now),
+		isotime(tok.Created), isotime(tok.Activated),
+		isotime(tok.ValidUntil()), remaining, prettyRate(tok.Limit), len(tok.Downloads), tok.Partial, tok.Client,
+		strings.Join(tok.Allow, ", "), countries, tok.Owner)
+	for i, t := range tok.Downloads {
+		origin := ""
+		if len(tok.Origins) == len(tok.Downloads) {
+			origin = tok.Origins[i]
+		}
+		fmt.Printf("           %s %s\n", isotime(t), origin)
 	}
+	fmt.Println()
+	return nil
 }
 
-// Purge expired tokens
-func (ltok LTokens) Purge() {
+// Purge expired tokens of owner, all of them if empty, removing their
+// files if requested
+func (ltok LTokens) Purge(owner string) {
 	now := time.Now()
 	for k, v := range ltok {
-		if isotime(v.Activated) != "no" && now.Sub(v.Activated) > TOKEN_VAL {
-			ltok.Del(k)
+		if v.Expired(now) && owns(owner, v) {
+			ltok.remove(k, "purge")
+			v.RemoveFile()
 		}
 	}
 }
@@ -213,283 +1002,1858 @@ AAD//wAA//8AAA==`
 
 	enc := base64.StdEncoding
 	fav, _ := enc.DecodeString(fav64)
-	// log.Println(req.RemoteAddr, req.URL, "favicon")
 	w.Write(fav)
 }
 
-// Send a web page showing download links
-func Show(w http.ResponseWriter, req *http.Request) {
-	reqpath := req.URL.Path[1:]
-	// log.Println("GET", req.RemoteAddr, req.URL)
-	ltok := make(LTokens)
-	ltok.Load(cnf.TOKEN_DB)
-	tok, err := ltok[reqpath]
-	if err == false {
-		log.Println("404", req.RemoteAddr, req.URL)
-		http.NotFound(w, req)
-		return
-	}
-	name := path.Base(tok.Path)
-	sta, s_err := os.Stat(tok.Path)
-	if s_err != nil {
-		log.Println("NOFILE", req.RemoteAddr, req.URL)
-		http.NotFound(w, req)
-		return
-	}
-	validity_period := ""
-	if tok.Activated.Year() > 1970 {
-		validity_period = "<dt>Valid until</dt><dd>" +
-			isotime(tok.Activated.Add(TOKEN_VAL)) +
-			"</dd>"
-	}
-	log.Println("DISP", req.RemoteAddr, req.URL)
-	fmt.Fprintf(w, `<!DOCTYPE html>
-<html>
-<head>
-<link href='http://fonts.googleapis.com/css?family=Ubuntu' rel='stylesheet' type='text/css'>
-<style type="text/css">
-body {
-    margin: 5%%;
-    max-width: 768px;
-    background-color: #9999ff;
-    font-family: 'Ubuntu', sans-serif;
-}
-#main {
-    background-color: #6666cc;
-    color: white;
-    padding: 10px;
-    border-radius: 15px;
-}
-#top {
-    font-weight: bold;
-}
-#disclaimer {
-    font-style: italic;
-}
-a {
-    color: white;
-}
-</style>
-<meta http-equiv="Content-Type" content="text/html; charset=UTF-8" />
-<title>
-Download
-</title>
-</head>
-<body>
-    <div id="main">
-    <p id="top">A file is ready to be retrieved:</p>
-    <dl>
-        <dt>Name</dt>
-        <dd>%s</dd>
-        <dt>Size</dt>
-        <dd>%s bytes</dd>
-        %s
-        <dt>Link</dt>
-        <dd><a href="/d/%s">Click here to start downloading</a></dd>
-    </dl>
-    </div>
-    <p id="disclaimer">
-    This link is only valid once. It will remain valid up to four hours
-    after it has first been clicked.
-    </p>
-</body>
-</html>`, name, prettySize(sta.Size()), validity_period, reqpath)
-}
-
-// Send the real data
-func Distribute(w http.ResponseWriter, req *http.Request) {
-	reqpath := req.URL.Path[3:]
-	// log.Println(req.RemoteAddr, req.URL)
-	ltok := make(LTokens)
-	ltok.Load(cnf.TOKEN_DB)
-	tok, err := ltok[reqpath]
-	if err == false {
-		log.Println("404", req.RemoteAddr, req.URL)
-		http.NotFound(w, req)
-		return
+// Check the file behind a token before offering or serving it, logging
+// problems. Return false if the request must be refused. Files modified
+// since add are refused unless ON_CHANGE is set to "warn".
+func checkFile(req *http.Request, tok Token) (os.FileInfo, bool) {
+	sta, err := tok.CheckFile()
+	if sta == nil {
+		reqLog(req).Warn("NOFILE")
+		return nil, false
 	}
-	if tok.Activated.Year() > 1970 {
-		if time.Now().Sub(tok.Activated) > TOKEN_VAL {
-			log.Println("EXPIRED", req.RemoteAddr, req.URL)
-			http.NotFound(w, req)
-			return
-		}
+	if err != nil {
+		reqLog(req).Warn("CHANGED", "file", tok.Path)
+		return sta, cnf.ON_CHANGE == "warn"
 	}
-	ltok[reqpath] = Token{tok.Path, tok.Created, time.Now()}
-	ltok.Save(cnf.TOKEN_DB)
-	name := path.Base(tok.Path)
-	log.Println("SEND", req.RemoteAddr, req.URL)
-	w.Header().Set("Content-disposition",
-		fmt.Sprintf("attachment; filename=\"%s\"", name))
-	http.ServeFile(w, req, tok.Path)
-	log.Println("DONE", req.RemoteAddr, reqpath)
+	return sta, true
 }
 
-// Server configure and start
-func Serve() {
-	fmt.Printf(`
-
-      config: %s
-    TOKEN_DB: %s
-    LOG_FILE: %s
-   BASE_ADDR: %s
-         CRT: %s
-         KEY: %s
-
-`, cnf.path, cnf.TOKEN_DB, cnf.LOG_FILE, cnf.BASE_ADDR, cnf.CRT, cnf.KEY)
-	logf, _ := os.OpenFile(cnf.LOG_FILE,
-		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
-		0666)
-	log.SetOutput(logf)
-	defer logf.Close()
-	http.HandleFunc("/favicon.ico", Favicon)
-	http.HandleFunc("/d/", Distribute)
-	http.HandleFunc("/", Show)
-
-	log.Println("START", cnf.BASE_ADDR)
-	// Choose http or https depending on BASE_ADDR
-	var err error
-	if strings.HasPrefix(cnf.BASE_ADDR, "https") {
-		// Force cipher suite to the least CPU-intensive
-		// Other suites are just unbearably slow on my 32-bit server
-		t := tls.Config{
-			// CipherSuites: []uint16{tls.TLS_RSA_WITH_RC4_128_SHA},
-		}
-		s := &http.Server{
-			Addr:      cnf.BASE_ADDR[8:],
-			TLSConfig: &t,
-		}
-		err = s.ListenAndServeTLS(cnf.CRT, cnf.KEY)
-	} else if strings.HasPrefix(cnf.BASE_ADDR, "http") {
-		err = http.ListenAndServe(cnf.BASE_ADDR[7:], nil)
-	} else {
-		err = errors.New("unknown protocol in BASE_ADDR")
-	}
+// Ask search engines not to index or follow token URLs, in case they leak
+// into crawlable places
+func noIndex(w http.ResponseWriter) {
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+}
 
-	if err != nil {
-		log.Fatal(err)
+// Let the form of the current page lead to the origin of target. Browsers
+// apply the form-action policy to redirections following a form post.
+func allowFormTarget(w http.ResponseWriter, target string) {
+	csp := w.Header().Get("Content-Security-Policy")
+	u, err := url.Parse(target)
+	if len(csp) < 1 || err != nil {
 		return
 	}
+	origin := u.Scheme + "://" + u.Host
+	w.Header().Set("Content-Security-Policy",
+		strings.Replace(csp, "form-action 'self'",
+			"form-action 'self' "+origin, 1))
 }
 
-// Create a default configuration file
-func setConfiguration() {
-	name, _ := os.Readlink("/proc/self/exe")
-	cname := path.Dir(name) + CNF_NAME
+// User agents of link preview fetchers used by chat and mail clients,
+// matched as case-insensitive substrings
+var defaultBotAgents = []string{
+	"Slackbot",
+	"Slack-ImgProxy",
+	"WhatsApp",
+	"TelegramBot",
+	"Discordbot",
+	"facebookexternalhit",
+	"Twitterbot",
+	"LinkedInBot",
+	"SkypeUriPreview",
+	"Microsoft Office",
+	"ms-office",
+	"BingPreview",
+	"Google-Safety",
+	"Iframely",
+	"Embedly",
+}
 
-	fo, err := os.Create(cname)
-	if err != nil {
-		fmt.Println("cannot create config file: ", cname)
-		return
+// Tell whether a request comes from a known link preview bot
+func previewBot(req *http.Request) bool {
+	agents := cnf.BOT_AGENTS
+	if agents == nil {
+		agents = defaultBotAgents
 	}
-	defer fo.Close()
-
-	fmt.Fprintf(fo,
-		`{
-    "TOKEN_DB": "token.db",
-    "LOG_FILE": "onetime.log",
-   "BASE_ADDR": "http://localhost:2500",
-         "CRT": "server.crt",
-         "KEY": "server.key"
+	ua := strings.ToLower(req.UserAgent())
+	for _, a := range agents {
+		if len(a) > 0 && strings.Contains(ua, strings.ToLower(a)) {
+			return true
+		}
+	}
+	return false
 }
-`)
-	fmt.Println("Config file created: ", cname)
-	fmt.Println("Edit this file before launching the server")
+
+// Send link preview bots a neutral page telling nothing about the token,
+// whether it exists or not
+func botPreview(w http.ResponseWriter, req *http.Request) {
+	reqLog(req).Info("BOT", "agent", req.UserAgent())
+	render(w, "preview.html", Page{
+		Title:   tr("shared"),
+		Message: tr("shared_message"),
+	})
 }
 
-// Read configuration from file
-func readConfiguration() error {
-	// Locate config file if it exists
-	name, _ := os.Readlink("/proc/self/exe")
-	cpath := path.Dir(name)
-	cnf.path = cpath + CNF_NAME
+// Send a robots.txt keeping all crawlers away
+func Robots(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "User-agent: *\nDisallow: /\n")
+}
 
-	// Load config file
-	js, err := ioutil.ReadFile(cnf.path)
-	if err != nil {
-		return err
+// Send a web page showing download links. Downloads start with a POST
+// from the button on this page, which activates the token.
+func Show(w http.ResponseWriter, req *http.Request) {
+	reqpath := req.URL.Path[1:]
+	noIndex(w)
+	backoff(req)
+	if banned(req) {
+		forbidden(w, req, "BANNED")
+		return
 	}
-	json.Unmarshal(js, &cnf)
-	// Check all required values are there
-	if len(cnf.TOKEN_DB) > 0 {
-		if cnf.TOKEN_DB[0] != '/' {
-			cnf.TOKEN_DB = cpath + "/" + cnf.TOKEN_DB
-		}
-	} else {
-		return errors.New("TOKEN_DB undefined in " + cnf.path)
+	if previewBot(req) {
+		botPreview(w, req)
+		return
 	}
-	if len(cnf.LOG_FILE) > 0 {
-		if cnf.LOG_FILE[0] != '/' {
-			cnf.LOG_FILE = cpath + "/" + cnf.LOG_FILE
-		}
+	ltok := make(LTokens)
+	ltok.LoadContext(req.Context(), cnf.TOKEN_DB)
+	tok, err := ltok[reqpath]
+	if err == false {
+		reqLog(req).Warn("404")
+		miss(req, "unknown")
+		notFound(w, req)
+		return
+	}
+	if tok.Kind == KIND_TRAP {
+		// Looks like any download page
+		trapHit(req, reqpath)
+		render(w, "show.html", Page{
+			Title:    tr("download"),
+			Token:    reqpath,
+			Name:     tok.FileName(),
+			MimeType: tok.MimeType,
+			Size:     prettySize(tok.Size),
+			Sha256:   tok.Sha256,
+			Validity: localDuration(tok.ValidFor()),
+		})
+		return
+	}
+	if tok.Expired(time.Now()) {
+		reqLog(req).Warn("EXPIRED")
+		miss(req, "expired")
+		tok.RemoveFile()
+		gone(w, req)
+		return
+	}
+	if !allowedClient(tok, req) || !allowedCountry(tok, req) {
+		forbidden(w, req, "BLOCKED")
+		return
+	}
+	if !boundClient(tok, req) {
+		forbidden(w, req, "BOUND")
+		return
+	}
+	if tok.Opened.IsZero() {
+		tok.Opened = time.Now()
+		updateToken(req.Context(), reqpath, func(t *Token) bool {
+			if !t.Opened.IsZero() {
+				return false
+			}
+			t.Opened = tok.Opened
+			return true
+		})
+	}
+	// Pages showing content or following links only do so when the
+	// recipient confirms with a POST, so that link previews fetched by
+	// mail and chat clients do not consume them
+	kind := tok.Kind
+	if kind == KIND_FILE && tok.Inline && isMarkdown(tok) {
+		kind = "document"
+	}
+	if kind != KIND_FILE && req.Method != "POST" {
+		reqLog(req).Debug("CONFIRM", "token", reqpath)
+		journal("view", reqpath, req, req.UserAgent())
+		if kind == KIND_REDIRECT {
+			allowFormTarget(w, tok.URL)
+		}
+		render(w, "confirm.html", Page{
+			Title: tr(kind),
+			Kind:  kind,
+			Token: reqpath,
+			Note:  tok.Note,
+		})
+		return
+	}
+	switch kind {
+	case KIND_PASTE:
+		ShowText(w, req, ltok, reqpath)
+		return
+	case KIND_SECRET:
+		ShowSecret(w, req, reqpath)
+		return
+	case "document":
+		if _, ok := checkFile(req, tok); !ok {
+			notFound(w, req)
+			return
+		}
+		ShowText(w, req, ltok, reqpath)
+		return
+	case KIND_REDIRECT:
+		// Claimed first, so that one click only is ever redirected
+		if tok, ok := claimToken(req.Context(), reqpath); !ok {
+			reqLog(req).Warn("404")
+			miss(req, "unknown")
+			notFound(w, req)
+		} else {
+			reqLog(req).Info("REDIRECT", "token", reqpath, "url", tok.URL)
+			journal("serve", reqpath, req, tok.URL)
+			hook("completed", reqpath, tok, req)
+			// Not 302: this answers the POST of the confirmation page,
+			// and 303 is the status telling browsers to follow with a GET
+			http.Redirect(w, req, tok.URL, http.StatusSeeOther)
+		}
+		return
+	}
+	name := tok.FileName()
+	sta, ok := checkFile(req, tok)
+	if !ok {
+		notFound(w, req)
+		return
+	}
+	until := ""
+	if tok.IsActivated() {
+		until = isotime(tok.ValidUntil())
+	}
+	mimetype := tok.MimeType
+	if len(mimetype) < 1 {
+		mimetype = detectMimeType(tok.Path, tok.Name)
+	}
+	reqLog(req).Debug("DISP", "token", reqpath)
+	journal("view", reqpath, req, req.UserAgent())
+	render(w, "show.html", Page{
+		Title:    tr("download"),
+		Kind:     tok.Kind,
+		Token:    reqpath,
+		Name:     name,
+		MimeType: mimetype,
+		Size:     prettySize(sta.Size()),
+		Sha256:   tok.Sha256,
+		Note:     tok.Note,
+		Until:    until,
+		Validity: localDuration(tok.ValidFor()),
+		Preview:  hasPreview(tok),
+	})
+}
+
+// Send a web page showing a text paste, or a Markdown document rendered
+// to HTML. Displaying the text counts as a download and activates the
+// token.
+func ShowText(w http.ResponseWriter, req *http.Request, ltok LTokens,
+	ott string) {
+	tok := ltok[ott]
+	text, err := ioutil.ReadFile(tok.Path)
+	if err != nil {
+		reqLog(req).Warn("NOFILE")
+		notFound(w, req)
+		return
+	}
+	tok, ok := updateToken(req.Context(), ott, func(tok *Token) bool {
+		tok.download(req, ott, time.Now())
+		tok.Sent += int64(len(text))
+		writeReceipt(req, ott, *tok, len(tok.Downloads))
+		return true
+	})
+	if !ok {
+		reqLog(req).Warn("404")
+		notFound(w, req)
+		return
+	}
+	p := Page{
+		Title:    tr("paste"),
+		Kind:     tok.Kind,
+		Token:    ott,
+		Name:     tok.FileName(),
+		Note:     tok.Note,
+		Validity: localDuration(tok.ValidFor()),
+	}
+	if tok.Kind == KIND_PASTE {
+		p.Text = string(text)
+	} else {
+		p.Title = tr("document")
+		p.Document = template.HTML(Markdown(string(text)))
+	}
+	reqLog(req).Info("VIEW", "token", ott, "bytes", len(text))
+	render(w, "text.html", p)
+}
+
+// Send a web page showing a secret, then destroy the token and its data
+// so that the secret can never be displayed again
+func ShowSecret(w http.ResponseWriter, req *http.Request, ott string) {
+	// Claimed before reading: of concurrent requests, one only gets it
+	tok, ok := claimToken(req.Context(), ott)
+	if !ok {
+		reqLog(req).Warn("404")
+		miss(req, "unknown")
+		notFound(w, req)
+		return
+	}
+	text, err := ioutil.ReadFile(tok.Path)
+	tok.RemoveFile()
+	if err != nil {
+		reqLog(req).Warn("NOFILE")
+		notFound(w, req)
+		return
+	}
+	reqLog(req).Info("SECRET", "token", ott)
+	journal("serve", ott, req, req.UserAgent())
+	hook("completed", ott, tok, req)
+	w.Header().Set("Cache-Control", "no-store")
+	render(w, "secret.html", Page{
+		Title: tr("secret"),
+		Kind:  tok.Kind,
+		Note:  tok.Note,
+		Text:  string(text),
+	})
+}
+
+// Announce the file checksum recorded at add time, both as a plain hex
+// header and as an RFC 3230 Digest
+func setChecksumHeaders(w http.ResponseWriter, tok Token) {
+	sum, err := hex.DecodeString(tok.Sha256)
+	if len(tok.Sha256) < 1 || err != nil {
+		return
+	}
+	w.Header().Set("X-Checksum-SHA256", tok.Sha256)
+	w.Header().Set("Digest",
+		"sha-256="+base64.StdEncoding.EncodeToString(sum))
+}
+
+// Tell whether a token file is a Markdown document
+func isMarkdown(tok Token) bool {
+	switch strings.ToLower(filepath.Ext(tok.FileName())) {
+	case ".md", ".markdown":
+		return true
+	}
+	return strings.HasPrefix(tok.MimeType, "text/markdown")
+}
+
+// Tell whether an image preview can be offered for a token
+func hasPreview(tok Token) bool {
+	if len(cnf.CACHE_DIR) < 1 || tok.Kind != KIND_FILE ||
+		isS3(tok.Path) || isRemote(tok.Path) {
+		return false
+	}
+	switch tok.MimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Return the path of the cached preview for a token
+func thumbnailPath(ott string) string {
+	return filepath.Join(cnf.CACHE_DIR, ott+".jpg")
+}
+
+// Remove the cached preview of a token, if any
+func removeThumbnail(ott string) {
+	if len(cnf.CACHE_DIR) > 0 {
+		os.Remove(thumbnailPath(ott))
+	}
+}
+
+// Downscale an image so that its largest side is at most max pixels,
+// averaging the source pixels covered by each destination pixel
+func downscale(src image.Image, max int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= max && h <= max {
+		return src
+	}
+	tw, th := max, h*max/w
+	if h > w {
+		tw, th = w*max/h, max
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg),
+						bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// Generate the preview of a token image into the cache directory
+func makeThumbnail(ott string, tok Token) error {
+	f, err := os.Open(tok.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	conf, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	if conf.Width*conf.Height > THUMB_MAX_PIXELS {
+		return errors.New("image too large for preview")
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(cnf.CACHE_DIR, 0755); err != nil {
+		return err
+	}
+	tmp := thumbnailPath(ott) + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(out, downscale(img, THUMB_SZ),
+		&jpeg.Options{Quality: 80})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, thumbnailPath(ott))
+}
+
+// Send the downscaled preview of an image token, generating it on first
+// request. Previews never activate tokens.
+func Thumbnail(w http.ResponseWriter, req *http.Request) {
+	reqpath := req.URL.Path[3:]
+	noIndex(w)
+	backoff(req)
+	ltok := make(LTokens)
+	ltok.LoadContext(req.Context(), cnf.TOKEN_DB)
+	tok, ok := ltok[reqpath]
+	if !ok || tok.Expired(time.Now()) || !hasPreview(tok) {
+		notFound(w, req)
+		return
+	}
+	if _, ok := checkFile(req, tok); !ok {
+		notFound(w, req)
+		return
+	}
+	thumb := thumbnailPath(reqpath)
+	if _, err := os.Stat(thumb); err != nil {
+		if err = makeThumbnail(reqpath, tok); err != nil {
+			reqLog(req).Error("NOTHUMB", "err", err)
+			notFound(w, req)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, req, thumb)
+}
+
+// Set the headers describing a token file: checksum, content type and
+// disposition
+func setDownloadHeaders(w http.ResponseWriter, tok Token) {
+	setChecksumHeaders(w, tok)
+	if len(tok.MimeType) > 0 {
+		w.Header().Set("Content-Type", tok.MimeType)
+	}
+	w.Header().Set("Content-disposition", contentDisposition(tok))
+}
+
+// Return the Content-Disposition of a token file: inline or attachment
+func contentDisposition(tok Token) string {
+	disposition := "attachment"
+	if tok.Inline && inlineSafe(tok.MimeType) {
+		disposition = "inline"
+	}
+	return mime.FormatMediaType(disposition,
+		map[string]string{"filename": tok.FileName()})
+}
+
+// Ask the front proxy to send the token file: nginx with X-Accel-Redirect
+// to an internal location, Apache with X-Sendfile
+func offload(w http.ResponseWriter, tok Token) {
+	switch cnf.OFFLOAD {
+	case "nginx":
+		u := url.URL{Path: cnf.OFFLOAD_PREFIX + tok.Path}
+		w.Header().Set("X-Accel-Redirect", u.EscapedPath())
+		if tok.Limit > 0 {
+			w.Header().Set("X-Accel-Limit-Rate",
+				strconv.FormatInt(tok.Limit, 10))
+		}
+	case "apache":
+		w.Header().Set("X-Sendfile", tok.Path)
+	}
+}
+
+// Send the real data
+func Distribute(w http.ResponseWriter, req *http.Request) {
+	reqpath := req.URL.Path[3:]
+	noIndex(w)
+	backoff(req)
+	if banned(req) {
+		forbidden(w, req, "BANNED")
+		return
+	}
+	if previewBot(req) {
+		botPreview(w, req)
+		return
+	}
+	ltok := make(LTokens)
+	ltok.LoadContext(req.Context(), cnf.TOKEN_DB)
+	tok, err := ltok[reqpath]
+	if err == false {
+		reqLog(req).Warn("404")
+		miss(req, "unknown")
+		notFound(w, req)
+		return
+	}
+	if tok.Kind == KIND_TRAP {
+		trapHit(req, reqpath)
+		notFound(w, req)
+		return
+	}
+	if tok.Kind == KIND_SECRET || tok.Kind == KIND_REDIRECT {
+		reqLog(req).Warn("404")
+		miss(req, "unknown")
+		notFound(w, req)
+		return
+	}
+	if tok.Expired(time.Now()) {
+		reqLog(req).Warn("EXPIRED")
+		miss(req, "expired")
+		tok.RemoveFile()
+		gone(w, req)
+		return
+	}
+	if !allowedClient(tok, req) || !allowedCountry(tok, req) {
+		forbidden(w, req, "BLOCKED")
+		return
+	}
+	if !boundClient(tok, req) {
+		forbidden(w, req, "BOUND")
+		return
+	}
+	sta, ok := checkFile(req, tok)
+	if !ok {
+		notFound(w, req)
+		return
+	}
+	// HEAD requests (curl -I, monitoring, scanners) get metadata only and
+	// never activate the token nor count as a download
+	if req.Method == "HEAD" {
+		reqLog(req).Debug("HEAD", "token", reqpath)
+		setDownloadHeaders(w, tok)
+		w.Header().Set("Content-Length", strconv.FormatInt(sta.Size(), 10))
+		return
+	}
+	// Only a POST from the download page may activate a token. Plain GET
+	// requests, e.g. link previews, are sent back to that page, except
+	// ranged requests resuming an interrupted download from the same client.
+	resuming := len(req.Header.Get("Range")) > 0 &&
+		len(tok.Resume) > 0 && tok.Resume == clientHost(req)
+	if req.Method != "POST" && !tok.IsActivated() && !resuming {
+		reqLog(req).Debug("NOTACTIVE", "token", reqpath)
+		http.Redirect(w, req, "/"+reqpath, http.StatusSeeOther)
+		return
+	}
+	if isS3(tok.Path) && cnf.S3_MODE != "stream" {
+		// The bucket sends the object: as with offloading, the token is
+		// activated when handing the download over
+		if !s3Redirect(w, req, tok) {
+			notFound(w, req)
+			return
+		}
+		reqLog(req).Info("S3REDIRECT", "token", reqpath, "bytes", tok.Size)
+		handOver(req, reqpath)
+		return
+	}
+	if cdnServes(tok) {
+		// The CDN sends the file, activating as with S3 redirects
+		if !cdnRedirect(w, req, tok) {
+			notFound(w, req)
+			return
+		}
+		reqLog(req).Info("CDNREDIRECT", "token", reqpath, "bytes", tok.Size)
+		handOver(req, reqpath)
+		return
+	}
+	if len(cnf.OFFLOAD) > 0 && !isS3(tok.Path) && !isRemote(tok.Path) {
+		// The proxy sends the file: the transfer cannot be followed, so
+		// the token is activated when handing it over
+		reqLog(req).Info("OFFLOAD", "token", reqpath, "bytes", tok.Size)
+		handOver(req, reqpath)
+		setDownloadHeaders(w, tok)
+		offload(w, tok)
+		return
+	}
+	if !acquireSlot(reqpath) {
+		tooBusy(w, req)
+		return
+	}
+	defer releaseSlot(reqpath)
+	if isRemote(tok.Path) && tok.Spooled {
+		var ferr error
+		if tok, sta, ferr = fetchRemote(reqpath); ferr != nil {
+			reqLog(req).Error("FETCH", "token", reqpath, "err", ferr)
+			notFound(w, req)
+			return
+		}
+	}
+	reqLog(req).Debug("SEND", "token", reqpath,
+		"range", req.Header.Get("Range"))
+	start := time.Now()
+	setDownloadHeaders(w, tok)
+	cw := &countingWriter{ResponseWriter: throttle(w, tok.Limit)}
+	switch {
+	case isS3(tok.Path):
+		s3Stream(cw, req, tok)
+	case isRemote(tok.Path):
+		remoteStream(cw, req, tok)
+	default:
+		http.ServeFile(cw, req, tok.Path)
+	}
+	done, complete := cw.progress(sta.Size())
+	// Only a complete transfer activates the token, so that a download
+	// cut short can be resumed up to RETRIES times
+	updateToken(req.Context(), reqpath, func(tok *Token) bool {
+		now := time.Now()
+		tok.Sent += cw.n
+		switch {
+		case done:
+			reqLog(req).Info("DONE", "token", reqpath, "bytes", cw.n,
+				"duration", time.Since(start).Round(time.Millisecond))
+			tok.download(req, reqpath, now)
+			writeReceipt(req, reqpath, *tok, len(tok.Downloads))
+			tok.Resume = ""
+		case complete:
+			// A range sent in full but not reaching the end of the file,
+			// part of a download resumed or split by the client
+			reqLog(req).Info("RANGE", "token", reqpath, "bytes", cw.n,
+				"duration", time.Since(start).Round(time.Millisecond),
+				"range", cw.Header().Get("Content-Range"))
+		default:
+			reqLog(req).Warn("PARTIAL", "token", reqpath, "bytes", cw.n,
+				"size", sta.Size(),
+				"duration", time.Since(start).Round(time.Millisecond))
+			tok.Partial++
+			tok.Resume = clientHost(req)
+			if tok.Partial > cnf.RETRIES && !tok.IsActivated() {
+				reqLog(req).Warn("RETRIES", "token", reqpath,
+					"partial", tok.Partial)
+				tok.activate(req, reqpath, now)
+			}
+		}
+		return true
+	})
+}
+
+// Record a download handed over to a bucket, a CDN or the front proxy:
+// the transfer cannot be followed, so the token is activated right away
+func handOver(req *http.Request, ott string) {
+	updateToken(req.Context(), ott, func(tok *Token) bool {
+		tok.download(req, ott, time.Now())
+		tok.Sent += tok.Size
+		tok.Resume = ""
+		return true
+	})
+}
+
+// A ResponseWriter counting the bytes of body actually sent
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Tell whether a transfer of a file of the given size sent the file up to
+// its last byte (done) and whether the requested body was sent in full
+// (complete). A full file or a single range ending the file are done.
+func (cw *countingWriter) progress(size int64) (done, complete bool) {
+	cr := cw.Header().Get("Content-Range")
+	if strings.HasPrefix(cw.Header().Get("Content-Type"),
+		"multipart/byteranges") {
+		// Multipart ranges: not followed
+		return false, true
+	}
+	if len(cr) < 1 {
+		return cw.n == size, cw.n == size
+	}
+	var first, last, total int64
+	_, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &first, &last, &total)
+	if err != nil {
+		return false, true
+	}
+	complete = cw.n == last-first+1
+	return complete && last == size-1, complete
+}
+
+// Tell whether the client of req may use an activated token, as
+// configured with BIND_CLIENT
+func boundClient(tok Token, req *http.Request) bool {
+	if len(cnf.BIND_CLIENT) < 1 || !tok.IsActivated() || len(tok.Client) < 1 {
+		return true
+	}
+	host := clientHost(req)
+	if cnf.BIND_CLIENT == "ip" {
+		return host == tok.Client
+	}
+	return sameSubnet(host, tok.Client)
+}
+
+// Tell whether two addresses belong to the same /24 (IPv4) or /64 (IPv6)
+// network
+func sameSubnet(a, b string) bool {
+	ipa, ipb := net.ParseIP(a), net.ParseIP(b)
+	if ipa == nil || ipb == nil {
+		return a == b
+	}
+	mask := net.CIDRMask(64, 128)
+	if ipa.To4() != nil {
+		ipa, ipb = ipa.To4(), ipb.To4()
+		mask = net.CIDRMask(24, 32)
+	}
+	if ipb == nil {
+		return false
+	}
+	return ipa.Mask(mask).Equal(ipb.Mask(mask))
+}
+
+// Refuse a request from a client not allowed to use a token
+func forbidden(w http.ResponseWriter, req *http.Request, reason string) {
+	reqLog(req).Warn(reason)
+	renderError(w, http.StatusForbidden, tr("forbidden"),
+		tr("forbidden_message"))
+}
+
+// Return the address of a client, without its port. Behind one of the
+// TRUSTED_PROXIES, the client is the last address the proxies added
+// to X-Forwarded-For or Forwarded that is not itself a trusted proxy.
+func clientHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if len(cnf.trustedProxies) < 1 {
+		return host
+	}
+	if ip := net.ParseIP(host); ip == nil || !inNets(ip, cnf.trustedProxies) {
+		return host
+	}
+	if fwd := forwardedFor(req.Header); fwd != "" {
+		return fwd
+	}
+	return host
+}
+
+// Check the bearer key presented with an API request
+func apiAuthorized(req *http.Request) bool {
+	if len(cnf.API_KEY) < 1 {
+		return false
+	}
+	auth := []byte(req.Header.Get("Authorization"))
+	want := []byte("Bearer " + cnf.API_KEY)
+	return subtle.ConstantTimeCompare(auth, want) == 1
+}
+
+// Reply to an API request with a JSON document
+func apiReply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Reply to an API request with an error message
+func apiError(w http.ResponseWriter, code int, msg string) {
+	apiReply(w, code, map[string]string{"error": msg})
+}
+
+// An entry of the API token list
+type apiToken struct {
+	Token      string    `json:"token"`
+	URL        string    `json:"url"`
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner,omitempty"`
+	State      string    `json:"state"`
+	Created    time.Time `json:"created"`
+	ValidUntil time.Time `json:"valid_until"`
+	Downloads  int       `json:"downloads"`
+}
+
+// Token management API. Requests must carry the configured API_KEY, or
+// the key of a user, as a bearer token. Users only reach their own
+// tokens. Endpoints:
+//
+//	GET  /api/list
+//	POST /api/renew/<token>   [validity=<duration>]
+func Api(w http.ResponseWriter, req *http.Request) {
+	user, ok := apiUser(req)
+	if !ok {
+		reqLog(req).Warn("DENIED")
+		failure(req, "apikey")
+		apiError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if req.URL.Path == "/api/list" && req.Method == "GET" {
+		ltok := make(LTokens)
+		ltok.LoadContext(req.Context(), cnf.TOKEN_DB)
+		now := time.Now()
+		list := []apiToken{}
+		for ott, tok := range ltok {
+			if !owns(user, tok) || tok.Kind == KIND_TRAP {
+				continue
+			}
+			list = append(list, apiToken{
+				Token:      ott,
+				URL:        cnf.BASE_ADDR + "/" + ott,
+				Name:       tok.FileName(),
+				Owner:      tok.Owner,
+				State:      tok.State(now),
+				Created:    tok.Created,
+				ValidUntil: tok.ValidUntil(),
+				Downloads:  len(tok.Downloads),
+			})
+		}
+		apiReply(w, http.StatusOK, list)
+		return
+	}
+	parts := strings.SplitN(req.URL.Path[5:], "/", 2)
+	if len(parts) != 2 || req.Method != "POST" {
+		apiError(w, http.StatusNotFound, "no such endpoint")
+		return
+	}
+	verb, ott := parts[0], parts[1]
+	switch verb {
+	case "renew":
+		var d time.Duration
+		if v := req.FormValue("validity"); len(v) > 0 {
+			var err error
+			d, err = time.ParseDuration(v)
+			if err != nil {
+				apiError(w, http.StatusBadRequest, "invalid validity")
+				return
+			}
+		}
+		var renewed Token
+		err := errors.New("no such token: " + ott)
+		updateTokens(req.Context(), func(ltok LTokens) bool {
+			// Not telling other users' tokens from unknown ones
+			if tok, ok := ltok[ott]; !ok || !owns(user, tok) {
+				return false
+			}
+			err = ltok.Renew(ott, d)
+			renewed = ltok[ott]
+			return err == nil
+		})
+		if err != nil {
+			apiError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		reqLog(req).Info("RENEW", "token", ott)
+		journal("renew", ott, req, isotime(renewed.ValidUntil()))
+		apiReply(w, http.StatusOK, renewed)
+	default:
+		apiError(w, http.StatusNotFound, "no such endpoint")
+	}
+}
+
+// Server configure and start
+func Serve() {
+	fmt.Printf(`
+
+      config: %s
+    TOKEN_DB: %s
+    LOG_FILE: %s
+   BASE_ADDR: %s
+         CRT: %s
+         KEY: %s
+
+`, cnf.path, dbName(cnf.TOKEN_DB), cnf.LOG_FILE, cnf.BASE_ADDR, cnf.CRT, cnf.KEY)
+	logf, err := setupLogging()
+	if err != nil {
+		fmt.Println("cannot open log:", err)
+		return
+	}
+	defer logf.Close()
+	if err := openFailLog(); err != nil {
+		log.Fatal(err)
+	}
+	reopenOnSignal()
+	if err := loadLocale(cnf.LOCALE); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTemplates(); err != nil {
+		log.Fatal(err)
+	}
+	if cnf.rateLimit > 0 {
+		globalLimiter.Store(newRateLimiter(cnf.rateLimit))
+	}
+	if len(cnf.GEOIP_DB) > 0 {
+		db, err := openGeoIP(cnf.GEOIP_DB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		geoip = db
+	}
+	// Not the default mux: importing net/http/pprof registers profiles
+	// there, for anyone to fetch
+	mux := http.NewServeMux()
+	mux.HandleFunc("/favicon.ico", Favicon)
+	mux.HandleFunc("/robots.txt", Robots)
+	mux.HandleFunc("/d/", Distribute)
+	mux.HandleFunc("/t/", Thumbnail)
+	mux.HandleFunc("/s/", requireClientCert(Status))
+	mux.HandleFunc("/logo", Logo)
+	mux.Handle("/static/", Static())
+	mux.HandleFunc("/api/", requireClientCert(Api))
+	mux.HandleFunc("/admin/", requireClientCert(Admin))
+	mux.HandleFunc("/", Show)
+	startPprof(mux)
+	// See middleware.go
+	mws := []Middleware{withRequestID}
+	if len(cnf.OTLP_ENDPOINT) > 0 {
+		startTracing()
+		mws = append(mws, withTracing)
+	}
+	if len(cnf.ACCESS_LOG) > 0 {
+		accessf, err := openLog(cnf.ACCESS_LOG)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mws = append(mws, func(next http.Handler) http.Handler {
+			return withAccessLog(next, accessf, cnf.access)
+		})
+	}
+	mws = append(mws, middlewares...)
+	mws = append(mws, withSecurityHeaders)
+	handler := chain(mux, mws)
+
+	slog.Info("START", "addr", cnf.BASE_ADDR, "version", version)
+	watchConfiguration()
+	var t *tls.Config
+	if cnf.usesTLS() {
+		// TLS_CIPHERS can force the least CPU-intensive suites
+		// Other suites are just unbearably slow on my 32-bit server
+		if t, err = tlsConfig(); err != nil {
+			log.Fatal(err)
+		}
+		watchCertificates()
+	}
+	// Bind all addresses before serving any, so that readiness means all
+	// of them answer
+	// Take over the sockets of the previous server when upgrading
+	if err = inheritSockets(); err != nil {
+		log.Fatal(err)
+	}
+	addrs := cnf.listenAddrs()
+	listeners := make([]net.Listener, len(addrs))
+	for i, addr := range addrs {
+		if listeners[i], err = takeOrBind(addr, bind); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var redirect net.Listener
+	if len(cnf.HTTP_REDIRECT) > 0 {
+		redirect, err = takeOrBind("redirect="+cnf.HTTP_REDIRECT,
+			func(string) (net.Listener, error) {
+				return net.Listen("tcp", cnf.HTTP_REDIRECT)
+			})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	closeInherited()
+	// Serve on all addresses, stop at the first failure
+	errc := make(chan error)
+	for i, addr := range addrs {
+		go func(addr string, l net.Listener) {
+			errc <- listen(addr, l, handler, t)
+		}(addr, listeners[i])
+	}
+	if redirect != nil {
+		go func() {
+			errc <- redirectToHTTPS(redirect)
+		}()
+	}
+	notifyReady()
+	close(serverReady)
+	if len(cnf.TELEGRAM_TOKEN) > 0 {
+		go telegramBot()
+	}
+	upgraded()
+	watchUpgrade()
+	err = <-errc
+
+	if drained() {
+		// Exits once requests in progress are over
+		select {}
+	}
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+}
+
+// Create a default configuration file next to the executable, or in the
+// user configuration directory if that one cannot be written to, or
+// where --config says
+func setConfiguration() {
+	cname := filepath.Join(exeDir(), CNF_NAME)
+	if len(configFile) > 0 {
+		cname = configFile
+		os.MkdirAll(filepath.Dir(cname), 0755)
+	}
+	fo, err := os.Create(cname)
+	if dir, derr := os.UserConfigDir(); err != nil && derr == nil &&
+		len(configFile) < 1 {
+		cname = filepath.Join(dir, "onetime", CNF_NAME)
+		os.MkdirAll(filepath.Dir(cname), 0755)
+		fo, err = os.Create(cname)
+	}
+	if err != nil {
+		fmt.Println("cannot create config file: ", cname)
+		return
+	}
+	defer fo.Close()
+
+	fmt.Fprintf(fo,
+		`{
+    "TOKEN_DB": "token.db",
+    "LOG_FILE": "onetime.log",
+   "BASE_ADDR": "http://localhost:2500",
+         "CRT": "server.crt",
+         "KEY": "server.key",
+   "UNCLAIMED": "168h",
+   "SPOOL_DIR": "spool",
+   "CACHE_DIR": "cache",
+     "RETRIES": 3
+}
+`)
+	fmt.Println("Config file created: ", cname)
+	fmt.Println("Edit this file before launching the server")
+}
+
+// Return the directory holding the executable
+func exeDir() string {
+	name, err := os.Executable()
+	if err != nil {
+		return "."
+	}
+	if real, err := filepath.EvalSymlinks(name); err == nil {
+		name = real
+	}
+	return filepath.Dir(name)
+}
+
+// Return a file name of the configuration, relative to dir unless it is
+// absolute
+func configPath(dir, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// Return the places where onetime.json is looked for, in order of
+// precedence: next to the executable, in the user configuration
+// directory, then in /etc/onetime. Only the file given with --config
+// if any.
+func configFiles() []string {
+	if len(configFile) > 0 {
+		return []string{configFile}
+	}
+	files := []string{filepath.Join(exeDir(), CNF_NAME)}
+	if dir, err := os.UserConfigDir(); err == nil {
+		files = append(files, filepath.Join(dir, "onetime", CNF_NAME))
+	}
+	return append(files, filepath.Join("/etc/onetime", CNF_NAME))
+}
+
+// Read configuration from file into c
+func readConfiguration(c *Config) error {
+	// Locate config file if it exists
+	files := configFiles()
+	for _, name := range files {
+		if _, err := os.Stat(name); err == nil {
+			c.path = name
+			break
+		}
+	}
+	var cpath string
+	var err error
+	if len(c.path) > 0 {
+		// Relative names are relative to the configuration file
+		cpath = filepath.Dir(c.path)
+		// Load config file
+		js, err := ioutil.ReadFile(c.path)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(js, c); err != nil {
+			return errors.New("invalid JSON in " + c.path + ": " +
+				err.Error())
+		}
+	} else if len(configFile) > 0 {
+		return errors.New("no configuration file " + configFile)
+	} else if envConfigured() {
+		cpath, _ = os.Getwd()
+		c.path = "environment"
+	} else if cmdlineConfigured() {
+		cpath, _ = os.Getwd()
+		c.path = "command line"
 	} else {
-		return errors.New("LOG_FILE undefined in " + cnf.path)
+		return errors.New("no configuration file among " +
+			strings.Join(files, ", "))
+	}
+	if err = c.readEnvironment(); err != nil {
+		return err
+	}
+	if err = c.readCommandLine(); err != nil {
+		return err
+	}
+	if err = c.decryptSettings(); err != nil {
+		return err
+	}
+	// Check all required values are there
+	if isPostgres(c.TOKEN_DB) {
+		if _, err = newPgPool(c.TOKEN_DB); err != nil {
+			return errors.New("invalid TOKEN_DB in " + c.path + ": " +
+				err.Error())
+		}
+		// Shared by all servers using the database
+		if len(c.SECRET) < 1 {
+			return errors.New("SECRET needed with a PostgreSQL TOKEN_DB in " +
+				c.path)
+		}
+	} else if isPluginStore(c.TOKEN_DB) {
+		// Shared by all servers using the plugin, checked with PLUGINS
+		if len(c.SECRET) < 1 {
+			return errors.New("SECRET needed with a plugin TOKEN_DB in " +
+				c.path)
+		}
+	} else if len(c.TOKEN_DB) > 0 {
+		c.TOKEN_DB = configPath(cpath, c.TOKEN_DB)
+	} else {
+		return errors.New("TOKEN_DB undefined in " + c.path)
+	}
+	if len(c.LOG_FILE) > 0 {
+		if !isSyslog(c.LOG_FILE) && !isJournal(c.LOG_FILE) {
+			c.LOG_FILE = configPath(cpath, c.LOG_FILE)
+		}
+	} else {
+		return errors.New("LOG_FILE undefined in " + c.path)
+	}
+	if len(c.PID_FILE) > 0 {
+		c.PID_FILE = configPath(cpath, c.PID_FILE)
+	}
+	if len(c.FAIL_LOG) > 0 {
+		c.FAIL_LOG = configPath(cpath, c.FAIL_LOG)
+	}
+	if len(c.ACCESS_LOG) > 0 {
+		c.ACCESS_LOG = configPath(cpath, c.ACCESS_LOG)
+		format := c.ACCESS_LOG_FORMAT
+		if len(format) < 1 {
+			format = "combined"
+		}
+		if c.access, err = parseAccessFormat(format); err != nil {
+			return err
+		}
+	}
+	if len(c.AUDIT_LOG) > 0 {
+		c.AUDIT_LOG = configPath(cpath, c.AUDIT_LOG)
+	}
+	if len(c.BASE_ADDR) < 1 {
+		return errors.New("BASE_ADDR undefined in " + c.path)
+	}
+	if err = c.checkHTTPRedirect(); err != nil {
+		return err
+	}
+	if len(c.ACME_DIR) > 0 {
+		c.ACME_DIR = configPath(cpath, c.ACME_DIR)
+	}
+	for _, addr := range c.LISTEN {
+		if !strings.HasPrefix(addr, "http://") &&
+			!strings.HasPrefix(addr, "https://") &&
+			!strings.HasPrefix(addr, FCGI_PREFIX) {
+			return errors.New("invalid LISTEN in " + c.path)
+		}
+	}
+	if len(c.CRT) > 0 {
+		c.CRT = configPath(cpath, c.CRT)
+	}
+	if len(c.KEY) > 0 {
+		c.KEY = configPath(cpath, c.KEY)
+	}
+	for i, p := range c.CERTS {
+		if len(p.CRT) < 1 || len(p.KEY) < 1 {
+			return errors.New("invalid CERTS in " + c.path)
+		}
+		c.CERTS[i].CRT = configPath(cpath, p.CRT)
+		c.CERTS[i].KEY = configPath(cpath, p.KEY)
+	}
+	if len(c.CLIENT_CA) > 0 {
+		c.CLIENT_CA = configPath(cpath, c.CLIENT_CA)
+	}
+	if len(c.SPOOL_DIR) > 0 {
+		c.SPOOL_DIR = configPath(cpath, c.SPOOL_DIR)
+	}
+	if len(c.CACHE_DIR) > 0 {
+		c.CACHE_DIR = configPath(cpath, c.CACHE_DIR)
+	}
+	if len(c.RECEIPT_DIR) > 0 {
+		c.RECEIPT_DIR = configPath(cpath, c.RECEIPT_DIR)
+	}
+	if len(c.TEMPLATE_DIR) > 0 {
+		c.TEMPLATE_DIR = configPath(cpath, c.TEMPLATE_DIR)
+	}
+	if len(c.GEOIP_DB) > 0 {
+		c.GEOIP_DB = configPath(cpath, c.GEOIP_DB)
+	}
+	if len(c.BRAND_LOGO) > 0 {
+		c.BRAND_LOGO = configPath(cpath, c.BRAND_LOGO)
+	}
+	if len(c.CDN_KEY_FILE) > 0 {
+		c.CDN_KEY_FILE = configPath(cpath, c.CDN_KEY_FILE)
+	}
+	if c.logLevel, err = parseLevel(c.LOG_LEVEL); err != nil {
+		return err
+	}
+	switch c.LOG_FORMAT {
+	case "", "text", "json":
+	default:
+		return errors.New("invalid LOG_FORMAT in " + c.path)
+	}
+	switch c.LOG_JOURNAL {
+	case "", "auto", "off":
+	default:
+		return errors.New("invalid LOG_JOURNAL in " + c.path)
+	}
+	switch c.ON_CHANGE {
+	case "", "refuse", "warn":
+	default:
+		return errors.New("invalid ON_CHANGE in " + c.path)
+	}
+	switch c.THEME {
+	case "", "auto", "light", "dark":
+	default:
+		return errors.New("invalid THEME in " + c.path)
+	}
+	switch c.SPOOL_FULL {
+	case "", "refuse", "evict":
+	default:
+		return errors.New("invalid SPOOL_FULL in " + c.path)
+	}
+	switch c.OFFLOAD {
+	case "", "nginx", "apache":
+	default:
+		return errors.New("invalid OFFLOAD in " + c.path)
+	}
+	c.OFFLOAD_PREFIX = strings.TrimRight(c.OFFLOAD_PREFIX, "/")
+	if c.allow, err = parseNets(c.ALLOW); err != nil {
+		return errors.New("invalid ALLOW in " + c.path)
+	}
+	if c.deny, err = parseNets(c.DENY); err != nil {
+		return errors.New("invalid DENY in " + c.path)
+	}
+	if c.trustedProxies, err = parseNets(c.TRUSTED_PROXIES); err != nil {
+		return errors.New("invalid TRUSTED_PROXIES in " + c.path)
+	}
+	switch c.HTTP2 {
+	case "", "on", "off", "h2c":
+	default:
+		return errors.New("invalid HTTP2 in " + c.path)
+	}
+	switch c.BIND_CLIENT {
+	case "", "ip", "subnet":
+	default:
+		return errors.New("invalid BIND_CLIENT in " + c.path)
+	}
+	switch c.S3_MODE {
+	case "", "redirect", "stream":
+	default:
+		return errors.New("invalid S3_MODE in " + c.path)
+	}
+	if len(c.S3_REGION) < 1 {
+		c.S3_REGION = "us-east-1"
+	}
+	if c.PPROF == PPROF_API && len(c.API_KEY) < 1 {
+		return errors.New("PPROF needs API_KEY in " + c.path)
+	}
+	if c.MAX_DOWNLOADS < 0 {
+		return errors.New("invalid MAX_DOWNLOADS in " + c.path)
+	}
+	if c.MAX_TOKEN_DOWNLOADS < 0 {
+		return errors.New("invalid MAX_TOKEN_DOWNLOADS in " + c.path)
+	}
+	if len(c.TRAP_BAN) > 0 {
+		c.trapBan, err = time.ParseDuration(c.TRAP_BAN)
+		if err != nil {
+			return errors.New("invalid TRAP_BAN in " + c.path)
+		}
+	}
+	if len(c.LOG_MAX_SIZE) > 0 {
+		c.logMaxSize, err = parseRate(c.LOG_MAX_SIZE)
+		if err != nil {
+			return errors.New("invalid LOG_MAX_SIZE in " + c.path)
+		}
+	}
+	if len(c.LOG_MAX_AGE) > 0 {
+		c.logMaxAge, err = time.ParseDuration(c.LOG_MAX_AGE)
+		if err != nil || c.logMaxAge <= 0 {
+			return errors.New("invalid LOG_MAX_AGE in " + c.path)
+		}
+	}
+	if err = c.parseLimits(); err != nil {
+		return err
+	}
+	if err = c.parseTLSPolicy(); err != nil {
+		return err
+	}
+	if err = c.loadClientCA(); err != nil {
+		return err
+	}
+	if err = c.checkUsers(); err != nil {
+		return err
+	}
+	if err = c.checkOIDC(); err != nil {
+		return err
+	}
+	if err = c.checkLDAP(); err != nil {
+		return err
+	}
+	if err = c.parseQuotas(); err != nil {
+		return err
+	}
+	if err = c.checkHooks(); err != nil {
+		return err
+	}
+	if err = c.checkPlugins(); err != nil {
+		return err
+	}
+	if err = c.checkSlack(); err != nil {
+		return err
+	}
+	if err = c.checkTelegram(); err != nil {
+		return err
+	}
+	if err = c.checkMatrix(); err != nil {
+		return err
+	}
+	if err = c.checkSMS(); err != nil {
+		return err
+	}
+	if err = c.checkMail(); err != nil {
+		return err
 	}
-	if len(cnf.BASE_ADDR) < 1 {
-		return errors.New("BASE_ADDR undefined in " + cnf.path)
+	if err = c.checkCDN(); err != nil {
+		return err
 	}
-	if len(cnf.CRT) > 0 {
-		if cnf.CRT[0] != '/' {
-			cnf.CRT = cpath + "/" + cnf.CRT
+	if len(c.RATE_LIMIT) > 0 {
+		c.rateLimit, err = parseRate(c.RATE_LIMIT)
+		if err != nil {
+			return errors.New("invalid RATE_LIMIT in " + c.path)
 		}
 	}
-	if len(cnf.KEY) > 0 {
-		if cnf.KEY[0] != '/' {
-			cnf.KEY = cpath + "/" + cnf.KEY
+	if len(c.UNCLAIMED) > 0 {
+		c.unclaimed, err = time.ParseDuration(c.UNCLAIMED)
+		if err != nil {
+			return errors.New("invalid UNCLAIMED in " + c.path)
 		}
 	}
 	return nil
 }
 
+// A flag that may be repeated or given a comma-separated list
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, strings.Split(v, ",")...)
+	return nil
+}
+
+// Parse flags found anywhere among args and return the remaining
+// positional arguments, so that flags may follow file names
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var rest []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return rest
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
+
 //----------------- main
 func main() {
+	args, err := parseConfigFlags(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	os.Args = args
 	if len(os.Args) < 2 {
-		fmt.Println(`
+		fmt.Print(`
         
     use:
     onetime config          Configure server
-    onetime serve           Serve onetime requests
-    onetime add path        Create onetime request for path
-    onetime ls              List existing requests
+    onetime serve [--daemon] [--pidfile file]
+                            Serve onetime requests
+    onetime stop|status|restart [--pidfile file]
+                            Stop, check or restart the server
+    onetime add [--unlink] [--spool] [--inline] [--name name] [--note text]
+                [--limit rate] [--allow net] [--country cc]
+                [--block-country cc] path...
+                            Create onetime request for each path
+    onetime add - [--name name]
+                            Create onetime request for stdin
+    onetime add --fetch url Create onetime request for a remote url
+    onetime send-sms [--note text] path number
+                            Create onetime request for path and text its
+                            link to a phone number, e.g. +33612345678
+    onetime paste [text]    Create onetime request for text or stdin
+    onetime secret [text]   Create display-once secret for text or stdin
+    onetime redirect url    Create onetime redirection to url
+    onetime ls [--user name] [--all]
+                            List existing requests
+    onetime info token      Show details about a request
     onetime del token       Delete onetime request
+    onetime renew token [d] Extend token validity by duration d
+    onetime trap [n]        Plant n honeypot tokens (default 1)
     onetime purge           Delete all expired tokens
+    onetime stats           Count requests and show usage against quotas
+    onetime verify receipt  Check the signature of a download receipt
+    onetime backup archive  Save configuration, tokens and spool to a
+                            .tar, .tar.gz or .tar.zst archive
+    onetime restore [--force] archive
+                            Restore a backup, on a new host
+    onetime import-db [--force] file
+                            Copy the tokens of a token DB file to TOKEN_DB,
+                            e.g. a PostgreSQL database
+    onetime testmail address
+                            Send a test mail through SMTP_SERVER
+    onetime service install|uninstall|start|stop|status [--name name]
+                            Run the server at boot on Windows
+    onetime doctor          Check the configuration and environment
+    onetime version         Show version and build information
+    onetime update [--check] [--force]
+                            Replace onetime with its latest release
+    onetime gencert [--ca] [--host name] [--days n] [--force]
+                            Create a certificate for BASE_ADDR in CRT/KEY
+    onetime genkey          Print a new key for encrypted settings
+    onetime encrypt [value] Encrypt a setting given or read from stdin
+    onetime audit [--token token] [--event event] [--since d] [--json]
+                            Show the audit journal and check its chain
+
+    Any command accepts -c file to use another configuration file, and
+    --base-addr url, --token-db file and --log-file file to override it.
 
 `)
 		return
 	}
 
-	err := readConfiguration()
-	if err != nil && os.Args[1] != "config" {
+	switch os.Args[1] {
+	case "version", "--version":
+		Version()
+		return
+	case "genkey":
+		fmt.Println(genKey())
+		return
+	case "encrypt":
+		if err = Encrypt(strings.Join(os.Args[2:], " ")); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	err = readConfiguration(&cnf)
+	if err != nil && os.Args[1] != "config" && os.Args[1] != "doctor" &&
+		os.Args[1] != "restore" {
 		fmt.Println(err)
 		return
 	}
+	defer waitNotifications()
 	ltok := make(LTokens)
 	switch os.Args[1] {
 	case "config":
 		setConfiguration()
 	case "serve", "server":
+		fs := flag.NewFlagSet("serve", flag.ExitOnError)
+		daemon := fs.Bool("daemon", false, "run in the background")
+		pidfile := fs.String("pidfile", "",
+			"file recording the process ID, PID_FILE if empty")
+		parseArgs(fs, os.Args[2:])
+		if *daemon && !isDaemon() {
+			if err = daemonize(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+		if name, perr := pidFile(*pidfile); perr == nil {
+			if err = writePidFile(name); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
 		Serve()
+	case "stop", "status", "restart":
+		fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+		pidfile := fs.String("pidfile", "",
+			"file recording the process ID, PID_FILE if empty")
+		parseArgs(fs, os.Args[2:])
+		name, err := pidFile(*pidfile)
+		if err == nil && os.Args[1] == "stop" {
+			err = StopServer(name)
+		} else if err == nil && os.Args[1] == "restart" {
+			err = RestartServer(name)
+		} else if err == nil {
+			err = ServerStatus(name)
+		}
+		if err != nil {
+			fmt.Println(err)
+			// LSB status code of a stopped program
+			os.Exit(3)
+		}
 	case "add", "create":
-		if len(os.Args) >= 3 {
+		var opt AddOptions
+		fs := flag.NewFlagSet("add", flag.ExitOnError)
+		fs.BoolVar(&opt.Unlink, "unlink", false,
+			"remove the file once the token expires")
+		fs.BoolVar(&opt.Spool, "spool", false,
+			"copy the file to the spool directory")
+		fs.StringVar(&opt.Name, "name", "",
+			"file name presented to the recipient")
+		fs.StringVar(&opt.Note, "note", "",
+			"message shown to the recipient")
+		fs.BoolVar(&opt.Inline, "inline", false,
+			"let the browser display the file")
+		fs.BoolVar(&opt.Fetch, "fetch", false,
+			"share a remote URL fetched by the server")
+		limit := fs.String("limit", "",
+			"download rate limit, e.g. 5MB/s")
+		fs.Var((*listFlag)(&opt.Allow), "allow",
+			"network allowed to download, e.g. 10.0.0.0/8")
+		fs.Var((*listFlag)(&opt.Countries), "country",
+			"country allowed to download, e.g. FR")
+		fs.Var((*listFlag)(&opt.DenyCountries), "block-country",
+			"country refused, e.g. RU")
+		args := parseArgs(fs, os.Args[2:])
+		opt.Owner = loginName()
+		if _, err = parseNets(opt.Allow); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if len(*limit) > 0 {
+			if opt.Limit, err = parseRate(*limit); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		if len(args) > 1 && len(opt.Name) > 0 {
+			fmt.Println("--name cannot be used with several files")
+			return
+		}
+		if len(args) >= 1 {
 			ltok.Load(cnf.TOKEN_DB)
-			ltok.Add(os.Args[2])
-			ltok.Save(cnf.TOKEN_DB)
+			base := ltok.clone()
+			var added []string
+			for _, arg := range args {
+				if ott := ltok.Add(arg, opt); len(ott) > 0 {
+					added = append(added, ott)
+				}
+			}
+			ltok.Commit(context.Background(), base)
+			if len(args) > 1 {
+				ltok.Summary(added)
+			}
 		}
 	case "ls", "list":
+		fs := flag.NewFlagSet("ls", flag.ExitOnError)
+		user := fs.String("user", cliUser(), "list the tokens of this user")
+		all := fs.Bool("all", false, "list the tokens of all users")
+		parseArgs(fs, os.Args[2:])
+		if *all {
+			*user = ""
+		}
 		ltok.Load(cnf.TOKEN_DB)
-		ltok.List()
-	case "del", "delete", "rm":
-		if len(os.Args) >= 2 {
+		ltok.List(*user)
+	case "info", "show":
+		if len(os.Args) >= 3 {
 			ltok.Load(cnf.TOKEN_DB)
+			if err = ltok.Info(os.Args[2]); err != nil {
+				fmt.Println(err)
+			}
+		}
+	case "del", "delete", "rm":
+		updateTokens(context.Background(), func(ltok LTokens) bool {
 			for i := 2; i < len(os.Args); i++ {
 				ltok.Del(os.Args[i])
 			}
-			ltok.Save(cnf.TOKEN_DB)
+			return len(os.Args) > 2
+		})
+	case "renew":
+		if len(os.Args) >= 3 {
+			var d time.Duration
+			if len(os.Args) >= 4 {
+				d, err = time.ParseDuration(os.Args[3])
+				if err != nil {
+					fmt.Println("invalid duration:", os.Args[3])
+					return
+				}
+			}
+			var until time.Time
+			updateTokens(context.Background(), func(ltok LTokens) bool {
+				err = ltok.Renew(os.Args[2], d)
+				until = ltok[os.Args[2]].ValidUntil()
+				return err == nil
+			})
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			journal("renew", os.Args[2], nil, isotime(until))
+			fmt.Printf("token %s valid until %s\n", os.Args[2],
+				isotime(until))
+		}
+	case "send-sms", "sms":
+		var opt AddOptions
+		fs := flag.NewFlagSet("send-sms", flag.ExitOnError)
+		fs.StringVar(&opt.Note, "note", "",
+			"message shown to the recipient")
+		args := parseArgs(fs, os.Args[2:])
+		opt.Owner = loginName()
+		if len(args) != 2 {
+			fmt.Println("use: onetime send-sms [--note text] path number")
+			return
+		}
+		if !smsEnabled() {
+			fmt.Println("no SMS_TWILIO_SID or SMS_GATEWAY in", cnf.path)
+			return
+		}
+		if !e164.MatchString(args[1]) {
+			fmt.Println("invalid phone number", args[1]+
+				", expecting e.g. +33612345678")
+			return
+		}
+		ltok.Load(cnf.TOKEN_DB)
+		base := ltok.clone()
+		ott := ltok.Add(args[0], opt)
+		if len(ott) < 1 {
+			return
+		}
+		ltok.Commit(context.Background(), base)
+		if err = ltok.SendSMS(ott, args[1]); err != nil {
+			fmt.Println(err)
+			fmt.Println("the link was not sent, token", ott, "is kept")
+			return
+		}
+		fmt.Println("link sent to", args[1])
+	case "paste":
+		var opt AddOptions
+		fs := flag.NewFlagSet("paste", flag.ExitOnError)
+		fs.StringVar(&opt.Name, "name", "",
+			"file name for the raw download")
+		fs.StringVar(&opt.Note, "note", "",
+			"message shown to the recipient")
+		args := parseArgs(fs, os.Args[2:])
+		opt.Owner = loginName()
+		var r io.Reader = os.Stdin
+		if len(args) > 0 {
+			r = strings.NewReader(strings.Join(args, " ") + "\n")
+		}
+		ltok.Load(cnf.TOKEN_DB)
+		base := ltok.clone()
+		if len(ltok.Paste(r, opt)) > 0 {
+			ltok.Commit(context.Background(), base)
+		}
+	case "secret":
+		var opt AddOptions
+		fs := flag.NewFlagSet("secret", flag.ExitOnError)
+		fs.StringVar(&opt.Note, "note", "",
+			"message shown to the recipient")
+		args := parseArgs(fs, os.Args[2:])
+		opt.Owner = loginName()
+		var r io.Reader = os.Stdin
+		if len(args) > 0 {
+			r = strings.NewReader(strings.Join(args, " "))
 		}
-	case "purge":
 		ltok.Load(cnf.TOKEN_DB)
-		ltok.Purge()
-		ltok.Save(cnf.TOKEN_DB)
+		base := ltok.clone()
+		if len(ltok.Secret(r, opt)) > 0 {
+			ltok.Commit(context.Background(), base)
+		}
+	case "redirect", "url":
+		if len(os.Args) >= 3 {
+			ltok.Load(cnf.TOKEN_DB)
+			base := ltok.clone()
+			if len(ltok.Redirect(os.Args[2], loginName())) > 0 {
+				ltok.Commit(context.Background(), base)
+			}
+		}
+	case "trap":
+		n := 1
+		if len(os.Args) >= 3 {
+			if n, err = strconv.Atoi(os.Args[2]); err != nil || n < 1 {
+				fmt.Println("invalid count:", os.Args[2])
+				return
+			}
+		}
+		ltok.Load(cnf.TOKEN_DB)
+		base := ltok.clone()
+		for i := 0; i < n; i++ {
+			ltok.Trap()
+		}
+		ltok.Commit(context.Background(), base)
+	case "backup":
+		if len(os.Args) < 3 {
+			fmt.Println("use: onetime backup archive.tar.gz")
+			return
+		}
+		if err = Backup(os.Args[2]); err != nil {
+			fmt.Println("backup failed:", err)
+			os.Exit(1)
+		}
+	case "restore":
+		fs := flag.NewFlagSet("restore", flag.ExitOnError)
+		force := fs.Bool("force", false, "replace existing tokens")
+		args := parseArgs(fs, os.Args[2:])
+		if len(args) < 1 {
+			fmt.Println("use: onetime restore [--force] archive.tar.gz")
+			return
+		}
+		if err = Restore(args[0], *force); err != nil {
+			fmt.Println("restore failed:", err)
+			os.Exit(1)
+		}
+	case "import-db":
+		fs := flag.NewFlagSet("import-db", flag.ExitOnError)
+		force := fs.Bool("force", false, "replace existing tokens")
+		args := parseArgs(fs, os.Args[2:])
+		if len(args) < 1 {
+			fmt.Println("use: onetime import-db [--force] token.db")
+			return
+		}
+		if err = ImportTokens(args[0], *force); err != nil {
+			fmt.Println("import failed:", err)
+			os.Exit(1)
+		}
+	case "testmail":
+		if len(os.Args) < 3 {
+			fmt.Println("use: onetime testmail address")
+			return
+		}
+		err = sendMail(os.Args[2:], "test", Mail{
+			Text: "This mail was sent by onetime testmail: mail works.",
+		})
+		if err != nil {
+			fmt.Println("cannot send mail:", err)
+			os.Exit(1)
+		}
+		fmt.Println("mail sent through", smtpAddr(&cnf))
+	case "stats":
+		ltok.Load(cnf.TOKEN_DB)
+		ltok.Stats()
+	case "purge":
+		updateTokens(context.Background(), func(ltok LTokens) bool {
+			ltok.Purge("")
+			return true
+		})
+	case "audit":
+		var opt AuditOptions
+		fs := flag.NewFlagSet("audit", flag.ExitOnError)
+		fs.StringVar(&opt.Token, "token", "",
+			"only show events of this token")
+		fs.StringVar(&opt.Event, "event", "",
+			"only show events of this type, e.g. serve")
+		fs.DurationVar(&opt.Since, "since", 0,
+			"only show events of the last duration, e.g. 24h")
+		fs.BoolVar(&opt.JSON, "json", false,
+			"print raw journal lines")
+		parseArgs(fs, os.Args[2:])
+		if err = Audit(opt); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "gencert":
+		var opt CertOptions
+		fs := flag.NewFlagSet("gencert", flag.ExitOnError)
+		fs.BoolVar(&opt.CA, "ca", false,
+			"sign with an internal CA, created next to CRT if needed")
+		fs.BoolVar(&opt.Force, "force", false,
+			"replace existing certificate and key files")
+		fs.Var((*listFlag)(&opt.Hosts), "host",
+			"more host names or addresses for the certificate")
+		fs.IntVar(&opt.Days, "days", CERT_DAYS,
+			"validity of the certificate in days")
+		parseArgs(fs, os.Args[2:])
+		if err = GenCert(opt); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "update":
+		var opt UpdateOptions
+		fs := flag.NewFlagSet("update", flag.ExitOnError)
+		fs.BoolVar(&opt.Check, "check", false,
+			"only tell whether an update is available")
+		fs.BoolVar(&opt.Force, "force", false,
+			"install even if the version is the same")
+		parseArgs(fs, os.Args[2:])
+		if err = Update(opt); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "service":
+		var opt ServiceOptions
+		fs := flag.NewFlagSet("service", flag.ExitOnError)
+		fs.StringVar(&opt.Name, "name", "onetime",
+			"name of the service")
+		args := parseArgs(fs, os.Args[2:])
+		action := ""
+		if len(args) > 0 {
+			action = args[0]
+		}
+		if err = Service(action, opt); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "doctor":
+		if err = Doctor(err); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "verify":
+		if len(os.Args) >= 3 {
+			if err = Verify(os.Args[2]); err != nil {
+				fmt.Println(err)
+			}
+		}
 	}
 	return
 }
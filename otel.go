@@ -0,0 +1,281 @@
+// OpenTelemetry tracing.
+// With OTLP_ENDPOINT set, e.g. "http://collector:4318", every HTTP request
+// is traced as a server span, with child spans for token DB reads and
+// writes, and spans are sent in batches to the collector with OTLP over
+// HTTP in JSON encoding. OTLP_HEADERS adds headers to export requests,
+// typically for authentication, and SERVICE_NAME names the service
+// ("onetime" by default). Incoming W3C traceparent headers are honored so
+// that traces started by a front proxy continue here. Log records of a
+// traced request carry its trace ID.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OTLP_BATCH    = 256             // Spans sent per export request
+	OTLP_INTERVAL = 5 * time.Second // Longest wait before exporting
+	OTLP_QUEUE    = 4096            // Spans waiting for export, then dropped
+)
+
+// Span kinds and status codes of the OTLP protocol
+const (
+	SPAN_INTERNAL = 1
+	SPAN_SERVER   = 2
+	SPAN_ERROR    = 2
+)
+
+// A traced operation
+type span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   map[string]interface{}
+	failed  string // Error message, span succeeded if empty
+}
+
+// Key of the current span in request contexts
+type spanKey struct{}
+
+// Spans waiting for export, nil when tracing is disabled
+var spans chan *span
+
+// Start a span, child of the span in ctx if any, and return a context
+// holding it
+func startSpan(ctx context.Context, name string, kind int) (context.Context,
+	*span) {
+	s := &span{name: name, kind: kind, start: time.Now(),
+		attrs: make(map[string]interface{})}
+	if p, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID, s.parent = p.traceID, p.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Finish a span and queue it for export
+func (s *span) End() {
+	s.end = time.Now()
+	select {
+	case spans <- s:
+	default:
+		// Collector too slow or unreachable
+	}
+}
+
+// Return the trace ID of the span in ctx, "" if none
+func traceID(ctx context.Context) string {
+	if s, ok := ctx.Value(spanKey{}).(*span); ok {
+		return hex.EncodeToString(s.traceID[:])
+	}
+	return ""
+}
+
+// Return a context continuing the trace of a W3C traceparent header
+func remoteParent(ctx context.Context, header string) context.Context {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 ||
+		len(parts[2]) != 16 {
+		return ctx
+	}
+	p := &span{}
+	if _, err := hex.Decode(p.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(p.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, p)
+}
+
+// Return the route of a request path, used to name its span
+func spanRoute(p string) string {
+	for _, prefix := range []string{"/d/", "/t/", "/s/", "/api/", "/static/"} {
+		if strings.HasPrefix(p, prefix) {
+			return prefix
+		}
+	}
+	if p == "/favicon.ico" || p == "/robots.txt" || p == "/logo" {
+		return p
+	}
+	return "/"
+}
+
+// Trace every request served by next
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := remoteParent(req.Context(), req.Header.Get("Traceparent"))
+		ctx, s := startSpan(ctx, req.Method+" "+spanRoute(req.URL.Path),
+			SPAN_SERVER)
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, req.WithContext(ctx))
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+		s.attrs["http.request.method"] = req.Method
+		s.attrs["url.path"] = req.URL.Path
+		s.attrs["http.route"] = spanRoute(req.URL.Path)
+		s.attrs["client.address"] = clientHost(req)
+		s.attrs["user_agent.original"] = req.UserAgent()
+		s.attrs["http.response.status_code"] = aw.status
+		s.attrs["http.response.body.size"] = aw.bytes
+		if id := requestID(req); len(id) > 0 {
+			s.attrs["onetime.request_id"] = id
+		}
+		if aw.status >= 500 {
+			s.failed = http.StatusText(aw.status)
+		}
+		s.End()
+	})
+}
+
+// Read the token DB within the trace of ctx
+func (ltok LTokens) LoadContext(ctx context.Context, fname string) {
+	if spans == nil {
+		ltok.Load(fname)
+		return
+	}
+	_, s := startSpan(ctx, "tokens.load", SPAN_INTERNAL)
+	ltok.Load(fname)
+	s.attrs["onetime.tokens"] = len(ltok)
+	s.End()
+}
+
+// Write the token DB within the trace of ctx
+func (ltok LTokens) SaveContext(ctx context.Context, fname string) error {
+	if spans == nil {
+		return ltok.Save(fname)
+	}
+	_, s := startSpan(ctx, "tokens.save", SPAN_INTERNAL)
+	err := ltok.Save(fname)
+	s.attrs["onetime.tokens"] = len(ltok)
+	if err != nil {
+		s.failed = err.Error()
+	}
+	s.End()
+	return err
+}
+
+// Return an attribute in OTLP JSON form
+func otlpAttr(k string, v interface{}) map[string]interface{} {
+	var val map[string]interface{}
+	switch x := v.(type) {
+	case int:
+		val = map[string]interface{}{"intValue": strconv.Itoa(x)}
+	case int64:
+		val = map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+	case bool:
+		val = map[string]interface{}{"boolValue": x}
+	default:
+		val = map[string]interface{}{"stringValue": x}
+	}
+	return map[string]interface{}{"key": k, "value": val}
+}
+
+// Send a batch of spans to the collector
+func exportSpans(batch []*span) error {
+	var list []map[string]interface{}
+	for _, s := range batch {
+		attrs := []map[string]interface{}{}
+		for k, v := range s.attrs {
+			attrs = append(attrs, otlpAttr(k, v))
+		}
+		j := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attrs,
+		}
+		if s.parent != [8]byte{} {
+			j["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if len(s.failed) > 0 {
+			j["status"] = map[string]interface{}{
+				"code": SPAN_ERROR, "message": s.failed}
+		}
+		list = append(list, j)
+	}
+	service := cnf.SERVICE_NAME
+	if len(service) < 1 {
+		service = "onetime"
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{
+					otlpAttr("service.name", service),
+				},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "onetime"},
+				"spans": list,
+			}},
+		}},
+	})
+	req, err := http.NewRequest("POST",
+		strings.TrimRight(cnf.OTLP_ENDPOINT, "/")+"/v1/traces",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range cnf.OTLP_HEADERS {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("collector replied " + resp.Status)
+	}
+	return nil
+}
+
+// Start exporting spans to OTLP_ENDPOINT
+func startTracing() {
+	spans = make(chan *span, OTLP_QUEUE)
+	go func() {
+		tick := time.NewTicker(OTLP_INTERVAL)
+		var batch []*span
+		for {
+			select {
+			case s := <-spans:
+				batch = append(batch, s)
+				if len(batch) < OTLP_BATCH {
+					continue
+				}
+			case <-tick.C:
+				if len(batch) < 1 {
+					continue
+				}
+			}
+			if err := exportSpans(batch); err != nil {
+				slog.Warn("OTLP", "spans", len(batch), "err", err)
+			}
+			batch = nil
+		}
+	}()
+}
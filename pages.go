@@ -0,0 +1,179 @@
+// Web pages sent to recipients.
+// Pages are rendered with html/template from templates embedded in the
+// executable, so all values are escaped according to their context.
+// Setting TEMPLATE_DIR in the configuration replaces any of them by the
+// files with the same name found in that directory. Override files may
+// also just redefine one of the blocks declared by the default templates
+// (style, header, footer). Pages only reference assets served by onetime
+// itself, so recipient visits never leak to third parties.
+
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"regexp"
+)
+
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
+
+// Style sheets and other assets served under /static/
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+// Parsed page templates, set by loadTemplates
+var pages *template.Template
+
+// Deployment branding, from the configuration
+type Branding struct {
+	Title      string // Organization name shown in headers and titles
+	Logo       bool   // A logo is available at /logo
+	Background string // Page background color
+	Accent     string // Color of the main box and links
+	Footer     string // Text shown at the bottom of all pages
+	Theme      string // Forced theme, "light" or "dark", empty for auto
+}
+
+// Accept CSS colors given as #rgb, #rrggbb or plain names
+var cssColor = regexp.MustCompile(`^(#[0-9a-fA-F]{3}|#[0-9a-fA-F]{6}|[a-zA-Z]+)$`)
+
+// Return the branding configured in onetime.json, with default colors
+func brand() Branding {
+	b := Branding{
+		Title:      cnf.BRAND_TITLE,
+		Logo:       len(cnf.BRAND_LOGO) > 0,
+		Background: "#9999ff",
+		Accent:     "#6666cc",
+		Footer:     cnf.BRAND_FOOTER,
+	}
+	if cssColor.MatchString(cnf.BRAND_BACKGROUND) {
+		b.Background = cnf.BRAND_BACKGROUND
+	}
+	if cssColor.MatchString(cnf.BRAND_ACCENT) {
+		b.Accent = cnf.BRAND_ACCENT
+	}
+	switch cnf.THEME {
+	case "light", "dark":
+		b.Theme = cnf.THEME
+	}
+	return b
+}
+
+// Return a handler serving the embedded static assets under /static/
+func Static() http.Handler {
+	sub, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		panic(err)
+	}
+	files := http.StripPrefix("/static/", http.FileServer(http.FS(sub)))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		files.ServeHTTP(w, req)
+	})
+}
+
+// Send the logo configured in BRAND_LOGO
+func Logo(w http.ResponseWriter, req *http.Request) {
+	if len(cnf.BRAND_LOGO) < 1 {
+		notFound(w, req)
+		return
+	}
+	http.ServeFile(w, req, cnf.BRAND_LOGO)
+}
+
+// Data passed to page templates
+type Page struct {
+	Title    string // Page title
+	Kind     string // Token kind, one of the KIND_ constants
+	Token    string // One-time token, used to build links
+	Name     string // File name presented to the recipient
+	MimeType string // Content type of the file
+	Size     string // Pretty-printed file size
+	Sha256   string // Hex-encoded checksum of the file
+	Note     string // Message left by the sender
+	Until    string // End of validity, empty until activated
+	Validity string // Validity once clicked, e.g. "4 hours"
+	Preview  bool   // An image preview is available at /t/Token
+	Text     string // Pasted text or secret, shown verbatim
+	// Rendered Markdown document. Markdown() escapes its input so the
+	// result can be trusted as HTML.
+	Document template.HTML
+	Status   int         // HTTP status of error pages
+	Message  string      // Explanation shown on error pages
+	Rows     []StatusRow // Token details shown on status pages
+	Events   []StatusRow // Downloads shown on status pages
+	Request  string      // Request ID shown on error pages
+	Links    []AdminRow  // Links listed on the administration page
+	Activity []StatusRow // Recent events shown there
+	CSRF     string      // Form token of the administration session
+	User     string      // User logged in there, "" for the administrator
+	SSO      bool        // Offer single sign-on on the login page
+	Issue    bool        // User may issue personal API keys
+	Admin    bool        // User may share paths on the server
+	Key      string      // API key just issued, shown once
+	Brand    Branding
+}
+
+// Load embedded templates, then operator templates from TEMPLATE_DIR
+func loadTemplates() error {
+	t := template.New("pages").Funcs(template.FuncMap{"T": tr})
+	t, err := t.ParseFS(embeddedTemplates, "templates/*.html")
+	if err != nil {
+		return err
+	}
+	if len(cnf.TEMPLATE_DIR) > 0 {
+		files, err := filepath.Glob(filepath.Join(cnf.TEMPLATE_DIR, "*.html"))
+		if err != nil {
+			return err
+		}
+		if len(files) > 0 {
+			if t, err = t.ParseFiles(files...); err != nil {
+				return err
+			}
+		}
+	}
+	pages = t
+	return nil
+}
+
+// Send a page rendered from the named template
+func render(w http.ResponseWriter, name string, p Page) {
+	renderStatus(w, http.StatusOK, name, p)
+}
+
+// Send a page rendered from the named template with an HTTP status code
+func renderStatus(w http.ResponseWriter, code int, name string, p Page) {
+	p.Brand = brand()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	if err := pages.ExecuteTemplate(w, name, p); err != nil {
+		slog.Error("TEMPLATE", "name", name, "err", err)
+	}
+}
+
+// Send an error page
+func renderError(w http.ResponseWriter, code int, title, msg string) {
+	renderStatus(w, code, "error.html", Page{
+		Title:   title,
+		Status:  code,
+		Message: msg,
+		Request: w.Header().Get("X-Request-Id"),
+	})
+}
+
+// Send the error page for links that do not exist
+func notFound(w http.ResponseWriter, req *http.Request) {
+	renderError(w, http.StatusNotFound, tr("not_found"),
+		tr("not_found_message"))
+}
+
+// Send the error page for links that have been used or have expired
+func gone(w http.ResponseWriter, req *http.Request) {
+	renderError(w, http.StatusGone, tr("gone"), tr("gone_message"))
+}
@@ -0,0 +1,213 @@
+// Plugins.
+// Third parties add integrations without forking onetime by declaring
+// plugins in PLUGINS: programs that provide notifiers, told about every
+// token event, scanners, checking uploaded files next to SCAN_CLAMD and
+// SCAN_COMMAND, or a token store, see pluginstore.go:
+//
+//	"PLUGINS": [{"NAME": "teams", "COMMAND": ["/usr/lib/onetime/teams"],
+//	             "KINDS": ["notifier"]}]
+//
+// onetime is built from the standard library alone, which rules out
+// hashicorp/go-plugin and WASM runtimes: a plugin is any executable,
+// started for each call with one JSON request on its standard input and
+// answering one JSON document on its standard output.
+//
+//	{"kind": "notify", "event": {"event": "created", "token": ...}}
+//	{"kind": "scan", "path": "/var/spool/onetime/x1y2z3/file.zip"}
+//
+// Notifiers answer {} or {"error": "..."}, scanners {"infected": "name"}
+// when they find something. Exiting with a failure is an error too.
+// Plugins keep tokens, not files: spooled files, S3 buckets and remote
+// URLs are still served by onetime, as streaming downloads through plugin
+// processes would need a protocol of its own.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PLUGIN_TIMEOUT = time.Minute
+
+// A plugin declared in the configuration
+type Plugin struct {
+	NAME    string
+	COMMAND []string
+	KINDS   []string // "notifier", "scanner", "store"
+}
+
+// Told about token events
+type Notifier interface {
+	Notify(ev Event) error
+}
+
+// Checks files, returning the name of what it found, if anything
+type Scanner interface {
+	Scan(path string) (string, error)
+}
+
+// Request sent to a plugin
+type pluginRequest struct {
+	Kind  string `json:"kind"`
+	Event *Event `json:"event,omitempty"`
+	Path  string `json:"path,omitempty"`
+	// Saved by a store
+	Tokens   LTokens `json:"tokens,omitempty"`
+	Version  int     `json:"version,omitempty"`
+	Revision string  `json:"revision,omitempty"`
+}
+
+// Answer of a plugin
+type pluginReply struct {
+	Infected string `json:"infected,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Loaded from a store
+	Tokens   map[string]json.RawMessage `json:"tokens,omitempty"`
+	Version  int                        `json:"version,omitempty"`
+	Revision string                     `json:"revision,omitempty"`
+	Conflict bool                       `json:"conflict,omitempty"`
+}
+
+// Check PLUGINS
+func (c *Config) checkPlugins() error {
+	for _, p := range c.PLUGINS {
+		if len(p.NAME) < 1 || len(p.COMMAND) < 1 || len(p.COMMAND[0]) < 1 {
+			return errors.New("plugin without NAME or COMMAND in " + c.path)
+		}
+		for _, k := range p.KINDS {
+			if k != "notifier" && k != "scanner" && k != "store" {
+				return errors.New("unknown kind " + k + " of plugin " +
+					p.NAME + " in " + c.path)
+			}
+		}
+	}
+	if isPluginStore(c.TOKEN_DB) {
+		name := strings.TrimPrefix(c.TOKEN_DB, PLUGIN_STORE_PREFIX)
+		for _, p := range c.PLUGINS {
+			if p.NAME == name && p.provides("store") {
+				return nil
+			}
+		}
+		return errors.New("TOKEN_DB names no store plugin of PLUGINS in " +
+			c.path)
+	}
+	return nil
+}
+
+// Tell whether the plugin provides kind
+func (p Plugin) provides(kind string) bool {
+	for _, k := range p.KINDS {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Run the plugin with a request and decode its answer
+func (p Plugin) call(req pluginRequest, timeout time.Duration) (
+	pluginReply, error) {
+	var reply pluginReply
+	in, _ := json.Marshal(req)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, p.COMMAND[0], p.COMMAND[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return reply, errors.New("plugin " + p.NAME + ": " + err.Error() +
+			" " + strings.TrimSpace(stderr.String()))
+	}
+	if err = json.Unmarshal(out, &reply); err != nil {
+		return reply, errors.New("plugin " + p.NAME + ": invalid answer")
+	}
+	if len(reply.Error) > 0 {
+		return reply, errors.New("plugin " + p.NAME + ": " + reply.Error)
+	}
+	return reply, nil
+}
+
+// Send an event to the plugin
+func (p Plugin) Notify(ev Event) error {
+	_, err := p.call(pluginRequest{Kind: "notify", Event: &ev},
+		PLUGIN_TIMEOUT)
+	return err
+}
+
+// Have the plugin check a file
+func (p Plugin) Scan(path string) (string, error) {
+	reply, err := p.call(pluginRequest{Kind: "scan", Path: path},
+		SCAN_TIMEOUT)
+	return reply.Infected, err
+}
+
+// Return the notifiers to tell about events, built-in ones first
+func notifiers() []Notifier {
+	var n []Notifier
+	if len(cnf.SLACK_WEBHOOK) > 0 {
+		n = append(n, slack{})
+	}
+	if len(cnf.TELEGRAM_TOKEN) > 0 {
+		n = append(n, telegram{})
+	}
+	if len(cnf.MATRIX_ROOM) > 0 {
+		n = append(n, matrix{})
+	}
+	for _, p := range cnf.PLUGINS {
+		if p.provides("notifier") {
+			n = append(n, p)
+		}
+	}
+	return n
+}
+
+// Return the scanners of plugins
+func scanners() []Scanner {
+	var s []Scanner
+	for _, p := range cnf.PLUGINS {
+		if p.provides("scanner") {
+			s = append(s, p)
+		}
+	}
+	return s
+}
+
+// Notifications in progress
+var notifying sync.WaitGroup
+
+// Tell all notifiers about an event, in the background
+func notify(ev Event) {
+	for _, n := range notifiers() {
+		notifying.Add(1)
+		go func(n Notifier) {
+			defer notifying.Done()
+			if err := n.Notify(ev); err != nil {
+				slog.Error("NOTIFY", "event", ev.Event, "token", ev.Token,
+					"err", err)
+			}
+		}(n)
+	}
+}
+
+// Wait for notifications in progress, before the command line exits
+func waitNotifications() {
+	done := make(chan struct{})
+	go func() {
+		notifying.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(PLUGIN_TIMEOUT):
+	}
+}
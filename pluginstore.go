@@ -0,0 +1,129 @@
+// Plugin token store.
+// With TOKEN_DB set to "plugin:NAME", tokens are kept by the plugin NAME
+// of PLUGINS, of kind "store", which implements the Store interface for
+// a database onetime has no client for:
+//
+//	"TOKEN_DB": "plugin:redis",
+//	"PLUGINS": [{"NAME": "redis", "COMMAND": ["/usr/lib/onetime/redis"],
+//	             "KINDS": ["store"]}]
+//
+// Like other plugins it is started for each call, with one of two
+// requests:
+//
+//	{"kind": "load"}
+//	{"kind": "save", "tokens": {...}, "version": 2, "revision": "41"}
+//
+// load answers all tokens, the version of their format and a revision,
+// any string changing with every save:
+//
+//	{"tokens": {"x1y2z3w4": {...}}, "version": 2, "revision": "41"}
+//
+// save replaces all tokens, only if the revision is still the one loaded:
+// it answers {"conflict": true} otherwise, and onetime loads the tokens
+// again and reapplies its change, up to PLUGIN_STORE_TRIES times. A token
+// is then claimed by one server only, as with the other stores. Tokens of
+// an older version are migrated when loaded. Spooled files stay on disk.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PLUGIN_STORE_PREFIX = "plugin:"
+	PLUGIN_STORE_TRIES  = 10                     // Saves lost to others
+	PLUGIN_STORE_PAUSE  = 100 * time.Millisecond // Between tries
+)
+
+// Tell whether a TOKEN_DB names a store plugin
+func isPluginStore(name string) bool {
+	return strings.HasPrefix(name, PLUGIN_STORE_PREFIX)
+}
+
+// Changes of this server wait for each other rather than conflict
+var pluginStoreMutex sync.Mutex
+
+// Tokens kept by a plugin
+type pluginStore struct {
+	Plugin
+}
+
+// Return the store of TOKEN_DB "plugin:NAME"
+func openPluginStore(name string) (Store, error) {
+	pname := strings.TrimPrefix(name, PLUGIN_STORE_PREFIX)
+	for _, p := range cnf.PLUGINS {
+		if p.NAME == pname && p.provides("store") {
+			return pluginStore{p}, nil
+		}
+	}
+	return nil, errors.New("no store plugin " + pname + " in PLUGINS")
+}
+
+// Load the tokens with the revision of the store
+func (p pluginStore) load() (LTokens, string, error) {
+	reply, err := p.call(pluginRequest{Kind: "load"}, PLUGIN_TIMEOUT)
+	if err != nil {
+		return nil, "", err
+	}
+	if reply.Version == 0 {
+		reply.Version = DB_VERSION
+	}
+	if reply.Tokens == nil {
+		reply.Tokens = map[string]json.RawMessage{}
+	}
+	ltok, err := tokensOf(reply.Tokens, reply.Version)
+	if err != nil {
+		return nil, "", errors.New("plugin " + p.NAME + ": " + err.Error())
+	}
+	return ltok, reply.Revision, nil
+}
+
+func (p pluginStore) Load(ctx context.Context) (LTokens, error) {
+	ltok, _, err := p.load()
+	return ltok, err
+}
+
+func (p pluginStore) Update(ctx context.Context, change func(LTokens) bool) error {
+	pluginStoreMutex.Lock()
+	defer pluginStoreMutex.Unlock()
+	for try := 0; try < PLUGIN_STORE_TRIES; try++ {
+		ltok, revision, err := p.load()
+		if err != nil {
+			return err
+		}
+		if !change(ltok) {
+			return nil
+		}
+		reply, err := p.call(pluginRequest{Kind: "save", Tokens: ltok,
+			Version: DB_VERSION, Revision: revision}, PLUGIN_TIMEOUT)
+		if err != nil || !reply.Conflict {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(PLUGIN_STORE_PAUSE):
+		}
+	}
+	return errors.New("plugin " + p.NAME + ": tokens changed by others " +
+		"on every try")
+}
+
+func (p pluginStore) UpdateToken(ctx context.Context, ott string,
+	change func(*Token) bool) (Token, bool, error) {
+	return updateStoreToken(ctx, p, ott, change)
+}
+
+func (p pluginStore) Claim(ctx context.Context, ott string) (Token, bool, error) {
+	return claimStoreToken(ctx, p, ott)
+}
+
+func (p pluginStore) Commit(ctx context.Context, ltok, base LTokens) error {
+	return commitStore(ctx, p, ltok, base)
+}
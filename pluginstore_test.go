@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// Contents of the store kept by the test plugin
+type testStoreDB struct {
+	Tokens   map[string]json.RawMessage `json:"tokens"`
+	Revision string                     `json:"revision"`
+}
+
+// The test binary as a store plugin, keeping tokens in the file named by
+// ONETIME_TEST_STORE
+func TestHelperStore(t *testing.T) {
+	db := os.Getenv("ONETIME_TEST_STORE")
+	if len(db) < 1 {
+		return
+	}
+	var req struct {
+		pluginRequest
+		Tokens map[string]json.RawMessage `json:"tokens"`
+	}
+	json.NewDecoder(os.Stdin).Decode(&req)
+	var cur testStoreDB
+	if js, err := os.ReadFile(db); err == nil {
+		json.Unmarshal(js, &cur)
+	}
+	reply := map[string]any{}
+	switch {
+	case req.Kind == "load":
+		reply["tokens"], reply["revision"] = cur.Tokens, cur.Revision
+	case req.Revision != cur.Revision:
+		reply["conflict"] = true
+	default:
+		n, _ := strconv.Atoi(cur.Revision)
+		js, _ := json.Marshal(testStoreDB{req.Tokens, strconv.Itoa(n + 1)})
+		os.WriteFile(db, js, 0600)
+	}
+	json.NewEncoder(os.Stdout).Encode(reply)
+	os.Exit(0)
+}
+
+func TestPluginStore(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "store.json")
+	t.Setenv("ONETIME_TEST_STORE", db)
+	saved := cnf.PLUGINS
+	cnf.PLUGINS = []Plugin{{NAME: "test", KINDS: []string{"store"},
+		COMMAND: []string{os.Args[0], "-test.run=^TestHelperStore$"}}}
+	t.Cleanup(func() { cnf.PLUGINS = saved })
+	if _, err := openStore("plugin:other"); err == nil {
+		t.Error("no error for a plugin missing from PLUGINS")
+	}
+	st, err := openStore("plugin:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = st.Update(ctx, func(ltok LTokens) bool {
+		ltok["aaaa1111"] = Token{Path: "/a.txt"}
+		ltok["bbbb2222"] = Token{Path: "/b.txt"}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another server claims bbbb2222 while this one changes aaaa1111
+	tries := 0
+	tok, found, err := st.UpdateToken(ctx, "aaaa1111", func(tok *Token) bool {
+		if tries++; tries == 1 {
+			p := st.(pluginStore)
+			ltok, revision, err := p.load()
+			delete(ltok, "bbbb2222")
+			if err == nil {
+				_, err = p.call(pluginRequest{Kind: "save", Tokens: ltok,
+					Revision: revision}, PLUGIN_TIMEOUT)
+			}
+			if err != nil {
+				t.Error("claim by another server:", err)
+			}
+		}
+		tok.Path = "/c.txt"
+		return true
+	})
+	if err != nil || !found || tok.Path != "/c.txt" {
+		t.Fatalf("update: %v, %v, %v", tok, found, err)
+	}
+	if tries != 2 {
+		t.Errorf("change applied %d times, want 2 after a conflict", tries)
+	}
+	ltok, err := st.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ltok) != 1 || ltok["aaaa1111"].Path != "/c.txt" {
+		t.Errorf("tokens %v, want aaaa1111 changed and bbbb2222 claimed",
+			ltok)
+	}
+	if _, found, _ = st.Claim(ctx, "bbbb2222"); found {
+		t.Error("bbbb2222 claimed twice")
+	}
+}
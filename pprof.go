@@ -0,0 +1,60 @@
+// Profiling.
+// PPROF exposes the Go profiler to study memory and CPU use, e.g. while
+// many large downloads are being served. Set to "api", profiles are served
+// on the main listener under /debug/pprof/ to requests carrying API_KEY:
+//
+//	curl -H "Authorization: Bearer $KEY" https://host/debug/pprof/heap
+//
+// Set to an address such as "127.0.0.1:6060", they are served without
+// authentication on a separate plain HTTP listener, to be kept private.
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+)
+
+const PPROF_API = "api"
+
+// Return a mux serving profiles under /debug/pprof/
+func pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// Serve profiles to requests carrying API_KEY
+func profiles() http.HandlerFunc {
+	mux := pprofMux()
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !apiAuthorized(req) {
+			reqLog(req).Warn("DENIED")
+			failure(req, "apikey")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		reqLog(req).Info("PPROF")
+		mux.ServeHTTP(w, req)
+	}
+}
+
+// Make profiles available as configured by PPROF
+func startPprof(mux *http.ServeMux) {
+	switch cnf.PPROF {
+	case "":
+	case PPROF_API:
+		mux.HandleFunc("/debug/pprof/", requireClientCert(profiles()))
+	default:
+		go func() {
+			slog.Info("PPROF", "addr", cnf.PPROF)
+			err := http.ListenAndServe(cnf.PPROF, pprofMux())
+			slog.Error("PPROF", "addr", cnf.PPROF, "err", err)
+		}()
+	}
+}
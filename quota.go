@@ -0,0 +1,275 @@
+// Per-user quotas.
+// QUOTAS limits what each user may keep shared at once: TOKENS active
+// (unexpired) tokens, SPOOL bytes of files in the spool directory and
+// FILE bytes per file, unlimited if zero or empty. Limits apply by owner
+// name, USERS, single sign-on and directory accounts alike, and to the
+// command line under the login name of whoever runs it; "*" applies to
+// users without their own entry:
+//
+//	"QUOTAS": {"*": {"TOKENS": 20, "SPOOL": "5GB", "FILE": "1GB"},
+//	           "alice": {"TOKENS": 100}}
+//
+// The administrator (API_KEY, ADMIN_PASSWORD) is never limited. Uploads
+// from the administration pages stop as soon as they exceed what is left,
+// rather than filling the spool first. onetime stats shows usage against
+// the quotas.
+// SPOOL_QUOTA caps the spool directory as a whole, for everybody. When
+// full, new spooled files are refused, or with SPOOL_FULL "evict" the
+// files of expired tokens are removed first, oldest first, as onetime
+// purge would.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Limits of a user, none if zero
+type Quota struct {
+	TOKENS int    // Active tokens
+	SPOOL  string // Total size of spooled files, e.g. "5GB"
+	FILE   string // Size of a single file
+	spool  int64
+	file   int64
+}
+
+// Parse the sizes of QUOTAS and SPOOL_QUOTA
+func (c *Config) parseQuotas() error {
+	c.spoolQuota = 0
+	if len(c.SPOOL_QUOTA) > 0 {
+		var err error
+		if c.spoolQuota, err = parseRate(c.SPOOL_QUOTA); err != nil {
+			return errors.New("invalid SPOOL_QUOTA in " + c.path)
+		}
+	}
+	for name, q := range c.QUOTAS {
+		var err error
+		if len(q.SPOOL) > 0 {
+			if q.spool, err = parseRate(q.SPOOL); err != nil {
+				return errors.New("invalid SPOOL quota of " + name + " in " +
+					c.path)
+			}
+		}
+		if len(q.FILE) > 0 {
+			if q.file, err = parseRate(q.FILE); err != nil {
+				return errors.New("invalid FILE quota of " + name + " in " +
+					c.path)
+			}
+		}
+		if q.TOKENS < 0 {
+			return errors.New("invalid TOKENS quota of " + name + " in " +
+				c.path)
+		}
+		c.QUOTAS[name] = q
+	}
+	return nil
+}
+
+// Return the quota of user, false if unlimited
+func userQuota(user string) (Quota, bool) {
+	if len(user) < 1 {
+		return Quota{}, false
+	}
+	if q, ok := cnf.QUOTAS[user]; ok {
+		return q, true
+	}
+	q, ok := cnf.QUOTAS["*"]
+	return q, ok
+}
+
+// Return the number of active tokens of user and the size of their
+// spooled files
+func (ltok LTokens) usage(user string) (int, int64) {
+	now := time.Now()
+	tokens, spooled := 0, int64(0)
+	for _, tok := range ltok {
+		if tok.Owner != user || tok.Kind == KIND_TRAP || tok.Expired(now) {
+			continue
+		}
+		tokens++
+		if tok.Spooled {
+			spooled += tok.Size
+		}
+	}
+	return tokens, spooled
+}
+
+// Return the size of all spooled files, and of those of expired tokens
+func (ltok LTokens) spoolUsage() (int64, int64) {
+	now := time.Now()
+	var used, expired int64
+	for _, tok := range ltok {
+		if !tok.Spooled {
+			continue
+		}
+		used += tok.Size
+		if tok.Expired(now) {
+			expired += tok.Size
+		}
+	}
+	return used, expired
+}
+
+// Make room for size more bytes in the spool, evicting the files of
+// expired tokens if SPOOL_FULL allows
+func (ltok LTokens) spoolRoom(size int64) error {
+	if cnf.spoolQuota <= 0 {
+		return nil
+	}
+	used, expired := ltok.spoolUsage()
+	if used+size <= cnf.spoolQuota {
+		return nil
+	}
+	if cnf.SPOOL_FULL != "evict" || used-expired+size > cnf.spoolQuota {
+		return errors.New("spool full: " + prettySize(max(cnf.spoolQuota-used,
+			0)) + " bytes left of " + cnf.SPOOL_QUOTA)
+	}
+	now := time.Now()
+	var evict []string
+	for ott, tok := range ltok {
+		if tok.Spooled && tok.Expired(now) {
+			evict = append(evict, ott)
+		}
+	}
+	sort.Slice(evict, func(i, j int) bool {
+		return ltok[evict[i]].Created.Before(ltok[evict[j]].Created)
+	})
+	for _, ott := range evict {
+		if used+size <= cnf.spoolQuota {
+			break
+		}
+		used -= ltok[ott].Size
+		slog.Info("EVICT", "token", ott, "bytes", ltok[ott].Size)
+		ltok.remove(ott, "evict")
+	}
+	return nil
+}
+
+// Check that user may create one more token for a file of size bytes,
+// kept in the spool directory if spooled
+func (ltok LTokens) checkQuota(user string, size int64, spooled bool) error {
+	if spooled {
+		if err := ltok.spoolRoom(size); err != nil {
+			return err
+		}
+	}
+	q, ok := userQuota(user)
+	if !ok {
+		return nil
+	}
+	tokens, used := ltok.usage(user)
+	if q.TOKENS > 0 && tokens >= q.TOKENS {
+		return errors.New("quota exceeded: " + strconv.Itoa(q.TOKENS) +
+			" active tokens at most for " + user)
+	}
+	if q.file > 0 && size > q.file {
+		return errors.New("quota exceeded: files of " + q.FILE +
+			" at most for " + user)
+	}
+	if q.spool > 0 && spooled && used+size > q.spool {
+		return errors.New("quota exceeded: " + prettySize(q.spool-used) +
+			" bytes left in the spool for " + user)
+	}
+	return nil
+}
+
+// Return how many bytes user may still spool in a single file, -1 if
+// unlimited
+func (ltok LTokens) quotaRoom(user string) int64 {
+	room := int64(-1)
+	if cnf.spoolQuota > 0 {
+		used, expired := ltok.spoolUsage()
+		if cnf.SPOOL_FULL == "evict" {
+			used -= expired
+		}
+		room = max(cnf.spoolQuota-used, 0)
+	}
+	q, ok := userQuota(user)
+	if !ok {
+		return room
+	}
+	if q.file > 0 && (room < 0 || q.file < room) {
+		room = q.file
+	}
+	if q.spool > 0 {
+		_, used := ltok.usage(user)
+		if left := max(q.spool-used, 0); room < 0 || left < room {
+			room = left
+		}
+	}
+	return room
+}
+
+// Return r, reading at most one byte past room unless room is negative,
+// enough for checkQuota to refuse the file
+func quotaReader(r io.Reader, room int64) io.Reader {
+	if room < 0 {
+		return r
+	}
+	return io.LimitReader(r, room+1)
+}
+
+// Format a quota limit, "-" if none
+func quotaLimit(n int64) string {
+	if n <= 0 {
+		return "-"
+	}
+	return prettySize(n)
+}
+
+// Show the tokens in the list by state, and usage by owner against quotas
+func (ltok LTokens) Stats() {
+	now := time.Now()
+	states := make(map[string]int)
+	owners := make(map[string]bool)
+	for _, tok := range ltok {
+		states[tok.State(now)]++
+		owners[tok.Owner] = true
+	}
+	for name := range cnf.QUOTAS {
+		if name != "*" {
+			owners[name] = true
+		}
+	}
+	fmt.Printf("\n  tokens: %d\n", len(ltok))
+	for _, s := range []string{"pending", "active", "expired", "missing",
+		"changed", "trap"} {
+		if states[s] > 0 {
+			fmt.Printf("%8s: %d\n", s, states[s])
+		}
+	}
+	used, expired := ltok.spoolUsage()
+	fmt.Printf(" spooled: %s bytes", prettySize(used))
+	if cnf.spoolQuota > 0 {
+		fmt.Printf(" of %s", prettySize(cnf.spoolQuota))
+	}
+	fmt.Printf(", %s expired\n\n", prettySize(expired))
+	var names []string
+	for name := range owners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("%-20s %7s %7s %16s %16s %16s\n", "owner", "tokens", "max",
+		"spooled", "max", "max file")
+	for _, name := range names {
+		tokens, used := ltok.usage(name)
+		q, _ := userQuota(name)
+		limit := "-"
+		if q.TOKENS > 0 {
+			limit = strconv.Itoa(q.TOKENS)
+		}
+		label := name
+		if len(label) < 1 {
+			label = "(administrator)"
+		}
+		fmt.Printf("%-20s %7d %7s %16s %16s %16s\n", label, tokens, limit,
+			prettySize(used), quotaLimit(q.spool), quotaLimit(q.file))
+	}
+	fmt.Println()
+}
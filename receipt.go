@@ -0,0 +1,315 @@
+// Download receipts.
+// With RECEIPT_DIR set in the configuration, every completed download
+// leaves a receipt in that directory: a JSON document recording the token,
+// the file name, size and SHA-256, the time and the recipient address,
+// signed with the server key. When the server runs HTTPS, receipts are
+// signed with the private key of its certificate and carry that
+// certificate and its chain, so that they still check after the
+// certificate is renewed. Otherwise they carry an HMAC made with the
+// server secret and only the server can check them. Owners retrieve
+// receipts from the status page of their token, onetime verify checks one.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Proof that a file was delivered
+type Receipt struct {
+	Token     string    `json:"token"`
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`
+	Sha256    string    `json:"sha256"`
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Agent     string    `json:"agent"`
+	Algorithm string    `json:"algorithm"`
+	// Signing certificate and its chain, base64 DER, leaf first
+	Certificates []string `json:"certificates,omitempty"`
+	Signature    string   `json:"signature,omitempty"`
+}
+
+// Return the file name of receipt n of token ott
+func receiptFile(ott string, n int) string {
+	return filepath.Join(cnf.RECEIPT_DIR, ott+"-"+strconv.Itoa(n)+".json")
+}
+
+// Load the certificate and private key of the server, when it runs HTTPS
+func serverKey() (*tls.Certificate, error) {
+	if !strings.HasPrefix(cnf.BASE_ADDR, "https") {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cnf.CRT, cnf.KEY)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// Return the bytes covered by the signature of a receipt
+func (r Receipt) payload() []byte {
+	r.Signature = ""
+	b, _ := json.Marshal(r)
+	return b
+}
+
+// Sign a receipt with the server key, or the server secret over HTTP
+func (r *Receipt) sign() error {
+	cert, err := serverKey()
+	if err != nil {
+		return err
+	}
+	if cert == nil {
+		r.Algorithm = "HMAC-SHA256"
+		r.Signature = base64.StdEncoding.EncodeToString(
+			hmacSHA256(serverSecret(), string(r.payload())))
+		return nil
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("unsupported key in " + cnf.KEY)
+	}
+	var opts crypto.SignerOpts = crypto.SHA256
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		r.Algorithm = "RSA-SHA256"
+	case *ecdsa.PrivateKey:
+		r.Algorithm = "ECDSA-SHA256"
+	case ed25519.PrivateKey:
+		r.Algorithm = "Ed25519"
+		opts = crypto.Hash(0)
+	default:
+		return errors.New("unsupported key in " + cnf.KEY)
+	}
+	r.Certificates = nil
+	for _, der := range cert.Certificate {
+		r.Certificates = append(r.Certificates,
+			base64.StdEncoding.EncodeToString(der))
+	}
+	msg := r.payload()
+	if opts.HashFunc() != 0 {
+		sum := sha256.Sum256(msg)
+		msg = sum[:]
+	}
+	sig, err := signer.Sign(rand.Reader, msg, opts)
+	if err != nil {
+		return err
+	}
+	r.Signature = base64.StdEncoding.EncodeToString(sig)
+	return nil
+}
+
+// Check the signature of a receipt against the certificate it carries,
+// or the server key or secret, and return the signing certificate
+func (r Receipt) verify() (*x509.Certificate, error) {
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil || len(sig) < 1 {
+		return nil, errors.New("missing signature")
+	}
+	msg := r.payload()
+	sum := sha256.Sum256(msg)
+	if r.Algorithm == "HMAC-SHA256" {
+		if !hmac.Equal(sig, hmacSHA256(serverSecret(), string(msg))) {
+			return nil, errors.New("invalid signature")
+		}
+		return nil, nil
+	}
+	// Receipts written before they carried certificates
+	leaf, err := serverCertificate()
+	if len(r.Certificates) > 0 {
+		leaf, err = r.signer()
+	}
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	switch pub := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		ok = r.Algorithm == "RSA-SHA256" &&
+			rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	case *ecdsa.PublicKey:
+		ok = r.Algorithm == "ECDSA-SHA256" &&
+			ecdsa.VerifyASN1(pub, sum[:], sig)
+	case ed25519.PublicKey:
+		ok = r.Algorithm == "Ed25519" && ed25519.Verify(pub, msg, sig)
+	}
+	if !ok {
+		return nil, errors.New("invalid signature")
+	}
+	return leaf, nil
+}
+
+// Return the certificate a receipt was signed with, provided it is the
+// current server certificate, has the same key, or was valid for the
+// server name when the receipt was written
+func (r Receipt) signer() (*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for _, s := range r.Certificates {
+		der, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, errors.New("invalid certificate in receipt")
+		}
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.New("invalid certificate in receipt")
+		}
+		chain = append(chain, c)
+	}
+	leaf := chain[0]
+	if cur, err := serverCertificate(); err == nil {
+		if leaf.Equal(cur) {
+			return leaf, nil
+		}
+		a, err1 := x509.MarshalPKIXPublicKey(leaf.PublicKey)
+		b, err2 := x509.MarshalPKIXPublicKey(cur.PublicKey)
+		if err1 == nil && err2 == nil && string(a) == string(b) {
+			return leaf, nil
+		}
+	}
+	u, err := url.Parse(cnf.BASE_ADDR)
+	if err != nil || len(u.Hostname()) < 1 {
+		return nil, errors.New("untrusted certificate: " +
+			leaf.Subject.String())
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       u.Hostname(),
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   r.Time,
+	}
+	for _, c := range chain[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return nil, errors.New("untrusted certificate: " +
+			leaf.Subject.String() + ": " + err.Error())
+	}
+	return leaf, nil
+}
+
+// Parse the first certificate of the CRT file
+func serverCertificate() (*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(cnf.CRT)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			return nil, errors.New("no certificate in " + cnf.CRT)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// Write a receipt for download n of token ott, just completed by the
+// client of req
+func writeReceipt(req *http.Request, ott string, tok Token, n int) {
+	if len(cnf.RECEIPT_DIR) < 1 {
+		return
+	}
+	r := Receipt{
+		Token:  ott,
+		File:   tok.FileName(),
+		Size:   tok.Size,
+		Sha256: tok.Sha256,
+		Time:   time.Now().UTC().Truncate(time.Second),
+		Client: clientHost(req),
+		Agent:  req.UserAgent(),
+	}
+	if len(r.Sha256) < 1 && !isS3(tok.Path) && !isRemote(tok.Path) {
+		r.Sha256, _ = fileSha256(tok.Path)
+	}
+	if err := r.sign(); err != nil {
+		slog.Error("RECEIPT", "token", ott, "err", err)
+		return
+	}
+	b, _ := json.MarshalIndent(r, "", "    ")
+	if err := os.MkdirAll(cnf.RECEIPT_DIR, 0755); err != nil {
+		slog.Error("RECEIPT", "token", ott, "err", err)
+		return
+	}
+	fname := receiptFile(ott, n)
+	if err := ioutil.WriteFile(fname, append(b, '\n'), 0644); err != nil {
+		slog.Error("RECEIPT", "token", ott, "err", err)
+		return
+	}
+	slog.Info("RECEIPT", "token", ott, "file", fname)
+}
+
+// Send receipt n of token ott to its owner
+func sendReceipt(w http.ResponseWriter, req *http.Request, ott, n string) {
+	i, err := strconv.Atoi(strings.TrimSuffix(n, ".json"))
+	if err != nil || len(cnf.RECEIPT_DIR) < 1 {
+		notFound(w, req)
+		return
+	}
+	b, err := ioutil.ReadFile(receiptFile(ott, i))
+	if err != nil {
+		notFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="receipt-`+ott+`-`+strconv.Itoa(i)+`.json"`)
+	w.Write(b)
+}
+
+// Check a receipt file and print what it proves
+func Verify(fname string) error {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	var r Receipt
+	if err = json.Unmarshal(b, &r); err != nil {
+		return err
+	}
+	leaf, err := r.verify()
+	if err != nil {
+		return err
+	}
+	signer := "server secret"
+	if leaf != nil {
+		signer = leaf.Subject.String() + ", until " +
+			isotime(leaf.NotAfter.Local())
+	}
+	fmt.Printf(`
+valid receipt (%s)
+    token: %s
+     file: %s
+     size: %s bytes
+   sha256: %s
+     time: %s
+   client: %s
+    agent: %s
+   signer: %s
+
+`, r.Algorithm, r.Token, r.File, prettySize(r.Size), r.Sha256,
+		isotime(r.Time.Local()), r.Client, r.Agent, signer)
+	return nil
+}
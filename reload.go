@@ -0,0 +1,188 @@
+// Configuration reload.
+// The server reads onetime.json again when it changes, checked every
+// CONFIG_CHECK, or when it receives SIGHUP. Settings used while serving
+// requests take effect at once: token lifetime and defaults, alerts, rate
+// and concurrency limits, access rules, link preview bots, branding,
+// security headers and the log level. Other settings (addresses,
+// certificates, files and directories...) are logged as needing a restart
+// and keep their current value until then. A file that does not load is
+// ignored as a whole, with an error logged. The Go standard library has no
+// file notifications, so the file is polled.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const CONFIG_CHECK = 5 * time.Second // Delay between checks of onetime.json
+
+// Settings applied without a restart
+var liveSettings = map[string]bool{
+	"UNCLAIMED":           true,
+	"ON_CHANGE":           true,
+	"UNLINK":              true,
+	"SPOOL":               true,
+	"RETRIES":             true,
+	"BIND_CLIENT":         true,
+	"ENUM_ALERT":          true,
+	"ALERT_WEBHOOK":       true,
+	"ALERT_MAIL":          true,
+	"SMTP_SERVER":         true,
+	"SMTP_TLS":            true,
+	"SMTP_USER":           true,
+	"SMTP_PASSWORD":       true,
+	"MAIL_FROM":           true,
+	"TRAP_BAN":            true,
+	"RATE_LIMIT":          true,
+	"MAX_DOWNLOADS":       true,
+	"MAX_TOKEN_DOWNLOADS": true,
+	"ALLOW":               true,
+	"DENY":                true,
+	"TRUSTED_PROXIES":     true,
+	"COUNTRY_ALLOW":       true,
+	"COUNTRY_DENY":        true,
+	"BOT_AGENTS":          true,
+	"BRAND_TITLE":         true,
+	"BRAND_LOGO":          true,
+	"BRAND_BACKGROUND":    true,
+	"BRAND_ACCENT":        true,
+	"BRAND_FOOTER":        true,
+	"THEME":               true,
+	"SECURITY_HEADERS":    true,
+	"SERVER_HEADER":       true,
+	"LOG_LEVEL":           true,
+	"ADMIN_PASSWORD":      true,
+	"USERS":               true,
+	"OIDC_ISSUER":         true,
+	"OIDC_CLIENT_ID":      true,
+	"OIDC_CLIENT_SECRET":  true,
+	"OIDC_CLAIM":          true,
+	"OIDC_ALLOW":          true,
+	"OIDC_ADMINS":         true,
+	"LDAP_URL":            true,
+	"LDAP_CA":             true,
+	"LDAP_USER_DN":        true,
+	"LDAP_BASE_DN":        true,
+	"LDAP_USER_ATTR":      true,
+	"LDAP_GROUP":          true,
+	"LDAP_ADMIN_GROUP":    true,
+	"QUOTAS":              true,
+	"SPOOL_QUOTA":         true,
+	"SPOOL_FULL":          true,
+	"MAX_UPLOAD":          true,
+	"SCAN_CLAMD":          true,
+	"SCAN_COMMAND":        true,
+	"QUARANTINE_DIR":      true,
+	"HOOKS":               true,
+	"PLUGINS":             true,
+	"SLACK_WEBHOOK":       true,
+	"SLACK_EVENTS":        true,
+	"SLACK_MASK_IP":       true,
+	"TELEGRAM_USERS":      true,
+	"MATRIX_HOMESERVER":   true,
+	"MATRIX_TOKEN":        true,
+	"MATRIX_ROOM":         true,
+	"MATRIX_EVENTS":       true,
+	"MATRIX_MASK_IP":      true,
+	"SMS_TWILIO_SID":      true,
+	"SMS_TWILIO_TOKEN":    true,
+	"SMS_GATEWAY":         true,
+	"SMS_GATEWAY_HEADERS": true,
+	"SMS_FROM":            true,
+	"CDN_URL":             true,
+	"CDN_SIGN":            true,
+	"CDN_KEY":             true,
+	"CDN_KEY_ID":          true,
+	"CDN_KEY_FILE":        true,
+	"CDN_EXPIRY":          true,
+}
+
+// Return a string changing whenever the configuration file changes
+func configStamp() string {
+	sta, err := os.Stat(cnf.path)
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatInt(sta.ModTime().UnixNano(), 10) + "/" +
+		strconv.FormatInt(sta.Size(), 10)
+}
+
+// Read the configuration again and apply the settings that can change
+// while serving
+func reloadConfiguration() {
+	var next Config
+	if err := readConfiguration(&next); err != nil {
+		slog.Error("RELOAD", "err", err)
+		return
+	}
+	var live, restart []string
+	cur, nv := reflect.ValueOf(&cnf).Elem(), reflect.ValueOf(next)
+	for i := 0; i < nv.NumField(); i++ {
+		f := nv.Type().Field(i)
+		if !f.IsExported() ||
+			reflect.DeepEqual(cur.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if !liveSettings[f.Name] {
+			restart = append(restart, f.Name)
+			continue
+		}
+		live = append(live, f.Name)
+		cur.Field(i).Set(nv.Field(i))
+	}
+	// Values parsed from live settings
+	cnf.unclaimed, cnf.trapBan = next.unclaimed, next.trapBan
+	cnf.allow, cnf.deny = next.allow, next.deny
+	cnf.trustedProxies = next.trustedProxies
+	cnf.logLevel = next.logLevel
+	cnf.spoolQuota, cnf.maxUpload = next.spoolQuota, next.maxUpload
+	cnf.ldapCAs = next.ldapCAs
+	cnf.cdnExpiry, cnf.cdnKey = next.cdnExpiry, next.cdnKey
+	logLevel.Set(cnf.logLevel)
+	if cnf.rateLimit != next.rateLimit {
+		cnf.rateLimit = next.rateLimit
+		if cnf.rateLimit > 0 {
+			globalLimiter.Store(newRateLimiter(cnf.rateLimit))
+		} else {
+			globalLimiter.Store(nil)
+		}
+	}
+	if len(live) > 0 {
+		slog.Info("RELOAD", "changed", live)
+	}
+	if len(restart) > 0 {
+		slog.Warn("RELOAD", "restart", restart)
+	}
+}
+
+// Reload the configuration when its file changes or on SIGHUP
+func watchConfiguration() {
+	stamp := configStamp()
+	if len(stamp) < 1 {
+		// Configured from the environment or command line only
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		tick := time.NewTicker(CONFIG_CHECK)
+		for {
+			select {
+			case <-c:
+			case <-tick.C:
+				if configStamp() == stamp {
+					continue
+				}
+			}
+			stamp = configStamp()
+			reloadConfiguration()
+		}
+	}()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	tests := []struct {
+		name           string
+		contentType    string
+		contentRange   string
+		n, size        int64
+		done, complete bool
+	}{
+		{"whole file", "", "", 1000, 1000, true, true},
+		{"whole file, cut short", "", "", 400, 1000, false, false},
+		{"empty file", "", "", 0, 0, true, true},
+		{"first range", "", "bytes 0-99/1000", 100, 1000, false, true},
+		{"middle range", "", "bytes 100-499/1000", 400, 1000, false, true},
+		{"last range", "", "bytes 900-999/1000", 100, 1000, true, true},
+		{"last range, cut short", "", "bytes 900-999/1000", 50, 1000, false,
+			false},
+		{"resumed to the end", "", "bytes 400-999/1000", 600, 1000, true,
+			true},
+		{"multipart", "multipart/byteranges; boundary=x", "", 260, 1000,
+			false, true},
+		{"unparsable", "", "bytes */1000", 0, 1000, false, true},
+	}
+	for _, tt := range tests {
+		cw := &countingWriter{ResponseWriter: httptest.NewRecorder(), n: tt.n}
+		if len(tt.contentRange) > 0 {
+			cw.Header().Set("Content-Range", tt.contentRange)
+		}
+		cw.Header().Set("Content-Type", tt.contentType)
+		done, complete := cw.progress(tt.size)
+		if done != tt.done || complete != tt.complete {
+			t.Errorf("%s: progress = %v, %v, want %v, %v", tt.name, done,
+				complete, tt.done, tt.complete)
+		}
+	}
+}
+
+// A response writer failing after a number of bytes, as when the client
+// goes away in the middle of a download
+type cutWriter struct {
+	*httptest.ResponseRecorder
+	left int
+}
+
+func (cw *cutWriter) Write(b []byte) (int, error) {
+	if len(b) > cw.left {
+		n, _ := cw.ResponseRecorder.Write(b[:cw.left])
+		cw.left = 0
+		return n, errors.New("connection reset")
+	}
+	cw.left -= len(b)
+	return cw.ResponseRecorder.Write(b)
+}
+
+func TestResume(t *testing.T) {
+	savedRetries := cnf.RETRIES
+	defer func() { cnf.RETRIES = savedRetries }()
+	cnf.RETRIES = 1
+	db := testTokenDB(t)
+	file := filepath.Join(filepath.Dir(db), "data.bin")
+	data := strings.Repeat("0123456789", 100)
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const ott = "aaaa1111"
+	if err := (LTokens{ott: {Path: file}}).Save(db); err != nil {
+		t.Fatal(err)
+	}
+	token := func() Token {
+		ltok := make(LTokens)
+		ltok.Load(db)
+		return ltok[ott]
+	}
+	get := func(method, client, rng string, w http.ResponseWriter) {
+		req := httptest.NewRequest(method, "/d/"+ott, nil)
+		req.RemoteAddr = client + ":4321"
+		if len(rng) > 0 {
+			req.Header.Set("Range", rng)
+		}
+		Distribute(w, req)
+	}
+
+	// A ranged GET is not enough to start a download
+	w := httptest.NewRecorder()
+	get("GET", "192.0.2.1", "bytes=0-", w)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("GET before any download: %d, want 303", w.Code)
+	}
+	// A download cut short leaves the token for the same client to resume
+	get("POST", "192.0.2.1", "", &cutWriter{httptest.NewRecorder(), 400})
+	tok := token()
+	if tok.IsActivated() || tok.Partial != 1 || tok.Resume != "192.0.2.1" {
+		t.Fatalf("after a partial download: activated %v, partial %d, "+
+			"resume %q", tok.IsActivated(), tok.Partial, tok.Resume)
+	}
+	w = httptest.NewRecorder()
+	get("GET", "198.51.100.7", "bytes=400-", w)
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("resumed by another client: %d, want 303", w.Code)
+	}
+	w = httptest.NewRecorder()
+	get("GET", "192.0.2.1", "", w)
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("GET without a range: %d, want 303", w.Code)
+	}
+	// A range short of the end is followed but does not activate
+	w = httptest.NewRecorder()
+	get("GET", "192.0.2.1", "bytes=400-499", w)
+	if w.Code != http.StatusPartialContent || w.Body.String() != data[400:500] {
+		t.Fatalf("middle range: %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if tok = token(); tok.IsActivated() || tok.Partial != 1 {
+		t.Errorf("after a middle range: activated %v, partial %d",
+			tok.IsActivated(), tok.Partial)
+	}
+	// So is a multipart range, without counting as cut short
+	w = httptest.NewRecorder()
+	get("GET", "192.0.2.1", "bytes=0-9,20-29", w)
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("multipart range: %d", w.Code)
+	}
+	multipart := int64(w.Body.Len())
+	if tok = token(); tok.IsActivated() || tok.Partial != 1 {
+		t.Errorf("after a multipart range: activated %v, partial %d",
+			tok.IsActivated(), tok.Partial)
+	}
+	// The rest of the file completes the download
+	w = httptest.NewRecorder()
+	get("GET", "192.0.2.1", "bytes=500-", w)
+	if w.Code != http.StatusPartialContent || w.Body.String() != data[500:] {
+		t.Fatalf("last range: %d, %d bytes", w.Code, w.Body.Len())
+	}
+	tok = token()
+	if !tok.IsActivated() || len(tok.Downloads) != 1 || len(tok.Resume) > 0 {
+		t.Errorf("after the last range: activated %v, downloads %d, "+
+			"resume %q", tok.IsActivated(), len(tok.Downloads), tok.Resume)
+	}
+	if want := 1000 + multipart; tok.Sent != want {
+		t.Errorf("sent %d bytes, want %d", tok.Sent, want)
+	}
+}
+
+func TestResumeRetries(t *testing.T) {
+	savedRetries := cnf.RETRIES
+	defer func() { cnf.RETRIES = savedRetries }()
+	cnf.RETRIES = 1
+	db := testTokenDB(t)
+	file := filepath.Join(filepath.Dir(db), "data.bin")
+	if err := os.WriteFile(file, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const ott = "bbbb2222"
+	if err := (LTokens{ott: {Path: file}}).Save(db); err != nil {
+		t.Fatal(err)
+	}
+	// Past RETRIES partial downloads, the token is activated anyway
+	for i := 1; i <= 2; i++ {
+		req := httptest.NewRequest("POST", "/d/"+ott, nil)
+		req.RemoteAddr = "192.0.2.1:4321"
+		Distribute(&cutWriter{httptest.NewRecorder(), 100}, req)
+		ltok := make(LTokens)
+		ltok.Load(db)
+		tok := ltok[ott]
+		if tok.Partial != i || tok.IsActivated() != (i > cnf.RETRIES) {
+			t.Errorf("partial download %d: partial %d, activated %v", i,
+				tok.Partial, tok.IsActivated())
+		}
+	}
+}
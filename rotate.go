@@ -0,0 +1,221 @@
+// Log file rotation.
+// Deployments without logrotate can have the server rotate its log file:
+// once it reaches LOG_MAX_SIZE bytes, or has been written to for
+// LOG_MAX_AGE, the file is renamed with the time of rotation appended,
+// e.g. onetime.log.20260102-150405, and a new one is started; a sequence
+// number follows when rotated again within the same second. Rotated
+// files are compressed with gzip when LOG_COMPRESS is set, and only the
+// LOG_KEEP most recent ones are kept.
+// External tools such as logrotate can move log files away instead, then
+// send SIGUSR1 to have the server reopen them.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A log file rotated by size or age
+type rotatingFile struct {
+	sync.Mutex
+	name    string
+	file    *os.File
+	size    int64
+	opened  time.Time
+	maxSize int64
+	maxAge  time.Duration
+}
+
+// Log files opened by the server, reopened on SIGUSR1
+var openLogs struct {
+	sync.Mutex
+	files []*rotatingFile
+}
+
+// Open a log file for appending, rotating it as configured
+func openLog(name string) (*rotatingFile, error) {
+	r := &rotatingFile{
+		name:    name,
+		maxSize: cnf.logMaxSize,
+		maxAge:  cnf.logMaxAge,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	openLogs.Lock()
+	openLogs.files = append(openLogs.files, r)
+	openLogs.Unlock()
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	sta, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size, r.opened = f, sta.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.size > 0 && ((r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize) ||
+		(r.maxAge > 0 && time.Since(r.opened) > r.maxAge)) {
+		r.rotate()
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close the file and open it again, after it was moved away by an
+// external tool
+func (r *rotatingFile) Reopen() error {
+	r.Lock()
+	defer r.Unlock()
+	r.file.Close()
+	if err := r.open(); err != nil {
+		r.file, r.size, r.opened = os.Stderr, 0, time.Now()
+		return err
+	}
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.file.Close()
+}
+
+// Move the current file away and start a new one. Errors are reported
+// on stderr since the log itself may be what is failing.
+func (r *rotatingFile) rotate() {
+	r.file.Close()
+	old := rotatedName(r.name, time.Now())
+	if err := os.Rename(r.name, old); err != nil {
+		os.Stderr.WriteString("cannot rotate log: " + err.Error() + "\n")
+	}
+	if err := r.open(); err != nil {
+		// Keep writing somewhere rather than failing every request
+		os.Stderr.WriteString("cannot open log: " + err.Error() + "\n")
+		r.file, r.size, r.opened = os.Stderr, 0, time.Now()
+		return
+	}
+	go func() {
+		if cnf.LOG_COMPRESS {
+			if err := compressFile(old); err != nil {
+				os.Stderr.WriteString("cannot compress log: " +
+					err.Error() + "\n")
+			}
+		}
+		pruneLogs(r.name, cnf.LOG_KEEP)
+	}()
+}
+
+// Return the name a log is rotated to at t, with a sequence number when
+// rotated more than once within a second: onetime.log.20260102-150405,
+// then onetime.log.20260102-150405.1
+func rotatedName(name string, t time.Time) string {
+	base := name + "." + t.Format("20060102-150405")
+	old := base
+	for i := 1; ; i++ {
+		_, err := os.Lstat(old)
+		_, gzerr := os.Lstat(old + ".gz")
+		if os.IsNotExist(err) && os.IsNotExist(gzerr) {
+			return old
+		}
+		old = base + "." + strconv.Itoa(i)
+	}
+}
+
+// Replace a file with a gzipped copy
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0666)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// Remove the oldest rotated files of a log, keeping the keep most
+// recent ones, all of them if keep is 0
+func pruneLogs(name string, keep int) {
+	if keep < 1 {
+		return
+	}
+	old, _ := filepath.Glob(name + ".2*")
+	// Suffixes are times, then sequence numbers within a second
+	order := func(file string) (string, int) {
+		suffix := strings.TrimSuffix(file, ".gz")[len(name)+1:]
+		stamp, seq, _ := strings.Cut(suffix, ".")
+		n, _ := strconv.Atoi(seq)
+		return stamp, n
+	}
+	sort.Slice(old, func(i, j int) bool {
+		si, ni := order(old[i])
+		sj, nj := order(old[j])
+		return si > sj || (si == sj && ni > nj)
+	})
+	for i := keep; i < len(old); i++ {
+		os.Remove(old[i])
+	}
+}
+
+// Reopen all log files whenever SIGUSR1 is received
+func reopenOnSignal() {
+	if sigReopen == nil {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigReopen)
+	go func() {
+		for range c {
+			openLogs.Lock()
+			files := openLogs.files
+			openLogs.Unlock()
+			for _, r := range files {
+				if err := r.Reopen(); err != nil {
+					os.Stderr.WriteString("cannot reopen log: " +
+						err.Error() + "\n")
+				}
+			}
+			if err := openFailLog(); err != nil {
+				slog.Error("FAILLOG", "err", err)
+			}
+			slog.Info("REOPEN")
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatedName(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "onetime.log")
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.Local)
+	want := []string{
+		name + ".20260102-150405",
+		name + ".20260102-150405.1",
+		name + ".20260102-150405.2",
+	}
+	for i, w := range want {
+		got := rotatedName(name, now)
+		if got != w {
+			t.Fatalf("rotation %d: %s, want %s", i+1, got, w)
+		}
+		// Compressed or not, a rotated file keeps its name taken
+		if i == 1 {
+			got += ".gz"
+		}
+		os.WriteFile(got, nil, 0644)
+	}
+}
+
+func TestRotateTwice(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "onetime.log")
+	r := &rotatingFile{name: name, maxSize: 10}
+	if err := r.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, line := range []string{"first line\n", "second line\n",
+		"third line\n"} {
+		r.Write([]byte(line))
+	}
+	old, _ := filepath.Glob(name + ".2*")
+	if len(old) != 2 {
+		t.Errorf("rotated files %v, want 2", old)
+	}
+}
+
+func TestPruneLogs(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "onetime.log")
+	files := []string{
+		".20260101-000000.gz",
+		".20260102-150405",
+		".20260102-150405.2",
+		".20260102-150405.10.gz",
+	}
+	for _, f := range files {
+		os.WriteFile(name+f, nil, 0644)
+	}
+	pruneLogs(name, 2)
+	for i, f := range files {
+		_, err := os.Stat(name + f)
+		if kept := err == nil; kept != (i >= 2) {
+			t.Errorf("%s kept %v", f, kept)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Files stored in S3-compatible buckets.
+// Tokens added for s3://bucket/key paths refer to objects in the bucket
+// configured with S3_ENDPOINT, S3_REGION, S3_ACCESS_KEY and S3_SECRET_KEY.
+// Requests are signed with AWS Signature Version 4 and use path-style
+// URLs, which AWS, MinIO, Ceph and most other implementations accept.
+// Downloads are either redirected to a short-lived presigned URL (default)
+// or streamed through the server when S3_MODE is "stream".
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	S3_PREFIX = "s3://"
+	// Validity of presigned download URLs
+	S3_PRESIGN = 5 * time.Minute
+	// Hash of an empty payload, sent with GET and HEAD requests
+	S3_EMPTY_SHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Tell whether a token path refers to an object in a bucket
+func isS3(p string) bool {
+	return strings.HasPrefix(p, S3_PREFIX)
+}
+
+// Return the URL of the object behind an s3://bucket/key path
+func s3URL(p string) (*url.URL, error) {
+	bk := strings.TrimPrefix(p, S3_PREFIX)
+	i := strings.Index(bk, "/")
+	if i < 1 || i == len(bk)-1 {
+		return nil, errors.New("invalid S3 path: " + p)
+	}
+	if len(cnf.S3_ENDPOINT) < 1 {
+		return nil, errors.New("S3_ENDPOINT undefined in " + cnf.path)
+	}
+	u, err := url.Parse(cnf.S3_ENDPOINT)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + bk
+	return u, nil
+}
+
+// URI-encode a string as SigV4 expects: everything but unreserved
+// characters, and slashes unless told to keep them
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z',
+			'0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Return the credential scope of requests signed at time t
+func s3Scope(t time.Time) string {
+	return t.Format("20060102") + "/" + cnf.S3_REGION + "/s3/aws4_request"
+}
+
+// Compute the SigV4 signature of a request to u with the given signed
+// headers (lowercase names, host included) and payload hash
+func s3Signature(method string, u *url.URL, hdr map[string]string,
+	payload string, t time.Time) (signature, signed string) {
+	names := make([]string, 0, len(hdr))
+	for k := range hdr {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, k := range names {
+		headers.WriteString(k + ":" + strings.TrimSpace(hdr[k]) + "\n")
+	}
+	signed = strings.Join(names, ";")
+
+	q := u.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var query []string
+	for _, k := range keys {
+		query = append(query, s3Escape(k, false)+"="+s3Escape(q.Get(k), false))
+	}
+
+	canonical := strings.Join([]string{
+		method,
+		s3Escape(u.Path, true),
+		strings.Join(query, "&"),
+		headers.String(),
+		signed,
+		payload,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" +
+		s3Scope(t) + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+cnf.S3_SECRET_KEY), t.Format("20060102"))
+	key = hmacSHA256(key, cnf.S3_REGION)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign)), signed
+}
+
+// Send a signed request for the object at p, with an optional Range
+func s3Do(method, p, rng string) (*http.Response, error) {
+	u, err := s3URL(p)
+	if err != nil {
+		return nil, err
+	}
+	t := time.Now().UTC()
+	hdr := map[string]string{
+		"host":                 u.Host,
+		"x-amz-content-sha256": S3_EMPTY_SHA256,
+		"x-amz-date":           t.Format("20060102T150405Z"),
+	}
+	if len(rng) > 0 {
+		hdr["range"] = rng
+	}
+	sig, signed := s3Signature(method, u, hdr, S3_EMPTY_SHA256, t)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		if k != "host" {
+			req.Header.Set(k, v)
+		}
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+
+		cnf.S3_ACCESS_KEY+"/"+s3Scope(t)+", SignedHeaders="+signed+
+		", Signature="+sig)
+	return http.DefaultClient.Do(req)
+}
+
+// Return a presigned URL letting anyone GET the object at p for a short
+// while, with the response headers to send along
+func s3Presign(p string, params map[string]string) (string, error) {
+	u, err := s3URL(p)
+	if err != nil {
+		return "", err
+	}
+	t := time.Now().UTC()
+	q := url.Values{}
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", cnf.S3_ACCESS_KEY+"/"+s3Scope(t))
+	q.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(S3_PRESIGN/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = q.Encode()
+	sig, _ := s3Signature("GET", u,
+		map[string]string{"host": u.Host}, "UNSIGNED-PAYLOAD", t)
+	var query []string
+	for k := range q {
+		query = append(query, s3Escape(k, false)+"="+s3Escape(q.Get(k), false))
+	}
+	sort.Strings(query)
+	u.RawQuery = strings.Join(query, "&") + "&X-Amz-Signature=" + sig
+	return u.String(), nil
+}
+
+// Description of a remote object, as an os.FileInfo
+type objectInfo struct {
+	name     string
+	size     int64
+	modTime  time.Time
+	mimeType string
+}
+
+func (o objectInfo) Name() string       { return o.name }
+func (o objectInfo) Size() int64        { return o.size }
+func (o objectInfo) Mode() os.FileMode  { return 0444 }
+func (o objectInfo) ModTime() time.Time { return o.modTime }
+func (o objectInfo) IsDir() bool        { return false }
+func (o objectInfo) Sys() interface{}   { return nil }
+
+// Fetch the size, time and type of the object at p
+func s3Stat(p string) (objectInfo, error) {
+	resp, err := s3Do("HEAD", p, "")
+	if err != nil {
+		return objectInfo{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return objectInfo{}, errors.New(p + ": " + resp.Status)
+	}
+	mod, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return objectInfo{
+		name:     path.Base(p),
+		size:     resp.ContentLength,
+		modTime:  mod,
+		mimeType: resp.Header.Get("Content-Type"),
+	}, nil
+}
+
+// Stat a local file, an object in a bucket or a remote URL
+func statFile(p string) (os.FileInfo, error) {
+	var o objectInfo
+	var err error
+	switch {
+	case isS3(p):
+		o, err = s3Stat(p)
+	case isRemote(p):
+		o, err = remoteStat(p)
+	default:
+		return os.Stat(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Register a Token for an object in a bucket and print its URL
+func (ltok LTokens) addS3(ott, p string, opt AddOptions) string {
+	o, err := s3Stat(p)
+	if err != nil {
+		fmt.Println("cannot find object:", err)
+		return ""
+	}
+	if err = ltok.checkQuota(opt.Owner, o.size, false); err != nil {
+		fmt.Println(err)
+		return ""
+	}
+	name := opt.Name
+	if len(name) < 1 {
+		name = o.name
+	}
+	mimetype := mime.TypeByExtension(path.Ext(name))
+	if len(mimetype) < 1 {
+		mimetype = o.mimeType
+	}
+	if len(mimetype) < 1 {
+		mimetype = "application/octet-stream"
+	}
+	ltok[ott] = Token{
+		Path:          p,
+		Created:       time.Now(),
+		Activated:     time.Unix(0, 0),
+		Name:          opt.Name,
+		Note:          opt.Note,
+		Size:          o.size,
+		ModTime:       o.modTime,
+		MimeType:      mimetype,
+		Inline:        opt.Inline,
+		Limit:         opt.Limit,
+		Allow:         opt.Allow,
+		Countries:     opt.Countries,
+		DenyCountries: opt.DenyCountries,
+		Owner:         opt.Owner,
+	}
+	fmt.Printf(`
+
+Name: %s
+Size: %s bytes
+%s/%s
+Status: %s
+
+`, ltok[ott].FileName(),
+		prettySize(o.size),
+		cnf.BASE_ADDR, ott, statusURL(ott))
+	journal("create", ott, nil, p)
+	hook("created", ott, ltok[ott], nil)
+	return ott
+}
+
+// Redirect the recipient to a presigned URL of the token object
+func s3Redirect(w http.ResponseWriter, req *http.Request, tok Token) bool {
+	target, err := s3Presign(tok.Path, map[string]string{
+		"response-content-type":        tok.MimeType,
+		"response-content-disposition": contentDisposition(tok),
+	})
+	if err != nil {
+		reqLog(req).Error("S3", "url", tok.Path, "err", err)
+		return false
+	}
+	allowFormTarget(w, target)
+	http.Redirect(w, req, target, http.StatusSeeOther)
+	return true
+}
+
+// Stream the token object to the recipient, passing Range requests on
+func s3Stream(w http.ResponseWriter, req *http.Request, tok Token) {
+	resp, err := s3Do("GET", tok.Path, req.Header.Get("Range"))
+	if err != nil {
+		reqLog(req).Error("S3", "url", tok.Path, "err", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	relay(w, req, resp)
+}
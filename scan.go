@@ -0,0 +1,153 @@
+// Scanning of uploaded files.
+// With SCAN_CLAMD, files uploaded from the administration pages are
+// streamed to clamd before they get a link: a path names its unix
+// socket, host:port its TCP socket. SCAN_COMMAND runs any other scanner
+// instead, with the path of the file appended to its arguments; it must
+// exit with 0 for clean files and 1 for infected ones, as clamdscan does:
+//
+//	"SCAN_COMMAND": ["clamdscan", "--no-summary", "--fdpass"]
+//
+// Infected files are moved to QUARANTINE_DIR, or removed if empty, and
+// the upload is refused. A scanner that cannot be reached refuses the
+// upload too: files are not shared unscanned. Scanner plugins, see
+// plugin.go, check files too.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	SCAN_TIMEOUT = 5 * time.Minute
+	SCAN_CHUNK   = 64 << 10
+)
+
+// Tell whether uploaded files are scanned
+func scanEnabled() bool {
+	return len(cnf.SCAN_CLAMD) > 0 || len(cnf.SCAN_COMMAND) > 0 ||
+		len(scanners()) > 0
+}
+
+// Scan a file with clamd, return the name of the virus found, if any
+func clamdScan(path string) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(cnf.SCAN_CLAMD, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, cnf.SCAN_CLAMD, 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SCAN_TIMEOUT))
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	// Chunks prefixed with their length, then an empty one
+	buf := make([]byte, 4+SCAN_CHUNK)
+	for {
+		n, err := f.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return "", werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && len(reply) < 1 {
+		return "", err
+	}
+	// "stream: OK", "stream: Eicar-Signature FOUND" or "... ERROR"
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", errors.New("clamd: " + reply)
+}
+
+// Scan a file with SCAN_COMMAND, return what it says about a virus found
+func commandScan(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SCAN_TIMEOUT)
+	defer cancel()
+	args := append([]string{}, cnf.SCAN_COMMAND[1:]...)
+	cmd := exec.CommandContext(ctx, cnf.SCAN_COMMAND[0], append(args, path)...)
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		found := strings.TrimSpace(string(out))
+		if len(found) < 1 {
+			found = "infected"
+		}
+		return found, nil
+	}
+	if err != nil {
+		return "", errors.New(cnf.SCAN_COMMAND[0] + ": " + err.Error() +
+			" " + strings.TrimSpace(string(out)))
+	}
+	return "", nil
+}
+
+// Scan a file, return the name of the virus found, if any
+func scanFile(path string) (string, error) {
+	var found string
+	var err error
+	if len(cnf.SCAN_CLAMD) > 0 {
+		found, err = clamdScan(path)
+	} else if len(cnf.SCAN_COMMAND) > 0 {
+		found, err = commandScan(path)
+	}
+	for _, s := range scanners() {
+		if err != nil || len(found) > 0 {
+			break
+		}
+		found, err = s.Scan(path)
+	}
+	return found, err
+}
+
+// Move an infected spooled file of token ott out of the spool, to
+// QUARANTINE_DIR if set
+func quarantine(ott, path string) error {
+	defer os.RemoveAll(filepath.Dir(path))
+	if len(cnf.QUARANTINE_DIR) < 1 {
+		return nil
+	}
+	if err := os.MkdirAll(cnf.QUARANTINE_DIR, 0700); err != nil {
+		return err
+	}
+	dst := filepath.Join(cnf.QUARANTINE_DIR, ott+"-"+filepath.Base(path))
+	if os.Rename(path, dst) == nil {
+		return nil
+	}
+	return copyFile(path, dst)
+}
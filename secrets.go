@@ -0,0 +1,181 @@
+// Encrypted settings.
+// Sensitive values of onetime.json, such as API_KEY, S3_SECRET_KEY or
+// ALERT_WEBHOOK, may be stored encrypted so that the file can be kept in
+// configuration management. An encrypted value reads "enc:" followed by
+// base64 data, sealed with AES-256-GCM under a key given at startup in
+// ONETIME_SECRETS_KEY, in the file named by ONETIME_SECRETS_KEY_FILE
+// (e.g. a systemd credential or a Docker secret), or in the OS keyring
+// under the name given in ONETIME_SECRETS_KEYRING, see keyring.go. Any
+// string setting can be encrypted, as well as the values of OTLP_HEADERS
+// and SECURITY_HEADERS.
+//
+//	onetime genkey > /etc/onetime/key
+//	ONETIME_SECRETS_KEY_FILE=/etc/onetime/key onetime encrypt s3cr3t
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const (
+	ENC_PREFIX  = "enc:"
+	KEY_ENV     = "ONETIME_SECRETS_KEY"      // Base64 key
+	KEY_FILE    = "ONETIME_SECRETS_KEY_FILE" // File holding the base64 key
+	KEY_RING    = "ONETIME_SECRETS_KEYRING"  // Keyring entry of the key
+	SECRETS_KEY = 32                         // Key size, for AES-256
+)
+
+// Return the key of encrypted settings, nil if none is given
+func secretsKey() ([]byte, error) {
+	s := os.Getenv(KEY_ENV)
+	if name := os.Getenv(KEY_FILE); len(name) > 0 {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		s = string(b)
+	}
+	if name := os.Getenv(KEY_RING); len(s) < 1 && len(name) > 0 {
+		secret, err := keyringSecret(name)
+		if err != nil {
+			return nil, err
+		}
+		s = secret
+	}
+	if len(s) < 1 {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != SECRETS_KEY {
+		return nil, errors.New("invalid key in " + KEY_ENV + ", " +
+			KEY_FILE + " or " + KEY_RING + ", create one with onetime genkey")
+	}
+	return key, nil
+}
+
+// Return a new random key
+func genKey() string {
+	key := make([]byte, SECRETS_KEY)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// Return an AEAD sealing settings under key
+func secretsAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Return the encrypted form of a setting
+func encryptSetting(key []byte, value string) (string, error) {
+	aead, err := secretsAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	sealed := aead.Seal(nonce, nonce, []byte(value), nil)
+	return ENC_PREFIX + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Return the clear form of a setting, unchanged unless encrypted
+func decryptSetting(key []byte, value string) (string, error) {
+	if !strings.HasPrefix(value, ENC_PREFIX) {
+		return value, nil
+	}
+	if key == nil {
+		return "", errors.New("encrypted but " + KEY_ENV + ", " +
+			KEY_FILE + " and " + KEY_RING + " are not set")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value[len(ENC_PREFIX):])
+	if err != nil {
+		return "", err
+	}
+	aead, err := secretsAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("truncated")
+	}
+	clear, err := aead.Open(nil, sealed[:aead.NonceSize()],
+		sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("wrong key or altered value")
+	}
+	return string(clear), nil
+}
+
+// Decrypt the encrypted settings of c
+func (c *Config) decryptSettings() error {
+	key, err := secretsKey()
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.String:
+			s, err := decryptSetting(key, field.String())
+			if err != nil {
+				return errors.New("cannot decrypt " + f.Name + " in " +
+					c.path + ": " + err.Error())
+			}
+			field.SetString(s)
+		case field.Kind() == reflect.Map &&
+			field.Type().Elem().Kind() == reflect.String:
+			for _, k := range field.MapKeys() {
+				s, err := decryptSetting(key, field.MapIndex(k).String())
+				if err != nil {
+					return errors.New("cannot decrypt " + f.Name + " in " +
+						c.path + ": " + err.Error())
+				}
+				field.SetMapIndex(k, reflect.ValueOf(s))
+			}
+		}
+	}
+	return nil
+}
+
+// Print the encrypted form of value, or of stdin if empty
+func Encrypt(value string) error {
+	key, err := secretsKey()
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return errors.New(KEY_ENV + ", " + KEY_FILE + " or " + KEY_RING +
+			" must be set, create a key with onetime genkey")
+	}
+	if len(value) < 1 {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		value = strings.TrimRight(string(b), "\r\n")
+	}
+	enc, err := encryptSetting(key, value)
+	if err != nil {
+		return err
+	}
+	os.Stdout.WriteString(enc + "\n")
+	return nil
+}
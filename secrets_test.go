@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSecretsKeyring(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("keyring of the Credential Manager")
+	}
+	// A keyring tool answering for the entry "onetime" only
+	key := genKey()
+	tool := "secret-tool"
+	if runtime.GOOS == "darwin" {
+		tool = "security"
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncase \"$*\" in *onetime*) echo " + key +
+		";; *) echo 'not found' >&2; exit 1;; esac\n"
+	err := os.WriteFile(filepath.Join(dir, tool), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	t.Setenv(KEY_ENV, "")
+	t.Setenv(KEY_FILE, "")
+	t.Setenv(KEY_RING, "onetime")
+	got, err := secretsKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := encryptSetting(got, "s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(KEY_RING, "")
+	t.Setenv(KEY_ENV, key)
+	envKey, _ := secretsKey()
+	if clear, err := decryptSetting(envKey, enc); clear != "s3cr3t" {
+		t.Errorf("decrypted %q, %v, with the key of the keyring", clear, err)
+	}
+	// The key given in the environment comes first
+	t.Setenv(KEY_RING, "other")
+	if _, err = secretsKey(); err != nil {
+		t.Error(err)
+	}
+	t.Setenv(KEY_ENV, "")
+	if _, err = secretsKey(); err == nil {
+		t.Error("no error for an entry missing from the keyring")
+	}
+}
@@ -0,0 +1,216 @@
+// HTTP servers: limits and listen addresses.
+// Clients must send request headers within READ_HEADER_TIMEOUT (10s by
+// default) and whole requests within READ_TIMEOUT (unlimited by default),
+// so that slowloris clients cannot hold connections open. Idle keep-alive
+// connections are closed after IDLE_TIMEOUT (2m by default) and request
+// headers are limited to MAX_HEADER_SIZE, e.g. "16KB" (1MB by default).
+// Uploads are limited to MAX_UPLOAD bytes (unlimited by default); larger
+// ones are cut off as soon as they go over.
+// A download may rightly last hours on a slow link, so WRITE_TIMEOUT does
+// not bound whole responses as http.Server.WriteTimeout would: it aborts
+// responses that made no progress for that long (unlimited by default).
+// The server listens on the address of BASE_ADDR, or on all addresses of
+// LISTEN, each with its own scheme, e.g. ["https://:443",
+// "http://127.0.0.1:2500"] to serve the public over TLS and a local
+// proxy in plain HTTP. FastCGI addresses are described in fastcgi.go.
+// HTTP/2 is offered to TLS clients unless HTTP2 is "off". Set to "h2c",
+// it is also accepted without TLS, from front proxies speaking HTTP/2 in
+// clear text. HTTP/3 is left to such proxies: it needs QUIC, which the
+// standard library does not have.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"strings"
+	"time"
+)
+
+const (
+	READ_HEADER_TIMEOUT = 10 * time.Second
+	IDLE_TIMEOUT        = 2 * time.Minute
+	UPLOAD_SLACK        = 64 << 10 // Form fields around an uploaded file
+)
+
+// Parse the server limits of the configuration
+func (c *Config) parseLimits() error {
+	var err error
+	c.readHeaderTimeout, c.idleTimeout = READ_HEADER_TIMEOUT, IDLE_TIMEOUT
+	if len(c.READ_HEADER_TIMEOUT) > 0 {
+		c.readHeaderTimeout, err = time.ParseDuration(c.READ_HEADER_TIMEOUT)
+		if err != nil || c.readHeaderTimeout <= 0 {
+			return errors.New("invalid READ_HEADER_TIMEOUT in " + c.path)
+		}
+	}
+	if len(c.READ_TIMEOUT) > 0 {
+		c.readTimeout, err = time.ParseDuration(c.READ_TIMEOUT)
+		if err != nil || c.readTimeout <= 0 {
+			return errors.New("invalid READ_TIMEOUT in " + c.path)
+		}
+	}
+	if len(c.WRITE_TIMEOUT) > 0 {
+		c.writeTimeout, err = time.ParseDuration(c.WRITE_TIMEOUT)
+		if err != nil || c.writeTimeout <= 0 {
+			return errors.New("invalid WRITE_TIMEOUT in " + c.path)
+		}
+	}
+	if len(c.IDLE_TIMEOUT) > 0 {
+		c.idleTimeout, err = time.ParseDuration(c.IDLE_TIMEOUT)
+		if err != nil || c.idleTimeout <= 0 {
+			return errors.New("invalid IDLE_TIMEOUT in " + c.path)
+		}
+	}
+	if len(c.MAX_HEADER_SIZE) > 0 {
+		c.maxHeaderSize, err = parseRate(c.MAX_HEADER_SIZE)
+		if err != nil {
+			return errors.New("invalid MAX_HEADER_SIZE in " + c.path)
+		}
+	}
+	c.maxUpload = 0
+	if len(c.MAX_UPLOAD) > 0 {
+		c.maxUpload, err = parseRate(c.MAX_UPLOAD)
+		if err != nil || c.maxUpload <= 0 {
+			return errors.New("invalid MAX_UPLOAD in " + c.path)
+		}
+	}
+	return nil
+}
+
+// Limit the body of an upload to MAX_UPLOAD, with room for the other
+// fields of the form. Return false, having answered, if the announced
+// length is already too large.
+func limitUpload(w http.ResponseWriter, req *http.Request) bool {
+	if cnf.maxUpload <= 0 {
+		return true
+	}
+	limit := cnf.maxUpload + UPLOAD_SLACK
+	if req.ContentLength > limit {
+		uploadTooLarge(w, req)
+		return false
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, limit)
+	return true
+}
+
+// Answer an upload over MAX_UPLOAD
+func uploadTooLarge(w http.ResponseWriter, req *http.Request) {
+	reqLog(req).Warn("UPLOAD", "err", "over MAX_UPLOAD", "bytes",
+		req.ContentLength)
+	renderError(w, http.StatusRequestEntityTooLarge, tr("upload_too_large"),
+		tr("upload_too_large_message")+" "+cnf.MAX_UPLOAD)
+}
+
+// Return a server for handler with the configured limits
+func newServer(addr string, handler http.Handler) *http.Server {
+	if cnf.writeTimeout > 0 {
+		handler = withStallTimeout(handler, cnf.writeTimeout)
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cnf.readHeaderTimeout,
+		ReadTimeout:       cnf.readTimeout,
+		IdleTimeout:       cnf.idleTimeout,
+		MaxHeaderBytes:    int(cnf.maxHeaderSize),
+		Protocols:         protocols(),
+	}
+}
+
+// Return the protocols served, as set by HTTP2
+func protocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(cnf.HTTP2 != "off")
+	p.SetUnencryptedHTTP2(cnf.HTTP2 == "h2c")
+	return p
+}
+
+// A ResponseWriter pushing its write deadline back on every write
+type stallWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (sw *stallWriter) Write(p []byte) (int, error) {
+	sw.rc.SetWriteDeadline(time.Now().Add(sw.timeout))
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *stallWriter) Flush() {
+	sw.rc.Flush()
+}
+
+func (sw *stallWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// Abort responses of next making no progress for timeout
+func withStallTimeout(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Now().Add(timeout))
+		next.ServeHTTP(&stallWriter{w, rc, timeout}, req)
+	})
+}
+
+// Return the addresses to listen on
+func (c *Config) listenAddrs() []string {
+	if len(c.LISTEN) > 0 {
+		return c.LISTEN
+	}
+	return []string{c.BASE_ADDR}
+}
+
+// Tell whether any listen address uses https
+func (c *Config) usesTLS() bool {
+	for _, addr := range c.listenAddrs() {
+		if strings.HasPrefix(addr, "https") {
+			return true
+		}
+	}
+	return false
+}
+
+// Open the socket of a listen address, "http://host:port",
+// "https://host:port" or a FastCGI address. Returns a nil listener for
+// FastCGI on stdin.
+func bind(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "https://") {
+		return net.Listen("tcp", hostPort(addr[8:], ":https"))
+	} else if strings.HasPrefix(addr, "http://") {
+		return net.Listen("tcp", hostPort(addr[7:], ":http"))
+	} else if strings.HasPrefix(addr, FCGI_PREFIX) {
+		return bindFastCGI(addr[len(FCGI_PREFIX):])
+	}
+	return nil, errors.New("unknown protocol in " + addr)
+}
+
+// Return addr, or def if empty
+func hostPort(addr, def string) string {
+	if len(addr) < 1 {
+		return def
+	}
+	return addr
+}
+
+// Serve handler on l, bound to addr, with the TLS configuration t for
+// https addresses
+func listen(addr string, l net.Listener, handler http.Handler,
+	t *tls.Config) error {
+	slog.Info("LISTEN", "addr", addr)
+	if strings.HasPrefix(addr, "https://") {
+		s := track(newServer(addr[8:], handler))
+		s.TLSConfig = t
+		// Certificates are already loaded
+		return s.ServeTLS(l, "", "")
+	} else if strings.HasPrefix(addr, "http://") {
+		return track(newServer(addr[7:], handler)).Serve(l)
+	}
+	return fcgi.Serve(l, withInflight(handler))
+}
@@ -0,0 +1,43 @@
+// Windows service.
+// onetime service install registers the server with the Service Control
+// Manager, to start at boot under the LocalSystem account with the
+// current configuration file, and uninstall removes it. start, stop and
+// status act on the installed service. The SCM runs onetime service run,
+// which serves until asked to stop, then stops accepting connections and
+// waits up to SERVICE_STOP_WAIT for requests in progress, as a restart
+// does, so that stopping the service does not cut downloads short.
+// Starts, stops and failures are reported to the Application event log
+// under the service name. The Windows API is reached through syscall, see
+// service_windows.go. --name sets the service name, to install several
+// instances configured with -c.
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Longest wait for requests in progress when the service is stopped
+const SERVICE_STOP_WAIT = 5 * time.Minute
+
+// Options of onetime service
+type ServiceOptions struct {
+	Name string // Service name
+}
+
+// Closed by Serve once the server answers on all its addresses
+var serverReady = make(chan bool)
+
+// Act on the onetime service
+func Service(action string, opt ServiceOptions) error {
+	if len(opt.Name) < 1 {
+		opt.Name = "onetime"
+	}
+	switch action {
+	case "install", "uninstall", "start", "stop", "status", "run":
+		return serviceControl(action, opt)
+	}
+	return errors.New("use: onetime service install|uninstall|start|" +
+		"stop|status")
+}
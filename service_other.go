@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func serviceControl(action string, opt ServiceOptions) error {
+	return errors.New("onetime service is for Windows: use " +
+		"onetime.service with systemd, or serve --daemon")
+}
@@ -0,0 +1,460 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Service Control Manager and event log API, from winsvc.h and winnt.h
+const (
+	SC_MANAGER_CONNECT         = 0x0001
+	SC_MANAGER_CREATE_SERVICE  = 0x0002
+	SERVICE_QUERY_STATUS       = 0x0004
+	SERVICE_START              = 0x0010
+	SERVICE_STOP               = 0x0020
+	SERVICE_CHANGE_CONFIG      = 0x0002
+	SERVICE_DELETE             = 0x10000
+	SERVICE_WIN32_OWN_PROCESS  = 0x10
+	SERVICE_AUTO_START         = 2
+	SERVICE_ERROR_NORMAL       = 1
+	SERVICE_CONFIG_DESCRIPTION = 1
+
+	SERVICE_STOPPED       = 1
+	SERVICE_START_PENDING = 2
+	SERVICE_STOP_PENDING  = 3
+	SERVICE_RUNNING       = 4
+
+	SERVICE_CONTROL_STOP        = 1
+	SERVICE_CONTROL_INTERROGATE = 4
+	SERVICE_CONTROL_SHUTDOWN    = 5
+	SERVICE_ACCEPT_STOP         = 1
+	SERVICE_ACCEPT_SHUTDOWN     = 4
+
+	ERROR_CALL_NOT_IMPLEMENTED = 120
+	ERROR_SERVICE_SPECIFIC     = 1066
+
+	EVENTLOG_ERROR_TYPE       = 1
+	EVENTLOG_WARNING_TYPE     = 2
+	EVENTLOG_INFORMATION_TYPE = 4
+	// Messages of EventCreate.exe are the text given, for IDs 1 to 1000
+	EVENT_ID  = 1
+	EVENT_KEY = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+)
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procOpenSCManagerW       = advapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW       = advapi32.NewProc("CreateServiceW")
+	procOpenServiceW         = advapi32.NewProc("OpenServiceW")
+	procDeleteService        = advapi32.NewProc("DeleteService")
+	procCloseServiceHandle   = advapi32.NewProc("CloseServiceHandle")
+	procChangeServiceConfig2 = advapi32.NewProc("ChangeServiceConfig2W")
+	procStartServiceW        = advapi32.NewProc("StartServiceW")
+	procControlService       = advapi32.NewProc("ControlService")
+	procQueryServiceStatus   = advapi32.NewProc("QueryServiceStatus")
+	procStartDispatcher      = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterHandler      = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus     = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSource  = advapi32.NewProc("RegisterEventSourceW")
+	procReportEventW         = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyExW      = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueExW       = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKeyW        = advapi32.NewProc("RegDeleteKeyW")
+)
+
+// SERVICE_STATUS
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// SERVICE_TABLE_ENTRYW
+type serviceTableEntry struct {
+	ServiceName *uint16
+	ServiceProc uintptr
+}
+
+// Names of service states, as printed by onetime service status
+var serviceStates = map[uint32]string{
+	SERVICE_STOPPED:       "stopped",
+	SERVICE_START_PENDING: "starting",
+	SERVICE_STOP_PENDING:  "stopping",
+	SERVICE_RUNNING:       "running",
+}
+
+func serviceControl(action string, opt ServiceOptions) error {
+	switch action {
+	case "install":
+		return installService(opt)
+	case "uninstall":
+		return uninstallService(opt)
+	case "run":
+		return runService(opt)
+	}
+	access := uint32(SERVICE_QUERY_STATUS)
+	switch action {
+	case "start":
+		access |= SERVICE_START
+	case "stop":
+		access |= SERVICE_STOP
+	}
+	h, err := openService(opt.Name, access)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(h)
+	switch action {
+	case "start":
+		if r, _, err := procStartServiceW.Call(h, 0, 0); r == 0 {
+			return errors.New("cannot start " + opt.Name + ": " + err.Error())
+		}
+		return printServiceState(opt.Name, h, SERVICE_RUNNING, STOP_WAIT)
+	case "stop":
+		var st serviceStatus
+		r, _, err := procControlService.Call(h, SERVICE_CONTROL_STOP,
+			uintptr(unsafe.Pointer(&st)))
+		if r == 0 {
+			return errors.New("cannot stop " + opt.Name + ": " + err.Error())
+		}
+		return printServiceState(opt.Name, h, SERVICE_STOPPED,
+			SERVICE_STOP_WAIT+STOP_WAIT)
+	}
+	return printServiceState(opt.Name, h, 0, 0)
+}
+
+// Return a handle of the Service Control Manager
+func openSCManager(access uint32) (uintptr, error) {
+	scm, _, err := procOpenSCManagerW.Call(0, 0, uintptr(access))
+	if scm == 0 {
+		return 0, errors.New("cannot reach the Service Control Manager: " +
+			err.Error())
+	}
+	return scm, nil
+}
+
+// Return a handle of the service name
+func openService(name string, access uint32) (uintptr, error) {
+	scm, err := openSCManager(SC_MANAGER_CONNECT)
+	if err != nil {
+		return 0, err
+	}
+	defer procCloseServiceHandle.Call(scm)
+	wname, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	h, _, err := procOpenServiceW.Call(scm, uintptr(unsafe.Pointer(wname)),
+		uintptr(access))
+	if h == 0 {
+		return 0, errors.New("service " + name + ": " + err.Error())
+	}
+	return h, nil
+}
+
+// Wait up to wait for service h to reach state, then print its state.
+// Return an error unless it is running or in the state wanted.
+func printServiceState(name string, h uintptr, state uint32,
+	wait time.Duration) error {
+	var st serviceStatus
+	for deadline := time.Now().Add(wait); ; {
+		r, _, err := procQueryServiceStatus.Call(h,
+			uintptr(unsafe.Pointer(&st)))
+		if r == 0 {
+			return errors.New("service " + name + ": " + err.Error())
+		}
+		if st.CurrentState == state || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	fmt.Println("service", name, serviceStates[st.CurrentState])
+	if st.CurrentState != SERVICE_RUNNING && st.CurrentState != state {
+		return errors.New("service " + name + " not " + serviceStates[state])
+	}
+	return nil
+}
+
+// Register the service, started at boot, running the current executable
+// with the current configuration
+func installService(opt ServiceOptions) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if real, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = real
+	}
+	run := `"` + exe + `"`
+	if _, err := os.Stat(cnf.path); err == nil {
+		run += ` -c "` + cnf.path + `"`
+	}
+	run += ` service --name "` + opt.Name + `" run`
+	scm, err := openSCManager(SC_MANAGER_CREATE_SERVICE)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+	wname, err := syscall.UTF16PtrFromString(opt.Name)
+	if err != nil {
+		return err
+	}
+	wrun, err := syscall.UTF16PtrFromString(run)
+	if err != nil {
+		return err
+	}
+	h, _, err := procCreateServiceW.Call(scm, uintptr(unsafe.Pointer(wname)),
+		uintptr(unsafe.Pointer(wname)), SERVICE_CHANGE_CONFIG,
+		SERVICE_WIN32_OWN_PROCESS, SERVICE_AUTO_START, SERVICE_ERROR_NORMAL,
+		uintptr(unsafe.Pointer(wrun)), 0, 0, 0, 0, 0)
+	if h == 0 {
+		return errors.New("cannot install " + opt.Name + ": " + err.Error())
+	}
+	defer procCloseServiceHandle.Call(h)
+	// SERVICE_DESCRIPTIONW
+	desc := struct{ Description *uint16 }{}
+	desc.Description, _ = syscall.UTF16PtrFromString("One-time download links")
+	procChangeServiceConfig2.Call(h, SERVICE_CONFIG_DESCRIPTION,
+		uintptr(unsafe.Pointer(&desc)))
+	if err = addEventSource(opt.Name); err != nil {
+		fmt.Println("no event log source:", err)
+	}
+	fmt.Println("service", opt.Name, "installed:", run)
+	return nil
+}
+
+// Stop the service if running, and remove it
+func uninstallService(opt ServiceOptions) error {
+	h, err := openService(opt.Name,
+		SERVICE_STOP|SERVICE_QUERY_STATUS|SERVICE_DELETE)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(h)
+	var st serviceStatus
+	r, _, _ := procControlService.Call(h, SERVICE_CONTROL_STOP,
+		uintptr(unsafe.Pointer(&st)))
+	if r != 0 {
+		printServiceState(opt.Name, h, SERVICE_STOPPED,
+			SERVICE_STOP_WAIT+STOP_WAIT)
+	}
+	if r, _, err = procDeleteService.Call(h); r == 0 {
+		return errors.New("cannot uninstall " + opt.Name + ": " + err.Error())
+	}
+	removeEventSource(opt.Name)
+	fmt.Println("service", opt.Name, "uninstalled")
+	return nil
+}
+
+// Register name as a source of the Application event log, with the
+// messages of EventCreate.exe which show the text reported as is
+func addEventSource(name string) error {
+	wkey, err := syscall.UTF16PtrFromString(EVENT_KEY + name)
+	if err != nil {
+		return err
+	}
+	var key syscall.Handle
+	r, _, _ := procRegCreateKeyExW.Call(uintptr(syscall.HKEY_LOCAL_MACHINE),
+		uintptr(unsafe.Pointer(wkey)), 0, 0, 0, syscall.KEY_SET_VALUE, 0,
+		uintptr(unsafe.Pointer(&key)), 0)
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	defer syscall.RegCloseKey(key)
+	wvalue, _ := syscall.UTF16PtrFromString("EventMessageFile")
+	file, _ := syscall.UTF16FromString(`%SystemRoot%\System32\EventCreate.exe`)
+	r, _, _ = procRegSetValueExW.Call(uintptr(key),
+		uintptr(unsafe.Pointer(wvalue)), 0, syscall.REG_EXPAND_SZ,
+		uintptr(unsafe.Pointer(&file[0])), uintptr(len(file)*2))
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	wvalue, _ = syscall.UTF16PtrFromString("TypesSupported")
+	types := uint32(EVENTLOG_ERROR_TYPE | EVENTLOG_WARNING_TYPE |
+		EVENTLOG_INFORMATION_TYPE)
+	r, _, _ = procRegSetValueExW.Call(uintptr(key),
+		uintptr(unsafe.Pointer(wvalue)), 0, syscall.REG_DWORD,
+		uintptr(unsafe.Pointer(&types)), 4)
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+func removeEventSource(name string) {
+	wkey, err := syscall.UTF16PtrFromString(EVENT_KEY + name)
+	if err == nil {
+		procRegDeleteKeyW.Call(uintptr(syscall.HKEY_LOCAL_MACHINE),
+			uintptr(unsafe.Pointer(wkey)))
+	}
+}
+
+// State of the service being run
+var service struct {
+	sync.Mutex
+	name   string
+	handle uintptr
+	events uintptr // Event source, 0 if it could not be opened
+	stop   chan bool
+}
+
+// Report msg to the event log, as an event of the given type
+func reportEvent(kind uint16, msg string) {
+	if service.events == 0 {
+		return
+	}
+	wmsg, err := syscall.UTF16PtrFromString(strings.ToValidUTF8(
+		strings.ReplaceAll(msg, "\x00", ""), "?"))
+	if err != nil {
+		return
+	}
+	msgs := [1]*uint16{wmsg}
+	procReportEventW.Call(service.events, uintptr(kind), 0, EVENT_ID, 0, 1,
+		0, uintptr(unsafe.Pointer(&msgs[0])), 0)
+}
+
+// The log package writing to the event log, for log.Fatal
+type eventWriter uint16
+
+func (w eventWriter) Write(p []byte) (int, error) {
+	reportEvent(uint16(w), strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// Tell the Service Control Manager the state of the service
+func setServiceState(state, checkPoint uint32, waitHint time.Duration,
+	exitCode uint32) {
+	st := serviceStatus{
+		ServiceType:  SERVICE_WIN32_OWN_PROCESS,
+		CurrentState: state,
+		CheckPoint:   checkPoint,
+		WaitHint:     uint32(waitHint / time.Millisecond),
+	}
+	if state == SERVICE_RUNNING {
+		st.ControlsAccepted = SERVICE_ACCEPT_STOP | SERVICE_ACCEPT_SHUTDOWN
+	}
+	if exitCode != 0 {
+		st.Win32ExitCode = ERROR_SERVICE_SPECIFIC
+		st.ServiceSpecificExitCode = exitCode
+	}
+	service.Lock()
+	defer service.Unlock()
+	procSetServiceStatus.Call(service.handle, uintptr(unsafe.Pointer(&st)))
+}
+
+// Serve as a service, when started by the Service Control Manager
+func runService(opt ServiceOptions) error {
+	service.name = opt.Name
+	service.stop = make(chan bool, 1)
+	wname, err := syscall.UTF16PtrFromString(opt.Name)
+	if err != nil {
+		return err
+	}
+	service.events, _, _ = procRegisterEventSource.Call(0,
+		uintptr(unsafe.Pointer(wname)))
+	// Fatal errors of the server, with no console to print them
+	log.SetOutput(eventWriter(EVENTLOG_ERROR_TYPE))
+	log.SetFlags(0)
+	table := []serviceTableEntry{
+		{wname, syscall.NewCallback(serviceMain)},
+		{nil, 0},
+	}
+	r, _, err := procStartDispatcher.Call(uintptr(unsafe.Pointer(&table[0])))
+	if r == 0 {
+		return errors.New("onetime service run is for the Service Control " +
+			"Manager, use onetime service start: " + err.Error())
+	}
+	return nil
+}
+
+// ServiceMain: serve until stopped
+func serviceMain(argc uint32, argv **uint16) uintptr {
+	wname, _ := syscall.UTF16PtrFromString(service.name)
+	h, _, err := procRegisterHandler.Call(uintptr(unsafe.Pointer(wname)),
+		syscall.NewCallback(serviceHandler), 0)
+	if h == 0 {
+		reportEvent(EVENTLOG_ERROR_TYPE, "cannot register the service "+
+			"control handler: "+err.Error())
+		return 0
+	}
+	service.handle = h
+	setServiceState(SERVICE_START_PENDING, 0, STOP_WAIT, 0)
+	failed := make(chan bool)
+	go func() {
+		// Fatal errors exit through log, reported to the event log
+		Serve()
+		close(failed)
+	}()
+	select {
+	case <-serverReady:
+	case <-failed:
+		reportEvent(EVENTLOG_ERROR_TYPE, service.name+" could not start, "+
+			"see "+cnf.LOG_FILE)
+		setServiceState(SERVICE_STOPPED, 0, 0, 1)
+		return 0
+	}
+	setServiceState(SERVICE_RUNNING, 0, 0, 0)
+	reportEvent(EVENTLOG_INFORMATION_TYPE, service.name+" "+version+
+		" serving on "+strings.Join(cnf.listenAddrs(), " "))
+	<-service.stop
+	slog.Info("STOP", "service", service.name)
+	reportEvent(EVENTLOG_INFORMATION_TYPE, service.name+" stopping, "+
+		"waiting for requests in progress")
+	// Checkpoints keep the SCM waiting while downloads end
+	ctx, cancel := context.WithTimeout(context.Background(), SERVICE_STOP_WAIT)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		for n := uint32(1); ; n++ {
+			setServiceState(SERVICE_STOP_PENDING, n, 5*time.Second, 0)
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	draining.Store(true)
+	shutdown(ctx, false)
+	cancel()
+	wg.Wait()
+	reportEvent(EVENTLOG_INFORMATION_TYPE, service.name+" stopped")
+	setServiceState(SERVICE_STOPPED, 0, 0, 0)
+	return 0
+}
+
+// HandlerEx: pass stop requests on to serviceMain
+func serviceHandler(control, eventType uint32, eventData,
+	eventContext uintptr) uintptr {
+	switch control {
+	case SERVICE_CONTROL_STOP, SERVICE_CONTROL_SHUTDOWN:
+		select {
+		case service.stop <- true:
+		default:
+		}
+		return 0
+	case SERVICE_CONTROL_INTERROGATE:
+		return 0
+	}
+	return ERROR_CALL_NOT_IMPLEMENTED
+}
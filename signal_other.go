@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// No SIGUSR1 or SIGUSR2 on Windows: logs are rotated by size or age,
+// and restarts go through stop and serve
+var sigReopen, sigUpgrade os.Signal
@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals asking the server to reopen its log files, and to hand over
+// to a new process
+var (
+	sigReopen  os.Signal = syscall.SIGUSR1
+	sigUpgrade os.Signal = syscall.SIGUSR2
+)
@@ -0,0 +1,116 @@
+// Slack notifications.
+// With SLACK_WEBHOOK set to an incoming webhook URL, a message is posted
+// to its channel when tokens are created, activated or fully downloaded,
+// naming the file, its size and the client behind the event:
+//
+//	"SLACK_WEBHOOK": "https://hooks.slack.com/services/T000/B000/XXXX",
+//	"SLACK_EVENTS": ["created", "completed"], "SLACK_MASK_IP": true
+//
+// SLACK_EVENTS picks other events among those of HOOKS. SLACK_MASK_IP
+// hides the host part of client addresses (192.0.2.x, 2001:db8:1:2::x).
+// Links are never posted: anyone in the channel could use them.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const SLACK_TIMEOUT = 10 * time.Second
+
+// Events posted when SLACK_EVENTS is empty
+var slackEvents = []string{"created", "activated", "completed"}
+
+var slackClient = &http.Client{Timeout: SLACK_TIMEOUT}
+
+// Posts token events to SLACK_WEBHOOK
+type slack struct{}
+
+// Check SLACK_EVENTS
+func (c *Config) checkSlack() error {
+	for _, e := range c.SLACK_EVENTS {
+		if !hookEvents[e] {
+			return errors.New("unknown event " + e + " in SLACK_EVENTS in " +
+				c.path)
+		}
+	}
+	return nil
+}
+
+// Tell whether event is one of events, or of defaults if events is empty
+func eventWanted(event string, events, defaults []string) bool {
+	if len(events) < 1 {
+		events = defaults
+	}
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Hide the host part of an address, keeping its /24 (IPv4) or /64 (IPv6)
+// network
+func maskIP(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return strings.TrimSuffix(ip4.Mask(net.CIDRMask(24, 32)).String(),
+			"0") + "x"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "x"
+}
+
+// Describe an event in one line, for chat notifications
+func (ev Event) summary(mask bool) string {
+	verbs := map[string]string{
+		"created":         "created",
+		"activated":       "activated",
+		"completed":       "downloaded",
+		"expired":         "expired",
+		"deleted":         "deleted",
+		"upload-received": "uploaded",
+	}
+	msg := "onetime: " + ev.Name + " (" + prettySize(ev.Size) + " bytes) " +
+		verbs[ev.Event] + ", token " + ev.Token
+	if len(ev.Owner) > 0 {
+		msg += " of " + ev.Owner
+	}
+	if len(ev.Client) > 0 {
+		client := ev.Client
+		if mask {
+			client = maskIP(client)
+		}
+		msg += ", client " + client
+	}
+	return msg
+}
+
+// Post an event to SLACK_WEBHOOK
+func (slack) Notify(ev Event) error {
+	if !eventWanted(ev.Event, cnf.SLACK_EVENTS, slackEvents) {
+		return nil
+	}
+	body, _ := json.Marshal(map[string]string{
+		"text": ev.summary(cnf.SLACK_MASK_IP),
+	})
+	resp, err := slackClient.Post(cnf.SLACK_WEBHOOK, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("slack: " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Link delivery by SMS.
+// onetime send-sms creates a token for a file and texts its link to a
+// phone number, through Twilio:
+//
+//	"SMS_TWILIO_SID": "AC...", "SMS_TWILIO_TOKEN": "...",
+//	"SMS_FROM": "+15005550006"
+//
+// or through any other HTTP gateway given in SMS_GATEWAY, receiving a
+// JSON POST {"from": SMS_FROM, "to": "+33612345678", "text": "..."} with
+// SMS_GATEWAY_HEADERS, e.g. an Authorization header, and answering 2xx.
+// Numbers are given in E.164 format. The token is kept when the message
+// cannot be sent, so that its link can be passed on another way.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	TWILIO_API  = "https://api.twilio.com/2010-04-01/Accounts/"
+	SMS_TIMEOUT = 30 * time.Second
+)
+
+var smsClient = &http.Client{Timeout: SMS_TIMEOUT}
+
+// Phone numbers in E.164 format
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// Check the SMS settings
+func (c *Config) checkSMS() error {
+	if len(c.SMS_TWILIO_SID) > 0 && len(c.SMS_GATEWAY) > 0 {
+		return errors.New("SMS_TWILIO_SID and SMS_GATEWAY both set in " +
+			c.path)
+	}
+	if len(c.SMS_TWILIO_SID) > 0 && (len(c.SMS_TWILIO_TOKEN) < 1 ||
+		len(c.SMS_FROM) < 1) {
+		return errors.New("SMS_TWILIO_SID needs SMS_TWILIO_TOKEN and " +
+			"SMS_FROM in " + c.path)
+	}
+	if len(c.SMS_GATEWAY) > 0 {
+		if u, err := url.Parse(c.SMS_GATEWAY); err != nil ||
+			(u.Scheme != "https" && u.Scheme != "http") {
+			return errors.New("invalid SMS_GATEWAY in " + c.path)
+		}
+	}
+	return nil
+}
+
+// Tell whether texts can be sent
+func smsEnabled() bool {
+	return len(cnf.SMS_TWILIO_SID) > 0 || len(cnf.SMS_GATEWAY) > 0
+}
+
+// Text a message to a phone number
+func sendSMS(to, text string) error {
+	if !e164.MatchString(to) {
+		return errors.New("invalid phone number " + to +
+			", expecting e.g. +33612345678")
+	}
+	var req *http.Request
+	var err error
+	switch {
+	case len(cnf.SMS_TWILIO_SID) > 0:
+		form := url.Values{"To": {to}, "From": {cnf.SMS_FROM}, "Body": {text}}
+		req, err = http.NewRequest(http.MethodPost, TWILIO_API+
+			url.PathEscape(cnf.SMS_TWILIO_SID)+"/Messages.json",
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(cnf.SMS_TWILIO_SID, cnf.SMS_TWILIO_TOKEN)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	case len(cnf.SMS_GATEWAY) > 0:
+		body, _ := json.Marshal(map[string]string{
+			"from": cnf.SMS_FROM,
+			"to":   to,
+			"text": text,
+		})
+		req, err = http.NewRequest(http.MethodPost, cnf.SMS_GATEWAY,
+			bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range cnf.SMS_GATEWAY_HEADERS {
+			req.Header.Set(k, v)
+		}
+	default:
+		return errors.New("no SMS_TWILIO_SID or SMS_GATEWAY in " + cnf.path)
+	}
+	resp, err := smsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		// Twilio explains errors in a JSON message field
+		var answer struct {
+			Message string `json:"message"`
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(msg, &answer) == nil && len(answer.Message) > 0 {
+			return errors.New("SMS refused: " + answer.Message)
+		}
+		return errors.New("SMS refused: " + resp.Status)
+	}
+	return nil
+}
+
+// Text the link of token ott to a phone number
+func (ltok LTokens) SendSMS(ott, to string) error {
+	text := ltok[ott].FileName() + " was shared with you, for one " +
+		"download: " + cnf.BASE_ADDR + "/" + ott
+	if err := sendSMS(to, text); err != nil {
+		return err
+	}
+	journal("sms", ott, nil, to)
+	return nil
+}
@@ -0,0 +1,153 @@
+// Owner status pages.
+// Every token has a management URL, /s/TOKEN/SIGNATURE, signed with a
+// server secret so that it cannot be derived from the download URL. It
+// shows the owner whether and when the link was opened and downloaded,
+// by which clients and how many bytes were delivered. It never links to
+// the download itself, so forwarding it does not give the file away.
+// The secret is SECRET in the configuration or, when unset, a random key
+// kept in onetime.secret next to the token DB.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server secret, loaded once
+var secret struct {
+	sync.Once
+	key []byte
+}
+
+// Return the server secret, creating onetime.secret when needed
+func serverSecret() []byte {
+	secret.Do(func() {
+		if len(cnf.SECRET) > 0 {
+			secret.key = []byte(cnf.SECRET)
+			return
+		}
+		fname := filepath.Join(filepath.Dir(cnf.TOKEN_DB), "onetime.secret")
+		if b, err := ioutil.ReadFile(fname); err == nil && len(b) > 0 {
+			secret.key = b
+			return
+		}
+		b := make([]byte, 32)
+		rand.Read(b)
+		key := []byte(hex.EncodeToString(b))
+		if err := ioutil.WriteFile(fname, key, 0600); err != nil {
+			slog.Error("SECRET", "err", err)
+		}
+		secret.key = key
+	})
+	return secret.key
+}
+
+// Return the signature of token ott for a purpose, e.g. "status"
+func sign(purpose, ott string) string {
+	h := hmac.New(sha256.New, serverSecret())
+	h.Write([]byte(purpose + ":" + ott))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:18])
+}
+
+// Return the owner status URL of token ott
+func statusURL(ott string) string {
+	return cnf.BASE_ADDR + "/s/" + ott + "/" + sign("status", ott)
+}
+
+// A label and a value shown on status pages
+type StatusRow struct {
+	Label string
+	Value string
+	Link  string // Receipt of a download
+}
+
+// Send the status page of a token to its owner
+func Status(w http.ResponseWriter, req *http.Request) {
+	noIndex(w)
+	backoff(req)
+	parts := strings.SplitN(req.URL.Path[3:], "/", 3)
+	if len(parts) < 2 || !hmac.Equal([]byte(parts[1]),
+		[]byte(sign("status", parts[0]))) {
+		reqLog(req).Warn("404")
+		miss(req, "unknown")
+		notFound(w, req)
+		return
+	}
+	ott := parts[0]
+	if len(parts) == 3 {
+		sendReceipt(w, req, ott, parts[2])
+		return
+	}
+	ltok := make(LTokens)
+	ltok.LoadContext(req.Context(), cnf.TOKEN_DB)
+	tok, ok := ltok[ott]
+	if !ok {
+		// Deleted, purged or a secret or redirection already used
+		gone(w, req)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	reqLog(req).Debug("STATUS", "token", ott)
+	when := func(t time.Time) string {
+		if t.Year() <= 1970 {
+			return tr("not_yet")
+		}
+		return isotime(t)
+	}
+	rows := []StatusRow{
+		{Label: tr("name"), Value: tok.FileName()},
+		{Label: tr("state"), Value: tr("state_" + tok.State(time.Now()))},
+		{Label: tr("created"), Value: isotime(tok.Created)},
+		{Label: tr("opened"), Value: when(tok.Opened)},
+		{Label: tr("activated"), Value: when(tok.Activated)},
+	}
+	if tok.IsActivated() {
+		rows = append(rows, StatusRow{Label: tr("valid_until"),
+			Value: isotime(tok.ValidUntil())})
+	}
+	rows = append(rows,
+		StatusRow{Label: tr("downloads"),
+			Value: strconv.Itoa(len(tok.Downloads))},
+		StatusRow{Label: tr("bytes_sent"),
+			Value: prettySize(tok.Sent) + " " + tr("bytes")})
+	var events []StatusRow
+	for i, t := range tok.Downloads {
+		var who []string
+		if i < len(tok.Clients) && len(tok.Clients) == len(tok.Downloads) {
+			who = append(who, tok.Clients[i])
+		}
+		if i < len(tok.Origins) && len(tok.Origins) == len(tok.Downloads) &&
+			len(tok.Origins[i]) > 0 {
+			who = append(who, "["+tok.Origins[i]+"]")
+		}
+		if i < len(tok.Agents) && len(tok.Agents) == len(tok.Downloads) {
+			who = append(who, tok.Agents[i])
+		}
+		row := StatusRow{Label: isotime(t), Value: strings.Join(who, " ")}
+		if len(cnf.RECEIPT_DIR) > 0 {
+			if _, err := os.Stat(receiptFile(ott, i+1)); err == nil {
+				row.Link = statusURL(ott) + "/" + strconv.Itoa(i+1) + ".json"
+			}
+		}
+		events = append(events, row)
+	}
+	render(w, "status.html", Page{
+		Title:  tr("status"),
+		Token:  ott,
+		Rows:   rows,
+		Events: events,
+	})
+}
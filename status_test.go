@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Sign with a given SECRET, reloaded on the next call to serverSecret
+func testSecret(t *testing.T, s string) {
+	t.Helper()
+	saved := cnf.SECRET
+	cnf.SECRET = s
+	secret.Once, secret.key = sync.Once{}, nil
+	t.Cleanup(func() {
+		cnf.SECRET = saved
+		secret.Once, secret.key = sync.Once{}, nil
+	})
+}
+
+func TestSign(t *testing.T) {
+	testSecret(t, "first")
+	sig := sign("status", "aaaa1111")
+	if len(sig) != 24 || strings.ContainsAny(sig, "+/=") {
+		t.Errorf("signature %q is not 24 URL-safe characters", sig)
+	}
+	if sign("status", "aaaa1111") != sig {
+		t.Error("signature not stable")
+	}
+	others := map[string]string{
+		"other token":   sign("status", "aaaa1112"),
+		"other purpose": sign("receipt", "aaaa1111"),
+		// The purpose and token are separated
+		"shifted separator": sign("status:aaaa", "1111"),
+	}
+	for name, other := range others {
+		if other == sig {
+			t.Errorf("%s: same signature %q", name, sig)
+		}
+	}
+	testSecret(t, "second")
+	if sign("status", "aaaa1111") == sig {
+		t.Error("same signature with another secret")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	db := testTokenDB(t)
+	testSecret(t, "test")
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (LTokens{"aaaa1111": {Path: "/a.txt"}}).Save(db); err != nil {
+		t.Fatal(err)
+	}
+	sig := sign("status", "aaaa1111")
+	tests := []struct {
+		name, path string
+		code       int
+	}{
+		{"signed", "/s/aaaa1111/" + sig, http.StatusOK},
+		{"no signature", "/s/aaaa1111", http.StatusNotFound},
+		{"empty signature", "/s/aaaa1111/", http.StatusNotFound},
+		{"wrong signature", "/s/aaaa1111/" + strings.Repeat("A", 24),
+			http.StatusNotFound},
+		{"truncated signature", "/s/aaaa1111/" + sig[:23],
+			http.StatusNotFound},
+		{"signature of another token", "/s/bbbb2222/" + sig,
+			http.StatusNotFound},
+		{"signature for another purpose",
+			"/s/aaaa1111/" + sign("receipt", "aaaa1111"), http.StatusNotFound},
+		// A valid signature of a token that is no more
+		{"gone", "/s/bbbb2222/" + sign("status", "bbbb2222"),
+			http.StatusGone},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tt.path, nil)
+		// One client per request, not to be slowed down by misses
+		req.RemoteAddr = "192.0.2." + strconv.Itoa(100+i) + ":4321"
+		Status(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: %d, want %d", tt.name, w.Code, tt.code)
+		}
+		if tt.code == http.StatusOK && !strings.Contains(w.Body.String(),
+			"a.txt") {
+			t.Errorf("%s: no file name on the page", tt.name)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Logging to syslog.
+// A LOG_FILE starting with "syslog:" sends log records to a syslog daemon
+// instead of a file. Options follow as a comma-separated list:
+//
+//	syslog:                                  local daemon, facility daemon
+//	syslog:facility=local3,tag=onetime       local daemon
+//	syslog:server=udp://logs.example.com:514 remote daemon
+//
+// Records keep their key=value or JSON format, without the time stamp
+// added by syslog, and are sent with the priority matching their level.
+// The local daemon is reached on /dev/log, or /var/run/syslog on macOS:
+// Windows has none, a server must be given there.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// log/syslog is not used: it does not build on Windows, where sending
+// to a remote daemon still makes sense
+
+const SYSLOG_PREFIX = "syslog:"
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Sockets of local syslog daemons
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// A connection to a syslog daemon
+type syslogWriter struct {
+	sync.Mutex
+	network  string // Empty for the local daemon
+	addr     string
+	facility int
+	tag      string
+	hostname string
+	conn     net.Conn
+}
+
+// Connect to the daemon
+func (w *syslogWriter) connect() error {
+	if len(w.network) > 0 {
+		conn, err := net.Dial(w.network, w.addr)
+		if err == nil {
+			w.conn = conn
+		}
+		return err
+	}
+	for _, name := range syslogSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err := net.Dial(network, name); err == nil {
+				w.conn = conn
+				return nil
+			}
+		}
+	}
+	return errors.New("no local syslog daemon")
+}
+
+// Send a message with a severity, reconnecting once if sending fails
+func (w *syslogWriter) send(severity int, msg string) error {
+	w.Lock()
+	defer w.Unlock()
+	pri := w.facility*8 + severity
+	var line string
+	if len(w.network) > 0 {
+		line = fmt.Sprintf("<%d>%s %s %s[%d]: %s\n", pri,
+			time.Now().Format(time.RFC3339), w.hostname, w.tag,
+			os.Getpid(), msg)
+	} else {
+		line = fmt.Sprintf("<%d>%s %s[%d]: %s\n", pri,
+			time.Now().Format(time.Stamp), w.tag, os.Getpid(), msg)
+	}
+	if w.conn != nil {
+		if _, err := w.conn.Write([]byte(line)); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	if err := w.connect(); err != nil {
+		return err
+	}
+	_, err := w.conn.Write([]byte(line))
+	return err
+}
+
+func (w *syslogWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// Tell whether LOG_FILE designates syslog
+func isSyslog(name string) bool {
+	return strings.HasPrefix(name, SYSLOG_PREFIX)
+}
+
+// Connect to the syslog daemon described by a "syslog:..." LOG_FILE
+func openSyslog(spec string) (*syslogWriter, error) {
+	facility := syslogFacilities["daemon"]
+	tag := "onetime"
+	network, addr := "", ""
+	opts := strings.TrimPrefix(spec, SYSLOG_PREFIX)
+	for _, opt := range strings.Split(opts, ",") {
+		if len(strings.TrimSpace(opt)) < 1 {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid syslog option: " + opt)
+		}
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch k {
+		case "facility":
+			f, ok := syslogFacilities[strings.ToLower(v)]
+			if !ok {
+				return nil, errors.New("invalid syslog facility: " + v)
+			}
+			facility = f
+		case "tag":
+			tag = v
+		case "server":
+			u, err := url.Parse(v)
+			if err != nil || len(u.Host) < 1 ||
+				(u.Scheme != "udp" && u.Scheme != "tcp") {
+				return nil, errors.New("invalid syslog server: " + v)
+			}
+			network, addr = u.Scheme, u.Host
+		default:
+			return nil, errors.New("invalid syslog option: " + opt)
+		}
+	}
+	hostname, _ := os.Hostname()
+	w := &syslogWriter{network: network, addr: addr, facility: facility,
+		tag: tag, hostname: hostname}
+	w.Lock()
+	defer w.Unlock()
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Destination of formatted records, sending each with the priority of
+// the record being handled
+type syslogOut struct {
+	sync.Mutex
+	w     *syslogWriter
+	level slog.Level
+}
+
+func (o *syslogOut) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	// Syslog severities are the journal priorities
+	return len(p), o.w.send(journalPriority(o.level), msg)
+}
+
+// A slog handler formatting records with another handler and sending
+// them to syslog
+type syslogHandler struct {
+	slog.Handler
+	out *syslogOut
+}
+
+// Return a handler sending records to w, formatted as text or JSON
+func newSyslogHandler(w *syslogWriter, opts slog.HandlerOptions) slog.Handler {
+	out := &syslogOut{w: w}
+	opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		// syslog stamps messages itself
+		if len(groups) < 1 && a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		return a
+	}
+	if cnf.LOG_FORMAT == "json" {
+		return syslogHandler{slog.NewJSONHandler(out, &opts), out}
+	}
+	return syslogHandler{slog.NewTextHandler(out, &opts), out}
+}
+
+func (h syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.Lock()
+	defer h.out.Unlock()
+	h.out.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return syslogHandler{h.Handler.WithAttrs(attrs), h.out}
+}
+
+func (h syslogHandler) WithGroup(name string) slog.Handler {
+	return syslogHandler{h.Handler.WithGroup(name), h.out}
+}
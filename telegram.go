@@ -0,0 +1,274 @@
+// Telegram bot.
+// With TELEGRAM_TOKEN set to the token BotFather gave, the server runs a
+// bot: users listed in TELEGRAM_USERS send it a file and get a one-time
+// link back, then a message when the link is used. TELEGRAM_USERS maps
+// Telegram user IDs to the owner names of their tokens, so that quotas,
+// the administration pages and notifications see them as usual:
+//
+//	"TELEGRAM_TOKEN": "123456:ABC-DEF...",
+//	"TELEGRAM_USERS": {"12345678": "alice"}
+//
+// Messages from other users are ignored, and logged. Files go through
+// the scanners, quotas and MAX_UPLOAD as uploads from the administration
+// pages do.
+// The public Bot API lets bots download files of 20MB at most;
+// TELEGRAM_API may point to a local Bot API server lifting that limit.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	TELEGRAM_API     = "https://api.telegram.org"
+	TELEGRAM_POLL    = 50 // Seconds waited for updates by each request
+	TELEGRAM_TIMEOUT = 10 * time.Second
+	TELEGRAM_RETRY   = 30 * time.Second
+)
+
+var telegramClient = &http.Client{
+	Timeout: TELEGRAM_POLL*time.Second + TELEGRAM_TIMEOUT,
+}
+
+// Tells Telegram users about their tokens
+type telegram struct{}
+
+// A message sent to the bot, the parts of it onetime reads
+type telegramMessage struct {
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	From struct {
+		ID int64 `json:"id"`
+	} `json:"from"`
+	Text     string `json:"text"`
+	Caption  string `json:"caption"`
+	Document *struct {
+		FileID   string `json:"file_id"`
+		FileName string `json:"file_name"`
+		FileSize int64  `json:"file_size"`
+	} `json:"document"`
+}
+
+// Check TELEGRAM_USERS
+func (c *Config) checkTelegram() error {
+	for id, name := range c.TELEGRAM_USERS {
+		if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+			return errors.New("invalid Telegram user ID " + id + " in " + c.path)
+		}
+		if len(name) < 1 {
+			return errors.New("no owner name for Telegram user " + id +
+				" in " + c.path)
+		}
+	}
+	return nil
+}
+
+// Return the URL of a Bot API method
+func telegramURL(method string) string {
+	api := cnf.TELEGRAM_API
+	if len(api) < 1 {
+		api = TELEGRAM_API
+	}
+	return api + "/bot" + cnf.TELEGRAM_TOKEN + "/" + method
+}
+
+// Call a Bot API method and decode its result into v, if not nil
+func telegramCall(method string, params url.Values, v any) error {
+	resp, err := telegramClient.PostForm(telegramURL(method), params)
+	if err != nil {
+		// Errors quote the URL, holding the bot token
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return errors.New("telegram " + method + ": " + err.Error())
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return errors.New("telegram " + method + ": " + resp.Status)
+	}
+	if !answer.OK {
+		return errors.New("telegram " + method + ": " + answer.Description)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(answer.Result, v)
+}
+
+// Send a text message to a chat
+func telegramSend(chat int64, text string) error {
+	return telegramCall("sendMessage", url.Values{
+		"chat_id": {strconv.FormatInt(chat, 10)},
+		"text":    {text},
+	}, nil)
+}
+
+// Answer messages sent to the bot, until the server stops
+func telegramBot() {
+	var offset int64
+	for {
+		var updates []struct {
+			UpdateID int64            `json:"update_id"`
+			Message  *telegramMessage `json:"message"`
+		}
+		err := telegramCall("getUpdates", url.Values{
+			"offset":          {strconv.FormatInt(offset, 10)},
+			"timeout":         {strconv.Itoa(TELEGRAM_POLL)},
+			"allowed_updates": {`["message"]`},
+		}, &updates)
+		if err != nil {
+			slog.Error("TELEGRAM", "err", err)
+			time.Sleep(TELEGRAM_RETRY)
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message != nil {
+				telegramReceive(u.Message)
+			}
+		}
+	}
+}
+
+// Handle a message sent to the bot
+func telegramReceive(m *telegramMessage) {
+	from := strconv.FormatInt(m.From.ID, 10)
+	user, ok := cnf.TELEGRAM_USERS[from]
+	if !ok {
+		slog.Warn("TELEGRAM", "from", from, "err", "unknown user")
+		return
+	}
+	if m.Document == nil {
+		telegramSend(m.Chat.ID, "Send me a file to get a one-time link "+
+			"for it. Files are sent as documents, not photos.")
+		return
+	}
+	ott, err := telegramAdd(user, m)
+	if err != nil {
+		slog.Error("TELEGRAM", "from", from, "user", user, "err", err)
+		telegramSend(m.Chat.ID, "Sorry, no link: "+err.Error())
+		return
+	}
+	slog.Info("TELEGRAM", "from", from, "user", user, "token", ott)
+	telegramSend(m.Chat.ID, cnf.BASE_ADDR+"/"+ott+"\n\nStatus: "+
+		statusURL(ott))
+}
+
+// Fetch the file of a message into the spool and create a token for it
+// on behalf of user
+func telegramAdd(user string, m *telegramMessage) (string, error) {
+	ltok := make(LTokens)
+	ltok.Load(cnf.TOKEN_DB)
+	if err := ltok.checkQuota(user, m.Document.FileSize, true); err != nil {
+		return "", err
+	}
+	if cnf.maxUpload > 0 && m.Document.FileSize > cnf.maxUpload {
+		return "", errors.New("files of " + cnf.MAX_UPLOAD + " at most")
+	}
+	var file struct {
+		FilePath string `json:"file_path"`
+	}
+	err := telegramCall("getFile", url.Values{
+		"file_id": {m.Document.FileID},
+	}, &file)
+	if err != nil {
+		return "", err
+	}
+	api := cnf.TELEGRAM_API
+	if len(api) < 1 {
+		api = TELEGRAM_API
+	}
+	resp, err := telegramClient.Get(api + "/file/bot" + cnf.TELEGRAM_TOKEN +
+		"/" + file.FilePath)
+	if err != nil {
+		return "", errors.New("download failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("download failed: " + resp.Status)
+	}
+	name := filepath.Base(m.Document.FileName)
+	if name == "." || name == string(filepath.Separator) {
+		name = filepath.Base(file.FilePath)
+	}
+	ott := GenerateOnetime(ONETIME_SZ)
+	room := ltok.quotaRoom(user)
+	if cnf.maxUpload > 0 && (room < 0 || cnf.maxUpload < room) {
+		room = cnf.maxUpload
+	}
+	path, err := spoolReader(ott, name, quotaReader(resp.Body, room))
+	if err != nil {
+		return "", errors.New("cannot store the file")
+	}
+	if sta, err := os.Stat(path); err == nil && cnf.maxUpload > 0 &&
+		sta.Size() > cnf.maxUpload {
+		os.RemoveAll(filepath.Dir(path))
+		return "", errors.New("files of " + cnf.MAX_UPLOAD + " at most")
+	}
+	if scanEnabled() {
+		found, err := scanFile(path)
+		if err != nil {
+			slog.Error("SCAN", "file", path, "err", err)
+			os.RemoveAll(filepath.Dir(path))
+			return "", errors.New("the file could not be scanned")
+		}
+		if len(found) > 0 {
+			slog.Warn("INFECTED", "file", filepath.Base(path), "found", found)
+			if err = quarantine(ott, path); err != nil {
+				slog.Error("QUARANTINE", "err", err)
+			}
+			return "", errors.New("the file is infected")
+		}
+	}
+	// Loaded again once the file is in, downloads may take long
+	ltok = make(LTokens)
+	ltok.Load(cnf.TOKEN_DB)
+	base := ltok.clone()
+	opt := AddOptions{Owner: user, Name: name, Note: m.Caption}
+	if len(ltok.add(ott, path, true, opt)) < 1 {
+		os.RemoveAll(filepath.Dir(path))
+		return "", errors.New("quota exceeded")
+	}
+	ltok.Commit(context.Background(), base)
+	return ott, nil
+}
+
+// Tell the Telegram users owning a token that it was downloaded
+func (telegram) Notify(ev Event) error {
+	if ev.Event != "completed" {
+		return nil
+	}
+	msg := ev.Name + " was downloaded"
+	if len(ev.Client) > 0 {
+		msg += " from " + ev.Client
+	}
+	msg += ".\n\nStatus: " + ev.StatusURL
+	var err error
+	for id, name := range cnf.TELEGRAM_USERS {
+		if name != ev.Owner {
+			continue
+		}
+		chat, _ := strconv.ParseInt(id, 10, 64)
+		if serr := telegramSend(chat, msg); serr != nil {
+			err = serr
+		}
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+// Bandwidth throttling and concurrency caps of downloads.
+// RATE_LIMIT in the configuration caps the total rate of all downloads
+// served, add --limit caps each download of a single token. Both are
+// token buckets holding at most one second worth of bytes.
+// MAX_DOWNLOADS and MAX_TOKEN_DOWNLOADS cap the number of transfers
+// running at the same time, in total and for one token.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Largest write passed at once through a throttled writer
+const THROTTLE_CHUNK = 16 * 1024
+
+// Limiter shared by all downloads, set when RATE_LIMIT is set
+var globalLimiter atomic.Pointer[rateLimiter]
+
+// A token bucket limiting the rate of bytes sent
+type rateLimiter struct {
+	mu    sync.Mutex
+	rate  float64   // Bytes per second
+	avail float64   // Bytes that may be sent now, negative when in debt
+	last  time.Time // Last update of avail
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:  float64(rate),
+		avail: float64(rate),
+		last:  time.Now(),
+	}
+}
+
+// Wait until n more bytes may be sent
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.avail += now.Sub(l.last).Seconds() * l.rate
+	if l.avail > l.rate {
+		l.avail = l.rate
+	}
+	l.last = now
+	l.avail -= float64(n)
+	var d time.Duration
+	if l.avail < 0 {
+		d = time.Duration(-l.avail / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// A ResponseWriter sending its body no faster than its limiters allow
+type throttledWriter struct {
+	http.ResponseWriter
+	limiters []*rateLimiter
+}
+
+func (tw *throttledWriter) Write(b []byte) (int, error) {
+	sent := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > THROTTLE_CHUNK {
+			chunk = chunk[:THROTTLE_CHUNK]
+		}
+		for _, l := range tw.limiters {
+			l.wait(len(chunk))
+		}
+		n, err := tw.ResponseWriter.Write(chunk)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+		b = b[n:]
+	}
+	return sent, nil
+}
+
+// Wrap w with the global limiter and a limiter of rate bytes per second
+// for this download, if any
+func throttle(w http.ResponseWriter, rate int64) http.ResponseWriter {
+	var limiters []*rateLimiter
+	if rate > 0 {
+		limiters = append(limiters, newRateLimiter(rate))
+	}
+	if g := globalLimiter.Load(); g != nil {
+		limiters = append(limiters, g)
+	}
+	if len(limiters) < 1 {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, limiters: limiters}
+}
+
+// Parse a rate such as "5MB/s", "500K" or "1.5GB/s" into bytes per
+// second. Units are powers of 1000.
+func parseRate(s string) (int64, error) {
+	r := strings.ToUpper(strings.TrimSpace(s))
+	r = strings.TrimSuffix(r, "/S")
+	r = strings.TrimSuffix(r, "B")
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(r, "K"):
+		mult = 1e3
+	case strings.HasSuffix(r, "M"):
+		mult = 1e6
+	case strings.HasSuffix(r, "G"):
+		mult = 1e9
+	}
+	if mult > 1 {
+		r = r[:len(r)-1]
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(r), 64)
+	if err != nil || v <= 0 {
+		return 0, errors.New("invalid rate: " + s)
+	}
+	return int64(v * mult), nil
+}
+
+// Pretty-print a rate in bytes per second
+func prettyRate(rate int64) string {
+	if rate <= 0 {
+		return "none"
+	}
+	return prettySize(rate) + " bytes/s"
+}
+
+// Seconds clients are asked to wait when all download slots are taken
+const RETRY_AFTER = 30
+
+// Transfers currently running, in total and per token
+var transfers = struct {
+	sync.Mutex
+	total int
+	token map[string]int
+}{token: make(map[string]int)}
+
+// Take a download slot for token ott, return false when the server or
+// the token already runs as many transfers as allowed
+func acquireSlot(ott string) bool {
+	transfers.Lock()
+	defer transfers.Unlock()
+	if cnf.MAX_DOWNLOADS > 0 && transfers.total >= cnf.MAX_DOWNLOADS {
+		return false
+	}
+	if cnf.MAX_TOKEN_DOWNLOADS > 0 &&
+		transfers.token[ott] >= cnf.MAX_TOKEN_DOWNLOADS {
+		return false
+	}
+	transfers.total++
+	transfers.token[ott]++
+	return true
+}
+
+// Give back a download slot taken by acquireSlot
+func releaseSlot(ott string) {
+	transfers.Lock()
+	defer transfers.Unlock()
+	transfers.total--
+	if transfers.token[ott]--; transfers.token[ott] <= 0 {
+		delete(transfers.token, ott)
+	}
+}
+
+// Tell a client to come back later, all download slots being taken
+func tooBusy(w http.ResponseWriter, req *http.Request) {
+	reqLog(req).Warn("BUSY")
+	w.Header().Set("Retry-After", strconv.Itoa(RETRY_AFTER))
+	renderError(w, http.StatusTooManyRequests, tr("busy"),
+		tr("busy_message"))
+}
@@ -0,0 +1,151 @@
+// TLS policy.
+// TLS_MIN_VERSION sets the oldest protocol version accepted: "1.0", "1.1",
+// "1.2" (default) or "1.3". TLS_CIPHERS restricts the cipher suites offered
+// with TLS 1.2 and older, listed by their Go names such as
+// "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", and TLS_CURVES the key
+// exchange groups, e.g. ["X25519", "P256"]. Suites of TLS 1.3 are not
+// configurable. Empty lists keep the Go defaults.
+// CERTS lists more certificate and key pairs, selected by the server name
+// clients ask for (SNI), to answer on several domains with one instance.
+// CRT and KEY remain the default for clients asking for other names.
+// With CLIENT_CA set to a file of PEM certificates, the API, owner status
+// pages and profiles are only served to clients presenting a certificate
+// signed by one of them, while download links stay open to all.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+}
+
+// A certificate and its key, as in CERTS
+type CertPair struct {
+	CRT string
+	KEY string
+}
+
+// Parse the TLS policy of the configuration
+func (c *Config) parseTLSPolicy() error {
+	c.tlsMin = tls.VersionTLS12
+	if len(c.TLS_MIN_VERSION) > 0 {
+		v, ok := tlsVersions[c.TLS_MIN_VERSION]
+		if !ok {
+			return errors.New("invalid TLS_MIN_VERSION in " + c.path)
+		}
+		c.tlsMin = v
+	}
+	suites := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s.ID
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		suites[s.Name] = s.ID
+	}
+	c.tlsCiphers = nil
+	for _, name := range c.TLS_CIPHERS {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return errors.New("invalid TLS_CIPHERS in " + c.path + ": " + name)
+		}
+		c.tlsCiphers = append(c.tlsCiphers, id)
+	}
+	if len(c.tlsCiphers) > 0 && c.HTTP2 != "off" && !c.hasH2Cipher() {
+		return errors.New("TLS_CIPHERS needs a *_AES_128_GCM_SHA256 " +
+			"suite for HTTP/2 in " + c.path)
+	}
+	c.tlsCurves = nil
+	for _, name := range c.TLS_CURVES {
+		id, ok := tlsCurves[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return errors.New("invalid TLS_CURVES in " + c.path + ": " + name)
+		}
+		c.tlsCurves = append(c.tlsCurves, id)
+	}
+	return nil
+}
+
+// Tell whether TLS_CIPHERS holds a suite required by HTTP/2
+func (c *Config) hasH2Cipher() bool {
+	for _, id := range c.tlsCiphers {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 ||
+			id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the TLS configuration of the server
+func tlsConfig() (*tls.Config, error) {
+	if err := reloadCertificates(); err != nil {
+		return nil, err
+	}
+	t := &tls.Config{
+		GetCertificate:   getCertificate,
+		MinVersion:       cnf.tlsMin,
+		CipherSuites:     cnf.tlsCiphers,
+		CurvePreferences: cnf.tlsCurves,
+	}
+	if cnf.clientCAs != nil {
+		// Certificates are checked by handlers: downloads need none
+		t.ClientAuth = tls.VerifyClientCertIfGiven
+		t.ClientCAs = cnf.clientCAs
+	}
+	return t, nil
+}
+
+// Load the CA of client certificates required by admin endpoints
+func (c *Config) loadClientCA() error {
+	c.clientCAs = nil
+	if len(c.CLIENT_CA) < 1 {
+		return nil
+	}
+	if !c.usesTLS() {
+		return errors.New("CLIENT_CA needs https in " + c.path)
+	}
+	b, err := os.ReadFile(c.CLIENT_CA)
+	if err != nil {
+		return err
+	}
+	c.clientCAs = x509.NewCertPool()
+	if !c.clientCAs.AppendCertsFromPEM(b) {
+		return errors.New("invalid CLIENT_CA in " + c.path)
+	}
+	return nil
+}
+
+// Only let requests presenting a client certificate signed by CLIENT_CA
+// through to next
+func requireClientCert(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if cnf.clientCAs != nil &&
+			(req.TLS == nil || len(req.TLS.VerifiedChains) < 1) {
+			failure(req, "clientcert")
+			reqLog(req).Warn("NOCERT")
+			renderError(w, http.StatusForbidden, tr("forbidden"),
+				tr("cert_required_message"))
+			return
+		}
+		next(w, req)
+	}
+}
@@ -0,0 +1,535 @@
+// Token DB format.
+// TOKEN_DB holds a format version next to the tokens:
+//
+//	{"tokens": {"x1y2z3w4": {...}}, "version": 2}
+//
+// Version 1 files, the bare map of tokens written by earlier releases,
+// are read as well and migrated in memory; a copy of the file is kept as
+// TOKEN_DB.v1 before the first save rewrites it. Migrations work on the
+// raw JSON of tokens, before it is decoded into Token. A file of a newer
+// version, or one that cannot be read, is never overwritten: onetime
+// logs an error and stops saving it until it loads again, so that an
+// older executable cannot drop fields it does not know about, and a
+// damaged file can still be restored. Files are replaced atomically.
+//
+// Changes go through the token DB lock, TOKEN_DB.lock, shared by the
+// server and the command line: the tokens are loaded again under the
+// lock, changed and saved, so that concurrent requests or commands never
+// write back tokens they loaded before another one saved its changes.
+//
+// These changes go through a Store: the TOKEN_DB file by default, a
+// PostgreSQL database when TOKEN_DB is a postgres:// URL, see pgstore.go,
+// or a plugin when it reads plugin:NAME, see pluginstore.go.
+// onetime import-db moves the tokens of a file, of any version, to the
+// configured store.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DB_VERSION = 2 // Format of TOKEN_DB written by this release
+
+	TOKENDB_LOCK_WAIT  = 10 * time.Second // Longest wait for the lock
+	TOKENDB_LOCK_STALE = 60 * time.Second // Age of locks left by crashes
+)
+
+// Migrations of raw tokens from version v to v+1
+var migrations = map[int]func(map[string]json.RawMessage) error{
+	// No field was renamed or changed meaning from version 1 to 2: the
+	// file only gained the version around the tokens. Fields added
+	// meanwhile are read as their zero values from older tokens.
+	1: func(map[string]json.RawMessage) error { return nil },
+}
+
+// Token DB files not to be overwritten, with the reason why
+var dbRefused sync.Map
+
+// Taken before the lock file, so that requests of the server wait for
+// each other without polling it
+var tokenDBMutex sync.Mutex
+
+// Read the tokens of a token DB, raw, with the version of its format
+func readTokenDB(filename string) (map[string]json.RawMessage, int, error) {
+	js, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return map[string]json.RawMessage{}, DB_VERSION, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseTokenDB(js)
+}
+
+// Return the raw tokens of the contents of a token DB, with the version
+// of its format
+func parseTokenDB(js []byte) (map[string]json.RawMessage, int, error) {
+	if len(js) == 0 {
+		return map[string]json.RawMessage{}, DB_VERSION, nil
+	}
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(js, &top); err != nil {
+		return nil, 0, err
+	}
+	// Tokens are objects, a version is a number
+	v, ok := top["version"]
+	if !ok {
+		return top, 1, nil
+	}
+	version, err := strconv.Atoi(string(v))
+	if err != nil {
+		return top, 1, nil
+	}
+	var file struct {
+		Tokens map[string]json.RawMessage `json:"tokens"`
+	}
+	if err = json.Unmarshal(js, &file); err != nil {
+		return nil, 0, err
+	}
+	if version < 2 {
+		return nil, 0, errors.New("invalid version " + string(v))
+	}
+	if file.Tokens == nil {
+		file.Tokens = map[string]json.RawMessage{}
+	}
+	return file.Tokens, version, nil
+}
+
+// Bring raw tokens of an older format to DB_VERSION
+func migrate(raw map[string]json.RawMessage, version int) error {
+	if version > DB_VERSION {
+		return fmt.Errorf("format version %d is newer than %d, written by "+
+			"a later onetime release", version, DB_VERSION)
+	}
+	for v := version; v < DB_VERSION; v++ {
+		if err := migrations[v](raw); err != nil {
+			return fmt.Errorf("migration from version %d: %v", v, err)
+		}
+	}
+	return nil
+}
+
+// Migrate and decode raw tokens
+func tokensOf(raw map[string]json.RawMessage, version int) (LTokens, error) {
+	if err := migrate(raw, version); err != nil {
+		return nil, err
+	}
+	tokens := make(LTokens)
+	for ott, js := range raw {
+		var tok Token
+		if err := json.Unmarshal(js, &tok); err != nil {
+			return nil, errors.New("token " + ott + ": " + err.Error())
+		}
+		tokens[ott] = tok
+	}
+	return tokens, nil
+}
+
+// Where tokens are kept
+type Store interface {
+	// Return all tokens
+	Load(ctx context.Context) (LTokens, error)
+	// Apply change to all tokens, kept from other changes meanwhile, and
+	// save them if it returns true
+	Update(ctx context.Context, change func(LTokens) bool) error
+	// Apply change to token ott, saved if it returns true. Return the
+	// token, and false if there is none.
+	UpdateToken(ctx context.Context, ott string,
+		change func(*Token) bool) (Token, bool, error)
+	// Remove token ott and return it, to one caller only
+	Claim(ctx context.Context, ott string) (Token, bool, error)
+	// Save the tokens of ltok changed since base and delete those removed
+	Commit(ctx context.Context, ltok, base LTokens) error
+}
+
+// Return the store of a TOKEN_DB, a file name, a PostgreSQL URL or a
+// plugin
+func openStore(name string) (Store, error) {
+	if isPostgres(name) {
+		return openPgStore(name)
+	}
+	if isPluginStore(name) {
+		return openPluginStore(name)
+	}
+	return fileStore(name), nil
+}
+
+// Tell whether a TOKEN_DB is a file, rather than a database or a plugin
+func isTokenFile(name string) bool {
+	return !isPostgres(name) && !isPluginStore(name)
+}
+
+// Return the store of the configured TOKEN_DB
+func tokenStore() (Store, error) {
+	st, err := openStore(cnf.TOKEN_DB)
+	if err != nil {
+		slog.Error("TOKENDB", "db", dbName(cnf.TOKEN_DB), "err", err)
+	}
+	return st, err
+}
+
+// Load a list of Tokens
+func (ltok LTokens) Load(filename string) {
+	if isTokenFile(filename) {
+		ltok.loadFile(filename)
+		return
+	}
+	st, err := openStore(filename)
+	if err != nil {
+		slog.Error("TOKENDB", "db", dbName(filename), "err", err)
+		return
+	}
+	tokens, _ := st.Load(context.Background())
+	for ott, tok := range tokens {
+		ltok[ott] = tok
+	}
+}
+
+// Load the tokens of a token DB file
+func (ltok LTokens) loadFile(filename string) {
+	raw, version, err := readTokenDB(filename)
+	var tokens LTokens
+	if err == nil {
+		tokens, err = tokensOf(raw, version)
+	}
+	if err != nil {
+		if _, known := dbRefused.Swap(filename, err); !known {
+			slog.Error("TOKENDB", "file", filename, "err", err)
+		}
+		return
+	}
+	dbRefused.Delete(filename)
+	for ott, tok := range tokens {
+		ltok[ott] = tok
+	}
+	if version < DB_VERSION {
+		backup := filename + ".v" + strconv.Itoa(version)
+		if _, err = os.Stat(backup); os.IsNotExist(err) {
+			slog.Info("MIGRATE", "file", filename, "from", version,
+				"to", DB_VERSION, "backup", backup)
+			if err = copyFile(filename, backup); err != nil {
+				dbRefused.Store(filename, err)
+				slog.Error("MIGRATE", "file", filename, "err", err)
+			}
+		}
+	}
+}
+
+// Save a list of Tokens
+func (ltok LTokens) Save(filename string) error {
+	if !isTokenFile(filename) {
+		st, err := openStore(filename)
+		if err != nil {
+			return err
+		}
+		return st.Update(context.Background(), func(cur LTokens) bool {
+			for ott := range cur {
+				delete(cur, ott)
+			}
+			for ott, tok := range ltok {
+				cur[ott] = tok
+			}
+			return true
+		})
+	}
+	if err, refused := dbRefused.Load(filename); refused {
+		slog.Error("TOKENDB", "file", filename, "err", err, "saved", false)
+		return err.(error)
+	}
+	js, _ := json.Marshal(struct {
+		Tokens  LTokens `json:"tokens"`
+		Version int     `json:"version"`
+	}{ltok, DB_VERSION})
+	// Written aside then renamed, never left half written
+	tmp, err := os.CreateTemp(filepath.Dir(filename),
+		filepath.Base(filename)+".*")
+	if err != nil {
+		slog.Error("TOKENDB", "file", filename, "err", err)
+		return err
+	}
+	_, err = tmp.Write(js)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		slog.Error("TOKENDB", "file", filename, "err", err)
+	}
+	return err
+}
+
+// Take the lock of the token DB and return its release function
+func lockTokenDB() (func(), error) {
+	tokenDBMutex.Lock()
+	unlock, err := lockFile(cnf.TOKEN_DB+".lock", TOKENDB_LOCK_WAIT,
+		TOKENDB_LOCK_STALE)
+	if err != nil {
+		tokenDBMutex.Unlock()
+		return nil, errors.New("token DB " + err.Error())
+	}
+	return func() {
+		unlock()
+		tokenDBMutex.Unlock()
+	}, nil
+}
+
+// Create the lock file name, waiting up to wait for other processes to
+// release it, and return its release function. Locks older than stale
+// were left by crashes and are taken over.
+func lockFile(name string, wait, stale time.Duration) (func(), error) {
+	deadline := time.Now().Add(wait)
+	for {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if sta, err := os.Stat(name); err == nil &&
+			time.Since(sta.ModTime()) > stale && takeOverLock(name, stale) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("locked by " + name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Remove the lock file name, found older than stale. Processes finding
+// it stale at the same time could otherwise remove the lock one of them
+// has just taken: it is renamed aside first, which only one of them
+// manages, and put back if what was renamed turns out to be a fresh lock.
+func takeOverLock(name string, stale time.Duration) bool {
+	aside := name + "." + GenerateOnetime(ONETIME_SZ)
+	if os.Rename(name, aside) != nil {
+		// Taken over by another process
+		return false
+	}
+	defer os.Remove(aside)
+	sta, err := os.Stat(aside)
+	if err == nil && time.Since(sta.ModTime()) <= stale {
+		os.Link(aside, name)
+		return false
+	}
+	return true
+}
+
+// Keep the token DB lock from looking stale while holding it long
+func touchTokenDBLock() {
+	now := time.Now()
+	os.Chtimes(cnf.TOKEN_DB+".lock", now, now)
+}
+
+// The TOKEN_DB file, changed under its lock
+type fileStore string
+
+func (f fileStore) Load(ctx context.Context) (LTokens, error) {
+	ltok := make(LTokens)
+	ltok.LoadContext(ctx, string(f))
+	if err, refused := dbRefused.Load(string(f)); refused {
+		return ltok, err.(error)
+	}
+	return ltok, nil
+}
+
+func (f fileStore) Update(ctx context.Context, change func(LTokens) bool) error {
+	unlock, err := lockTokenDB()
+	if err != nil {
+		slog.Error("TOKENDB", "file", string(f), "err", err)
+		return err
+	}
+	defer unlock()
+	ltok := make(LTokens)
+	ltok.LoadContext(ctx, string(f))
+	if change(ltok) {
+		return ltok.SaveContext(ctx, string(f))
+	}
+	return nil
+}
+
+func (f fileStore) UpdateToken(ctx context.Context, ott string,
+	change func(*Token) bool) (Token, bool, error) {
+	return updateStoreToken(ctx, f, ott, change)
+}
+
+func (f fileStore) Claim(ctx context.Context, ott string) (Token, bool, error) {
+	return claimStoreToken(ctx, f, ott)
+}
+
+func (f fileStore) Commit(ctx context.Context, ltok, base LTokens) error {
+	return commitStore(ctx, f, ltok, base)
+}
+
+// Store.UpdateToken through st.Update
+func updateStoreToken(ctx context.Context, st Store, ott string,
+	change func(*Token) bool) (Token, bool, error) {
+	var tok Token
+	found := false
+	err := st.Update(ctx, func(ltok LTokens) bool {
+		tok, found = ltok[ott]
+		if !found || !change(&tok) {
+			return false
+		}
+		ltok[ott] = tok
+		return true
+	})
+	return tok, found, err
+}
+
+// Store.Claim through st.Update
+func claimStoreToken(ctx context.Context, st Store, ott string) (Token,
+	bool, error) {
+	var tok Token
+	found := false
+	err := st.Update(ctx, func(ltok LTokens) bool {
+		if tok, found = ltok[ott]; found {
+			delete(ltok, ott)
+		}
+		return found
+	})
+	return tok, found, err
+}
+
+// Store.Commit through st.Update
+func commitStore(ctx context.Context, st Store, ltok, base LTokens) error {
+	return st.Update(ctx, func(cur LTokens) bool {
+		changed := false
+		for ott, tok := range ltok {
+			if old, ok := base[ott]; !ok || !tokenEqual(old, tok) {
+				cur[ott] = tok
+				changed = true
+			}
+		}
+		for ott := range base {
+			if _, ok := ltok[ott]; !ok {
+				delete(cur, ott)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// Tell whether a token is unchanged
+func tokenEqual(a, b Token) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// Load the tokens of TOKEN_DB, kept from other changes meanwhile, and
+// apply change to them, saving them when it returns true. Return an
+// error if they could not be saved.
+func updateTokens(ctx context.Context, change func(LTokens) bool) error {
+	st, err := tokenStore()
+	if err != nil {
+		return err
+	}
+	return st.Update(ctx, change)
+}
+
+// Apply change to token ott as it is now in the token DB, saving it when
+// change returns true. Return the token, and false if there is none.
+func updateToken(ctx context.Context, ott string,
+	change func(*Token) bool) (Token, bool) {
+	st, err := tokenStore()
+	if err != nil {
+		return Token{}, false
+	}
+	tok, found, _ := st.UpdateToken(ctx, ott, change)
+	return tok, found
+}
+
+// Remove token ott from the token DB and return it, unless another
+// request removed it first: one caller only ever gets a token this way
+func claimToken(ctx context.Context, ott string) (Token, bool) {
+	st, err := tokenStore()
+	if err != nil {
+		return Token{}, false
+	}
+	tok, found, err := st.Claim(ctx, ott)
+	return tok, found && err == nil
+}
+
+// Return a copy of a list of tokens, to commit changes made to the list
+// later on
+func (ltok LTokens) clone() LTokens {
+	base := make(LTokens, len(ltok))
+	for ott, tok := range ltok {
+		base[ott] = tok
+	}
+	return base
+}
+
+// Write the changes made to ltok since it was copied to base: tokens
+// added or modified are saved, tokens removed are deleted, others are
+// left as they are now in the token DB
+func (ltok LTokens) Commit(ctx context.Context, base LTokens) error {
+	st, err := tokenStore()
+	if err != nil {
+		return err
+	}
+	return st.Commit(ctx, ltok, base)
+}
+
+// Copy the tokens of token DB file fname, migrated as needed, to the
+// configured TOKEN_DB, replacing its tokens only with force
+func ImportTokens(fname string, force bool) error {
+	if _, err := os.Stat(fname); err != nil {
+		return err
+	}
+	raw, version, err := readTokenDB(fname)
+	if err != nil {
+		return err
+	}
+	tokens, err := tokensOf(raw, version)
+	if err != nil {
+		return err
+	}
+	st, err := openStore(cnf.TOKEN_DB)
+	if err != nil {
+		return err
+	}
+	var held int
+	err = st.Update(context.Background(), func(cur LTokens) bool {
+		if held = len(cur); held > 0 && !force {
+			return false
+		}
+		for ott := range cur {
+			delete(cur, ott)
+		}
+		for ott, tok := range tokens {
+			cur[ott] = tok
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if held > 0 && !force {
+		return fmt.Errorf("%s already holds %d tokens, use --force to "+
+			"replace them", dbName(cnf.TOKEN_DB), held)
+	}
+	fmt.Printf("%s: %d tokens of %s (version %d) imported\n",
+		dbName(cnf.TOKEN_DB), len(tokens), fname, version)
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseTokenDB(t *testing.T) {
+	tests := []struct {
+		name    string
+		js      string
+		tokens  []string
+		version int
+		err     bool
+	}{
+		{"empty file", "", nil, DB_VERSION, false},
+		{"version 1", `{"aaaa1111": {"Path": "/a"}, "bbbb2222": {}}`,
+			[]string{"aaaa1111", "bbbb2222"}, 1, false},
+		{"version 1, empty", `{}`, nil, 1, false},
+		{"version 2", `{"tokens": {"aaaa1111": {"Path": "/a"}}, "version": 2}`,
+			[]string{"aaaa1111"}, 2, false},
+		{"version 2, no tokens", `{"tokens": null, "version": 2}`, nil, 2,
+			false},
+		{"newer version", `{"tokens": {"aaaa1111": {}}, "version": 9}`,
+			[]string{"aaaa1111"}, 9, false},
+		// A token named version in a version 1 file
+		{"token named version", `{"version": {"Path": "/v"}}`,
+			[]string{"version"}, 1, false},
+		{"wrapped version 1", `{"tokens": {}, "version": 1}`, nil, 0, true},
+		{"not json", `{"tokens":`, nil, 0, true},
+		{"not an object", `[1, 2]`, nil, 0, true},
+	}
+	for _, tt := range tests {
+		raw, version, err := parseTokenDB([]byte(tt.js))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if version != tt.version {
+			t.Errorf("%s: version = %d, want %d", tt.name, version,
+				tt.version)
+		}
+		if len(raw) != len(tt.tokens) {
+			t.Errorf("%s: %d tokens, want %d", tt.name, len(raw),
+				len(tt.tokens))
+		}
+		for _, ott := range tt.tokens {
+			if _, ok := raw[ott]; !ok {
+				t.Errorf("%s: token %s missing", tt.name, ott)
+			}
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		version int
+		err     string
+	}{
+		{1, ""},
+		{DB_VERSION, ""},
+		{DB_VERSION + 1, "newer"},
+	}
+	for _, tt := range tests {
+		raw := map[string]json.RawMessage{"aaaa1111": json.RawMessage(
+			`{"Path": "/a", "Size": 3}`)}
+		err := migrate(raw, tt.version)
+		if len(tt.err) < 1 && err != nil {
+			t.Errorf("migrate from %d: %v", tt.version, err)
+		}
+		if len(tt.err) > 0 && (err == nil || !strings.Contains(err.Error(),
+			tt.err)) {
+			t.Errorf("migrate from %d: err = %v, want %q", tt.version, err,
+				tt.err)
+		}
+	}
+	for v := 1; v < DB_VERSION; v++ {
+		if migrations[v] == nil {
+			t.Errorf("no migration from version %d", v)
+		}
+	}
+}
+
+func TestTokensOf(t *testing.T) {
+	raw := map[string]json.RawMessage{
+		"aaaa1111": json.RawMessage(`{"Path": "/a", "Size": 3}`),
+	}
+	tokens, err := tokensOf(raw, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok := tokens["aaaa1111"]; tok.Path != "/a" || tok.Size != 3 {
+		t.Errorf("token = %+v", tok)
+	}
+	raw["bbbb2222"] = json.RawMessage(`{"Size": "big"}`)
+	if _, err = tokensOf(raw, DB_VERSION); err == nil ||
+		!strings.Contains(err.Error(), "bbbb2222") {
+		t.Errorf("err = %v, want one naming bbbb2222", err)
+	}
+}
+
+// Point the configuration at a token DB in a test directory
+func testTokenDB(t *testing.T) string {
+	t.Helper()
+	saved := cnf.TOKEN_DB
+	cnf.TOKEN_DB = filepath.Join(t.TempDir(), "token.db")
+	t.Cleanup(func() {
+		dbRefused.Delete(cnf.TOKEN_DB)
+		cnf.TOKEN_DB = saved
+	})
+	return cnf.TOKEN_DB
+}
+
+func TestTokenDBFiles(t *testing.T) {
+	db := testTokenDB(t)
+	// Version 1 files are read, and kept aside before the first save
+	err := os.WriteFile(db, []byte(`{"aaaa1111": {"Path": "/a"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ltok := make(LTokens)
+	ltok.Load(db)
+	if ltok["aaaa1111"].Path != "/a" {
+		t.Fatalf("version 1 tokens = %+v", ltok)
+	}
+	if _, err = os.Stat(db + ".v1"); err != nil {
+		t.Errorf("no copy of the version 1 file: %v", err)
+	}
+	if err = ltok.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	_, version, err := readTokenDB(db)
+	if err != nil || version != DB_VERSION {
+		t.Errorf("saved version %d, %v", version, err)
+	}
+	// Newer files are never overwritten
+	newer := `{"tokens": {}, "version": 99}`
+	if err = os.WriteFile(db, []byte(newer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ltok = make(LTokens)
+	ltok.Load(db)
+	ltok["bbbb2222"] = Token{Path: "/b"}
+	if err = ltok.Save(db); err == nil {
+		t.Error("newer token DB saved over")
+	}
+	if js, _ := os.ReadFile(db); string(js) != newer {
+		t.Errorf("newer token DB changed: %s", js)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	db := testTokenDB(t)
+	ctx := context.Background()
+	start := LTokens{
+		"aaaa1111": {Path: "/a"},
+		"bbbb2222": {Path: "/b"},
+		"cccc3333": {Path: "/c"},
+	}
+	if err := start.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	ltok := make(LTokens)
+	ltok.Load(db)
+	base := ltok.clone()
+	// Meanwhile, another process changes a, removes b and adds d
+	updateTokens(ctx, func(cur LTokens) bool {
+		cur["aaaa1111"] = Token{Path: "/a", Sent: 10}
+		delete(cur, "bbbb2222")
+		cur["dddd4444"] = Token{Path: "/d"}
+		return true
+	})
+	// This one removes c and adds e
+	delete(ltok, "cccc3333")
+	ltok["eeee5555"] = Token{Path: "/e"}
+	if err := ltok.Commit(ctx, base); err != nil {
+		t.Fatal(err)
+	}
+	got := make(LTokens)
+	got.Load(db)
+	want := map[string]bool{"aaaa1111": true, "dddd4444": true,
+		"eeee5555": true}
+	if len(got) != len(want) {
+		t.Errorf("tokens %v, want %v", got, want)
+	}
+	for ott := range want {
+		if _, ok := got[ott]; !ok {
+			t.Errorf("token %s lost", ott)
+		}
+	}
+	if got["aaaa1111"].Sent != 10 {
+		t.Error("concurrent change to aaaa1111 overwritten")
+	}
+	if _, ok := claimToken(ctx, "dddd4444"); !ok {
+		t.Error("claim of dddd4444 failed")
+	}
+	if _, ok := claimToken(ctx, "dddd4444"); ok {
+		t.Error("dddd4444 claimed twice")
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "token.db.lock")
+	old := time.Now().Add(-time.Hour)
+	var held, overlaps, taken atomic.Int32
+	for round := 0; round < 10; round++ {
+		// Left by a crash, then found stale by processes starting at once
+		if err := os.WriteFile(name, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(name, old, old)
+		start := make(chan bool)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				unlock, err := lockFile(name, 10*time.Second, time.Minute)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if held.Add(1) > 1 {
+					overlaps.Add(1)
+				}
+				taken.Add(1)
+				time.Sleep(time.Millisecond)
+				held.Add(-1)
+				unlock()
+			}()
+		}
+		close(start)
+		wg.Wait()
+	}
+	if overlaps.Load() > 0 || taken.Load() != 100 {
+		t.Errorf("lock held by several %d times, taken %d times, want 0, 100",
+			overlaps.Load(), taken.Load())
+	}
+	left, _ := filepath.Glob(name + "*")
+	if len(left) > 0 {
+		t.Errorf("files left: %v", left)
+	}
+	// Fresh locks are waited for
+	os.WriteFile(name, nil, 0600)
+	if _, err := lockFile(name, 50*time.Millisecond, time.Minute); err == nil {
+		t.Error("fresh lock taken over")
+	}
+	// Found stale, but taken by another process in the meantime
+	if takeOverLock(name, time.Minute) {
+		t.Error("fresh lock removed")
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("fresh lock not put back: %v", err)
+	}
+	if left, _ := filepath.Glob(name + ".*"); len(left) > 0 {
+		t.Errorf("files left: %v", left)
+	}
+	// Found stale and still so
+	os.Chtimes(name, old, old)
+	if !takeOverLock(name, time.Minute) {
+		t.Error("stale lock kept")
+	}
+	if left, _ := filepath.Glob(name + "*"); len(left) > 0 {
+		t.Errorf("files left: %v", left)
+	}
+}
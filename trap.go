@@ -0,0 +1,129 @@
+// Honeypot tokens.
+// onetime trap plants tokens that look like real downloads but point to
+// no file. Nobody is ever given their URL, so any request for one means
+// the URL was guessed, scanned or read from a leaked token DB: it is
+// logged as a TRAP line, reported to ALERT_WEBHOOK and ALERT_MAIL, and
+// the client is banned from all tokens for TRAP_BAN when set.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// File names given to honeypot tokens
+var trapNames = []string{
+	"backup.tar.gz",
+	"invoices-2024.zip",
+	"passwords.kdbx",
+	"payroll.xlsx",
+	"contract-signed.pdf",
+	"db-dump.sql.gz",
+	"vpn-config.ovpn",
+	"customer-list.csv",
+	"id_rsa.zip",
+	"financial-report-q3.pdf",
+}
+
+// Clients banned after hitting a honeypot, with the end of their ban
+var bans = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// Return a random number in [0, n)
+func randInt(n int64) int64 {
+	v, err := rand.Int(rand.Reader, big.NewInt(n))
+	if err != nil {
+		return 0
+	}
+	return v.Int64()
+}
+
+// Plant a honeypot token and print its URL
+func (ltok LTokens) Trap() string {
+	ott := GenerateOnetime(ONETIME_SZ)
+	name := trapNames[randInt(int64(len(trapNames)))]
+	sum := make([]byte, 32)
+	rand.Read(sum)
+	mimetype := mime.TypeByExtension(filepath.Ext(name))
+	if len(mimetype) < 1 {
+		mimetype = "application/octet-stream"
+	}
+	ltok[ott] = Token{
+		Created:   time.Now(),
+		Activated: time.Unix(0, 0),
+		Kind:      KIND_TRAP,
+		Name:      name,
+		Size:      100*1000 + randInt(50*1000*1000),
+		MimeType:  mimetype,
+		Sha256:    hex.EncodeToString(sum),
+	}
+	fmt.Printf(`
+
+Trap: %s
+%s/%s
+
+`, name, cnf.BASE_ADDR, ott)
+	journal("create", ott, nil, "trap")
+	return ott
+}
+
+// Report a request for a honeypot token and ban its client
+func trapHit(req *http.Request, ott string) {
+	reqLog(req).Warn("TRAP", "token", ott, "agent", req.UserAgent())
+	failure(req, "trap")
+	if cnf.trapBan > 0 {
+		bans.Lock()
+		bans.m[clientHost(req)] = time.Now().Add(cnf.trapBan)
+		bans.Unlock()
+	}
+	msg := fmt.Sprintf("onetime: honeypot token %s requested by %s (%s) at %s",
+		ott, clientHost(req), req.UserAgent(), isotime(time.Now()))
+	go alert(msg)
+}
+
+// Tell whether the client of req is banned
+func banned(req *http.Request) bool {
+	bans.Lock()
+	defer bans.Unlock()
+	host := clientHost(req)
+	until, ok := bans.m[host]
+	if ok && time.Now().After(until) {
+		delete(bans.m, host)
+		return false
+	}
+	return ok
+}
+
+// Send an alert to ALERT_WEBHOOK and ALERT_MAIL, when set
+func alert(msg string) {
+	if len(cnf.ALERT_WEBHOOK) > 0 {
+		// Slack, Mattermost and Rocket.Chat read "text", Discord "content"
+		body, _ := json.Marshal(map[string]string{"text": msg, "content": msg})
+		resp, err := http.Post(cnf.ALERT_WEBHOOK, "application/json",
+			bytes.NewReader(body))
+		if err != nil {
+			slog.Error("ALERT", "err", err)
+		} else {
+			resp.Body.Close()
+		}
+	}
+	if len(cnf.ALERT_MAIL) > 0 {
+		err := sendMail([]string{cnf.ALERT_MAIL}, "alert", Mail{Text: msg})
+		if err != nil {
+			slog.Error("ALERT", "err", err)
+		}
+	}
+}
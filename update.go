@@ -0,0 +1,244 @@
+// Self-update.
+// onetime update fetches the latest release of the project, downloads the
+// binary built for this system and replaces the running executable with
+// it. Releases are expected to carry one binary per system, named
+// onetime-<os>-<arch> (plus .exe on Windows), and a SHA256SUMS file in
+// sha256sum format. The binary must match its checksum. With UPDATE_KEY
+// set to a base64 Ed25519 public key, SHA256SUMS must also come with a
+// SHA256SUMS.sig signature made by that key, so that a compromised
+// release page cannot push a binary. UPDATE_URL points to another
+// releases API of the same form, e.g. a local mirror.
+// The new file is written next to the executable and renamed over it, so
+// that an interrupted update leaves the old binary in place. A running
+// server keeps the old code until restarted.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	UPDATE_URL     = "https://api.github.com/repos/nicolas314/onetime/releases/latest"
+	UPDATE_TIMEOUT = 10 * time.Minute
+)
+
+// Options of onetime update
+type UpdateOptions struct {
+	Check bool // Only tell whether an update is available
+	Force bool // Install even if the version is the same
+}
+
+// A release as described by the releases API
+type release struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+var updateClient = &http.Client{Timeout: UPDATE_TIMEOUT}
+
+// Return the body of a URL, at most max bytes of it
+func fetch(u string, max int64) ([]byte, error) {
+	resp, err := updateClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(u + ": " + resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, max))
+}
+
+// Return the download URL of an asset, "" if the release has none
+func (r release) asset(name string) string {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+// Return the checksum of name listed in a SHA256SUMS file
+func listedSum(sums []byte, name string) (string, error) {
+	sc := bufio.NewScanner(bytes.NewReader(sums))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) == 2 && strings.TrimPrefix(f[1], "*") == name {
+			return strings.ToLower(f[0]), nil
+		}
+	}
+	return "", errors.New("no checksum for " + name + " in SHA256SUMS")
+}
+
+// Check the signature of SHA256SUMS with UPDATE_KEY
+func checkSumsSignature(r release, sums []byte) error {
+	pub, err := base64.StdEncoding.DecodeString(cnf.UPDATE_KEY)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("invalid UPDATE_KEY in " + cnf.path)
+	}
+	u := r.asset("SHA256SUMS.sig")
+	if len(u) < 1 {
+		return errors.New("release " + r.Tag + " has no SHA256SUMS.sig")
+	}
+	sig, err := fetch(u, 1024)
+	if err != nil {
+		return err
+	}
+	// Raw or base64
+	if len(sig) != ed25519.SignatureSize {
+		if sig, err = base64.StdEncoding.DecodeString(
+			strings.TrimSpace(string(sig))); err != nil {
+			return errors.New("invalid SHA256SUMS.sig")
+		}
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), sums, sig) {
+		return errors.New("bad signature of SHA256SUMS, not updating")
+	}
+	return nil
+}
+
+// Download u to a new file in dir and return its name and checksum
+func download(u, dir string) (string, string, error) {
+	resp, err := updateClient.Get(u)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", errors.New(u + ": " + resp.Status)
+	}
+	f, err := os.CreateTemp(dir, ".onetime-update-")
+	if err != nil {
+		return "", "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+	return f.Name(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Put the file named next in place of the executable exe
+func replaceExecutable(exe, next string) error {
+	if err := os.Chmod(next, 0755); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// A running executable cannot be replaced, but can be renamed
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err := os.Rename(next, exe); err != nil {
+			os.Rename(old, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(next, exe)
+}
+
+// Install the latest release in place of the running executable
+func Update(opt UpdateOptions) error {
+	u := cnf.UPDATE_URL
+	if len(u) < 1 {
+		u = UPDATE_URL
+	}
+	b, err := fetch(u, 1<<20)
+	if err != nil {
+		return err
+	}
+	var r release
+	if err = json.Unmarshal(b, &r); err != nil || len(r.Tag) < 1 {
+		return errors.New("no release found at " + u)
+	}
+	latest := strings.TrimPrefix(r.Tag, "v")
+	current := strings.TrimPrefix(version, "v")
+	if latest == current && !opt.Force {
+		fmt.Println("onetime", version, "is up to date")
+		return nil
+	}
+	if opt.Check {
+		fmt.Println("onetime", latest, "is available, running", version)
+		return nil
+	}
+	if current == "dev" && !opt.Force {
+		return errors.New("this is a development build, use --force to " +
+			"replace it with " + latest)
+	}
+	name := "onetime-" + runtime.GOOS + "-" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	binURL, sumsURL := r.asset(name), r.asset("SHA256SUMS")
+	if len(binURL) < 1 {
+		return errors.New("release " + r.Tag + " has no " + name)
+	}
+	if len(sumsURL) < 1 {
+		return errors.New("release " + r.Tag + " has no SHA256SUMS")
+	}
+	sums, err := fetch(sumsURL, 1<<20)
+	if err != nil {
+		return err
+	}
+	if len(cnf.UPDATE_KEY) > 0 {
+		if err = checkSumsSignature(r, sums); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("UPDATE_KEY not set: checking the checksum only")
+	}
+	want, err := listedSum(sums, name)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if real, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = real
+	}
+	fmt.Println("Downloading", name, latest)
+	next, sum, err := download(binURL, filepath.Dir(exe))
+	if err != nil {
+		return err
+	}
+	if sum != want {
+		os.Remove(next)
+		return errors.New("checksum mismatch for " + name + ", not updating")
+	}
+	if err = replaceExecutable(exe, next); err != nil {
+		os.Remove(next)
+		return err
+	}
+	fmt.Println("Updated", exe, "from", version, "to", latest)
+	fmt.Println("Restart the server to run the new version")
+	return nil
+}
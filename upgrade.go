@@ -0,0 +1,322 @@
+// Zero-downtime restarts.
+// On SIGUSR2, or onetime restart, the server starts a new process of its
+// executable, e.g. the one just installed by onetime update, and hands it
+// its listening sockets. Once the new server is ready, the old one stops
+// accepting connections and exits when its requests are over, so that a
+// restart never cuts a download short, however long. If the new server
+// fails to start, the old one goes on serving. Sockets are matched by
+// listen address: addresses added to the configuration meanwhile are
+// bound anew, removed ones are closed. FastCGI on stdin cannot be handed
+// over. Not available on Windows, which has neither the signal nor
+// inheritable sockets. Under systemd, set NotifyAccess=all so that the
+// new server can announce itself as the main process:
+//
+//	systemctl kill --kill-whom=main -s USR2 onetime
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	UPGRADE_ENV  = "ONETIME_SOCKETS" // Addresses of the sockets handed over
+	UPGRADE_WAIT = 30 * time.Second  // Wait for the new server to be ready
+)
+
+// A socket being served, with its listen address
+type socket struct {
+	addr string
+	l    net.Listener
+}
+
+var (
+	// Sockets handed over by the previous server, by listen address
+	inherited = map[string]net.Listener{}
+	// Written to by the new server once ready
+	readyPipe *os.File
+	// Addresses handed over, empty unless started by an upgrade
+	upgradeFrom = os.Getenv(UPGRADE_ENV)
+
+	socketsMu sync.Mutex
+	sockets   []socket
+	servers   []*http.Server
+	// FastCGI requests in progress, which no http.Server waits for
+	inflight sync.WaitGroup
+	draining atomic.Bool
+)
+
+func init() {
+	// Not for the children of the server
+	os.Unsetenv(UPGRADE_ENV)
+}
+
+// Tell whether the server was started by an upgrade
+func upgrading() bool {
+	return len(upgradeFrom) > 0
+}
+
+// Take over the sockets of the previous server
+func inheritSockets() error {
+	addrs := strings.Fields(upgradeFrom)
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(3+i), addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return errors.New("cannot take over " + addr + ": " + err.Error())
+		}
+		inherited[addr] = l
+	}
+	if len(addrs) > 0 {
+		readyPipe = os.NewFile(uintptr(3+len(addrs)), "ready")
+	}
+	return nil
+}
+
+// Return the socket of addr handed over by the previous server, or bind a
+// new one
+func takeOrBind(addr string, bind func(string) (net.Listener, error)) (
+	net.Listener, error) {
+	l, ok := inherited[addr]
+	if !ok {
+		var err error
+		if l, err = bind(addr); err != nil {
+			return nil, err
+		}
+	}
+	delete(inherited, addr)
+	if l != nil {
+		socketsMu.Lock()
+		sockets = append(sockets, socket{addr, l})
+		socketsMu.Unlock()
+	}
+	return l, nil
+}
+
+// Close the sockets handed over for addresses no longer listened on
+func closeInherited() {
+	for addr, l := range inherited {
+		slog.Info("UNLISTEN", "addr", addr)
+		l.Close()
+	}
+	inherited = nil
+}
+
+// Register a server to drain on upgrade
+func track(s *http.Server) *http.Server {
+	socketsMu.Lock()
+	servers = append(servers, s)
+	socketsMu.Unlock()
+	return s
+}
+
+// Count handler requests in inflight
+func withInflight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		inflight.Add(1)
+		defer inflight.Done()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Tell the previous server that this one is ready
+func upgraded() {
+	if readyPipe == nil {
+		return
+	}
+	readyPipe.Write([]byte("ready\n"))
+	readyPipe.Close()
+	readyPipe = nil
+}
+
+// Return the file of a listening socket, shared with a child process
+func socketFile(s socket) (*os.File, error) {
+	fl, ok := s.l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("cannot hand over " + s.addr)
+	}
+	return fl.File()
+}
+
+// Start a new server with the sockets of this one, and wait until it is
+// ready
+func startSuccessor() (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	socketsMu.Lock()
+	var addrs []string
+	var files []*os.File
+	for _, s := range sockets {
+		f, err := socketFile(s)
+		if err != nil {
+			socketsMu.Unlock()
+			return 0, err
+		}
+		addrs = append(addrs, s.addr)
+		files = append(files, f)
+	}
+	socketsMu.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, serverArgs()...)
+	cmd.Env = append(os.Environ(), UPGRADE_ENV+"="+strings.Join(addrs, " "))
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+	ready := make(chan error, 2)
+	go func() {
+		b := make([]byte, 16)
+		n, _ := r.Read(b)
+		if n > 0 {
+			ready <- nil
+		} else {
+			ready <- errors.New("new server exited before ready")
+		}
+	}()
+	go func() {
+		err := cmd.Wait()
+		if err == nil {
+			err = errors.New("exited")
+		}
+		ready <- errors.New("new server failed (" + err.Error() + ")")
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(UPGRADE_WAIT):
+		err = errors.New("new server not ready after " + UPGRADE_WAIT.String())
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return 0, err
+	}
+	return cmd.Process.Pid, nil
+}
+
+// Stop accepting connections, wait for requests in progress, and exit
+func drain() {
+	shutdown(context.Background(), true)
+	slog.Info("STOP", "upgraded", true)
+	os.Exit(0)
+}
+
+// Stop accepting connections and wait for requests in progress, or until
+// ctx is done. Unix sockets handed over are left for the new server.
+func shutdown(ctx context.Context, handover bool) {
+	socketsMu.Lock()
+	for _, s := range sockets {
+		// The socket file now belongs to the new server
+		if ul, ok := s.l.(*net.UnixListener); ok && handover {
+			ul.SetUnlinkOnClose(false)
+		}
+		s.l.Close()
+	}
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			s.Shutdown(ctx)
+		}(s)
+	}
+	socketsMu.Unlock()
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// Hand over to a new server on SIGUSR2
+func watchUpgrade() {
+	if sigUpgrade == nil {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigUpgrade)
+	go func() {
+		for range c {
+			if draining.Load() {
+				continue
+			}
+			slog.Info("UPGRADE", "signal", sigUpgrade.String())
+			pid, err := startSuccessor()
+			if err != nil {
+				slog.Error("UPGRADE", "err", err)
+				continue
+			}
+			slog.Info("UPGRADE", "pid", pid)
+			draining.Store(true)
+			go drain()
+		}
+	}()
+}
+
+// Tell whether the server stopped serving because of an upgrade
+func drained() bool {
+	return draining.Load()
+}
+
+// Restart the server recorded in a pid file without dropping connections
+func RestartServer(name string) error {
+	if sigUpgrade == nil {
+		return errors.New("restarts without downtime are not available on " +
+			runtime.GOOS + ", use stop and serve")
+	}
+	pid, err := readPidFile(name)
+	if err != nil {
+		return err
+	}
+	if !processAlive(pid) {
+		return errors.New("onetime not running")
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err = p.Signal(sigUpgrade); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(UPGRADE_WAIT + time.Second); time.Now().Before(deadline); {
+		if next, err := readPidFile(name); err == nil && next != pid {
+			fmt.Println("onetime restarted, pid", next, "replacing", pid)
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New("onetime not restarted, see " + cnf.LOG_FILE +
+		" (pid " + strconv.Itoa(pid) + " still serving)")
+}
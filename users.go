@@ -0,0 +1,125 @@
+// User accounts.
+// USERS in the configuration gives each member of a team a personal API
+// key, by user name:
+//
+//	"USERS": {"alice": "enc:...", "bob": "enc:..."}
+//
+// Tokens record the user who created them. With their key, users reach
+// the API and log in to /admin/ under their name, and only see, renew
+// and delete their own tokens. API_KEY and ADMIN_PASSWORD remain those of
+// the administrator, who sees everything. The command line records the
+// login name of whoever runs it, and ls lists the tokens of that user
+// when USERS names them; other logins list all tokens. It reads the DB
+// directly, so this is a convenience, not a protection: keep the DB
+// readable by the server account only and give users API keys rather
+// than shell accounts.
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+)
+
+// Valid user names, also safe in session cookies
+var userName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Check user names and keys
+func (c *Config) checkUsers() error {
+	seen := make(map[string]bool)
+	for name, key := range c.USERS {
+		if !userName.MatchString(name) {
+			return errors.New("invalid user name " + name + " in " + c.path)
+		}
+		if len(key) < 16 {
+			return errors.New("API key of " + name + " too short in " +
+				c.path + ", see onetime genkey")
+		}
+		if seen[key] || key == c.API_KEY || key == c.ADMIN_PASSWORD {
+			return errors.New("API key of " + name + " not unique in " +
+				c.path)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// Return the user holding key, false if none
+func keyUser(key string) (string, bool) {
+	found, ok := "", false
+	// Compare all keys, in constant time
+	for name, k := range cnf.USERS {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			found, ok = name, true
+		}
+	}
+	return found, ok
+}
+
+// Return the user presenting the bearer key of an API request, "" for
+// the administrator, false if the key is unknown
+func apiUser(req *http.Request) (string, bool) {
+	if apiAuthorized(req) {
+		return "", true
+	}
+	if name, password, ok := req.BasicAuth(); ok && ldapEnabled() {
+		if _, known := cnf.USERS[name]; !known && ldapAuth(req, name, password) {
+			return name, true
+		}
+		return "", false
+	}
+	key, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || len(key) < 1 {
+		return "", false
+	}
+	if user, ok := issuedKeyUser(key); ok {
+		return user, true
+	}
+	return keyUser(key)
+}
+
+// Tell whether user sees all tokens: the administrator, OIDC_ADMINS and
+// members of LDAP_ADMIN_GROUP
+func isAdmin(user string) bool {
+	if len(user) < 1 || oidcAdmin(user) {
+		return true
+	}
+	_, admin := ldapLoggedIn(user)
+	return admin
+}
+
+// Tell whether user may see and manage tok, any token for the
+// administrators
+func owns(user string, tok Token) bool {
+	return isAdmin(user) || tok.Owner == user
+}
+
+// Return the login name of whoever runs the command line
+func loginName() string {
+	if u, err := user.Current(); err == nil {
+		// DOMAIN\name on Windows
+		name := u.Username
+		if i := strings.LastIndex(name, `\`); i >= 0 {
+			name = name[i+1:]
+		}
+		return name
+	}
+	if name := os.Getenv("USER"); len(name) > 0 {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
+
+// Return the user whose tokens the command line lists, "" for all
+func cliUser() string {
+	name := loginName()
+	if _, ok := cnf.USERS[name]; ok {
+		return name
+	}
+	return ""
+}
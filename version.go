@@ -0,0 +1,66 @@
+// Version information.
+// Release builds set the version, commit and build date with the linker:
+//
+//	go build -ldflags "-X main.version=1.4.0 \
+//	    -X main.commit=$(git rev-parse --short HEAD) \
+//	    -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" -o onetime .
+//
+// Values left empty are taken from the build info stamped by the go
+// command when it has them, e.g. when building from a module checkout.
+// The version is printed by onetime version, logged at START and, with
+// SERVER_HEADER set, sent in the Server header of every response.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	version   = "" // Semantic version, "dev" if unknown
+	commit    = "" // Git commit
+	buildDate = "" // Build time
+)
+
+// Fill version information missing from the linker flags with the build
+// info of the binary
+func init() {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if len(version) < 1 && bi.Main.Version != "(devel)" {
+			version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if len(commit) < 1 {
+					commit = s.Value
+				}
+			case "vcs.time":
+				if len(buildDate) < 1 {
+					buildDate = s.Value
+				}
+			case "vcs.modified":
+				if s.Value == "true" && len(commit) > 0 {
+					commit += "-dirty"
+				}
+			}
+		}
+	}
+	if len(version) < 1 {
+		version = "dev"
+	}
+}
+
+// Print version information
+func Version() {
+	fmt.Println("onetime", version)
+	if len(commit) > 0 {
+		fmt.Println("  commit:", commit)
+	}
+	if len(buildDate) > 0 {
+		fmt.Println("   built:", buildDate)
+	}
+	fmt.Println("      go:", runtime.Version(), runtime.GOOS+"/"+runtime.GOARCH)
+}